@@ -61,3 +61,169 @@ func SetUserData(conf config.App, user fusionauth.User, key string, value interf
 	}
 	return nil
 }
+
+// VerifyFusionAuthConfig makes sure that the application and tenant
+// configured for an app actually exist in FusionAuth. Any problems are
+// appended to errs using path as the prefix for the field names.
+func VerifyFusionAuthConfig(conf config.App, path string, errs *config.ValidationErrors) {
+	appResp, err := conf.FusionAuth.Client.RetrieveApplication(conf.FusionAuth.AppID)
+	if err != nil {
+		errs.Add(
+			path+".fusionAuth.internalHostUrl",
+			"failed to reach fusionauth: %v",
+			err.Error(),
+		)
+		return
+	}
+	if appResp.Application.Id != conf.FusionAuth.AppID {
+		errs.Add(
+			path+".fusionAuth.appID",
+			"application %v was not found in fusionauth (http %v)",
+			conf.FusionAuth.AppID,
+			appResp.StatusCode,
+		)
+	} else if appResp.Application.TenantId != "" && appResp.Application.TenantId != conf.FusionAuth.TenantID {
+		errs.Add(
+			path+".fusionAuth.tenantID",
+			"application %v belongs to tenant %v, not %v",
+			conf.FusionAuth.AppID,
+			appResp.Application.TenantId,
+			conf.FusionAuth.TenantID,
+		)
+	}
+
+	tenantResp, faErrs, err := conf.FusionAuth.Client.RetrieveTenant(conf.FusionAuth.TenantID)
+	if err != nil {
+		errs.Add(
+			path+".fusionAuth.tenantID",
+			"failed to retrieve tenant %v: %v",
+			conf.FusionAuth.TenantID,
+			err.Error(),
+		)
+		return
+	}
+	if faErrs != nil || tenantResp.Tenant.Id != conf.FusionAuth.TenantID {
+		errs.Add(
+			path+".fusionAuth.tenantID",
+			"tenant %v was not found in fusionauth (http %v)",
+			conf.FusionAuth.TenantID,
+			tenantResp.StatusCode,
+		)
+	}
+}
+
+// GetUserByID retrieves a user from FusionAuth, and fails if the user
+// doesn't exist
+func GetUserByID(conf config.App, userID string) (user fusionauth.User, err error) {
+	userResp, errs, err := conf.FusionAuth.Client.RetrieveUser(userID)
+	if err != nil {
+		return user, fmt.Errorf("failed to retrieve user %v: %v", userID, err.Error())
+	}
+	if errs != nil {
+		return user, fmt.Errorf("failed to retrieve user %v due to errors: %v", userID, errs.Error())
+	}
+	if userResp.User.Id != userID {
+		return user, fmt.Errorf("user %v was not found", userID)
+	}
+	return userResp.User, nil
+}
+
+// GetUserByEmail retrieves a user from FusionAuth by their email, and fails
+// if there is no such user
+func GetUserByEmail(conf config.App, email string) (user fusionauth.User, err error) {
+	userResp, errs, err := conf.FusionAuth.Client.RetrieveUserByEmail(email)
+	if err != nil {
+		return user, fmt.Errorf("failed to retrieve user by email %v: %v", email, err.Error())
+	}
+	if errs != nil {
+		return user, fmt.Errorf("failed to retrieve user by email %v due to errors: %v", email, errs.Error())
+	}
+	if userResp.User.Id == "" {
+		return user, fmt.Errorf("no user has the email %v", email)
+	}
+	return userResp.User, nil
+}
+
+// UserSearchPageSize is how many users are retrieved per FusionAuth search
+// request by GetAppUsers
+const UserSearchPageSize = 500
+
+// GetAppUsers pages through every FusionAuth user in the app's tenant that
+// is registered to the app. The search matches all users and is filtered
+// here, so that it works with both the database and the elasticsearch
+// search engines.
+func GetAppUsers(conf config.App) (users []fusionauth.User, err error) {
+	for startRow := 0; ; startRow += UserSearchPageSize {
+		searchResp, errs, err := conf.FusionAuth.Client.SearchUsersByQuery(
+			fusionauth.SearchRequest{
+				Search: fusionauth.UserSearchCriteria{
+					BaseSearchCriteria: fusionauth.BaseSearchCriteria{
+						NumberOfResults: UserSearchPageSize,
+						StartRow:        startRow,
+					},
+					QueryString: "*",
+					SortFields: []fusionauth.SortField{
+						{Name: "insertInstant"},
+					},
+				},
+			},
+		)
+		if err != nil {
+			return users, fmt.Errorf("failed to search users: %v", err.Error())
+		}
+		if errs != nil {
+			return users, fmt.Errorf("failed to search users due to errors: %v", errs.Error())
+		}
+
+		for _, user := range searchResp.Users {
+			if user.TenantId != conf.FusionAuth.TenantID {
+				continue
+			}
+			for _, registration := range user.Registrations {
+				if registration.ApplicationId == conf.FusionAuth.AppID {
+					users = append(users, user)
+					break
+				}
+			}
+		}
+
+		if len(searchResp.Users) < UserSearchPageSize {
+			return users, nil
+		}
+	}
+}
+
+// UserExists checks if a user still exists in FusionAuth
+func UserExists(conf config.App, userID string) (bool, error) {
+	userResp, errs, err := conf.FusionAuth.Client.RetrieveUser(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve user %v: %v", userID, err.Error())
+	}
+	if userResp.StatusCode == 404 {
+		return false, nil
+	}
+	if errs != nil {
+		return false, fmt.Errorf("failed to retrieve user %v due to errors: %v", userID, errs.Error())
+	}
+	return userResp.User.Id == userID, nil
+}
+
+// GetRoles returns the roles of a user's registration to the app
+func GetRoles(conf config.App, user fusionauth.User) []string {
+	for _, registration := range user.Registrations {
+		if registration.ApplicationId == conf.FusionAuth.AppID {
+			return registration.Roles
+		}
+	}
+	return nil
+}
+
+// HasRole checks if a user's registration to the app has a role
+func HasRole(conf config.App, user fusionauth.User, role string) bool {
+	for _, userRole := range GetRoles(conf, user) {
+		if userRole == role {
+			return true
+		}
+	}
+	return false
+}
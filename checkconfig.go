@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	"fa-middleware/payments"
+
+	"flag"
+	"fmt"
+	"os"
+)
+
+// checkConfig implements the check-config subcommand, which validates the
+// config file and exits. With -online it also verifies that the configured
+// Stripe products/prices and FusionAuth applications/tenants actually exist.
+//
+// Usage: fa-middleware check-config [-online] [-config /res/config.yml]
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	online := flags.Bool("online", false, "verify stripe and fusionauth ids against the live apis")
+	confFile := flags.String("config", config.GetConfigFilePath(), "path to the config file")
+	_ = flags.Parse(args)
+
+	conf, err := config.LoadConfigYamlFile(*confFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	if *online {
+		err = conf.InitClients()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		errs := config.ValidationErrors{}
+		for i, app := range conf.Apps {
+			path := fmt.Sprintf("apps[%v]", i)
+			auth.VerifyFusionAuthConfig(app, path, &errs)
+			payments.VerifyStripeConfig(app, path, &errs)
+		}
+		if len(errs) > 0 {
+			fmt.Fprintf(os.Stderr, "invalid config file %v: %v\n", *confFile, errs.Error())
+			return 1
+		}
+	}
+
+	fmt.Printf("config file %v is valid\n", *confFile)
+	return 0
+}
@@ -0,0 +1,477 @@
+// Package client calls the middleware's private api from other Go services,
+// so that they don't have to build the request bodies and pass the app's
+// api key around themselves:
+//
+//	mw := client.New("https://auth.example.com/mw", apiKey)
+//	subscribed, err := mw.IsSubscribed(ctx, client.ByJWT(jwt), "prod_xxx")
+//
+// Requests that fail with a network error, a 429 or a 5xx are retried with
+// exponential backoff, and results are cached for a short time, see
+// WithRetries and WithCacheTTL.
+package client
+
+import (
+	"fa-middleware/models"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the http timeout for a single attempt
+	DefaultTimeout = time.Second * 10
+
+	// DefaultRetries is how many times a failed request is attempted again
+	DefaultRetries = 2
+
+	// DefaultRetryWait is how long the first retry waits; every following
+	// retry waits twice as long as the one before
+	DefaultRetryWait = time.Millisecond * 200
+
+	// DefaultCacheTTL is how long subscription checks and user data are
+	// cached. It matches payments.CacheExpirationSeconds, so cached results
+	// are never much staler than the middleware's own.
+	DefaultCacheTTL = time.Second * 60
+
+	// maxCacheEntries limits how many results are cached; when it's reached,
+	// expired results are forgotten first, and then the ones that expire
+	// soonest
+	maxCacheEntries = 10000
+)
+
+var (
+	// ErrNotFound is returned when user data doesn't exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrVersionConflict is returned when a write or delete of user data
+	// expected a different version
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+// Error is returned for any other response than the expected one. Message
+// is the body of the response, such as "jwt doesn't correspond to any user".
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("middleware responded with %v: %v", err.StatusCode, err.Message)
+}
+
+// User selects the user of a request, either by the JWT that the user logged
+// in with or by their FusionAuth user id. The JWT is used if both are set.
+type User struct {
+	JWT    string
+	UserID string
+}
+
+// ByJWT looks up the user that a JWT belongs to, such as the one from the
+// app's cookie
+func ByJWT(jwt string) User {
+	return User{JWT: jwt}
+}
+
+// ByUserID looks up a user by their FusionAuth user id
+func ByUserID(userID string) User {
+	return User{UserID: userID}
+}
+
+// cacheKey identifies the user in cache keys; JWTs and user ids can't
+// collide since they're prefixed differently
+func (user User) cacheKey() string {
+	if user.JWT != "" {
+		return "jwt:" + user.JWT
+	}
+	return "id:" + user.UserID
+}
+
+// Client calls the private api of a single app
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retries    int
+	retryWait  time.Duration
+	cacheTTL   time.Duration
+
+	cacheMutex sync.Mutex
+	cache      map[string]cachedResult
+	sweptAt    time.Time
+}
+
+type cachedResult struct {
+	expiresAt time.Time
+	value     interface{}
+}
+
+// Option changes how a Client makes its requests, see New
+type Option func(cl *Client)
+
+// WithHTTPClient sends requests through hc, such as one with its own
+// transport. Its timeout applies to every attempt.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(cl *Client) {
+		cl.httpClient = hc
+	}
+}
+
+// WithTimeout sets the http timeout for a single attempt. The context of a
+// call limits how long all of its attempts may take together.
+func WithTimeout(timeout time.Duration) Option {
+	return func(cl *Client) {
+		cl.httpClient = &http.Client{Timeout: timeout}
+	}
+}
+
+// WithRetries sets how many times a failed request is attempted again, and
+// how long the first retry waits. 0 retries turns retrying off.
+func WithRetries(retries int, wait time.Duration) Option {
+	return func(cl *Client) {
+		cl.retries = retries
+		cl.retryWait = wait
+	}
+}
+
+// WithCacheTTL sets how long results are cached; 0 turns caching off
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(cl *Client) {
+		cl.cacheTTL = ttl
+	}
+}
+
+// New returns a client for the app with the given api key. baseURL is where
+// the middleware's routes are mounted, such as https://auth.example.com/mw.
+func New(baseURL string, apiKey string, options ...Option) *Client {
+	cl := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+		retries:    DefaultRetries,
+		retryWait:  DefaultRetryWait,
+		cacheTTL:   DefaultCacheTTL,
+		cache:      make(map[string]cachedResult),
+	}
+	for _, option := range options {
+		option(cl)
+	}
+	return cl
+}
+
+// IsSubscribed checks if the user has access to a product, through a
+// subscription or a one-time purchase
+func (cl *Client) IsSubscribed(ctx context.Context, user User, productID string) (bool, error) {
+	cacheKey := fmt.Sprintf("substatus:%v:%v", productID, user.cacheKey())
+	if value, ok := cl.getCached(cacheKey); ok {
+		return value.(bool), nil
+	}
+
+	status, body, err := cl.post(ctx, "/private/substatus", models.SubscriptionStatusCheckBody{
+		APIKey:    cl.apiKey,
+		JWT:       user.JWT,
+		UserID:    user.UserID,
+		ProductID: productID,
+	})
+	if err != nil {
+		return false, err
+	}
+	if status != 200 {
+		return false, &Error{StatusCode: status, Message: string(body)}
+	}
+
+	subscribed := strings.TrimSpace(string(body)) == "true"
+	cl.setCached(cacheKey, subscribed)
+	return subscribed, nil
+}
+
+// Introspect returns the user's profile, roles, stripe customer, active
+// subscriptions, products and entitlements in one request. Results are
+// cached like subscription checks.
+func (cl *Client) Introspect(ctx context.Context, user User) (models.IntrospectResponse, error) {
+	cacheKey := "introspect:" + user.cacheKey()
+	if value, ok := cl.getCached(cacheKey); ok {
+		return value.(models.IntrospectResponse), nil
+	}
+
+	resp := models.IntrospectResponse{}
+	status, body, err := cl.post(ctx, "/private/introspect", models.PrivateUserBody{
+		APIKey: cl.apiKey,
+		JWT:    user.JWT,
+		UserID: user.UserID,
+	})
+	if err != nil {
+		return resp, err
+	}
+	if status != 200 {
+		return resp, &Error{StatusCode: status, Message: string(body)}
+	}
+
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return resp, fmt.Errorf("failed to decode introspection: %v", err.Error())
+	}
+	cl.setCached(cacheKey, resp)
+	return resp, nil
+}
+
+// GetData reads a key of the user's data. ErrNotFound is returned if it
+// doesn't exist.
+func (cl *Client) GetData(ctx context.Context, user User, key string) (models.UserDataEntry, error) {
+	cacheKey := dataCacheKey(user, key)
+	if value, ok := cl.getCached(cacheKey); ok {
+		return value.(models.UserDataEntry), nil
+	}
+
+	entry, err := cl.data(ctx, user, key, "get", nil, 0)
+	if err != nil {
+		return entry, err
+	}
+	cl.setCached(cacheKey, entry)
+	return entry, nil
+}
+
+// PutData writes a key of the user's data; value must be valid JSON. If
+// version isn't 0, the write only succeeds if it matches the current version
+// of the key, and otherwise ErrVersionConflict is returned.
+//
+// The key is forgotten from the cache for every user, since the same user
+// may also be cached by their JWT or user id.
+func (cl *Client) PutData(ctx context.Context, user User, key string, value json.RawMessage, version int64) (models.UserDataEntry, error) {
+	cl.forgetDataKey(key)
+	entry, err := cl.data(ctx, user, key, "put", value, version)
+	if err != nil {
+		return entry, err
+	}
+	cl.setCached(dataCacheKey(user, key), entry)
+	return entry, nil
+}
+
+// DeleteData removes a key of the user's data. If version isn't 0, the
+// delete only succeeds if it matches the current version of the key. Like
+// PutData, the key is forgotten from the cache for every user.
+func (cl *Client) DeleteData(ctx context.Context, user User, key string, version int64) error {
+	cl.forgetDataKey(key)
+	_, err := cl.data(ctx, user, key, "delete", nil, version)
+	return err
+}
+
+func dataCacheKey(user User, key string) string {
+	return fmt.Sprintf("data:%v:%v", key, user.cacheKey())
+}
+
+// forgetDataKey forgets the cached key of every user; it may also forget
+// keys that start with "key:", which is harmless
+func (cl *Client) forgetDataKey(key string) {
+	prefix := fmt.Sprintf("data:%v:", key)
+	cl.cacheMutex.Lock()
+	defer cl.cacheMutex.Unlock()
+	for cacheKey := range cl.cache {
+		if strings.HasPrefix(cacheKey, prefix) {
+			delete(cl.cache, cacheKey)
+		}
+	}
+}
+
+// data sends a request to /private/data
+func (cl *Client) data(ctx context.Context, user User, key string, action string, value json.RawMessage, version int64) (entry models.UserDataEntry, err error) {
+	status, body, err := cl.post(ctx, "/private/data", models.PrivateDataBody{
+		APIKey:  cl.apiKey,
+		JWT:     user.JWT,
+		UserID:  user.UserID,
+		DataKey: key,
+		Action:  action,
+		Value:   value,
+		Version: version,
+	})
+	if err != nil {
+		return entry, err
+	}
+
+	switch status {
+	case 200:
+		err = json.Unmarshal(body, &entry)
+		if err != nil {
+			return entry, fmt.Errorf("failed to decode user data: %v", err.Error())
+		}
+		return entry, nil
+	case 204:
+		return entry, nil
+	case 404:
+		return entry, ErrNotFound
+	case 412:
+		return entry, ErrVersionConflict
+	default:
+		return entry, &Error{StatusCode: status, Message: string(body)}
+	}
+}
+
+// FailedWebhooks lists the app's outbound webhook deliveries that ran out of
+// retries
+func (cl *Client) FailedWebhooks(ctx context.Context) ([]models.WebhookDelivery, error) {
+	status, body, err := cl.post(ctx, "/private/webhooks/failed", models.WebhookDeliveriesBody{
+		APIKey: cl.apiKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, &Error{StatusCode: status, Message: string(body)}
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	err = json.Unmarshal(body, &deliveries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode webhook deliveries: %v", err.Error())
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhooks queues failed webhook deliveries to be sent again, and
+// returns how many were queued
+func (cl *Client) RedeliverWebhooks(ctx context.Context, deliveryIDs []string) (int, error) {
+	status, body, err := cl.post(ctx, "/private/webhooks/redeliver", models.WebhookDeliveriesBody{
+		APIKey:      cl.apiKey,
+		DeliveryIDs: deliveryIDs,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if status != 200 {
+		return 0, &Error{StatusCode: status, Message: string(body)}
+	}
+
+	result := struct {
+		Redelivered int `json:"redelivered"`
+	}{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode redelivery result: %v", err.Error())
+	}
+	return result.Redelivered, nil
+}
+
+// ClearCache forgets every cached result, such as after the user's access
+// was changed elsewhere
+func (cl *Client) ClearCache() {
+	cl.cacheMutex.Lock()
+	defer cl.cacheMutex.Unlock()
+	cl.cache = make(map[string]cachedResult)
+}
+
+func (cl *Client) getCached(key string) (interface{}, bool) {
+	cl.cacheMutex.Lock()
+	defer cl.cacheMutex.Unlock()
+	result, ok := cl.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(result.expiresAt) {
+		delete(cl.cache, key)
+		return nil, false
+	}
+	return result.value, true
+}
+
+func (cl *Client) setCached(key string, value interface{}) {
+	if cl.cacheTTL <= 0 {
+		return
+	}
+	cl.cacheMutex.Lock()
+	defer cl.cacheMutex.Unlock()
+
+	now := time.Now()
+	if _, ok := cl.cache[key]; !ok && len(cl.cache) >= maxCacheEntries {
+		cl.evictCached(now)
+	} else if now.Sub(cl.sweptAt) > cl.cacheTTL {
+		// results that are never read again would otherwise stay forever
+		cl.sweepCached(now)
+	}
+	cl.cache[key] = cachedResult{expiresAt: now.Add(cl.cacheTTL), value: value}
+}
+
+// sweepCached forgets expired results. The caller must hold the lock.
+func (cl *Client) sweepCached(now time.Time) {
+	for key, result := range cl.cache {
+		if now.After(result.expiresAt) {
+			delete(cl.cache, key)
+		}
+	}
+	cl.sweptAt = now
+}
+
+// evictCached makes room for a result: expired results are forgotten, or
+// the one that expires soonest if none have. The caller must hold the lock.
+func (cl *Client) evictCached(now time.Time) {
+	cl.sweepCached(now)
+	if len(cl.cache) < maxCacheEntries {
+		return
+	}
+	soonest := ""
+	for key, result := range cl.cache {
+		if soonest == "" || result.expiresAt.Before(cl.cache[soonest].expiresAt) {
+			soonest = key
+		}
+	}
+	delete(cl.cache, soonest)
+}
+
+// post sends a JSON body to a private endpoint and returns the status and
+// body of the response. Network errors, 429s and 5xx's are retried until the
+// retries or the context run out.
+func (cl *Client) post(ctx context.Context, path string, payload interface{}) (status int, body []byte, err error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to encode request: %v", err.Error())
+	}
+
+	wait := cl.retryWait
+	for attempt := 0; ; attempt++ {
+		status, body, err = cl.send(ctx, path, encoded)
+		retryable := err != nil || status == 429 || status >= 500
+		if !retryable || attempt >= cl.retries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+	return status, body, nil
+}
+
+// send makes a single attempt at a request
+func (cl *Client) send(ctx context.Context, path string, encoded []byte) (status int, body []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", cl.baseURL+path, bytes.NewReader(encoded))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to build request: %v", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := cl.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to call %v: %v", path, err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read response of %v: %v", path, err.Error())
+	}
+	return resp.StatusCode, body, nil
+}
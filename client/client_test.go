@@ -0,0 +1,175 @@
+package client
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dataServer is a /private/data endpoint that stores a single user's data,
+// whether they're selected by JWT or by id, and counts the reads
+type dataServer struct {
+	mu    sync.Mutex
+	data  map[string]models.UserDataEntry
+	reads int
+}
+
+func newDataServer(t *testing.T) (*dataServer, *httptest.Server) {
+	srv := &dataServer{data: make(map[string]models.UserDataEntry)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := models.PrivateDataBody{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		switch body.Action {
+		case "get":
+			srv.reads++
+			entry, ok := srv.data[body.DataKey]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(entry)
+		case "put":
+			entry := srv.data[body.DataKey]
+			entry.Key = body.DataKey
+			entry.Value = body.Value
+			entry.Version++
+			srv.data[body.DataKey] = entry
+			_ = json.NewEncoder(w).Encode(entry)
+		case "delete":
+			delete(srv.data, body.DataKey)
+			w.WriteHeader(204)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return srv, server
+}
+
+func TestPutDataForgetsTheKeyForEveryUser(t *testing.T) {
+	srv, server := newDataServer(t)
+	cl := New(server.URL, "key")
+	ctx := context.Background()
+
+	_, err := cl.PutData(ctx, ByUserID("user-1"), "theme", json.RawMessage(`"dark"`), 0)
+	if err != nil {
+		t.Fatalf("failed to put data: %v", err)
+	}
+	entry, err := cl.GetData(ctx, ByJWT("jwt-of-user-1"), "theme")
+	if err != nil || string(entry.Value) != `"dark"` {
+		t.Fatalf("expected the dark theme, got %s: %v", entry.Value, err)
+	}
+
+	// the same user writes through their id, which must not leave the
+	// entry that was cached by their jwt behind
+	_, err = cl.PutData(ctx, ByUserID("user-1"), "theme", json.RawMessage(`"light"`), 0)
+	if err != nil {
+		t.Fatalf("failed to put data: %v", err)
+	}
+	entry, err = cl.GetData(ctx, ByJWT("jwt-of-user-1"), "theme")
+	if err != nil || string(entry.Value) != `"light"` {
+		t.Errorf("expected the light theme, got %s: %v", entry.Value, err)
+	}
+
+	err = cl.DeleteData(ctx, ByUserID("user-1"), "theme", 0)
+	if err != nil {
+		t.Fatalf("failed to delete data: %v", err)
+	}
+	_, err = cl.GetData(ctx, ByJWT("jwt-of-user-1"), "theme")
+	if err != ErrNotFound {
+		t.Errorf("expected the deleted key to be gone, got %v", err)
+	}
+	if srv.reads != 3 {
+		t.Errorf("expected every read after a write to reach the server, got %v reads", srv.reads)
+	}
+}
+
+func TestCacheSweepsExpiredResults(t *testing.T) {
+	cl := New("http://localhost", "key", WithCacheTTL(time.Millisecond))
+	cl.setCached("a", true)
+	cl.setCached("b", true)
+	time.Sleep(5 * time.Millisecond)
+
+	cl.setCached("c", true)
+	if len(cl.cache) != 1 {
+		t.Errorf("expected the expired results to be swept, got %v results", len(cl.cache))
+	}
+}
+
+func TestCacheIsCapped(t *testing.T) {
+	cl := New("http://localhost", "key")
+	for i := 0; i < maxCacheEntries+10; i++ {
+		cl.setCached(fmt.Sprintf("key-%v", i), i)
+	}
+	if len(cl.cache) != maxCacheEntries {
+		t.Errorf("expected %v results, got %v", maxCacheEntries, len(cl.cache))
+	}
+	if _, ok := cl.getCached(fmt.Sprintf("key-%v", maxCacheEntries+9)); !ok {
+		t.Errorf("expected the newest result to be cached")
+	}
+}
+
+// flakyServer answers with the given statuses in turn, then with an empty
+// list of webhook deliveries, and counts the requests
+func flakyServer(t *testing.T, statuses ...int) (*int, *httptest.Server) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= len(statuses) {
+			w.WriteHeader(statuses[requests-1])
+			return
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+	t.Cleanup(server.Close)
+	return &requests, server
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	requests, server := flakyServer(t, 503, 429)
+	cl := New(server.URL, "key", WithRetries(2, time.Millisecond))
+
+	_, err := cl.FailedWebhooks(context.Background())
+	if err != nil {
+		t.Errorf("expected the request to succeed after retrying, got %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("expected 3 requests, got %v", *requests)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	requests, server := flakyServer(t, 401)
+	cl := New(server.URL, "key", WithRetries(2, time.Millisecond))
+
+	_, err := cl.FailedWebhooks(context.Background())
+	clientErr, ok := err.(*Error)
+	if !ok || clientErr.StatusCode != 401 {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("expected a single request, got %v", *requests)
+	}
+}
+
+func TestRetriesCanBeTurnedOff(t *testing.T) {
+	requests, server := flakyServer(t, 503)
+	cl := New(server.URL, "key", WithRetries(0, time.Millisecond))
+
+	_, err := cl.FailedWebhooks(context.Background())
+	clientErr, ok := err.(*Error)
+	if !ok || clientErr.StatusCode != 503 {
+		t.Errorf("expected a 503 error, got %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("expected a single request, got %v", *requests)
+	}
+}
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TokenLeeway is how far the clocks of the middleware and the service
+	// may be apart when checking if a token expired
+	TokenLeeway = time.Second * 30
+
+	// jwksRefetchInterval limits how often the keys are fetched again when a
+	// token was signed with an unknown key, such as right after a rotation
+	jwksRefetchInterval = time.Second * 10
+)
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed, weren't
+	// signed by the middleware or are for another app
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrTokenExpired is returned for tokens that were valid but expired
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Token signs an entitlement token for the user, which services that only
+// have the middleware's public keys can check, see TokenVerifier
+func (cl *Client) Token(ctx context.Context, user User) (models.TokenResponse, error) {
+	token := models.TokenResponse{}
+	status, body, err := cl.post(ctx, "/private/token", models.PrivateUserBody{
+		APIKey: cl.apiKey,
+		JWT:    user.JWT,
+		UserID: user.UserID,
+	})
+	if err != nil {
+		return token, err
+	}
+	if status != 200 {
+		return token, &Error{StatusCode: status, Message: string(body)}
+	}
+
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return token, fmt.Errorf("failed to decode token: %v", err.Error())
+	}
+	return token, nil
+}
+
+// TokenVerifier checks entitlement tokens locally, with the public keys that
+// the middleware publishes at /.well-known/jwks.json
+type TokenVerifier struct {
+	jwksURL    string
+	appID      string
+	httpClient *http.Client
+
+	mutex     sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// TokenVerifier returns a verifier that only accepts tokens for the app with
+// the given FusionAuth application id. The keys are fetched through the
+// client's http client.
+func (cl *Client) TokenVerifier(appID string) *TokenVerifier {
+	return &TokenVerifier{
+		jwksURL:    cl.baseURL + "/.well-known/jwks.json",
+		appID:      appID,
+		httpClient: cl.httpClient,
+		keys:       make(map[string]*rsa.PublicKey),
+	}
+}
+
+// Verify checks the signature, expiry and audience of a token and returns
+// its claims
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (claims models.EntitlementClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidToken
+	}
+
+	header := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}{}
+	err = decodeTokenPart(parts[0], &header)
+	if err != nil || header.Algorithm != "RS256" {
+		return claims, ErrInvalidToken
+	}
+
+	key, err := v.getKey(ctx, header.KeyID)
+	if err != nil {
+		return claims, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+
+	err = decodeTokenPart(parts[1], &claims)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if v.appID != "" && claims.Audience != v.appID {
+		return claims, ErrInvalidToken
+	}
+	if time.Now().Add(-TokenLeeway).Unix() > claims.ExpiresAt {
+		return claims, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func decodeTokenPart(part string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, value)
+}
+
+// getKey returns the public key with the given id, fetching the keys again
+// if it's unknown
+func (v *TokenVerifier) getKey(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	key, ok := v.keys[keyID]
+	if ok {
+		return key, nil
+	}
+	if time.Since(v.fetchedAt) < jwksRefetchInterval {
+		return nil, ErrInvalidToken
+	}
+
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+
+	key, ok = v.keys[keyID]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return key, nil
+}
+
+func (v *TokenVerifier) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build jwks request: %v", err.Error())
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks: %v", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: string(body)}
+	}
+
+	jwks := models.JWKS{}
+	err = json.Unmarshal(body, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %v", err.Error())
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/FusionAuth/go-client/pkg/fusionauth"
 	"gopkg.in/yaml.v2"
@@ -13,12 +14,115 @@ import (
 
 const (
 	ConfigFile = "config.yml"
+
+	// DefaultDataMaxValueBytes is the largest value that can be stored for a
+	// single user data key when DataConfig.MaxValueBytes is not set
+	DefaultDataMaxValueBytes = 64 * 1024
+
+	// DefaultDataMaxKeys is the number of user data keys that a single user
+	// can have per app when DataConfig.MaxKeys is not set
+	DefaultDataMaxKeys = 100
+
+	// DefaultTokenTTLSeconds is how long entitlement tokens are valid when
+	// TokensConfig.TTLSeconds is not set
+	DefaultTokenTTLSeconds = 300
+
+	// DefaultTokenRotationHours is how long a signing key is used for new
+	// entitlement tokens when TokensConfig.RotationHours is not set
+	DefaultTokenRotationHours = 24
+)
+
+// Payment providers that can be set in stripe.provider
+const (
+	PaymentProviderStripe = "stripe"
+
+	// PaymentProviderFake keeps customers, checkout sessions and
+	// subscriptions in memory instead of calling Stripe, for local
+	// development and tests
+	PaymentProviderFake = "fake"
 )
 
+// DefaultPaymentMethodTypes are offered at checkout when
+// CheckoutConfig.PaymentMethodTypes is not set
+var DefaultPaymentMethodTypes = []string{"card"}
+
 type GlobalConfig struct {
 	BindAddr         string `yaml:"bindAddr"`
 	BindPort         int    `yaml:"bindPort"`
 	BindPortExternal int    `yaml:"bindPortExternal"`
+
+	// ReloadIntervalSeconds controls how often the config file is checked
+	// for changes; see DefaultReloadIntervalSeconds
+	ReloadIntervalSeconds int `yaml:"reloadIntervalSeconds"`
+
+	// DatabaseURL is the connection string for the middleware's own Postgres
+	// database; leave it empty to only use FusionAuth user data
+	DatabaseURL string `yaml:"databaseUrl"`
+
+	// JobWorkers is the number of background job workers; see
+	// jobs.DefaultWorkers
+	JobWorkers int `yaml:"jobWorkers"`
+
+	// FusionAuthWebhook authenticates the webhooks that FusionAuth sends to
+	// /mw/fusionauth/webhook
+	FusionAuthWebhook FusionAuthWebhookConfig `yaml:"fusionAuthWebhook"`
+
+	// Reconcile schedules the FusionAuth/Stripe reconciliation job
+	Reconcile ReconcileConfig `yaml:"reconcile"`
+
+	// Tokens controls the entitlement tokens that the middleware signs
+	Tokens TokensConfig `yaml:"tokens"`
+
+	// AdminAPIKey authenticates the /mw/private/jobs endpoints, which cover
+	// every app; they are disabled when it's empty
+	AdminAPIKey string `yaml:"adminApiKey"`
+}
+
+// TokensConfig controls how long entitlement tokens are valid and how often
+// the key that signs them is replaced; see DefaultTokenTTLSeconds and
+// DefaultTokenRotationHours
+type TokensConfig struct {
+	TTLSeconds    int `yaml:"ttlSeconds"`
+	RotationHours int `yaml:"rotationHours"`
+}
+
+// GetTTL returns how long entitlement tokens are valid
+func (tokens TokensConfig) GetTTL() time.Duration {
+	if tokens.TTLSeconds > 0 {
+		return time.Second * time.Duration(tokens.TTLSeconds)
+	}
+	return time.Second * DefaultTokenTTLSeconds
+}
+
+// GetRotationInterval returns how long a signing key is used for new tokens
+func (tokens TokensConfig) GetRotationInterval() time.Duration {
+	if tokens.RotationHours > 0 {
+		return time.Hour * time.Duration(tokens.RotationHours)
+	}
+	return time.Hour * DefaultTokenRotationHours
+}
+
+// ReconcileConfig controls the scheduled job that looks for mismatches
+// between FusionAuth users and Stripe customers. The job is disabled when
+// IntervalMinutes is 0. Without Fix, mismatches are only logged.
+type ReconcileConfig struct {
+	IntervalMinutes int  `yaml:"intervalMinutes"`
+	Fix             bool `yaml:"fix"`
+}
+
+// FusionAuthWebhookConfig holds the credentials that FusionAuth is configured
+// to send with its webhooks. Secret is compared to the Authorization header
+// (optionally prefixed with "Bearer "), and Username/Password are compared to
+// HTTP basic auth. If neither is set, the webhook endpoint is disabled.
+type FusionAuthWebhookConfig struct {
+	Secret   string `yaml:"secret"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Enabled checks if any credentials are configured for the webhook
+func (webhook FusionAuthWebhookConfig) Enabled() bool {
+	return webhook.Secret != "" || webhook.Username != ""
 }
 
 type FusionAuthConfig struct {
@@ -37,20 +141,180 @@ type JWTConfig struct {
 }
 
 type StripeConfig struct {
+	// Provider is either PaymentProviderStripe, the default, or
+	// PaymentProviderFake
+	Provider string `yaml:"provider"`
+
 	PublicKey         string                 `yaml:"publicKey"`
 	SecretKey         string                 `yaml:"secretKey"`
 	PaymentSuccessURL string                 `yaml:"paymentSuccessURL"`
 	PaymentCancelURL  string                 `yaml:"paymentCancelURL"`
 	Products          []models.StripeProduct `yaml:"products"`
+
+	Checkout CheckoutConfig `yaml:"checkout"`
+
+	// WebhookSecret is the signing secret of the Stripe webhook endpoint
+	// that sends events to /mw/stripe/webhook, used to record one-time
+	// purchases
+	WebhookSecret string `yaml:"webhookSecret"`
+}
+
+// CheckoutConfig holds the options for the Stripe checkout sessions that
+// /mw/create-checkout-session creates
+//
+// https://stripe.com/docs/api/checkout/sessions/create
+type CheckoutConfig struct {
+	AllowPromotionCodes bool `yaml:"allowPromotionCodes"`
+
+	// PaymentMethodTypes defaults to DefaultPaymentMethodTypes
+	PaymentMethodTypes []string `yaml:"paymentMethodTypes"`
+
+	// BillingAddressCollection is either "auto" or "required"
+	BillingAddressCollection string `yaml:"billingAddressCollection"`
+	TaxIDCollection          bool   `yaml:"taxIdCollection"`
+
+	// TrialDays is the free trial for subscriptions; 0 disables it
+	TrialDays int `yaml:"trialDays"`
+
+	// DefaultLineItems are checked out when no line items are requested
+	DefaultLineItems []models.CheckoutLineItem `yaml:"defaultLineItems"`
+}
+
+// GetPaymentMethodTypes returns the configured payment method types, or the
+// default
+func (checkout CheckoutConfig) GetPaymentMethodTypes() []string {
+	if len(checkout.PaymentMethodTypes) > 0 {
+		return checkout.PaymentMethodTypes
+	}
+	return DefaultPaymentMethodTypes
+}
+
+// HasPrice checks if a price belongs to one of the configured products
+func (stripe StripeConfig) HasPrice(priceID string) bool {
+	_, ok := stripe.GetProductForPrice(priceID)
+	return ok
+}
+
+// GetProductForPrice returns the configured product that a price belongs to
+func (stripe StripeConfig) GetProductForPrice(priceID string) (models.StripeProduct, bool) {
+	for _, product := range stripe.Products {
+		for _, configuredID := range product.PriceIDs {
+			if configuredID == priceID {
+				return product, true
+			}
+		}
+	}
+	return models.StripeProduct{}, false
+}
+
+// GetProductsWithEntitlement returns the configured products that grant an
+// entitlement
+func (stripe StripeConfig) GetProductsWithEntitlement(entitlement string) (products []models.StripeProduct) {
+	for _, product := range stripe.Products {
+		for _, granted := range product.Entitlements {
+			if granted == entitlement {
+				products = append(products, product)
+				break
+			}
+		}
+	}
+	return products
+}
+
+// GetProduct returns the configured product with the given ID
+func (stripe StripeConfig) GetProduct(productID string) (models.StripeProduct, bool) {
+	for _, product := range stripe.Products {
+		if product.ProductID == productID {
+			return product, true
+		}
+	}
+	return models.StripeProduct{}, false
+}
+
+// WebhookConfig is an outbound webhook endpoint in an app's backend that
+// receives signed events. If Events is empty, every event is sent.
+type WebhookConfig struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+// WantsEvent checks if the endpoint is subscribed to an event type
+func (webhook WebhookConfig) WantsEvent(eventType string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, event := range webhook.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DataConfig limits how much data each user can store via /mw/data
+type DataConfig struct {
+	MaxValueBytes int `yaml:"maxValueBytes"`
+	MaxKeys       int `yaml:"maxKeys"`
+}
+
+// ForwardAuthConfig is where /mw/forward-auth sends users that it turns
+// away, if the proxy asks for redirects. {URL} is replaced by the escaped URL
+// that the user wanted to visit.
+type ForwardAuthConfig struct {
+	LoginURL   string `yaml:"loginUrl"`
+	PricingURL string `yaml:"pricingUrl"`
+}
+
+// ProxyConfig puts other apps behind the middleware, which checks every
+// request before passing it upstream, see package proxy
+type ProxyConfig struct {
+	// Secret signs the identity headers that are sent upstream, so that
+	// upstreams can tell that they came from the middleware
+	Secret string `yaml:"secret"`
+
+	// LoginURL and PricingURL are where users are redirected if they aren't
+	// logged in or lack a product or entitlement; {URL} is replaced by the
+	// escaped URL that they wanted to visit. The failure is returned as JSON
+	// if they're empty.
+	LoginURL   string `yaml:"loginUrl"`
+	PricingURL string `yaml:"pricingUrl"`
+
+	Routes []ProxyRoute `yaml:"routes"`
+}
+
+// ProxyRoute sends requests whose path starts with PathPrefix to Upstream.
+// Users must be logged in unless Anonymous is set, and must meet Role,
+// Product and Entitlement if they're set.
+type ProxyRoute struct {
+	PathPrefix string `yaml:"pathPrefix"`
+	Upstream   string `yaml:"upstream"`
+
+	// StripPrefix removes PathPrefix from the path that is sent upstream
+	StripPrefix bool `yaml:"stripPrefix"`
+
+	Anonymous   bool   `yaml:"anonymous"`
+	Role        string `yaml:"role"`
+	Product     string `yaml:"product"`
+	Entitlement string `yaml:"entitlement"`
 }
 
 type App struct {
-	Domain                string                  `yaml:"domain"`
-	FullDomainURL         string                  `yaml:"fullDomainURL"`
+	Domain        string `yaml:"domain"`
+	FullDomainURL string `yaml:"fullDomainURL"`
+
+	// Mode is either AppModeLive, the default, or AppModeDev
+	Mode string    `yaml:"mode"`
+	Dev  DevConfig `yaml:"dev"`
+
 	FusionAuth            FusionAuthConfig        `yaml:"fusionAuth"`
 	JWT                   JWTConfig               `yaml:"jwt"`
 	Stripe                StripeConfig            `yaml:"stripe"`
 	APIKey                string                  `yaml:"apiKey"`
+	Data                  DataConfig              `yaml:"data"`
+	Webhooks              []WebhookConfig         `yaml:"webhooks"`
+	ForwardAuth           ForwardAuthConfig       `yaml:"forwardAuth"`
+	Proxy                 ProxyConfig             `yaml:"proxy"`
 	StripeProductsFromAPI []models.ProductSummary // will be set later
 }
 
@@ -59,13 +323,25 @@ type Config struct {
 	Global GlobalConfig `yaml:"global"`
 }
 
-// LoadConfig reads from a provided yaml-formatted configuration filename
-func LoadConfigYaml() (conf Config, err error) {
+// GetConfigFilePath returns the path of the config file, which can be
+// overridden via the "config" environment variable
+func GetConfigFilePath() string {
 	confFile := "/res/config.yml"
 	envConfFile := os.Getenv("config")
 	if envConfFile != "" {
 		confFile = envConfFile
 	}
+	return confFile
+}
+
+// LoadConfig reads from a provided yaml-formatted configuration filename
+func LoadConfigYaml() (conf Config, err error) {
+	return LoadConfigYamlFile(GetConfigFilePath())
+}
+
+// LoadConfigYamlFile reads and validates the yaml-formatted configuration
+// file at confFile
+func LoadConfigYamlFile(confFile string) (conf Config, err error) {
 
 	// read from config file
 	confData, err := ioutil.ReadFile(confFile)
@@ -78,9 +354,41 @@ func LoadConfigYaml() (conf Config, err error) {
 		return conf, fmt.Errorf("failed to parse config file %v: %v", confFile, err.Error())
 	}
 
+	err = conf.Interpolate()
+	if err != nil {
+		return conf, fmt.Errorf("failed to resolve references in config file %v: %v", confFile, err.Error())
+	}
+
+	err = conf.applyDevMode()
+	if err != nil {
+		return conf, fmt.Errorf("failed to set up dev mode for config file %v: %v", confFile, err.Error())
+	}
+
+	err = conf.Validate()
+	if err != nil {
+		return conf, fmt.Errorf("invalid config file %v: %v", confFile, err.Error())
+	}
+
 	return conf, nil
 }
 
+// GetMaxValueBytes returns the configured max value size, or the default
+func (data DataConfig) GetMaxValueBytes() int {
+	if data.MaxValueBytes > 0 {
+		return data.MaxValueBytes
+	}
+	return DefaultDataMaxValueBytes
+}
+
+// GetMaxKeys returns the configured max number of keys per user, or the
+// default
+func (data DataConfig) GetMaxKeys() int {
+	if data.MaxKeys > 0 {
+		return data.MaxKeys
+	}
+	return DefaultDataMaxKeys
+}
+
 func (conf *Config) GetAppByDomain(domain string) (App, bool) {
 	for _, app := range conf.Apps {
 		if app.Domain == domain {
@@ -101,6 +409,20 @@ func (conf *Config) GetAppByOrigin(origin string) (App, bool) {
 	return App{}, false
 }
 
+// GetAppByAPIKey finds the app that the private api key belongs to
+func (conf *Config) GetAppByAPIKey(apiKey string) (App, bool) {
+	if apiKey == "" {
+		return App{}, false
+	}
+	for _, app := range conf.Apps {
+		if app.APIKey == apiKey {
+			return app, true
+		}
+	}
+
+	return App{}, false
+}
+
 func (conf *Config) GetConfigForAppID(appID string) (App, bool) {
 	for _, app := range conf.Apps {
 		if app.FusionAuth.AppID == appID {
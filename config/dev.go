@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fa-middleware/dev"
+	"fa-middleware/models"
+
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+// Modes that can be set in App.Mode
+const (
+	AppModeLive = "live"
+
+	// AppModeDev swaps FusionAuth and Stripe for in-memory stand-ins that
+	// are seeded from DevConfig.FixturesFile, so that the middleware can run
+	// without any external services
+	AppModeDev = "dev"
+)
+
+const (
+	// DevAppID and DevTenantID are used for the FusionAuth application and
+	// tenant of apps in dev mode that don't configure their own
+	DevAppID    = "00000000-0000-4000-8000-000000000001"
+	DevTenantID = "00000000-0000-4000-8000-000000000002"
+
+	// devFusionAuthURL is where the FusionAuth client of apps in dev mode
+	// pretends to send its requests when no internalHostUrl is configured
+	devFusionAuthURL = "http://fusionauth.dev"
+)
+
+// DevMode puts every app into dev mode regardless of its config; it's set
+// by the --dev flag
+var DevMode = false
+
+// DevConfig holds the options of an app in dev mode
+type DevConfig struct {
+	// FixturesFile is a yaml file with the users and products that exist
+	// from the start, see res/fixtures.example.yml
+	FixturesFile string             `yaml:"fixturesFile"`
+	Fixtures     models.DevFixtures `yaml:"-"` // loaded from FixturesFile; is set automatically
+}
+
+// IsDev checks if the app runs against the in-memory FusionAuth and payment
+// provider
+func (app App) IsDev() bool {
+	return app.Mode == AppModeDev
+}
+
+// applyDevMode fills in everything that apps in dev mode don't need to
+// configure, and loads their fixtures
+func (conf *Config) applyDevMode() error {
+	for i := range conf.Apps {
+		app := &conf.Apps[i]
+		if DevMode {
+			app.Mode = AppModeDev
+		}
+		if !app.IsDev() {
+			continue
+		}
+
+		log.Printf("app %v is in dev mode; fusionauth and stripe are kept in memory", app.Domain)
+		app.Stripe.Provider = PaymentProviderFake
+		if app.FusionAuth.AppID == "" {
+			app.FusionAuth.AppID = DevAppID
+		}
+		if app.FusionAuth.TenantID == "" {
+			app.FusionAuth.TenantID = DevTenantID
+		}
+
+		fixtures, err := dev.LoadFixtures(app.Dev.FixturesFile)
+		if err != nil {
+			return fmt.Errorf("apps[%v].dev.fixturesFile: %v", i, err.Error())
+		}
+		app.Dev.Fixtures = fixtures
+	}
+	return nil
+}
+
+// newDevFusionAuthClient returns a FusionAuth client whose requests are
+// answered by the app's in-memory FusionAuth
+func newDevFusionAuthClient(app App) (*fusionauth.FusionAuthClient, error) {
+	fa, err := dev.GetFusionAuth(
+		app.Domain,
+		app.FusionAuth.AppID,
+		app.FusionAuth.TenantID,
+		app.Dev.Fixtures.Users,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"failed to seed the dev fusionauth of app %v: %v",
+			app.Domain,
+			err.Error(),
+		)
+	}
+
+	rawURL := app.FusionAuth.InternalHostURL
+	if rawURL == "" {
+		rawURL = devFusionAuthURL
+	}
+	faURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"failed to parse fusionauth url for app %v: %v",
+			app.Domain,
+			err.Error(),
+		)
+	}
+
+	hc := &http.Client{Transport: fa, Timeout: FusionAuthClientTimeout}
+	return fusionauth.NewClient(hc, faURL, app.FusionAuth.APIKey), nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// FileReferencePrefix marks a config value that should be read from a file,
+// such as a Docker secret: "file:/run/secrets/stripe_secret_key"
+const FileReferencePrefix = "file:"
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Interpolate replaces ${ENV_VAR} references and file: references in every
+// string field of the config. An env var that isn't set or a file that can't
+// be read is an error, so that a missing secret never silently becomes an
+// empty string.
+func (conf *Config) Interpolate() error {
+	errs := ValidationErrors{}
+	interpolateValue(reflect.ValueOf(conf).Elem(), "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// interpolateValue walks through structs and slices, resolving every string
+// that it finds. Only fields with a yaml tag are considered, since the others
+// are set at runtime.
+func interpolateValue(value reflect.Value, path string, errs *ValidationErrors) {
+	switch value.Kind() {
+	case reflect.String:
+		resolved, err := resolveString(value.String())
+		if err != nil {
+			errs.Add(path, "%v", err.Error())
+			return
+		}
+		value.SetString(resolved)
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			interpolateValue(value.Index(i), fmt.Sprintf("%v[%v]", path, i), errs)
+		}
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < valueType.NumField(); i++ {
+			name := strings.Split(valueType.Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			interpolateValue(value.Field(i), fieldPath, errs)
+		}
+	}
+}
+
+// resolveString reads the file for a file: reference, or otherwise expands
+// any ${ENV_VAR} references in the value
+func resolveString(value string) (string, error) {
+	if strings.HasPrefix(value, FileReferencePrefix) {
+		fileName := strings.TrimPrefix(value, FileReferencePrefix)
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return "", fmt.Errorf("failed to read referenced file %v: %v", fileName, err.Error())
+		}
+		// secret files almost always end with a newline
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var missing []string
+	resolved := envVarPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envVarPattern.FindStringSubmatch(ref)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("referenced env var(s) not set: %v", strings.Join(missing, ", "))
+	}
+
+	return resolved, nil
+}
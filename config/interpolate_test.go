@@ -0,0 +1,72 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("FAM_TEST_STRIPE_KEY", "sk_test_from_env")
+	os.Setenv("FAM_TEST_HOST", "fusionauth")
+	defer os.Unsetenv("FAM_TEST_STRIPE_KEY")
+	defer os.Unsetenv("FAM_TEST_HOST")
+
+	secretFile := filepath.Join(t.TempDir(), "api_key")
+	err := ioutil.WriteFile(secretFile, []byte("key-from-file\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+
+	conf := validConfig()
+	conf.Global.DatabaseURL = "postgres://mw:${FAM_TEST_HOST}@db/postgres"
+	conf.Apps[0].Stripe.SecretKey = "${FAM_TEST_STRIPE_KEY}"
+	conf.Apps[0].FusionAuth.InternalHostURL = "http://${FAM_TEST_HOST}:9011"
+	conf.Apps[0].FusionAuth.APIKey = FileReferencePrefix + secretFile
+	conf.Apps[0].APIKey = "$NOT_A_REFERENCE"
+
+	err = conf.Interpolate()
+	if err != nil {
+		t.Fatalf("failed to interpolate: %v", err)
+	}
+	app := conf.Apps[0]
+	if app.Stripe.SecretKey != "sk_test_from_env" {
+		t.Errorf("expected the secret key from the env, got %v", app.Stripe.SecretKey)
+	}
+	if app.FusionAuth.InternalHostURL != "http://fusionauth:9011" {
+		t.Errorf("expected the host to be expanded, got %v", app.FusionAuth.InternalHostURL)
+	}
+	if conf.Global.DatabaseURL != "postgres://mw:fusionauth@db/postgres" {
+		t.Errorf("expected the database url to be expanded, got %v", conf.Global.DatabaseURL)
+	}
+	if app.FusionAuth.APIKey != "key-from-file" {
+		t.Errorf("expected the api key from the file without the newline, got %q", app.FusionAuth.APIKey)
+	}
+	if app.APIKey != "$NOT_A_REFERENCE" {
+		t.Errorf("expected values without braces to be left alone, got %v", app.APIKey)
+	}
+}
+
+func TestInterpolateReportsMissingReferences(t *testing.T) {
+	os.Unsetenv("FAM_TEST_MISSING")
+	conf := validConfig()
+	conf.Apps[0].Stripe.SecretKey = "${FAM_TEST_MISSING}"
+	conf.Apps[0].FusionAuth.APIKey = FileReferencePrefix + filepath.Join(t.TempDir(), "missing")
+
+	paths := make(map[string]bool)
+	err := conf.Interpolate()
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	for _, fieldErr := range errs {
+		paths[fieldErr.Path] = true
+	}
+	if len(paths) != 2 || !paths["apps[0].stripe.secretKey"] || !paths["apps[0].fusionAuth.apiKey"] {
+		t.Errorf("expected both missing references to be reported, got %v", errs)
+	}
+	if conf.Apps[0].Stripe.SecretKey != "${FAM_TEST_MISSING}" {
+		t.Errorf("expected a missing reference not to become empty, got %q", conf.Apps[0].Stripe.SecretKey)
+	}
+}
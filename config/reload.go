@@ -0,0 +1,224 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+const (
+	// DefaultReloadIntervalSeconds is how often the config file's
+	// modification time is checked when GlobalConfig.ReloadIntervalSeconds
+	// is not set
+	DefaultReloadIntervalSeconds = 5
+
+	// FusionAuthClientTimeout is the http timeout used for every FusionAuth
+	// client that gets built from the config
+	FusionAuthClientTimeout = time.Second * 10
+)
+
+// Holder keeps track of the currently active Config. Each request should call
+// Get once and use the returned snapshot for its whole lifetime, so that a
+// reload that happens mid-request does not affect in-flight requests.
+type Holder struct {
+	value atomic.Value
+	mu    sync.Mutex // serializes reloads
+}
+
+// NewHolder returns a Holder with conf as the active config
+func NewHolder(conf Config) *Holder {
+	holder := &Holder{}
+	holder.value.Store(conf)
+	return holder
+}
+
+// Get returns the currently active config snapshot
+func (holder *Holder) Get() Config {
+	return holder.value.Load().(Config)
+}
+
+// InitClients builds the FusionAuth client for every app in the config
+func (conf *Config) InitClients() error {
+	for i, app := range conf.Apps {
+		if app.IsDev() {
+			client, err := newDevFusionAuthClient(app)
+			if err != nil {
+				return err
+			}
+			conf.Apps[i].FusionAuth.Client = client
+			continue
+		}
+
+		faURL, err := url.Parse(app.FusionAuth.InternalHostURL)
+		if err != nil {
+			return fmt.Errorf(
+				"failed to parse fusionauth url for app %v: %v",
+				app.Domain,
+				err.Error(),
+			)
+		}
+
+		// http client with custom options for usage with fusionauth
+		hc := &http.Client{Timeout: FusionAuthClientTimeout}
+
+		conf.Apps[i].FusionAuth.Client = fusionauth.NewClient(
+			hc,
+			faURL,
+			app.FusionAuth.APIKey,
+		)
+	}
+
+	return nil
+}
+
+// Reload re-reads and re-validates the config file, rebuilds the FusionAuth
+// clients and then atomically swaps the active config. If anything fails,
+// the previously active config is kept.
+func (holder *Holder) Reload() error {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+
+	conf, err := LoadConfigYaml()
+	if err != nil {
+		return fmt.Errorf("failed to reload config: %v", err.Error())
+	}
+
+	err = conf.InitClients()
+	if err != nil {
+		return fmt.Errorf("failed to reload config: %v", err.Error())
+	}
+
+	previous := holder.Get()
+	holder.value.Store(conf)
+
+	changes := DiffConfigs(previous, conf)
+	if len(changes) == 0 {
+		log.Printf("config reloaded, no changes")
+		return nil
+	}
+	for _, change := range changes {
+		log.Printf("config reloaded: %v", change)
+	}
+
+	return nil
+}
+
+// Watch reloads the config whenever the process receives SIGHUP or the
+// config file's modification time changes. It blocks forever, so it should
+// be run in its own goroutine.
+func (holder *Holder) Watch() {
+	interval := time.Duration(holder.Get().Global.ReloadIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = DefaultReloadIntervalSeconds * time.Second
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastModified := configModTime()
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("received SIGHUP, reloading config")
+		case <-ticker.C:
+			modified := configModTime()
+			if modified.Equal(lastModified) {
+				continue
+			}
+			log.Printf("config file changed, reloading config")
+		}
+
+		lastModified = configModTime()
+		err := holder.Reload()
+		if err != nil {
+			log.Printf("%v; keeping previous config", err.Error())
+		}
+	}
+}
+
+// configModTime returns the modification time of the config file, or the
+// zero time if it can't be determined
+func configModTime() time.Time {
+	info, err := os.Stat(GetConfigFilePath())
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// DiffConfigs returns a human-readable list of the differences between two
+// configs, one entry per added, removed or changed app. Apps are matched by
+// their domain since that's how requests are routed to them.
+func DiffConfigs(previous, current Config) (changes []string) {
+	previousApps := make(map[string]App)
+	for _, app := range previous.Apps {
+		previousApps[app.Domain] = app
+	}
+
+	currentApps := make(map[string]bool)
+	for _, app := range current.Apps {
+		currentApps[app.Domain] = true
+		old, ok := previousApps[app.Domain]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("app %v added", app.Domain))
+			continue
+		}
+		sections := diffApp(old, app)
+		if len(sections) > 0 {
+			changes = append(changes, fmt.Sprintf("app %v changed: %v", app.Domain, sections))
+		}
+	}
+
+	for _, app := range previous.Apps {
+		if !currentApps[app.Domain] {
+			changes = append(changes, fmt.Sprintf("app %v removed", app.Domain))
+		}
+	}
+
+	if !reflect.DeepEqual(previous.Global, current.Global) {
+		changes = append(changes, "global settings changed; bind address changes require a restart")
+	}
+
+	return changes
+}
+
+// diffApp returns the names of the top-level sections that differ between
+// two versions of the same app. Secrets are never included in the output,
+// only the name of the section that changed.
+func diffApp(old, current App) (sections []string) {
+	// runtime-only values are not part of the config file
+	old.FusionAuth.Client = nil
+	current.FusionAuth.Client = nil
+	old.StripeProductsFromAPI = nil
+	current.StripeProductsFromAPI = nil
+
+	oldValue := reflect.ValueOf(old)
+	currentValue := reflect.ValueOf(current)
+	appType := oldValue.Type()
+	for i := 0; i < appType.NumField(); i++ {
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			continue
+		}
+		name := appType.Field(i).Tag.Get("yaml")
+		if name == "" {
+			name = appType.Field(i).Name
+		}
+		sections = append(sections, name)
+	}
+
+	return sections
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+// diffConfig returns a config with a single app to diff against
+func diffConfig() Config {
+	return Config{
+		Global: GlobalConfig{BindPort: 8080},
+		Apps: []App{
+			{
+				Domain: "example.com",
+				APIKey: "private-key",
+				Stripe: StripeConfig{SecretKey: "sk_test_xxx"},
+			},
+		},
+	}
+}
+
+func TestDiffConfigs(t *testing.T) {
+	previous := diffConfig()
+	previous.Apps = append(previous.Apps, diffConfig().Apps[0])
+	previous.Apps[1].Domain = "removed.example.com"
+
+	current := diffConfig()
+	current.Apps[0].Stripe.SecretKey = "sk_test_rotated"
+	current.Apps[0].APIKey = "rotated-key"
+	current.Apps = append(current.Apps, diffConfig().Apps[0])
+	current.Apps[1].Domain = "added.example.com"
+	current.Global.BindPort = 9090
+
+	changes := DiffConfigs(previous, current)
+	expected := []string{
+		"app example.com changed: [stripe apiKey]",
+		"app added.example.com added",
+		"app removed.example.com removed",
+		"global settings changed; bind address changes require a restart",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected changes %q, got %q", expected, changes)
+	}
+	for _, change := range changes {
+		if strings.Contains(change, "rotated") {
+			t.Errorf("expected secrets to stay out of the changes, got %q", change)
+		}
+	}
+}
+
+func TestDiffConfigsIgnoresRuntimeValues(t *testing.T) {
+	previous := diffConfig()
+	current := diffConfig()
+	current.Apps[0].FusionAuth.Client = &fusionauth.FusionAuthClient{}
+
+	changes := DiffConfigs(previous, current)
+	if len(changes) != 0 {
+		t.Errorf("expected no changes, got %q", changes)
+	}
+}
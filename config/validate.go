@@ -0,0 +1,360 @@
+package config
+
+import (
+	"fa-middleware/models"
+
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var uuidPattern = regexp.MustCompile(
+	`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`,
+)
+
+// FieldError describes a single problem with a config field, identified by
+// its path in the yaml file, such as apps[0].jwt.cookieName
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (fieldErr FieldError) Error() string {
+	return fmt.Sprintf("%v: %v", fieldErr.Path, fieldErr.Message)
+}
+
+// ValidationErrors is the list of every problem found while validating a
+// config, so that all of them can be fixed at once instead of one at a time
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	lines := []string{}
+	for _, fieldErr := range errs {
+		lines = append(lines, fieldErr.Error())
+	}
+	return fmt.Sprintf(
+		"%v config error(s):\n  %v",
+		len(errs),
+		strings.Join(lines, "\n  "),
+	)
+}
+
+// Add appends a new FieldError for the given path
+func (errs *ValidationErrors) Add(path string, format string, args ...interface{}) {
+	*errs = append(*errs, FieldError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate checks the whole config for mistakes that would otherwise only
+// show up at request time. It does not make any network calls. The returned
+// error is always a ValidationErrors if it is not nil.
+func (conf *Config) Validate() error {
+	errs := ValidationErrors{}
+
+	if len(conf.Apps) == 0 {
+		errs.Add("apps", "at least one app must be configured")
+	}
+
+	domains := make(map[string]int)
+	apiKeys := make(map[string]int)
+	for i, app := range conf.Apps {
+		path := fmt.Sprintf("apps[%v]", i)
+		validateApp(&errs, path, app)
+
+		if app.Domain != "" {
+			if first, ok := domains[app.Domain]; ok {
+				errs.Add(path+".domain", "duplicates apps[%v].domain %v", first, app.Domain)
+			} else {
+				domains[app.Domain] = i
+			}
+		}
+
+		// the private api finds the app by its api key, so a duplicate would
+		// silently resolve to whichever app comes first
+		if app.APIKey != "" {
+			if first, ok := apiKeys[app.APIKey]; ok {
+				errs.Add(path+".apiKey", "duplicates apps[%v].apiKey; api keys must be unique per app", first)
+			} else {
+				apiKeys[app.APIKey] = i
+			}
+		}
+	}
+
+	if conf.Global.BindPort < 1 || conf.Global.BindPort > 65535 {
+		errs.Add("global.bindPort", "must be between 1 and 65535, got %v", conf.Global.BindPort)
+	}
+	if conf.Global.ReloadIntervalSeconds < 0 {
+		errs.Add("global.reloadIntervalSeconds", "must not be negative")
+	}
+	if conf.Global.JobWorkers < 0 {
+		errs.Add("global.jobWorkers", "must not be negative")
+	}
+	if conf.Global.Reconcile.IntervalMinutes < 0 {
+		errs.Add("global.reconcile.intervalMinutes", "must not be negative")
+	}
+	if conf.Global.Tokens.TTLSeconds < 0 {
+		errs.Add("global.tokens.ttlSeconds", "must not be negative")
+	}
+	if conf.Global.Tokens.RotationHours < 0 {
+		errs.Add("global.tokens.rotationHours", "must not be negative")
+	}
+
+	faWebhook := conf.Global.FusionAuthWebhook
+	if (faWebhook.Username == "") != (faWebhook.Password == "") {
+		errs.Add("global.fusionAuthWebhook", "username and password must be set together")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateApp(errs *ValidationErrors, path string, app App) {
+	if app.Domain == "" {
+		errs.Add(path+".domain", "must not be empty")
+	} else if strings.Contains(app.Domain, "/") {
+		errs.Add(path+".domain", "must be a host such as example.com or localhost:3001, not a url")
+	}
+	validateURL(errs, path+".fullDomainURL", app.FullDomainURL)
+	if app.APIKey == "" {
+		errs.Add(path+".apiKey", "must not be empty")
+	}
+
+	switch app.Mode {
+	case "", AppModeLive, AppModeDev:
+	default:
+		errs.Add(path+".mode", "must be either %v or %v", AppModeLive, AppModeDev)
+	}
+
+	fa := app.FusionAuth
+	// apps in dev mode never talk to a real fusionauth
+	if !app.IsDev() {
+		validateURL(errs, path+".fusionAuth.internalHostUrl", fa.InternalHostURL)
+		if fa.APIKey == "" {
+			errs.Add(path+".fusionAuth.apiKey", "must not be empty")
+		}
+	}
+	validateUUID(errs, path+".fusionAuth.appID", fa.AppID)
+	validateUUID(errs, path+".fusionAuth.tenantID", fa.TenantID)
+
+	if app.JWT.CookieName == "" {
+		errs.Add(path+".jwt.cookieName", "must not be empty")
+	}
+	if app.JWT.CookieMaxAgeSeconds < 0 {
+		errs.Add(path+".jwt.cookieMaxAgeSeconds", "must not be negative")
+	}
+
+	if app.Data.MaxValueBytes < 0 {
+		errs.Add(path+".data.maxValueBytes", "must not be negative")
+	}
+	if app.Data.MaxKeys < 0 {
+		errs.Add(path+".data.maxKeys", "must not be negative")
+	}
+
+	for j, webhook := range app.Webhooks {
+		webhookPath := fmt.Sprintf("%v.webhooks[%v]", path, j)
+		validateURL(errs, webhookPath+".url", webhook.URL)
+		if webhook.Secret == "" {
+			errs.Add(webhookPath+".secret", "must not be empty")
+		}
+		for k, event := range webhook.Events {
+			if !isKnownWebhookEvent(event) {
+				errs.Add(
+					fmt.Sprintf("%v.events[%v]", webhookPath, k),
+					"unknown event %v, must be one of %v",
+					event,
+					strings.Join(models.WebhookEventTypes, ", "),
+				)
+			}
+		}
+	}
+
+	if app.ForwardAuth.LoginURL != "" {
+		validateURL(errs, path+".forwardAuth.loginUrl", app.ForwardAuth.LoginURL)
+	}
+	if app.ForwardAuth.PricingURL != "" {
+		validateURL(errs, path+".forwardAuth.pricingUrl", app.ForwardAuth.PricingURL)
+	}
+
+	validateProxy(errs, path+".proxy", app)
+
+	stripe := app.Stripe
+	switch stripe.Provider {
+	case "", PaymentProviderStripe:
+		validatePrefix(errs, path+".stripe.secretKey", stripe.SecretKey, "sk_", "rk_")
+	case PaymentProviderFake:
+		// nothing is sent to stripe, so no keys are needed
+	default:
+		errs.Add(
+			path+".stripe.provider",
+			"must be either %v or %v",
+			PaymentProviderStripe,
+			PaymentProviderFake,
+		)
+	}
+	if stripe.PublicKey != "" {
+		validatePrefix(errs, path+".stripe.publicKey", stripe.PublicKey, "pk_")
+	}
+	if stripe.WebhookSecret != "" {
+		validatePrefix(errs, path+".stripe.webhookSecret", stripe.WebhookSecret, "whsec_")
+	}
+	validateURL(errs, path+".stripe.paymentSuccessURL", stripe.PaymentSuccessURL)
+	validateURL(errs, path+".stripe.paymentCancelURL", stripe.PaymentCancelURL)
+
+	checkout := stripe.Checkout
+	switch checkout.BillingAddressCollection {
+	case "", "auto", "required":
+	default:
+		errs.Add(path+".stripe.checkout.billingAddressCollection", "must be either auto or required")
+	}
+	for j, methodType := range checkout.PaymentMethodTypes {
+		if methodType == "" {
+			errs.Add(fmt.Sprintf("%v.stripe.checkout.paymentMethodTypes[%v]", path, j), "must not be empty")
+		}
+	}
+	if checkout.TrialDays < 0 {
+		errs.Add(path+".stripe.checkout.trialDays", "must not be negative")
+	}
+	for j, item := range checkout.DefaultLineItems {
+		itemPath := fmt.Sprintf("%v.stripe.checkout.defaultLineItems[%v]", path, j)
+		if !stripe.HasPrice(item.PriceID) {
+			errs.Add(itemPath+".priceId", "price %v is not configured in stripe.products", item.PriceID)
+		}
+		if item.Quantity < 0 {
+			errs.Add(itemPath+".quantity", "must not be negative")
+		}
+	}
+
+	productIDs := make(map[string]bool)
+	for j, product := range stripe.Products {
+		productPath := fmt.Sprintf("%v.stripe.products[%v]", path, j)
+		validatePrefix(errs, productPath+".productId", product.ProductID, "prod_")
+		if productIDs[product.ProductID] {
+			errs.Add(productPath+".productId", "product %v is configured more than once", product.ProductID)
+		}
+		productIDs[product.ProductID] = true
+
+		if product.AccessDays < 0 {
+			errs.Add(productPath+".accessDays", "must not be negative")
+		} else if product.AccessDays > 0 && !product.OneTime {
+			errs.Add(productPath+".accessDays", "only applies to oneTime products")
+		}
+
+		if len(product.PriceIDs) == 0 {
+			errs.Add(productPath+".priceIds", "at least one price id must be configured")
+		}
+		for k, priceID := range product.PriceIDs {
+			validatePrefix(errs, fmt.Sprintf("%v.priceIds[%v]", productPath, k), priceID, "price_")
+		}
+		for k, entitlement := range product.Entitlements {
+			if entitlement == "" || strings.ContainsAny(entitlement, ", ") {
+				errs.Add(
+					fmt.Sprintf("%v.entitlements[%v]", productPath, k),
+					"must not be empty or contain commas or spaces",
+				)
+			}
+		}
+	}
+}
+
+func isKnownWebhookEvent(event string) bool {
+	for _, known := range models.WebhookEventTypes {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func validateProxy(errs *ValidationErrors, path string, app App) {
+	proxy := app.Proxy
+	if len(proxy.Routes) == 0 {
+		return
+	}
+	if proxy.Secret == "" {
+		errs.Add(path+".secret", "must not be empty when there are routes")
+	}
+	if proxy.LoginURL != "" {
+		validateURL(errs, path+".loginUrl", proxy.LoginURL)
+	}
+	if proxy.PricingURL != "" {
+		validateURL(errs, path+".pricingUrl", proxy.PricingURL)
+	}
+
+	prefixes := make(map[string]int)
+	for i, route := range proxy.Routes {
+		routePath := fmt.Sprintf("%v.routes[%v]", path, i)
+		switch {
+		case !strings.HasPrefix(route.PathPrefix, "/"):
+			errs.Add(routePath+".pathPrefix", "must start with /")
+		case route.PathPrefix == "/mw" || strings.HasPrefix(route.PathPrefix, "/mw/"):
+			errs.Add(routePath+".pathPrefix", "must not be under /mw, which the middleware serves itself")
+		}
+		if first, ok := prefixes[route.PathPrefix]; ok {
+			errs.Add(routePath+".pathPrefix", "duplicates %v.routes[%v].pathPrefix", path, first)
+		} else {
+			prefixes[route.PathPrefix] = i
+		}
+
+		validateURL(errs, routePath+".upstream", route.Upstream)
+
+		if route.Anonymous && (route.Role != "" || route.Product != "" || route.Entitlement != "") {
+			errs.Add(routePath+".anonymous", "can't be combined with role, product or entitlement")
+		}
+		if route.Product != "" {
+			if _, ok := app.Stripe.GetProduct(route.Product); !ok {
+				errs.Add(routePath+".product", "%v is not one of stripe.products", route.Product)
+			}
+		}
+		if route.Entitlement != "" && len(app.Stripe.GetProductsWithEntitlement(route.Entitlement)) == 0 {
+			errs.Add(routePath+".entitlement", "no product in stripe.products grants %v", route.Entitlement)
+		}
+	}
+}
+
+// validateURL requires an absolute http or https url
+func validateURL(errs *ValidationErrors, path string, value string) {
+	if value == "" {
+		errs.Add(path, "must not be empty")
+		return
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		errs.Add(path, "malformed url %v: %v", value, err.Error())
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		errs.Add(path, "url %v must start with http:// or https://", value)
+		return
+	}
+	if parsed.Host == "" {
+		errs.Add(path, "url %v has no host", value)
+	}
+}
+
+func validateUUID(errs *ValidationErrors, path string, value string) {
+	if value == "" {
+		errs.Add(path, "must not be empty")
+		return
+	}
+	if !uuidPattern.MatchString(value) {
+		errs.Add(path, "%v is not a valid uuid", value)
+	}
+}
+
+func validatePrefix(errs *ValidationErrors, path string, value string, prefixes ...string) {
+	if value == "" {
+		errs.Add(path, "must not be empty")
+		return
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return
+		}
+	}
+	errs.Add(path, "must start with %v", strings.Join(prefixes, " or "))
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fa-middleware/models"
+
+	"testing"
+)
+
+// validConfig returns a config with a single app that passes validation
+func validConfig() Config {
+	return Config{
+		Global: GlobalConfig{BindPort: 8080},
+		Apps: []App{
+			{
+				Domain:        "example.com",
+				FullDomainURL: "https://example.com",
+				APIKey:        "private-key",
+				FusionAuth: FusionAuthConfig{
+					InternalHostURL: "http://fusionauth:9011",
+					APIKey:          "fa-key",
+					AppID:           "7f4b6a5e-0c1d-4c1e-9a33-2d0c7b3f9e11",
+					TenantID:        "0a6c8e2f-5b1d-4a7e-8f3c-1e9d2b4c6a80",
+				},
+				JWT: JWTConfig{CookieName: "app-jwt"},
+				Stripe: StripeConfig{
+					SecretKey:         "sk_test_xxx",
+					PaymentSuccessURL: "https://example.com/welcome",
+					PaymentCancelURL:  "https://example.com/pricing",
+					Products: []models.StripeProduct{
+						{ProductID: "prod_pro", PriceIDs: []string{"price_pro"}, Entitlements: []string{"reports"}},
+					},
+				},
+				Webhooks: []WebhookConfig{
+					{URL: "https://backend.example.com/hooks", Secret: "secret"},
+				},
+			},
+		},
+	}
+}
+
+// validationPaths returns the paths of the fields that failed validation
+func validationPaths(t *testing.T, conf Config) map[string]bool {
+	t.Helper()
+	paths := make(map[string]bool)
+	err := conf.Validate()
+	if err == nil {
+		return paths
+	}
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %T", err)
+	}
+	for _, fieldErr := range errs {
+		paths[fieldErr.Path] = true
+	}
+	return paths
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+	conf := validConfig()
+	if err := conf.Validate(); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+}
+
+func TestValidateReportsEveryField(t *testing.T) {
+	for name, test := range map[string]struct {
+		change func(conf *Config)
+		path   string
+	}{
+		"no apps": {
+			func(conf *Config) { conf.Apps = nil },
+			"apps",
+		},
+		"bind port": {
+			func(conf *Config) { conf.Global.BindPort = 0 },
+			"global.bindPort",
+		},
+		"domain with scheme": {
+			func(conf *Config) { conf.Apps[0].Domain = "https://example.com" },
+			"apps[0].domain",
+		},
+		"relative url": {
+			func(conf *Config) { conf.Apps[0].FullDomainURL = "example.com" },
+			"apps[0].fullDomainURL",
+		},
+		"app id": {
+			func(conf *Config) { conf.Apps[0].FusionAuth.AppID = "not-a-uuid" },
+			"apps[0].fusionAuth.appID",
+		},
+		"secret key": {
+			func(conf *Config) { conf.Apps[0].Stripe.SecretKey = "pk_test_xxx" },
+			"apps[0].stripe.secretKey",
+		},
+		"product id": {
+			func(conf *Config) { conf.Apps[0].Stripe.Products[0].ProductID = "pro" },
+			"apps[0].stripe.products[0].productId",
+		},
+		"access days of a subscription": {
+			func(conf *Config) { conf.Apps[0].Stripe.Products[0].AccessDays = 30 },
+			"apps[0].stripe.products[0].accessDays",
+		},
+		"entitlement with a space": {
+			func(conf *Config) { conf.Apps[0].Stripe.Products[0].Entitlements = []string{"two words"} },
+			"apps[0].stripe.products[0].entitlements[0]",
+		},
+		"unknown webhook event": {
+			func(conf *Config) { conf.Apps[0].Webhooks[0].Events = []string{"user.exploded"} },
+			"apps[0].webhooks[0].events[0]",
+		},
+		"fusionauth webhook credentials": {
+			func(conf *Config) { conf.Global.FusionAuthWebhook.Username = "fusionauth" },
+			"global.fusionAuthWebhook",
+		},
+		"proxy route under /mw": {
+			func(conf *Config) {
+				conf.Apps[0].Proxy = ProxyConfig{
+					Secret: "secret",
+					Routes: []ProxyRoute{{PathPrefix: "/mw/reports", Upstream: "http://reports:8000"}},
+				}
+			},
+			"apps[0].proxy.routes[0].pathPrefix",
+		},
+	} {
+		conf := validConfig()
+		test.change(&conf)
+		paths := validationPaths(t, conf)
+		if !paths[test.path] {
+			t.Errorf("%v: expected an error for %v, got %v", name, test.path, paths)
+		}
+	}
+}
+
+func TestValidateRejectsDuplicates(t *testing.T) {
+	conf := validConfig()
+	conf.Apps = append(conf.Apps, conf.Apps[0])
+	paths := validationPaths(t, conf)
+	if !paths["apps[1].domain"] || !paths["apps[1].apiKey"] {
+		t.Errorf("expected the second app's domain and api key to be duplicates, got %v", paths)
+	}
+	if paths["apps[0].domain"] || paths["apps[0].apiKey"] {
+		t.Errorf("expected the first app to be fine, got %v", paths)
+	}
+}
+
+func TestValidateDevApp(t *testing.T) {
+	conf := validConfig()
+	conf.Apps[0].Mode = AppModeDev
+	conf.Apps[0].FusionAuth.InternalHostURL = ""
+	conf.Apps[0].FusionAuth.APIKey = ""
+	conf.Apps[0].Stripe.Provider = PaymentProviderFake
+	conf.Apps[0].Stripe.SecretKey = ""
+	if err := conf.Validate(); err != nil {
+		t.Errorf("expected dev apps not to need fusionauth or stripe keys, got %v", err)
+	}
+}
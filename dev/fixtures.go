@@ -0,0 +1,73 @@
+package dev
+
+import (
+	"fa-middleware/models"
+
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadFixtures reads a yaml-formatted fixtures file, see
+// res/fixtures.example.yml. An empty path means there are no fixtures.
+func LoadFixtures(path string) (fixtures models.DevFixtures, err error) {
+	if path == "" {
+		return fixtures, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fixtures, fmt.Errorf("failed to read fixtures file %v: %v", path, err.Error())
+	}
+
+	err = yaml.UnmarshalStrict(data, &fixtures)
+	if err != nil {
+		return fixtures, fmt.Errorf("failed to parse fixtures file %v: %v", path, err.Error())
+	}
+
+	emails := make(map[string]bool)
+	for i, user := range fixtures.Users {
+		if user.Email == "" {
+			return fixtures, fmt.Errorf("users[%v].email must not be empty in fixtures file %v", i, path)
+		}
+		if emails[user.Email] {
+			return fixtures, fmt.Errorf("users[%v].email %v is duplicated in fixtures file %v", i, user.Email, path)
+		}
+		emails[user.Email] = true
+		if len(user.Password) < MinPasswordLength {
+			return fixtures, fmt.Errorf(
+				"users[%v].password must be at least %v characters in fixtures file %v",
+				i,
+				MinPasswordLength,
+				path,
+			)
+		}
+	}
+
+	for i, product := range fixtures.Products {
+		if product.ProductID == "" {
+			return fixtures, fmt.Errorf("products[%v].productId must not be empty in fixtures file %v", i, path)
+		}
+		for j, price := range product.Prices {
+			if price.PriceID == "" {
+				return fixtures, fmt.Errorf("products[%v].prices[%v].priceId must not be empty in fixtures file %v", i, j, path)
+			}
+			if price.UnitAmount < 0 {
+				return fixtures, fmt.Errorf("products[%v].prices[%v].unitAmount must not be negative in fixtures file %v", i, j, path)
+			}
+			switch price.Interval {
+			case "", "day", "week", "month", "year":
+			default:
+				return fixtures, fmt.Errorf(
+					"products[%v].prices[%v].interval must be day, week, month, year or empty in fixtures file %v",
+					i,
+					j,
+					path,
+				)
+			}
+		}
+	}
+
+	return fixtures, nil
+}
@@ -0,0 +1,454 @@
+package dev
+
+import (
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+// MinPasswordLength is the shortest password that the in-memory FusionAuth
+// accepts, the same as FusionAuth's default password rules
+const MinPasswordLength = 8
+
+var (
+	fusionAuths     = make(map[string]*FusionAuth)
+	fusionAuthsLock sync.Mutex
+)
+
+// FusionAuth is an in-memory stand-in for the parts of the FusionAuth API
+// that the middleware uses: registration, login, retrieving, updating and
+// searching users, and retrieving the application and tenant. It implements
+// http.RoundTripper, so that it can be used as the transport of a regular
+// fusionauth.FusionAuthClient instead of talking to a real server.
+//
+// Tokens are opaque random strings rather than signed JWTs, and they never
+// expire. Passwords are kept in plain text, so this must only ever be used
+// for development.
+type FusionAuth struct {
+	lock sync.Mutex
+
+	appID     string
+	tenantID  string
+	users     []*fusionauth.User
+	passwords map[string]string // user id -> password
+	tokens    map[string]string // token -> user id
+}
+
+// GetFusionAuth returns the in-memory FusionAuth of an app, which lives for
+// as long as the middleware runs so that users survive config reloads.
+// Fixture users that don't exist yet are added.
+func GetFusionAuth(domain string, appID string, tenantID string, users []models.DevUser) (*FusionAuth, error) {
+	fusionAuthsLock.Lock()
+	fa, ok := fusionAuths[domain]
+	if !ok {
+		fa = NewFusionAuth(appID, tenantID)
+		fusionAuths[domain] = fa
+	}
+	fusionAuthsLock.Unlock()
+
+	fa.lock.Lock()
+	fa.appID = appID
+	fa.tenantID = tenantID
+	fa.lock.Unlock()
+
+	for i, devUser := range users {
+		if fa.HasUser(devUser.Email) {
+			continue
+		}
+		_, err := fa.AddUser(devUser)
+		if err != nil {
+			return fa, fmt.Errorf("failed to add fixture user %v: %v", i, err.Error())
+		}
+	}
+	return fa, nil
+}
+
+// NewFusionAuth returns an in-memory FusionAuth without any users
+func NewFusionAuth(appID string, tenantID string) *FusionAuth {
+	return &FusionAuth{
+		appID:     appID,
+		tenantID:  tenantID,
+		passwords: make(map[string]string),
+		tokens:    make(map[string]string),
+	}
+}
+
+// HasUser checks if a user with the email exists
+func (fa *FusionAuth) HasUser(email string) bool {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+
+	return fa.findUserByEmail(email) != nil
+}
+
+// AddUser creates a user that is registered to the app
+func (fa *FusionAuth) AddUser(devUser models.DevUser) (fusionauth.User, error) {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+
+	user := fusionauth.User{
+		Active:    true,
+		Email:     devUser.Email,
+		FirstName: devUser.FirstName,
+		LastName:  devUser.LastName,
+		FullName:  strings.TrimSpace(devUser.FirstName + " " + devUser.LastName),
+		Data:      devUser.Data,
+	}
+	user.Id = devUser.ID
+	user.Password = devUser.Password
+	registration := fusionauth.UserRegistration{
+		ApplicationId: fa.appID,
+		Roles:         devUser.Roles,
+	}
+
+	errs := fa.createUser(&user, registration)
+	if errs != nil {
+		return user, fmt.Errorf("%v", errs.Error())
+	}
+	return user, nil
+}
+
+// RoundTrip answers a request from a fusionauth.FusionAuthClient
+func (fa *FusionAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+	fa.ServeHTTP(w, req)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%v %v", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// responseBuffer is the http.ResponseWriter that RoundTrip hands to
+// ServeHTTP; the whole response is kept in memory
+type responseBuffer struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *responseBuffer) Header() http.Header {
+	return w.header
+}
+
+func (w *responseBuffer) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.status = status
+	w.wroteHeader = true
+}
+
+func (w *responseBuffer) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+func (fa *FusionAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/api/user/registration"):
+		fa.register(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "/api/user/registration"), "/"))
+	case r.Method == http.MethodPost && path == "/api/login":
+		fa.login(w, r)
+	case r.Method == http.MethodPost && path == "/api/user/search":
+		fa.search(w, r)
+	case r.Method == http.MethodGet && path == "/api/user":
+		fa.retrieveUser(w, r)
+	case strings.HasPrefix(path, "/api/user/"):
+		fa.userByID(w, r, strings.TrimPrefix(path, "/api/user/"))
+	case r.Method == http.MethodGet && path == "/api/application/"+fa.appID:
+		writeJSON(w, 200, fusionauth.ApplicationResponse{
+			Application: fusionauth.Application{
+				Id:       fa.appID,
+				Name:     "fa-middleware dev",
+				TenantId: fa.tenantID,
+				Active:   true,
+			},
+		})
+	case r.Method == http.MethodGet && path == "/api/tenant/"+fa.tenantID:
+		writeJSON(w, 200, fusionauth.TenantResponse{
+			Tenant: fusionauth.Tenant{
+				Id:   fa.tenantID,
+				Name: "fa-middleware dev",
+			},
+		})
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func fieldError(field string, code string, message string) *fusionauth.Errors {
+	return &fusionauth.Errors{
+		FieldErrors: map[string][]fusionauth.Error{
+			field: {{Code: fmt.Sprintf("[%v]%v", code, field), Message: message}},
+		},
+	}
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (fa *FusionAuth) findUserByEmail(email string) *fusionauth.User {
+	for _, user := range fa.users {
+		if strings.EqualFold(user.Email, email) {
+			return user
+		}
+	}
+	return nil
+}
+
+func (fa *FusionAuth) findUser(id string) *fusionauth.User {
+	for _, user := range fa.users {
+		if user.Id == id {
+			return user
+		}
+	}
+	return nil
+}
+
+// userWithoutPassword returns a copy of the user that is safe to respond
+// with
+func userWithoutPassword(user *fusionauth.User) fusionauth.User {
+	copied := *user
+	copied.Password = ""
+	return copied
+}
+
+func (fa *FusionAuth) issueToken(userID string) string {
+	token := strings.ReplaceAll(h.NewID()+h.NewID(), "-", "")
+	fa.tokens[token] = userID
+	return token
+}
+
+// createUser validates and stores a new user with a single registration
+func (fa *FusionAuth) createUser(user *fusionauth.User, registration fusionauth.UserRegistration) *fusionauth.Errors {
+	if user.Email == "" {
+		return fieldError("user.email", "blank", "You must specify the [user.email] property.")
+	}
+	if fa.findUserByEmail(user.Email) != nil {
+		return fieldError("user.email", "duplicate", "A User with email = ["+user.Email+"] already exists.")
+	}
+	if len(user.Password) < MinPasswordLength {
+		return fieldError(
+			"user.password",
+			"tooShort",
+			fmt.Sprintf("The [user.password] property is shorter than the minimum of [%v] characters.", MinPasswordLength),
+		)
+	}
+	if user.Id == "" {
+		user.Id = h.NewID()
+	} else if fa.findUser(user.Id) != nil {
+		return fieldError("userId", "duplicate", "A User with Id = ["+user.Id+"] already exists.")
+	}
+
+	fa.passwords[user.Id] = user.Password
+	user.Password = ""
+	user.TenantId = fa.tenantID
+	user.InsertInstant = nowMillis()
+	user.LastUpdateInstant = user.InsertInstant
+	if user.FullName == "" {
+		user.FullName = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+
+	registration.Id = h.NewID()
+	registration.ApplicationId = fa.appID
+	registration.InsertInstant = user.InsertInstant
+	registration.Verified = true
+	user.Registrations = []fusionauth.UserRegistration{registration}
+
+	fa.users = append(fa.users, user)
+	return nil
+}
+
+// register creates a user and registers them to the app, or registers an
+// existing user if userID is set
+//
+// https://fusionauth.io/docs/v1/tech/apis/registrations#create-a-user-registration-for-an-existing-user
+func (fa *FusionAuth) register(w http.ResponseWriter, r *http.Request, userID string) {
+	request := fusionauth.RegistrationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeJSON(w, 400, fieldError("body", "invalidJSON", err.Error()))
+		return
+	}
+
+	var user *fusionauth.User
+	if userID != "" {
+		user = fa.findUser(userID)
+		if user == nil {
+			writeJSON(w, 400, fieldError("userId", "invalid", "The user ["+userID+"] does not exist."))
+			return
+		}
+		for _, registration := range user.Registrations {
+			if registration.ApplicationId == fa.appID {
+				writeJSON(w, 400, fieldError("registration.applicationId", "duplicate", "The user is already registered."))
+				return
+			}
+		}
+		request.Registration.Id = h.NewID()
+		request.Registration.ApplicationId = fa.appID
+		request.Registration.InsertInstant = nowMillis()
+		user.Registrations = append(user.Registrations, request.Registration)
+	} else {
+		user = &request.User
+		errs := fa.createUser(user, request.Registration)
+		if errs != nil {
+			writeJSON(w, 400, errs)
+			return
+		}
+	}
+
+	writeJSON(w, 200, fusionauth.RegistrationResponse{
+		Registration: user.Registrations[len(user.Registrations)-1],
+		Token:        fa.issueToken(user.Id),
+		User:         userWithoutPassword(user),
+	})
+}
+
+// login responds with 404 for unknown emails and wrong passwords, like
+// FusionAuth does
+func (fa *FusionAuth) login(w http.ResponseWriter, r *http.Request) {
+	request := fusionauth.LoginRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeJSON(w, 400, fieldError("body", "invalidJSON", err.Error()))
+		return
+	}
+	user := fa.findUserByEmail(request.LoginId)
+	if user == nil || !user.Active || fa.passwords[user.Id] != request.Password {
+		w.WriteHeader(404)
+		return
+	}
+	user.LastLoginInstant = nowMillis()
+	writeJSON(w, 200, fusionauth.LoginResponse{
+		Token: fa.issueToken(user.Id),
+		User:  userWithoutPassword(user),
+	})
+}
+
+// retrieveUser finds a user by the token in the Authorization header, or by
+// the email parameter
+func (fa *FusionAuth) retrieveUser(w http.ResponseWriter, r *http.Request) {
+	var user *fusionauth.User
+	if email := r.URL.Query().Get("email"); email != "" {
+		user = fa.findUserByEmail(email)
+	} else {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		userID, ok := fa.tokens[token]
+		if !ok {
+			w.WriteHeader(401)
+			return
+		}
+		user = fa.findUser(userID)
+	}
+	if user == nil {
+		w.WriteHeader(404)
+		return
+	}
+	writeJSON(w, 200, fusionauth.UserResponse{User: userWithoutPassword(user)})
+}
+
+func (fa *FusionAuth) userByID(w http.ResponseWriter, r *http.Request, userID string) {
+	user := fa.findUser(userID)
+	if user == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// the registrations, tenant and timestamps can't be changed by
+		// updating the user
+		request := fusionauth.UserRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeJSON(w, 400, fieldError("body", "invalidJSON", err.Error()))
+			return
+		}
+		updated := request.User
+		if updated.Email == "" {
+			writeJSON(w, 400, fieldError("user.email", "blank", "You must specify the [user.email] property."))
+			return
+		}
+		if existing := fa.findUserByEmail(updated.Email); existing != nil && existing.Id != user.Id {
+			writeJSON(w, 400, fieldError("user.email", "duplicate", "A User with email = ["+updated.Email+"] already exists."))
+			return
+		}
+		if updated.Password != "" {
+			fa.passwords[user.Id] = updated.Password
+		}
+		updated.Id = user.Id
+		updated.Password = ""
+		updated.TenantId = user.TenantId
+		updated.Registrations = user.Registrations
+		updated.InsertInstant = user.InsertInstant
+		updated.LastLoginInstant = user.LastLoginInstant
+		updated.LastUpdateInstant = nowMillis()
+		*user = updated
+	default:
+		w.WriteHeader(405)
+		return
+	}
+	writeJSON(w, 200, fusionauth.UserResponse{User: userWithoutPassword(user)})
+}
+
+// search pages through every user in the order they were created; the
+// query itself is ignored
+func (fa *FusionAuth) search(w http.ResponseWriter, r *http.Request) {
+	request := fusionauth.SearchRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeJSON(w, 400, fieldError("body", "invalidJSON", err.Error()))
+		return
+	}
+
+	start := request.Search.StartRow
+	if start > len(fa.users) {
+		start = len(fa.users)
+	}
+	end := len(fa.users)
+	if request.Search.NumberOfResults > 0 && start+request.Search.NumberOfResults < end {
+		end = start + request.Search.NumberOfResults
+	}
+
+	users := []fusionauth.User{}
+	for _, user := range fa.users[start:end] {
+		users = append(users, userWithoutPassword(user))
+	}
+	writeJSON(w, 200, fusionauth.SearchResponse{
+		Total: int64(len(fa.users)),
+		Users: users,
+	})
+}
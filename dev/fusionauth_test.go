@@ -0,0 +1,50 @@
+package dev
+
+import (
+	"fa-middleware/models"
+
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+func TestFusionAuthRoundTrip(t *testing.T) {
+	fa, err := GetFusionAuth("roundtrip.test", "app-id", "tenant-id", []models.DevUser{
+		{ID: "user-1", Email: "dev@example.com", Password: "password1234", FirstName: "Dev"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create fusionauth: %v", err)
+	}
+	baseURL, _ := url.Parse("http://fusionauth.test")
+	client := fusionauth.NewClient(&http.Client{Transport: fa}, baseURL, "api-key")
+
+	resp, errs, err := client.Login(fusionauth.LoginRequest{
+		BaseLoginRequest: fusionauth.BaseLoginRequest{ApplicationId: "app-id"},
+		LoginId:          "dev@example.com",
+		Password:         "password1234",
+	})
+	if err != nil || errs != nil {
+		t.Fatalf("failed to log in: %v %v", err, errs)
+	}
+	if resp.StatusCode != 200 || resp.Token == "" || resp.User.Id != "user-1" {
+		t.Errorf("expected a token for user-1, got %v %+v", resp.StatusCode, resp)
+	}
+
+	userResp, errs, err := client.RetrieveUser("missing")
+	if err != nil {
+		t.Fatalf("failed to retrieve user: %v", err)
+	}
+	if userResp.StatusCode != 404 {
+		t.Errorf("expected a 404 for a missing user, got %v %v", userResp.StatusCode, errs)
+	}
+
+	userResp, errs, err = client.RetrieveUser("user-1")
+	if err != nil || errs != nil {
+		t.Fatalf("failed to retrieve user: %v %v", err, errs)
+	}
+	if userResp.User.FirstName != "Dev" || userResp.User.Password != "" {
+		t.Errorf("expected the user without their password, got %+v", userResp.User)
+	}
+}
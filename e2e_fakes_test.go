@@ -0,0 +1,409 @@
+package main
+
+import (
+	h "fa-middleware/helpers"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// fakeFusionAuth stands in for the parts of the FusionAuth API that the
+// middleware uses: registration, login, and retrieving and updating users
+type fakeFusionAuth struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	users     map[string]*fusionauth.User
+	passwords map[string]string
+	tokens    map[string]string
+}
+
+func newFakeFusionAuth(t *testing.T) *fakeFusionAuth {
+	fa := &fakeFusionAuth{
+		users:     make(map[string]*fusionauth.User),
+		passwords: make(map[string]string),
+		tokens:    make(map[string]string),
+	}
+	fa.Server = httptest.NewServer(http.HandlerFunc(fa.handle))
+	t.Cleanup(fa.Close)
+	return fa
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func faError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, fusionauth.Errors{
+		GeneralErrors: []fusionauth.Error{{Code: code, Message: code}},
+	})
+}
+
+func (fa *fakeFusionAuth) userByEmail(email string) *fusionauth.User {
+	for _, user := range fa.users {
+		if user.Email == email {
+			return user
+		}
+	}
+	return nil
+}
+
+// setRoles replaces the roles of a user's registrations
+func (fa *fakeFusionAuth) setRoles(userID string, roles ...string) {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+
+	for i := range fa.users[userID].Registrations {
+		fa.users[userID].Registrations[i].Roles = roles
+	}
+}
+
+// issueToken returns a new opaque token for the user; the middleware only
+// ever hands tokens back to FusionAuth, so they don't need to be real JWTs
+func (fa *fakeFusionAuth) issueToken(userID string) string {
+	token := "jwt-" + h.NewID()
+	fa.tokens[token] = userID
+	return token
+}
+
+func (fa *fakeFusionAuth) handle(w http.ResponseWriter, r *http.Request) {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/user/registration"):
+		request := fusionauth.RegistrationRequest{}
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			faError(w, 400, "[invalid]")
+			return
+		}
+		if fa.userByEmail(request.User.Email) != nil {
+			faError(w, 400, "[duplicate]user.email")
+			return
+		}
+		user := request.User
+		user.Id = h.NewID()
+		user.Password = ""
+		user.Registrations = []fusionauth.UserRegistration{request.Registration}
+		fa.users[user.Id] = &user
+		fa.passwords[user.Email] = request.User.Password
+		writeJSON(w, 200, fusionauth.RegistrationResponse{
+			Token: fa.issueToken(user.Id),
+			User:  user,
+		})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/api/login":
+		request := fusionauth.LoginRequest{}
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			faError(w, 400, "[invalid]")
+			return
+		}
+		user := fa.userByEmail(request.LoginId)
+		if user == nil || fa.passwords[user.Email] != request.Password {
+			w.WriteHeader(404)
+			return
+		}
+		writeJSON(w, 200, fusionauth.LoginResponse{
+			Token: fa.issueToken(user.Id),
+			User:  *user,
+		})
+
+	case r.Method == http.MethodGet && r.URL.Path == "/api/user":
+		var user *fusionauth.User
+		if email := r.URL.Query().Get("email"); email != "" {
+			user = fa.userByEmail(email)
+		} else {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			user = fa.users[fa.tokens[token]]
+			if user == nil {
+				w.WriteHeader(401)
+				return
+			}
+		}
+		if user == nil {
+			w.WriteHeader(404)
+			return
+		}
+		writeJSON(w, 200, fusionauth.UserResponse{User: *user})
+
+	case strings.HasPrefix(r.URL.Path, "/api/user/"):
+		user := fa.users[strings.TrimPrefix(r.URL.Path, "/api/user/")]
+		if user == nil {
+			w.WriteHeader(404)
+			return
+		}
+		if r.Method == http.MethodPut {
+			request := fusionauth.UserRequest{}
+			if json.NewDecoder(r.Body).Decode(&request) != nil {
+				faError(w, 400, "[invalid]")
+				return
+			}
+			user.Data = request.User.Data
+		}
+		writeJSON(w, 200, fusionauth.UserResponse{User: *user})
+
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// fakeStripe stands in for the Stripe API endpoints that the middleware
+// uses for customers, products, prices and checkout sessions. It is
+// installed with stripe.SetBackend.
+type fakeStripe struct {
+	*httptest.Server
+
+	lock            sync.Mutex
+	customers       []*stripe.Customer
+	idempotencyKeys map[string]*stripe.Customer
+	products        map[string]*stripe.Product
+	prices          map[string]*stripe.Price
+	sessions        []map[string]string
+}
+
+var searchMetadataQuery = regexp.MustCompile(`^metadata\['([^']+)'\]:'([^']*)'$`)
+
+func newFakeStripe(t *testing.T) *fakeStripe {
+	st := &fakeStripe{
+		idempotencyKeys: make(map[string]*stripe.Customer),
+		products:        make(map[string]*stripe.Product),
+		prices:          make(map[string]*stripe.Price),
+	}
+	st.Server = httptest.NewServer(http.HandlerFunc(st.handle))
+	t.Cleanup(st.Close)
+
+	previous := stripe.GetBackend(stripe.APIBackend)
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(
+		stripe.APIBackend,
+		&stripe.BackendConfig{
+			URL:           stripe.String(st.URL),
+			LeveledLogger: &stripe.LeveledLogger{Level: stripe.LevelNull},
+		},
+	))
+	t.Cleanup(func() {
+		stripe.SetBackend(stripe.APIBackend, previous)
+	})
+	return st
+}
+
+// addPrice adds a price, and its product if it doesn't exist yet. interval
+// is empty for one-time prices.
+func (st *fakeStripe) addPrice(productID string, priceID string, unitAmount int64, interval string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	product, ok := st.products[productID]
+	if !ok {
+		product = &stripe.Product{ID: productID, Object: "product", Name: productID, Active: true}
+		st.products[productID] = product
+	}
+	price := &stripe.Price{
+		ID:                priceID,
+		Object:            "price",
+		Active:            true,
+		Currency:          stripe.CurrencyUSD,
+		Product:           product,
+		UnitAmount:        unitAmount,
+		UnitAmountDecimal: float64(unitAmount),
+	}
+	if interval != "" {
+		price.Recurring = &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringInterval(interval),
+			IntervalCount: 1,
+		}
+	}
+	st.prices[priceID] = price
+}
+
+// subscribe gives a customer an active subscription to a price, as if they
+// had completed checkout
+func (st *fakeStripe) subscribe(custID string, priceID string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	cust := st.findCustomer(custID)
+	price := st.prices[priceID]
+	cust.Subscriptions.Data = append(cust.Subscriptions.Data, &stripe.Subscription{
+		ID:       "sub_" + h.NewID(),
+		Object:   "subscription",
+		Customer: &stripe.Customer{ID: custID},
+		Status:   stripe.SubscriptionStatusActive,
+		Plan: &stripe.Plan{
+			ID:      price.ID,
+			Product: price.Product,
+		},
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{{
+				ID:       "si_" + h.NewID(),
+				Price:    price,
+				Quantity: 1,
+			}},
+		},
+	})
+}
+
+func (st *fakeStripe) lastSession() map[string]string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if len(st.sessions) == 0 {
+		return nil
+	}
+	return st.sessions[len(st.sessions)-1]
+}
+
+func (st *fakeStripe) findCustomer(id string) *stripe.Customer {
+	for _, cust := range st.customers {
+		if cust.ID == id {
+			return cust
+		}
+	}
+	return nil
+}
+
+func stripeNotFound(w http.ResponseWriter, id string) {
+	writeJSON(w, 404, map[string]interface{}{
+		"error": map[string]string{
+			"type":    "invalid_request_error",
+			"code":    "resource_missing",
+			"message": fmt.Sprintf("No such object: '%v'", id),
+		},
+	})
+}
+
+func stripeList(w http.ResponseWriter, object string, data interface{}) {
+	writeJSON(w, 200, map[string]interface{}{
+		"object":   object,
+		"data":     data,
+		"has_more": false,
+	})
+}
+
+// applyCustomerForm copies the form fields of a customer create or update
+// request onto the customer
+func applyCustomerForm(cust *stripe.Customer, r *http.Request) {
+	if _, ok := r.PostForm["email"]; ok {
+		cust.Email = r.PostForm.Get("email")
+	}
+	if _, ok := r.PostForm["name"]; ok {
+		cust.Name = r.PostForm.Get("name")
+	}
+	for key := range r.PostForm {
+		if strings.HasPrefix(key, "metadata[") {
+			cust.Metadata[strings.TrimSuffix(strings.TrimPrefix(key, "metadata["), "]")] = r.PostForm.Get(key)
+		}
+	}
+}
+
+func (st *fakeStripe) handle(w http.ResponseWriter, r *http.Request) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if r.ParseForm() != nil {
+		w.WriteHeader(400)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	id := path[strings.LastIndex(path, "/")+1:]
+
+	switch {
+	case r.Method == http.MethodGet && path == "/customers/search":
+		matches := searchMetadataQuery.FindStringSubmatch(r.Form.Get("query"))
+		found := []*stripe.Customer{}
+		for _, cust := range st.customers {
+			if matches != nil && cust.Metadata[matches[1]] == matches[2] {
+				found = append(found, cust)
+			}
+		}
+		stripeList(w, "search_result", found)
+
+	case r.Method == http.MethodGet && path == "/customers":
+		found := []*stripe.Customer{}
+		for _, cust := range st.customers {
+			if r.Form.Get("email") == "" || cust.Email == r.Form.Get("email") {
+				found = append(found, cust)
+			}
+		}
+		stripeList(w, "list", found)
+
+	case r.Method == http.MethodPost && path == "/customers":
+		key := r.Header.Get("Idempotency-Key")
+		if cust, ok := st.idempotencyKeys[key]; ok && key != "" {
+			writeJSON(w, 200, cust)
+			return
+		}
+		cust := &stripe.Customer{
+			ID:            "cus_" + h.NewID(),
+			Object:        "customer",
+			Created:       time.Now().Unix(),
+			Metadata:      make(map[string]string),
+			Subscriptions: &stripe.SubscriptionList{Data: []*stripe.Subscription{}},
+		}
+		applyCustomerForm(cust, r)
+		st.customers = append(st.customers, cust)
+		st.idempotencyKeys[key] = cust
+		writeJSON(w, 200, cust)
+
+	case strings.HasPrefix(path, "/customers/"):
+		cust := st.findCustomer(id)
+		if cust == nil {
+			stripeNotFound(w, id)
+			return
+		}
+		if r.Method == http.MethodPost {
+			applyCustomerForm(cust, r)
+		}
+		writeJSON(w, 200, cust)
+
+	case r.Method == http.MethodGet && path == "/subscriptions":
+		found := []*stripe.Subscription{}
+		if cust := st.findCustomer(r.Form.Get("customer")); cust != nil {
+			found = cust.Subscriptions.Data
+		}
+		stripeList(w, "list", found)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/products/"):
+		product, ok := st.products[id]
+		if !ok {
+			stripeNotFound(w, id)
+			return
+		}
+		writeJSON(w, 200, product)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/prices/"):
+		price, ok := st.prices[id]
+		if !ok {
+			stripeNotFound(w, id)
+			return
+		}
+		writeJSON(w, 200, price)
+
+	case r.Method == http.MethodPost && path == "/checkout/sessions":
+		session := map[string]string{"id": "cs_test_" + h.NewID()}
+		for key := range r.PostForm {
+			session[key] = r.PostForm.Get(key)
+		}
+		st.sessions = append(st.sessions, session)
+		writeJSON(w, 200, map[string]interface{}{
+			"id":     session["id"],
+			"object": "checkout.session",
+			"mode":   session["mode"],
+			"url":    "https://checkout.stripe.test/" + session["id"],
+		})
+
+	default:
+		stripeNotFound(w, path)
+	}
+}
@@ -0,0 +1,944 @@
+package main
+
+import (
+	"fa-middleware/client"
+	"fa-middleware/config"
+	"fa-middleware/fam"
+	"fa-middleware/guard"
+	h "fa-middleware/helpers"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+	"fa-middleware/proxy"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	e2eOrigin     = "http://localhost:3001"
+	e2eCookieName = "e2e-jwt"
+	e2eProductID  = "prod_e2e"
+	e2ePriceID    = "price_e2e_monthly"
+	e2eAPIKey     = "e2e-private-key"
+	e2eAdminKey   = "e2e-admin-key"
+)
+
+// e2eEnv is the middleware's router wired up to fake FusionAuth and Stripe
+// servers
+type e2eEnv struct {
+	t      *testing.T
+	router *gin.Engine
+	fa     *fakeFusionAuth
+	stripe *fakeStripe
+}
+
+func newE2EEnv(t *testing.T) *e2eEnv {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	env := &e2eEnv{
+		t:      t,
+		fa:     newFakeFusionAuth(t),
+		stripe: newFakeStripe(t),
+	}
+	env.stripe.addPrice(e2eProductID, e2ePriceID, 1000, "month")
+
+	mw, err := fam.New(env.config(t))
+	if err != nil {
+		t.Fatalf("failed to set up middleware: %v", err.Error())
+	}
+	payments.InitializeSubscribedUserCache()
+
+	env.router = newRouter(mw)
+	return env
+}
+
+// config returns the config of an app that uses the fake servers, with its
+// clients set up
+func (env *e2eEnv) config(t *testing.T) config.Config {
+	conf := config.Config{
+		Global: config.GlobalConfig{AdminAPIKey: e2eAdminKey},
+		Apps: []config.App{
+			{
+				Domain:        "localhost:3001",
+				FullDomainURL: e2eOrigin,
+				APIKey:        e2eAPIKey,
+				FusionAuth: config.FusionAuthConfig{
+					InternalHostURL: env.fa.URL,
+					APIKey:          "e2e-api-key",
+					AppID:           "7f4b6a5e-0c1d-4c1e-9a33-2d0c7b3f9e11",
+					TenantID:        "0a6c8e2f-5b1d-4a7e-8f3c-1e9d2b4c6a80",
+				},
+				JWT: config.JWTConfig{
+					CookieName:          e2eCookieName,
+					CookieMaxAgeSeconds: 3600,
+				},
+				Stripe: config.StripeConfig{
+					Provider:          config.PaymentProviderStripe,
+					SecretKey:         "sk_test_e2e",
+					PaymentSuccessURL: e2eOrigin + "/success",
+					PaymentCancelURL:  e2eOrigin + "/cancel",
+					Products: []models.StripeProduct{
+						{
+							ProductID:    e2eProductID,
+							PriceIDs:     []string{e2ePriceID},
+							Entitlements: []string{"reports"},
+						},
+					},
+				},
+			},
+		},
+	}
+	err := conf.InitClients()
+	if err != nil {
+		t.Fatalf("failed to init clients: %v", err.Error())
+	}
+	return conf
+}
+
+// do sends a request to the router. Each header is a "Name: value" pair.
+func (env *e2eEnv) do(method string, path string, body interface{}, cookie *http.Cookie, headers ...string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			env.t.Fatalf("failed to encode body: %v", err.Error())
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ": ", 2)
+		if parts[0] == "Host" {
+			req.Host = parts[1]
+			continue
+		}
+		req.Header.Set(parts[0], parts[1])
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(closeNotifyRecorder{w}, req)
+	return w
+}
+
+// closeNotifyRecorder lets the reverse proxy use the recorder through gin,
+// whose response writer expects a real connection
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (closeNotifyRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// doFromApp sends a request with the app's origin, as a browser would
+func (env *e2eEnv) doFromApp(method string, path string, body interface{}, cookie *http.Cookie) *httptest.ResponseRecorder {
+	return env.do(method, path, body, cookie, "Origin: "+e2eOrigin)
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expected status %v, got %v: %v", status, w.Code, w.Body.String())
+	}
+}
+
+func jwtCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == e2eCookieName && cookie.Value != "" {
+			return cookie
+		}
+	}
+	t.Fatalf("no %v cookie was set", e2eCookieName)
+	return nil
+}
+
+func TestE2ECORS(t *testing.T) {
+	env := newE2EEnv(t)
+
+	w := env.doFromApp("OPTIONS", "/mw/create-checkout-session", nil, nil)
+	expectStatus(t, w, 200)
+	if got := w.Header().Get(h.AccessControlAllowOrigin); got != e2eOrigin {
+		t.Errorf("expected allowed origin %v, got %v", e2eOrigin, got)
+	}
+	if got := w.Header().Get(h.AccessControlAllowCredentials); got != "true" {
+		t.Errorf("expected credentials to be allowed, got %v", got)
+	}
+	if got := w.Header().Get(h.AccessControlAllowHeaders); got != h.CORSHeadersJSON {
+		t.Errorf("expected allowed headers %v, got %v", h.CORSHeadersJSON, got)
+	}
+
+	w = env.do("GET", "/mw/ping", nil, nil, "Origin: http://unknown.example.com")
+	expectStatus(t, w, 404)
+	if got := w.Header().Get(h.AccessControlAllowOrigin); got != "" {
+		t.Errorf("expected no allowed origin for an unknown app, got %v", got)
+	}
+
+	w = env.do("GET", "/mw/ping", nil, nil)
+	expectStatus(t, w, 404)
+
+	// requests without an origin fall back to the referer
+	w = env.do("GET", "/mw/ping", nil, nil, "Referer: "+e2eOrigin+"/pricing")
+	expectStatus(t, w, 200)
+	if got := w.Header().Get(h.AccessControlAllowOrigin); got != e2eOrigin {
+		t.Errorf("expected allowed origin %v via referer, got %v", e2eOrigin, got)
+	}
+}
+
+func TestE2ESignupToSubscription(t *testing.T) {
+	env := newE2EEnv(t)
+	email := "e2e@example.com"
+	password := "correct horse battery staple"
+
+	t.Log("register")
+	w := env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             email,
+		Password:          password,
+		ConfirmedPassword: "something else",
+	}, nil)
+	expectStatus(t, w, 400)
+
+	w = env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             email,
+		Password:          password,
+		ConfirmedPassword: password,
+	}, nil)
+	expectStatus(t, w, 200)
+	registered := models.LoggedInResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &registered)
+	if !registered.LoggedIn || registered.UserID == "" || registered.UserEmail != email {
+		t.Fatalf("unexpected register response: %v", w.Body.String())
+	}
+	jwtCookie(t, w)
+
+	t.Log("login")
+	w = env.doFromApp("POST", "/mw/login", models.LoginBody{Email: email, Password: "wrong"}, nil)
+	expectStatus(t, w, 401)
+
+	w = env.doFromApp("POST", "/mw/login", models.LoginBody{Email: email, Password: password}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+
+	t.Log("loggedin")
+	w = env.doFromApp("GET", "/mw/loggedin", nil, nil)
+	expectStatus(t, w, 200)
+	loggedIn := models.LoggedInResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &loggedIn)
+	if loggedIn.LoggedIn {
+		t.Fatalf("expected to be logged out without a cookie: %v", w.Body.String())
+	}
+
+	w = env.doFromApp("GET", "/mw/loggedin", nil, cookie)
+	expectStatus(t, w, 200)
+	_ = json.Unmarshal(w.Body.Bytes(), &loggedIn)
+	if !loggedIn.LoggedIn || loggedIn.UserID != registered.UserID {
+		t.Fatalf("expected to be logged in as %v: %v", registered.UserID, w.Body.String())
+	}
+
+	t.Log("products")
+	w = env.doFromApp("GET", "/mw/products", nil, nil)
+	expectStatus(t, w, 200)
+	products := []models.ProductSummary{}
+	_ = json.Unmarshal(w.Body.Bytes(), &products)
+	if len(products) != 1 || products[0].ID != e2eProductID || len(products[0].Prices) != 1 {
+		t.Fatalf("unexpected products: %v", w.Body.String())
+	}
+
+	t.Log("checkout")
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, nil)
+	expectStatus(t, w, 401)
+
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: "price_not_configured"}},
+	}, cookie)
+	expectStatus(t, w, 400)
+
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	checkout := models.CreateCheckoutSessionResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &checkout)
+	session := env.stripe.lastSession()
+	if checkout.SessionID == "" || session == nil || checkout.SessionID != session["id"] {
+		t.Fatalf("unexpected checkout response: %v", w.Body.String())
+	}
+	if session["mode"] != "subscription" || session["line_items[0][price]"] != e2ePriceID {
+		t.Errorf("unexpected checkout session: %v", session)
+	}
+	if session["client_reference_id"] != registered.UserID {
+		t.Errorf("expected client reference id %v, got %v", registered.UserID, session["client_reference_id"])
+	}
+	custID := session["customer"]
+	if !strings.HasPrefix(custID, "cus_") {
+		t.Fatalf("expected checkout as the user's customer, got %v", custID)
+	}
+
+	t.Log("substatus")
+	w = env.doFromApp("GET", "/mw/substatus", nil, cookie)
+	expectStatus(t, w, 400)
+
+	w = env.doFromApp("GET", "/mw/substatus?p="+e2eProductID, nil, cookie)
+	expectStatus(t, w, 200)
+	if w.Body.String() != "false" {
+		t.Fatalf("expected not to be subscribed yet, got %v", w.Body.String())
+	}
+
+	env.stripe.subscribe(custID, e2ePriceID)
+	payments.PurgeCachedCustomer(custID)
+
+	w = env.doFromApp("GET", "/mw/substatus?p="+e2eProductID, nil, cookie)
+	expectStatus(t, w, 200)
+	if w.Body.String() != "true" {
+		t.Fatalf("expected to be subscribed, got %v", w.Body.String())
+	}
+}
+
+func TestE2EDevMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dir := t.TempDir()
+	fixturesFile := dir + "/fixtures.yml"
+	err := ioutil.WriteFile(fixturesFile, []byte(`
+users:
+  - email: dev@example.com
+    password: password1234
+products:
+  - productId: `+e2eProductID+`
+    name: Pro
+    prices:
+      - priceId: `+e2ePriceID+`
+        unitAmount: 1500
+        interval: month
+`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write fixtures: %v", err.Error())
+	}
+	confFile := dir + "/config.yml"
+	err = ioutil.WriteFile(confFile, []byte(`
+apps:
+  - domain: localhost:3001
+    fullDomainURL: `+e2eOrigin+`
+    mode: dev
+    dev:
+      fixturesFile: `+fixturesFile+`
+    jwt:
+      cookieName: `+e2eCookieName+`
+    stripe:
+      paymentSuccessURL: `+e2eOrigin+`/success
+      paymentCancelURL: `+e2eOrigin+`/cancel
+      products:
+        - productId: `+e2eProductID+`
+          priceIds: [`+e2ePriceID+`]
+    apiKey: e2e-dev-key
+global:
+  bindPort: 8080
+`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err.Error())
+	}
+
+	conf, err := config.LoadConfigYamlFile(confFile)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err.Error())
+	}
+	mw, err := fam.New(conf)
+	if err != nil {
+		t.Fatalf("failed to set up middleware: %v", err.Error())
+	}
+	payments.InitializeSubscribedUserCache()
+	env := &e2eEnv{t: t, router: newRouter(mw)}
+
+	w := env.doFromApp("POST", "/mw/login", models.LoginBody{Email: "dev@example.com", Password: "password1234"}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+
+	w = env.doFromApp("GET", "/mw/products", nil, nil)
+	expectStatus(t, w, 200)
+	products := []models.ProductSummary{}
+	_ = json.Unmarshal(w.Body.Bytes(), &products)
+	if len(products) != 1 || products[0].Name != "Pro" || products[0].Prices[0].Price != 1500 {
+		t.Fatalf("expected the product fixture, got %v", w.Body.String())
+	}
+
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	checkout := models.CreateCheckoutSessionResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &checkout)
+
+	w = env.do("GET", payments.FakeCheckoutPath+checkout.SessionID, nil, nil)
+	expectStatus(t, w, 303)
+	if got := w.Header().Get("Location"); got != e2eOrigin+"/success" {
+		t.Errorf("expected a redirect to the success url, got %v", got)
+	}
+
+	w = env.doFromApp("GET", "/mw/substatus?p="+e2eProductID, nil, cookie)
+	expectStatus(t, w, 200)
+	if w.Body.String() != "true" {
+		t.Fatalf("expected to be subscribed after the fake checkout, got %v", w.Body.String())
+	}
+}
+
+func TestE2EEmbedded(t *testing.T) {
+	env := newE2EEnv(t)
+	previousCheckoutPath := payments.FakeCheckoutPath
+	t.Cleanup(func() { payments.FakeCheckoutPath = previousCheckoutPath })
+
+	mw := fam.NewWithHolder(
+		config.NewHolder(env.config(t)),
+		fam.WithoutRoutes(fam.RoutesData, fam.RoutesPrivate),
+	)
+	r := gin.New()
+	mw.Register(r.Group("/api/auth"))
+	env.router = r
+
+	w := env.doFromApp("GET", "/api/auth/ping", nil, nil)
+	expectStatus(t, w, 200)
+
+	w = env.doFromApp("GET", "/api/auth/loggedin", nil, nil)
+	expectStatus(t, w, 200)
+
+	w = env.doFromApp("GET", "/api/auth/data/settings", nil, nil)
+	expectStatus(t, w, 404)
+	w = env.do("POST", "/api/auth/private/substatus", nil, nil)
+	expectStatus(t, w, 404)
+
+	if payments.FakeCheckoutPath != "/api/auth/fake/checkout/" {
+		t.Errorf("expected the fake checkout page under the mount point, got %v", payments.FakeCheckoutPath)
+	}
+}
+
+func TestE2EGuard(t *testing.T) {
+	env := newE2EEnv(t)
+	mw, err := fam.New(env.config(t))
+	if err != nil {
+		t.Fatalf("failed to set up middleware: %v", err.Error())
+	}
+	g := mw.Guard("localhost:3001")
+	env.router.GET("/reports", g.RequireSubscription(e2eProductID), func(c *gin.Context) {
+		identity, ok := guard.IdentityFromGin(c)
+		if !ok {
+			c.Data(500, "text/plain", []byte("no identity"))
+			return
+		}
+		c.Data(200, "text/plain", []byte(identity.User.Email))
+	})
+	env.router.GET("/export", g.RequireUser(), g.RequireEntitlement("reports"), func(c *gin.Context) {
+		c.Data(200, "text/plain", []byte("ok"))
+	})
+	env.router.GET("/admin", g.RequireRole("admin"), func(c *gin.Context) {
+		c.Data(200, "text/plain", []byte("ok"))
+	})
+	redirecting := mw.Guard("localhost:3001", guard.WithRedirect(401, "/login?next={URL}"))
+	env.router.GET("/account", gin.WrapH(redirecting.HTTP().RequireUser()(http.NotFoundHandler())))
+
+	email := "guard@example.com"
+	password := "correct horse battery staple"
+	w := env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             email,
+		Password:          password,
+		ConfirmedPassword: password,
+	}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+
+	w = env.do("GET", "/reports", nil, nil)
+	expectStatus(t, w, 401)
+	w = env.do("GET", "/account", nil, nil)
+	expectStatus(t, w, 302)
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, "/login?next=http%3A%2F%2F") {
+		t.Errorf("expected a redirect to the login page, got %v", location)
+	}
+	w = env.do("GET", "/account", nil, cookie)
+	expectStatus(t, w, 404)
+
+	w = env.do("GET", "/reports", nil, cookie)
+	expectStatus(t, w, 402)
+	failure := guard.Failure{}
+	_ = json.Unmarshal(w.Body.Bytes(), &failure)
+	if failure.Reason != guard.ReasonSubscriptionRequired || failure.Required != e2eProductID {
+		t.Errorf("unexpected failure: %v", w.Body.String())
+	}
+	w = env.do("GET", "/export", nil, cookie)
+	expectStatus(t, w, 402)
+	w = env.do("GET", "/admin", nil, cookie)
+	expectStatus(t, w, 403)
+
+	// checking out creates the user's customer, which is then subscribed
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	custID := env.stripe.lastSession()["customer"]
+	env.stripe.subscribe(custID, e2ePriceID)
+	payments.PurgeCachedCustomer(custID)
+
+	w = env.do("GET", "/reports", nil, cookie)
+	expectStatus(t, w, 200)
+	if w.Body.String() != email {
+		t.Errorf("expected the identity of %v, got %v", email, w.Body.String())
+	}
+	w = env.do("GET", "/export", nil, cookie)
+	expectStatus(t, w, 200)
+}
+
+func TestE2EClient(t *testing.T) {
+	env := newE2EEnv(t)
+	server := httptest.NewServer(env.router)
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	w := env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             "client@example.com",
+		Password:          "correct horse battery staple",
+		ConfirmedPassword: "correct horse battery staple",
+	}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+	registered := models.LoggedInResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &registered)
+
+	mw := client.New(server.URL+"/mw/", e2eAPIKey)
+	subscribed, err := mw.IsSubscribed(ctx, client.ByJWT(cookie.Value), e2eProductID)
+	if err != nil || subscribed {
+		t.Fatalf("expected not to be subscribed yet, got %v, %v", subscribed, err)
+	}
+
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	custID := env.stripe.lastSession()["customer"]
+	env.stripe.subscribe(custID, e2ePriceID)
+	payments.PurgeCachedCustomer(custID)
+
+	// the previous result is still cached
+	subscribed, err = mw.IsSubscribed(ctx, client.ByJWT(cookie.Value), e2eProductID)
+	if err != nil || subscribed {
+		t.Fatalf("expected the cached result, got %v, %v", subscribed, err)
+	}
+	mw.ClearCache()
+	subscribed, err = mw.IsSubscribed(ctx, client.ByJWT(cookie.Value), e2eProductID)
+	if err != nil || !subscribed {
+		t.Fatalf("expected to be subscribed, got %v, %v", subscribed, err)
+	}
+	subscribed, err = mw.IsSubscribed(ctx, client.ByUserID(registered.UserID), e2eProductID)
+	if err != nil || !subscribed {
+		t.Fatalf("expected to be subscribed by user id, got %v, %v", subscribed, err)
+	}
+
+	// user data needs the database, which the e2e tests don't have
+	_, err = mw.GetData(ctx, client.ByUserID(registered.UserID), "settings")
+	statusErr := &client.Error{}
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 501 {
+		t.Errorf("expected a 501 without a database, got %v", err)
+	}
+
+	unauthorized := client.New(server.URL+"/mw", "wrong-key")
+	_, err = unauthorized.IsSubscribed(ctx, client.ByJWT(cookie.Value), e2eProductID)
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 401 {
+		t.Errorf("expected a 401 with the wrong api key, got %v", err)
+	}
+
+	t.Log("retries")
+	var attempts int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		env.router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(flaky.Close)
+	retrying := client.New(flaky.URL+"/mw", e2eAPIKey, client.WithRetries(2, time.Millisecond))
+	subscribed, err = retrying.IsSubscribed(ctx, client.ByJWT(cookie.Value), e2eProductID)
+	if err != nil || !subscribed || atomic.LoadInt32(&attempts) != 3 {
+		t.Fatalf("expected to succeed on the third attempt, got %v, %v after %v attempts", subscribed, err, attempts)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	noRetries := client.New(flaky.URL+"/mw", e2eAPIKey, client.WithRetries(0, 0))
+	_, err = noRetries.IsSubscribed(ctx, client.ByJWT(cookie.Value), e2eProductID)
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 503 {
+		t.Errorf("expected a 503 without retries, got %v", err)
+	}
+}
+
+func TestE2EForwardAuth(t *testing.T) {
+	env := newE2EEnv(t)
+	forwarded := "X-Forwarded-Host: localhost:3001"
+
+	w := env.do("GET", "/mw/forward-auth", nil, nil, "X-Forwarded-Host: unknown.example.com")
+	expectStatus(t, w, 404)
+	w = env.do("GET", "/mw/forward-auth", nil, nil, forwarded)
+	expectStatus(t, w, 401)
+
+	w = env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             "proxy@example.com",
+		Password:          "correct horse battery staple",
+		ConfirmedPassword: "correct horse battery staple",
+	}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+
+	w = env.do("GET", "/mw/forward-auth", nil, cookie, forwarded)
+	expectStatus(t, w, 200)
+	if w.Header().Get("X-User-Email") != "proxy@example.com" || w.Header().Get("X-User-Id") == "" {
+		t.Errorf("expected the user's headers, got %v", w.Header())
+	}
+	if w.Header().Get("X-Entitlements") != "" {
+		t.Errorf("expected no entitlements yet, got %v", w.Header().Get("X-Entitlements"))
+	}
+
+	w = env.do("GET", "/mw/forward-auth?product="+e2eProductID, nil, cookie, forwarded)
+	expectStatus(t, w, 402)
+	w = env.do("GET", "/mw/forward-auth?entitlement=reports&paymentStatus=403", nil, cookie, forwarded)
+	expectStatus(t, w, 403)
+	w = env.do("GET", "/mw/forward-auth?role=admin", nil, cookie, forwarded)
+	expectStatus(t, w, 403)
+
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	custID := env.stripe.lastSession()["customer"]
+	env.stripe.subscribe(custID, e2ePriceID)
+	payments.PurgeCachedCustomer(custID)
+
+	w = env.do("GET", "/mw/forward-auth?app=localhost:3001&product="+e2eProductID+"&entitlement=reports", nil, cookie)
+	expectStatus(t, w, 200)
+	if w.Header().Get("X-Entitlements") != "reports" {
+		t.Errorf("expected the reports entitlement, got %v", w.Header().Get("X-Entitlements"))
+	}
+
+	t.Log("login redirect")
+	conf := env.config(t)
+	conf.Apps[0].ForwardAuth.LoginURL = e2eOrigin + "/login?next={URL}"
+	mw, err := fam.New(conf)
+	if err != nil {
+		t.Fatalf("failed to set up middleware: %v", err.Error())
+	}
+	env.router = newRouter(mw)
+
+	w = env.do("GET", "/mw/forward-auth", nil, nil, forwarded)
+	expectStatus(t, w, 401)
+	w = env.do(
+		"GET",
+		"/mw/forward-auth?redirect=true",
+		nil,
+		nil,
+		forwarded,
+		"X-Forwarded-Proto: http",
+		"X-Forwarded-Uri: /reports?year=2021",
+	)
+	expectStatus(t, w, 302)
+	expected := e2eOrigin + "/login?next=" + url.QueryEscape("http://localhost:3001/reports?year=2021")
+	if w.Header().Get("Location") != expected {
+		t.Errorf("expected a redirect to %v, got %v", expected, w.Header().Get("Location"))
+	}
+}
+
+func TestE2EProxy(t *testing.T) {
+	env := newE2EEnv(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := proxy.Verify("e2e-proxy-secret", r.Header, proxy.DefaultMaxSignatureAge)
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+		w.Header().Set("X-Upstream-Cookie", r.Header.Get("Cookie"))
+		w.Header().Set("X-Upstream-User", r.Header.Get("X-User-Id"))
+		w.Header().Set("X-Upstream-Verified", fmt.Sprintf("%v", err == nil))
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	conf := env.config(t)
+	conf.Apps[0].Proxy = config.ProxyConfig{
+		Secret: "e2e-proxy-secret",
+		Routes: []config.ProxyRoute{
+			{PathPrefix: "/public", Upstream: upstream.URL + "/static", StripPrefix: true, Anonymous: true},
+			{PathPrefix: "/app", Upstream: upstream.URL},
+			{PathPrefix: "/app/reports", Upstream: upstream.URL, Product: e2eProductID},
+			{PathPrefix: "/app/admin", Upstream: upstream.URL, Role: "admin"},
+		},
+	}
+	mw, err := fam.New(conf)
+	if err != nil {
+		t.Fatalf("failed to set up middleware: %v", err.Error())
+	}
+	env.router = newRouter(mw)
+	host := "Host: localhost:3001"
+
+	w := env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             "proxied@example.com",
+		Password:          "correct horse battery staple",
+		ConfirmedPassword: "correct horse battery staple",
+	}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+
+	t.Log("anonymous")
+	w = env.do("GET", "/public/logo.png", nil, nil, host, "X-User-Id: spoofed")
+	expectStatus(t, w, 200)
+	if w.Header().Get("X-Upstream-Path") != "/static/logo.png" || w.Header().Get("X-Upstream-User") != "" {
+		t.Errorf("unexpected upstream request: %v", w.Header())
+	}
+	w = env.do("GET", "/public/logo.png", nil, cookie, host)
+	expectStatus(t, w, 200)
+	if w.Header().Get("X-Upstream-User") == "" || w.Header().Get("X-Upstream-Verified") != "true" {
+		t.Errorf("expected the logged-in user to be described: %v", w.Header())
+	}
+
+	t.Log("logged in")
+	w = env.do("GET", "/app/home", nil, nil, host)
+	expectStatus(t, w, 401)
+	w = env.do("GET", "/app/home", nil, cookie, host, "Cookie: theme=dark")
+	expectStatus(t, w, 200)
+	if w.Header().Get("X-Upstream-Path") != "/app/home" || w.Header().Get("X-Upstream-Verified") != "true" {
+		t.Errorf("unexpected upstream request: %v", w.Header())
+	}
+	if upstreamCookie := w.Header().Get("X-Upstream-Cookie"); strings.Contains(upstreamCookie, e2eCookieName) || !strings.Contains(upstreamCookie, "theme=dark") {
+		t.Errorf("expected only the jwt cookie to be removed, got %v", upstreamCookie)
+	}
+	if w.Body.String() != "upstream" {
+		t.Errorf("expected the upstream's response, got %v", w.Body.String())
+	}
+
+	t.Log("requirements")
+	w = env.do("GET", "/app/admin/users", nil, cookie, host)
+	expectStatus(t, w, 403)
+	w = env.do("GET", "/app/reports", nil, cookie, host)
+	expectStatus(t, w, 402)
+
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	custID := env.stripe.lastSession()["customer"]
+	env.stripe.subscribe(custID, e2ePriceID)
+	payments.PurgeCachedCustomer(custID)
+
+	w = env.do("GET", "/app/reports", nil, cookie, host)
+	expectStatus(t, w, 200)
+
+	w = env.do("GET", "/apple", nil, cookie, host)
+	expectStatus(t, w, 404)
+	w = env.do("GET", "/app/home", nil, cookie, "Host: unknown.example.com")
+	expectStatus(t, w, 404)
+}
+
+func TestE2ETokens(t *testing.T) {
+	env := newE2EEnv(t)
+	server := httptest.NewServer(env.router)
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+	appID := env.config(t).Apps[0].FusionAuth.AppID
+
+	w := env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             "tokens@example.com",
+		Password:          "correct horse battery staple",
+		ConfirmedPassword: "correct horse battery staple",
+	}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+	registered := models.LoggedInResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &registered)
+
+	w = env.do("GET", "/mw/.well-known/jwks.json", nil, nil)
+	expectStatus(t, w, 200)
+	jwks := models.JWKS{}
+	_ = json.Unmarshal(w.Body.Bytes(), &jwks)
+	if len(jwks.Keys) == 0 || jwks.Keys[0].Algorithm != "RS256" {
+		t.Fatalf("unexpected jwks: %v", w.Body.String())
+	}
+
+	w = env.doFromApp("GET", "/mw/token", nil, nil)
+	expectStatus(t, w, 401)
+	w = env.doFromApp("GET", "/mw/token", nil, cookie)
+	expectStatus(t, w, 200)
+	issued := models.TokenResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &issued)
+
+	mw := client.New(server.URL+"/mw", e2eAPIKey)
+	verifier := mw.TokenVerifier(appID)
+	claims, err := verifier.Verify(ctx, issued.Token)
+	if err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+	if claims.Subject != registered.UserID || claims.Email != "tokens@example.com" || claims.HasProduct(e2eProductID) {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if claims.ExpiresAt != issued.ExpiresAt {
+		t.Errorf("expected the token to expire at %v, got %v", issued.ExpiresAt, claims.ExpiresAt)
+	}
+
+	tampered := issued.Token[:len(issued.Token)-4] + "AAAA"
+	_, err = verifier.Verify(ctx, tampered)
+	if err != client.ErrInvalidToken {
+		t.Errorf("expected a tampered token to be invalid, got %v", err)
+	}
+	_, err = mw.TokenVerifier("another-app").Verify(ctx, issued.Token)
+	if err != client.ErrInvalidToken {
+		t.Errorf("expected a token for another app to be invalid, got %v", err)
+	}
+
+	t.Log("private token")
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	custID := env.stripe.lastSession()["customer"]
+	env.stripe.subscribe(custID, e2ePriceID)
+	payments.PurgeCachedCustomer(custID)
+
+	token, err := mw.Token(ctx, client.ByUserID(registered.UserID))
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	claims, err = verifier.Verify(ctx, token.Token)
+	if err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+	if !claims.HasProduct(e2eProductID) || !claims.HasEntitlement("reports") {
+		t.Errorf("expected the subscription in the claims: %+v", claims)
+	}
+}
+
+func TestE2EIntrospect(t *testing.T) {
+	env := newE2EEnv(t)
+	server := httptest.NewServer(env.router)
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	w := env.doFromApp("POST", "/mw/register", models.RegisterBody{
+		Email:             "introspect@example.com",
+		Password:          "correct horse battery staple",
+		ConfirmedPassword: "correct horse battery staple",
+	}, nil)
+	expectStatus(t, w, 200)
+	cookie := jwtCookie(t, w)
+	registered := models.LoggedInResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &registered)
+	env.fa.setRoles(registered.UserID, "editor")
+
+	w = env.do("POST", "/mw/private/introspect", models.PrivateUserBody{
+		APIKey: "wrong-key",
+		UserID: registered.UserID,
+	}, nil)
+	expectStatus(t, w, 401)
+
+	w = env.do("POST", "/mw/private/introspect", models.PrivateUserBody{
+		APIKey: e2eAPIKey,
+		UserID: registered.UserID,
+	}, nil)
+	expectStatus(t, w, 200)
+	introspected := models.IntrospectResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &introspected)
+	if introspected.User.ID != registered.UserID || introspected.User.Email != "introspect@example.com" {
+		t.Errorf("unexpected user: %+v", introspected.User)
+	}
+	if len(introspected.Roles) != 1 || introspected.Roles[0] != "editor" {
+		t.Errorf("expected the editor role, got %v", introspected.Roles)
+	}
+	if len(introspected.Subscriptions) != 0 || len(introspected.Products) != 0 || len(introspected.Entitlements) != 0 {
+		t.Errorf("expected no access yet: %v", w.Body.String())
+	}
+
+	t.Log("after subscribing")
+	w = env.doFromApp("POST", "/mw/create-checkout-session", models.CheckoutBody{
+		LineItems: []models.CheckoutLineItem{{PriceID: e2ePriceID, Quantity: 1}},
+	}, cookie)
+	expectStatus(t, w, 200)
+	custID := env.stripe.lastSession()["customer"]
+	env.stripe.subscribe(custID, e2ePriceID)
+	payments.PurgeCachedCustomer(custID)
+
+	mw := client.New(server.URL+"/mw", e2eAPIKey)
+	introspected, err := mw.Introspect(ctx, client.ByJWT(cookie.Value))
+	if err != nil {
+		t.Fatalf("failed to introspect: %v", err)
+	}
+	if introspected.StripeCustomerID != custID {
+		t.Errorf("expected stripe customer %v, got %v", custID, introspected.StripeCustomerID)
+	}
+	if len(introspected.Subscriptions) != 1 || introspected.Subscriptions[0].Status != "active" {
+		t.Errorf("expected an active subscription: %+v", introspected.Subscriptions)
+	}
+	if len(introspected.Products) != 1 || introspected.Products[0] != e2eProductID {
+		t.Errorf("expected product %v, got %v", e2eProductID, introspected.Products)
+	}
+	if len(introspected.Entitlements) != 1 || introspected.Entitlements[0] != "reports" {
+		t.Errorf("expected the reports entitlement, got %v", introspected.Entitlements)
+	}
+}
+
+func TestE2EDeadJobs(t *testing.T) {
+	env := newE2EEnv(t)
+	ctx := context.Background()
+
+	previous := jobs.Default
+	jobs.Default = jobs.NewMemoryQueue()
+	t.Cleanup(func() { jobs.Default = previous })
+	err := jobs.EnqueueWithAttempts("e2e.dead", nil, 1)
+	if err != nil {
+		t.Fatalf("failed to enqueue: %v", err)
+	}
+	claimed, _ := jobs.Default.Claim(ctx, 1, time.Minute)
+	if len(claimed) != 1 {
+		t.Fatalf("expected to claim the job")
+	}
+	_ = jobs.Default.Fail(ctx, claimed[0].ID, "e2e failure", nil)
+
+	// app api keys can't see jobs of other apps
+	w := env.do("POST", "/mw/private/jobs/dead", models.DeadJobsBody{APIKey: e2eAPIKey}, nil)
+	expectStatus(t, w, 401)
+
+	w = env.do("POST", "/mw/private/jobs/dead", models.DeadJobsBody{APIKey: e2eAdminKey}, nil)
+	expectStatus(t, w, 200)
+	dead := []models.Job{}
+	_ = json.Unmarshal(w.Body.Bytes(), &dead)
+	if len(dead) != 1 || dead[0].ID != claimed[0].ID || dead[0].LastError != "e2e failure" {
+		t.Fatalf("expected the dead job, got %v", w.Body.String())
+	}
+
+	w = env.do("POST", "/mw/private/jobs/requeue", models.DeadJobsBody{
+		APIKey: e2eAdminKey,
+		JobIDs: []string{claimed[0].ID, "unknown"},
+	}, nil)
+	expectStatus(t, w, 200)
+	if w.Body.String() != `{"requeued":1}` {
+		t.Errorf("expected 1 requeued job, got %v", w.Body.String())
+	}
+	claimed, _ = jobs.Default.Claim(ctx, 1, time.Minute)
+	if len(claimed) != 1 || claimed[0].Attempts != 0 {
+		t.Errorf("expected the job to be pending with a fresh set of attempts, got %+v", claimed)
+	}
+}
@@ -0,0 +1,286 @@
+// Package fam mounts the middleware's routes into a gin engine, so that Go
+// services can serve /mw themselves instead of running the middleware as a
+// separate binary:
+//
+//	mw, err := fam.New(conf, fam.WithoutRoutes(fam.RoutesData))
+//	if err != nil { ... }
+//	err = mw.Start(ctx)
+//	if err != nil { ... }
+//	mw.Register(router.Group("/mw"))
+//
+// The rest of the middleware keeps its state in package-level variables,
+// such as the database, the job queue and the subscription cache, so only
+// one Middleware should be used per process.
+package fam
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/guard"
+	"fa-middleware/jobs"
+	"fa-middleware/payments"
+	"fa-middleware/proxy"
+	"fa-middleware/store"
+	"fa-middleware/tokens"
+	"fa-middleware/webhooks"
+
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+// RouteGroup is a set of related routes that can be turned off, see
+// WithoutRoutes and WithOnlyRoutes. /ping is always registered.
+type RouteGroup string
+
+const (
+	// RoutesAuth is /login, /register and /loggedin
+	RoutesAuth RouteGroup = "auth"
+
+	// RoutesProducts is /products
+	RoutesProducts RouteGroup = "products"
+
+	// RoutesCheckout is /create-checkout-session, /checkout/session/:id and
+	// the checkout page of the fake payment provider
+	RoutesCheckout RouteGroup = "checkout"
+
+	// RoutesSubscriptions is /substatus, /subscriptions and /invoices
+	RoutesSubscriptions RouteGroup = "subscriptions"
+
+	// RoutesData is /data/:key
+	RoutesData RouteGroup = "data"
+
+	// RoutesPrivate is everything under /private, which is authenticated
+	// with the app's api key
+	RoutesPrivate RouteGroup = "private"
+
+	// RoutesWebhooks is /fusionauth/webhook and /stripe/webhook
+	RoutesWebhooks RouteGroup = "webhooks"
+
+	// RoutesForwardAuth is /forward-auth, which reverse proxies call to
+	// check requests to other apps
+	RoutesForwardAuth RouteGroup = "forwardAuth"
+
+	// RoutesTokens is /token, /private/token and /.well-known/jwks.json
+	RoutesTokens RouteGroup = "tokens"
+)
+
+// AllRouteGroups are registered unless options say otherwise
+var AllRouteGroups = []RouteGroup{
+	RoutesAuth,
+	RoutesProducts,
+	RoutesCheckout,
+	RoutesSubscriptions,
+	RoutesData,
+	RoutesPrivate,
+	RoutesWebhooks,
+	RoutesForwardAuth,
+	RoutesTokens,
+}
+
+// Middleware serves the routes of the middleware for every app in its
+// config
+type Middleware struct {
+	holder *config.Holder
+
+	disabled          map[RouteGroup]bool
+	fusionAuthClients map[string]*fusionauth.FusionAuthClient
+	providers         map[string]payments.PaymentProvider
+	store             *store.Store
+}
+
+// Option changes how a Middleware is set up, see New
+type Option func(mw *Middleware)
+
+// WithoutRoutes turns off route groups
+func WithoutRoutes(groups ...RouteGroup) Option {
+	return func(mw *Middleware) {
+		for _, group := range groups {
+			mw.disabled[group] = true
+		}
+	}
+}
+
+// WithOnlyRoutes turns off every route group except the given ones
+func WithOnlyRoutes(groups ...RouteGroup) Option {
+	return func(mw *Middleware) {
+		for _, group := range AllRouteGroups {
+			mw.disabled[group] = true
+		}
+		for _, group := range groups {
+			mw.disabled[group] = false
+		}
+	}
+}
+
+// WithFusionAuthClient uses client for the app with the given domain instead
+// of the one built from its fusionAuth config. The client is kept when the
+// config is reloaded.
+func WithFusionAuthClient(domain string, client *fusionauth.FusionAuthClient) Option {
+	return func(mw *Middleware) {
+		mw.fusionAuthClients[domain] = client
+	}
+}
+
+// WithPaymentProvider uses provider for the app with the given domain
+// instead of the one that its stripe config selects
+func WithPaymentProvider(domain string, provider payments.PaymentProvider) Option {
+	return func(mw *Middleware) {
+		mw.providers[domain] = provider
+	}
+}
+
+// WithStripeClient calls Stripe through sc for the app with the given
+// domain, such as a client with its own backends or http client
+func WithStripeClient(domain string, sc *client.API) Option {
+	return WithPaymentProvider(domain, payments.NewStripeProvider(sc))
+}
+
+// WithStore uses s as the middleware's database instead of connecting to
+// global.databaseUrl. It must already be migrated, see store.Store.Migrate.
+func WithStore(s *store.Store) Option {
+	return func(mw *Middleware) {
+		mw.store = s
+	}
+}
+
+// New sets up a Middleware for conf and builds the FusionAuth clients of its
+// apps
+func New(conf config.Config, options ...Option) (*Middleware, error) {
+	err := conf.InitClients()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize clients: %v", err.Error())
+	}
+	return NewWithHolder(config.NewHolder(conf), options...), nil
+}
+
+// NewWithHolder sets up a Middleware that reads its config from holder,
+// whose FusionAuth clients must already be built. Use it to reload the
+// config while running, see config.Holder.Watch.
+func NewWithHolder(holder *config.Holder, options ...Option) *Middleware {
+	mw := &Middleware{
+		holder:            holder,
+		disabled:          make(map[RouteGroup]bool),
+		fusionAuthClients: make(map[string]*fusionauth.FusionAuthClient),
+		providers:         make(map[string]payments.PaymentProvider),
+	}
+	for _, option := range options {
+		option(mw)
+	}
+
+	for domain, provider := range mw.providers {
+		payments.SetProvider(domain, provider)
+	}
+	return mw
+}
+
+// Holder returns the holder of the middleware's config
+func (mw *Middleware) Holder() *config.Holder {
+	return mw.holder
+}
+
+// Config returns the currently active config, with any injected FusionAuth
+// clients in place
+func (mw *Middleware) Config() config.Config {
+	conf := mw.holder.Get()
+	if len(mw.fusionAuthClients) == 0 {
+		return conf
+	}
+
+	// the apps are shared with other snapshots of the same config, so they
+	// must be copied before they're changed
+	apps := make([]config.App, len(conf.Apps))
+	copy(apps, conf.Apps)
+	for i, app := range apps {
+		if client, ok := mw.fusionAuthClients[app.Domain]; ok {
+			apps[i].FusionAuth.Client = client
+		}
+	}
+	conf.Apps = apps
+	return conf
+}
+
+// Start connects to the database, unless a store was injected or none is
+// configured, and starts the background jobs. It should be called once,
+// before serving any requests.
+func (mw *Middleware) Start(ctx context.Context) error {
+	conf := mw.Config()
+
+	if mw.store != nil {
+		store.DB = mw.store
+	} else if conf.Global.DatabaseURL != "" {
+		err := store.Initialize(ctx, conf.Global.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %v", err.Error())
+		}
+	}
+
+	// the job queue is durable when the database is enabled
+	jobs.Initialize()
+
+	payments.RegisterJobs(mw.Config)
+	webhooks.RegisterJobs(mw.Config)
+	tokens.RegisterJobs(mw.Config)
+	jobs.StartWorkers(conf.Global.JobWorkers)
+	payments.ScheduleReconcile(mw.Config)
+	return nil
+}
+
+// Enabled checks if a route group is registered
+func (mw *Middleware) Enabled(group RouteGroup) bool {
+	return !mw.disabled[group]
+}
+
+// Register adds the enabled routes to group, which is usually mounted at
+// /mw since that's where frontends expect the middleware
+func (mw *Middleware) Register(group *gin.RouterGroup) {
+	// the fake payment provider links to its checkout page, so it has to
+	// know where that ends up
+	payments.FakeCheckoutPath = path.Join(group.BasePath(), fakeCheckoutRoute) + "/"
+
+	mw.registerPing(group)
+	if mw.Enabled(RoutesAuth) {
+		mw.registerAuth(group)
+	}
+	if mw.Enabled(RoutesProducts) {
+		mw.registerProducts(group)
+	}
+	if mw.Enabled(RoutesCheckout) {
+		mw.registerCheckout(group)
+	}
+	if mw.Enabled(RoutesSubscriptions) {
+		mw.registerSubscriptions(group)
+	}
+	if mw.Enabled(RoutesData) {
+		mw.registerData(group)
+	}
+	if mw.Enabled(RoutesPrivate) {
+		mw.registerPrivate(group)
+	}
+	if mw.Enabled(RoutesWebhooks) {
+		mw.registerWebhooks(group)
+	}
+	if mw.Enabled(RoutesForwardAuth) {
+		mw.registerForwardAuth(group)
+	}
+	if mw.Enabled(RoutesTokens) {
+		mw.registerTokens(group)
+	}
+}
+
+// Guard returns gin and net/http middleware that protects the service's own
+// routes with the login and subscription state of the app with the given
+// domain, see package guard
+func (mw *Middleware) Guard(domain string, options ...guard.Option) *guard.Guard {
+	return guard.NewFromConfig(mw.Config, domain, options...)
+}
+
+// RegisterProxy sends requests that no other route of engine handles to the
+// upstreams in the proxy.routes of the app that they're for, see package
+// proxy
+func (mw *Middleware) RegisterProxy(engine *gin.Engine) {
+	engine.NoRoute(gin.WrapH(proxy.New(mw.Config)))
+}
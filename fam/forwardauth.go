@@ -0,0 +1,130 @@
+package fam
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/guard"
+	h "fa-middleware/helpers"
+	"fa-middleware/payments"
+
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (mw *Middleware) registerForwardAuth(group *gin.RouterGroup) {
+	// nginx's auth_request always sends GET, but Traefik's ForwardAuth
+	// keeps the method of the original request
+	group.Any("/forward-auth", func(c *gin.Context) {
+		mw.forwardAuth(c)
+	})
+}
+
+// forwardAuth lets reverse proxies check a request against the app's login
+// and subscription state before passing it on. The product, entitlement and
+// role query parameters are required if they're set.
+func (mw *Middleware) forwardAuth(c *gin.Context) {
+	conf := mw.Config()
+	app, ok := getForwardAuthApp(c, conf)
+	if !ok {
+		h.Simple404(c)
+		return
+	}
+
+	g := guard.New(app)
+	identity, failure := g.Check(c.Request, guard.Requirement{
+		Product:     c.Query("product"),
+		Entitlement: c.Query("entitlement"),
+		Role:        c.Query("role"),
+	})
+	if failure != nil {
+		respondForwardAuthFailure(c, app, *failure)
+		return
+	}
+
+	entitlements, err := payments.GetEntitlements(app, identity.User)
+	if err != nil {
+		log.Printf(
+			"forward-auth: failed to get entitlements of user %v: %v",
+			identity.User.Id,
+			err.Error(),
+		)
+		h.Simple500(c)
+		return
+	}
+
+	guard.SetIdentityHeaders(c.Writer.Header(), identity, entitlements)
+	h.Simple200OK(c)
+}
+
+// getForwardAuthApp finds the app that the original request was sent to,
+// via the app query parameter, X-Forwarded-Host or the Host header, in that
+// order
+func getForwardAuthApp(c *gin.Context, conf config.Config) (config.App, bool) {
+	domain := c.Query("app")
+	if domain == "" {
+		domain = c.GetHeader("X-Forwarded-Host")
+	}
+	if domain == "" {
+		domain = c.Request.Host
+	}
+	return conf.GetAppByDomain(domain)
+}
+
+// respondForwardAuthFailure responds with the failure's status, or redirects
+// to the app's login or pricing page if the proxy asked for it with
+// redirect=true. Since nginx only understands 401 and 403 from auth_request,
+// paymentStatus=403 turns 402s into 403s.
+func respondForwardAuthFailure(c *gin.Context, app config.App, failure guard.Failure) {
+	if c.Query("redirect") == "true" {
+		target := ""
+		switch failure.Status {
+		case 401:
+			target = app.ForwardAuth.LoginURL
+		case 402:
+			target = app.ForwardAuth.PricingURL
+		}
+		if target != "" {
+			target = strings.ReplaceAll(target, "{URL}", url.QueryEscape(getForwardedURL(c, app)))
+			c.Redirect(http.StatusFound, target)
+			return
+		}
+	}
+
+	status := failure.Status
+	if status == 402 && c.Query("paymentStatus") == "403" {
+		status = 403
+	}
+	c.JSON(status, guard.Failure{
+		Status:   status,
+		Reason:   failure.Reason,
+		Required: failure.Required,
+	})
+}
+
+// getForwardedURL reconstructs the URL of the original request from the
+// headers that the proxy sets: X-Original-URL is usually set for nginx, and
+// Traefik sets X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Uri. The
+// app's url is used if neither is present.
+func getForwardedURL(c *gin.Context, app config.App) string {
+	originalURL := c.GetHeader("X-Original-URL")
+	if originalURL != "" {
+		return originalURL
+	}
+
+	uri := c.GetHeader("X-Forwarded-Uri")
+	if uri == "" {
+		return app.FullDomainURL
+	}
+	proto := c.GetHeader("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	host := c.GetHeader("X-Forwarded-Host")
+	if host == "" {
+		host = app.Domain
+	}
+	return proto + "://" + host + uri
+}
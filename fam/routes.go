@@ -0,0 +1,492 @@
+package fam
+
+import (
+	"fa-middleware/auth"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+	"fa-middleware/routes"
+
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeCheckoutRoute is where the checkout page of the fake payment provider
+// is registered, followed by the session ID
+const fakeCheckoutRoute = "/fake/checkout/"
+
+func (mw *Middleware) registerPing(group *gin.RouterGroup) {
+	group.GET("/ping", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		c.JSON(200, gin.H{"message": "pong"})
+	})
+}
+
+func (mw *Middleware) registerAuth(group *gin.RouterGroup) {
+	group.OPTIONS("/login", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.POST("/login", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		// check if the user is already logged in
+		jwt := routes.GetJWTFromGin(c, app)
+		if jwt != "" {
+			log.Printf("user is already logged in")
+			user, err := auth.GetUserByJWT(app, jwt)
+			if err != nil {
+				log.Printf("user is already logged in, but failed to get user: %v", err.Error())
+				return
+			}
+
+			if user.Id != "" {
+				c.Data(200, "text/plain", []byte("already logged in"))
+				return
+			}
+		}
+		// user is not logged in, so redirect
+		routes.Login(c, app)
+	})
+	group.OPTIONS("/register", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.POST("/register", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		// check if the user is already logged in
+		jwt := routes.GetJWTFromGin(c, app)
+		if jwt != "" {
+			log.Printf("user is already logged in")
+			user, err := auth.GetUserByJWT(app, jwt)
+			if err != nil {
+				log.Printf("user is already logged in, but failed to get user: %v", err.Error())
+				return
+			}
+
+			if user.Id != "" {
+				c.Data(200, "text/plain", []byte("already logged in"))
+				return
+			}
+		}
+		routes.Register(c, app)
+	})
+	group.OPTIONS("/loggedin", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.GET("/loggedin", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		routes.LoggedIn(c, app, app.FusionAuth.Client)
+	})
+}
+
+func (mw *Middleware) registerProducts(group *gin.RouterGroup) {
+	group.OPTIONS("/products", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.GET("/products", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		products, err := payments.GetProducts(app)
+		if err != nil {
+			log.Printf("/mw/products failure: %v", err.Error())
+			h.Simple500(c)
+			return
+		}
+		c.JSON(200, products)
+	})
+}
+
+func (mw *Middleware) registerCheckout(group *gin.RouterGroup) {
+	group.OPTIONS("/create-checkout-session", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.SetCORSMethods(c)
+		c.Header(h.AccessControlAllowHeaders, h.CORSHeadersJSON)
+		h.Simple200OK(c)
+	})
+	group.POST("/create-checkout-session", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+
+		h.SetCORSMethods(c)
+		c.Header(h.AccessControlAllowHeaders, h.CORSHeadersJSON)
+
+		err = payments.CreateCheckoutSession(c, app, user)
+		if reqErr, ok := err.(payments.CheckoutRequestError); ok {
+			c.Data(400, "text/plain", []byte(reqErr.Reason))
+			return
+		}
+		if err != nil {
+			log.Printf(
+				"failed to create checkout session for user %v: %v",
+				user.Id,
+				err.Error(),
+			)
+			h.Simple500(c)
+			return
+		}
+	})
+	group.OPTIONS("/checkout/session/:id", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.GET("/checkout/session/:id", func(c *gin.Context) {
+		// lets the checkout success page confirm that the payment went through
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		routes.GetCheckoutSession(c, app, user)
+	})
+	group.GET(fakeCheckoutRoute+":id", func(c *gin.Context) {
+		// pays checkout sessions of apps with stripe.provider set to fake
+		routes.FakeCheckout(c, mw.Config())
+	})
+}
+
+func (mw *Middleware) registerSubscriptions(group *gin.RouterGroup) {
+	group.OPTIONS("/substatus", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.GET("/substatus", func(c *gin.Context) {
+		// alllows a logged-in user to check to see if they are subscribed
+		// to a product
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app) // will set the gin response if there's an error
+		if err != nil {
+			return
+		}
+		productID := c.Query("p")
+		if productID == "" { // TODO: add validation that this app contains this product ID
+			c.Data(400, "text/plain", []byte("invalid p value"))
+			return
+		}
+		subscribed, err := payments.IsUserSubscribed(app, user, productID)
+		if err != nil {
+			log.Printf(
+				"failed to check app id %v if user id %v is subscribed to product ID %v: %v",
+				app.FusionAuth.AppID,
+				user.Id,
+				productID,
+				err.Error(),
+			)
+			h.Simple500(c)
+			return
+		}
+		c.Data(200, "text/plain", []byte(fmt.Sprintf("%v", subscribed)))
+	})
+	group.OPTIONS("/subscriptions", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.SetCORSJSONMethods(c)
+		h.Simple200OK(c)
+	})
+	group.GET("/subscriptions", func(c *gin.Context) {
+		// lists the logged-in user's subscriptions to the app's products
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSJSONMethods(c)
+		routes.ListSubscriptions(c, app, user)
+	})
+	group.OPTIONS("/subscriptions/:id/:action", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.SetCORSJSONMethods(c)
+		h.Simple200OK(c)
+	})
+	group.POST("/subscriptions/:id/cancel", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSJSONMethods(c)
+		routes.CancelSubscription(c, app, user)
+	})
+	group.POST("/subscriptions/:id/resume", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSJSONMethods(c)
+		routes.ResumeSubscription(c, app, user)
+	})
+	group.POST("/subscriptions/:id/preview-change", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSJSONMethods(c)
+		routes.PreviewPlanChange(c, app, user)
+	})
+	group.POST("/subscriptions/:id/change", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSJSONMethods(c)
+		routes.ChangePlan(c, app, user)
+	})
+	group.OPTIONS("/invoices", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.GET("/invoices", func(c *gin.Context) {
+		// the logged-in user's invoices and one-time charges
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		routes.ListInvoices(c, app, user)
+	})
+}
+
+func (mw *Middleware) registerData(group *gin.RouterGroup) {
+	group.OPTIONS("/data/:key", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.SetCORSDataMethods(c)
+		h.Simple200OK(c)
+	})
+	group.GET("/data/:key", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSDataMethods(c)
+		routes.GetData(c, app, user)
+	})
+	group.PUT("/data/:key", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSDataMethods(c)
+		routes.PutData(c, app, user)
+	})
+	group.DELETE("/data/:key", func(c *gin.Context) {
+		app, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		h.SetCORSDataMethods(c)
+		routes.DeleteData(c, app, user)
+	})
+}
+
+func (mw *Middleware) registerPrivate(group *gin.RouterGroup) {
+	group.OPTIONS("/private/substatus", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/substatus", func(c *gin.Context) {
+		// enables other api's to check if a user is subscribed
+		sBody := models.SubscriptionStatusCheckBody{} // "value" will hold the product id
+		err := c.Bind(&sBody)
+		if err != nil {
+			h.Simple404(c)
+			return
+		}
+
+		app, user, ok := routes.GetPrivateAppAndUser(
+			c,
+			mw.Config(),
+			sBody.APIKey,
+			sBody.JWT,
+			sBody.UserID,
+		)
+		if !ok {
+			return
+		}
+
+		// check if the user is subscribed now
+		result, err := payments.IsUserSubscribed(app, user, sBody.ProductID)
+		if err != nil {
+			log.Printf(
+				"failed to check if user is subscribed to product %v: %v",
+				sBody.ProductID,
+				err.Error(),
+			)
+			c.Data(400, "text/plain", []byte("failed to check if user is subscribed"))
+			return
+		}
+		c.Data(200, "text/plain", []byte(fmt.Sprintf("%v", result)))
+	})
+	group.OPTIONS("/private/introspect", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/introspect", func(c *gin.Context) {
+		// enables other api's to get everything about a user at once
+		routes.Introspect(c, mw.Config())
+	})
+	group.OPTIONS("/private/data", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/data", func(c *gin.Context) {
+		// enables other api's to read and write a user's data
+		routes.PrivateData(c, mw.Config())
+	})
+	group.OPTIONS("/private/webhooks/failed", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/webhooks/failed", func(c *gin.Context) {
+		// lists outbound webhook deliveries that ran out of retries
+		routes.ListFailedWebhooks(c, mw.Config())
+	})
+	group.OPTIONS("/private/webhooks/redeliver", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/webhooks/redeliver", func(c *gin.Context) {
+		routes.RedeliverWebhooks(c, mw.Config())
+	})
+	group.OPTIONS("/private/jobs/dead", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/jobs/dead", func(c *gin.Context) {
+		// lists background jobs that ran out of attempts, for every app
+		routes.ListDeadJobs(c, mw.Config())
+	})
+	group.OPTIONS("/private/jobs/requeue", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/jobs/requeue", func(c *gin.Context) {
+		routes.RequeueDeadJobs(c, mw.Config())
+	})
+}
+
+func (mw *Middleware) registerWebhooks(group *gin.RouterGroup) {
+	group.POST("/fusionauth/webhook", func(c *gin.Context) {
+		// receives user lifecycle events from fusionauth
+		routes.FusionAuthWebhook(c, mw.Config())
+	})
+	group.POST("/stripe/webhook", func(c *gin.Context) {
+		// receives checkout and invoice events from stripe
+		routes.StripeWebhook(c, mw.Config())
+	})
+}
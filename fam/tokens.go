@@ -0,0 +1,80 @@
+package fam
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/routes"
+	"fa-middleware/tokens"
+
+	"fmt"
+	"log"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/gin-gonic/gin"
+)
+
+func (mw *Middleware) registerTokens(group *gin.RouterGroup) {
+	group.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		// anyone may verify tokens, including frontends
+		jwks, err := tokens.GetJWKS(mw.Config().Global.Tokens)
+		if err != nil {
+			log.Printf("failed to get jwks: %v", err.Error())
+			h.Simple500(c)
+			return
+		}
+		c.Header(h.AccessControlAllowOrigin, "*")
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%v", tokens.JWKSCacheSeconds))
+		c.JSON(200, jwks)
+	})
+	group.OPTIONS("/token", func(c *gin.Context) {
+		_, ok := routes.GetConfigViaRouteOrigin(c, mw.Config())
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		h.Simple200OK(c)
+	})
+	group.GET("/token", func(c *gin.Context) {
+		// signs a token for the logged-in user, which the frontend can pass
+		// on to other services
+		conf := mw.Config()
+		app, ok := routes.GetConfigViaRouteOrigin(c, conf)
+		if !ok {
+			h.Simple404(c)
+			return
+		}
+		user, err := routes.GetUserFromGinJWT(c, app)
+		if err != nil {
+			return
+		}
+		issueToken(c, conf.Global.Tokens, app, user)
+	})
+	group.OPTIONS("/private/token", func(c *gin.Context) {
+		h.Simple200OK(c)
+	})
+	group.POST("/private/token", func(c *gin.Context) {
+		// signs a token for a user on behalf of another api
+		body := models.PrivateUserBody{}
+		err := c.BindJSON(&body)
+		if err != nil {
+			return
+		}
+		conf := mw.Config()
+		app, user, ok := routes.GetPrivateAppAndUser(c, conf, body.APIKey, body.JWT, body.UserID)
+		if !ok {
+			return
+		}
+		issueToken(c, conf.Global.Tokens, app, user)
+	})
+}
+
+func issueToken(c *gin.Context, tokensConfig config.TokensConfig, app config.App, user fusionauth.User) {
+	token, err := tokens.Issue(tokensConfig, app, user)
+	if err != nil {
+		log.Printf("failed to issue token for user %v: %v", user.Id, err.Error())
+		h.Simple500(c)
+		return
+	}
+	c.JSON(200, token)
+}
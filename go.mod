@@ -1,13 +1,13 @@
 module fa-middleware
 
-go 1.15
+go 1.16
 
 require (
 	github.com/FusionAuth/go-client v0.0.0-20210306232522-985334282387
 	github.com/gin-gonic/gin v1.6.3
 	github.com/jackc/pgx/v4 v4.10.1
 	github.com/stripe/stripe-go/v71 v71.48.0
-	github.com/stripe/stripe-go/v72 v72.37.0
+	github.com/stripe/stripe-go/v72 v72.122.0
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	gopkg.in/yaml.v2 v2.2.8
 )
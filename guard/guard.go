@@ -0,0 +1,263 @@
+// Package guard protects the routes of downstream Go services with the
+// middleware's login and subscription state, without calling
+// /mw/private/substatus:
+//
+//	g := guard.New(app)
+//	router.GET("/reports", g.RequireUser(), g.RequireSubscription("prod_xxx"), reports)
+//	http.Handle("/admin", g.HTTP().RequireRole("admin")(adminHandler))
+//
+// The user is read from the app's JWT cookie the same way the /mw routes do
+// it, and subscriptions are checked with payments.IsUserSubscribed, so its
+// cache is shared with the rest of the process. Handlers can read what was
+// resolved with IdentityFromGin or IdentityFromContext.
+package guard
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	"fa-middleware/payments"
+	"fa-middleware/routes"
+
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+// Reasons that are given to failure handlers
+const (
+	ReasonNotLoggedIn          = "not logged in"
+	ReasonSubscriptionRequired = "subscription required"
+	ReasonEntitlementRequired  = "entitlement required"
+	ReasonRoleRequired         = "role required"
+	ReasonAppNotConfigured     = "app is not configured"
+	ReasonFailedToCheckAccess  = "failed to check access"
+)
+
+// redirectURLPlaceholder is replaced by the URL of the request in redirect
+// targets, see WithRedirect
+const redirectURLPlaceholder = "{URL}"
+
+type ctxKey string
+
+// identityKey holds the *Identity on request contexts
+const identityKey ctxKey = "fa-middleware/guard.identity"
+
+// Identity is what a guard resolved about the user of a request. Later
+// guards in the same chain reuse it instead of looking the user up again.
+type Identity struct {
+	App   config.App
+	User  fusionauth.User
+	Roles []string
+
+	// Products maps every product that was checked to whether the user has
+	// access to it
+	Products map[string]bool
+
+	// Entitlements maps every entitlement that was checked to whether the
+	// user has it
+	Entitlements map[string]bool
+}
+
+// Failure is why a request was turned away
+type Failure struct {
+	// Status is 401 if the user isn't logged in, 402 if they lack a
+	// subscription or entitlement, 403 if they lack a role, and 500 if
+	// their access couldn't be checked
+	Status int    `json:"status"`
+	Reason string `json:"error"`
+
+	// Required is the product, entitlement or role that was missing
+	Required string `json:"required,omitempty"`
+}
+
+// FailureHandler responds to a request that was turned away
+type FailureHandler func(w http.ResponseWriter, r *http.Request, failure Failure)
+
+// Guard checks requests against the app's login and subscription state
+type Guard struct {
+	getApp    func() (config.App, bool)
+	onFailure FailureHandler
+	redirects map[int]string
+}
+
+// Option changes how a Guard responds, see New
+type Option func(g *Guard)
+
+// WithFailureHandler responds to every failure with handler, instead of
+// the default JSON body
+func WithFailureHandler(handler FailureHandler) Option {
+	return func(g *Guard) {
+		g.onFailure = handler
+	}
+}
+
+// WithRedirect redirects failures with the given status to target instead
+// of responding with JSON, such as 401 to the login page or 402 to the
+// pricing page. {URL} in target is replaced by the escaped URL of the
+// request, so that the user can be sent back afterwards.
+func WithRedirect(status int, target string) Option {
+	return func(g *Guard) {
+		g.redirects[status] = target
+	}
+}
+
+// New returns a guard for an app whose config doesn't change
+func New(app config.App, options ...Option) *Guard {
+	return newGuard(func() (config.App, bool) { return app, true }, options...)
+}
+
+// NewFromConfig returns a guard for the app with the given domain, which is
+// looked up in the current config on every request so that reloads apply,
+// such as fam.Middleware.Config
+func NewFromConfig(getConfig func() config.Config, domain string, options ...Option) *Guard {
+	return newGuard(func() (config.App, bool) {
+		conf := getConfig()
+		return conf.GetAppByDomain(domain)
+	}, options...)
+}
+
+func newGuard(getApp func() (config.App, bool), options ...Option) *Guard {
+	g := &Guard{
+		getApp:    getApp,
+		onFailure: RespondJSON,
+		redirects: make(map[int]string),
+	}
+	for _, option := range options {
+		option(g)
+	}
+	return g
+}
+
+// RespondJSON is the default failure handler, which responds with the
+// failure's status and the failure as JSON
+func RespondJSON(w http.ResponseWriter, r *http.Request, failure Failure) {
+	body, _ := json.Marshal(failure)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(failure.Status)
+	_, _ = w.Write(body)
+}
+
+// fail responds to a request that was turned away
+func (g *Guard) fail(w http.ResponseWriter, r *http.Request, failure Failure) {
+	target, ok := g.redirects[failure.Status]
+	if !ok {
+		g.onFailure(w, r, failure)
+		return
+	}
+
+	requestURL := *r.URL
+	if requestURL.Host == "" {
+		requestURL.Host = r.Host
+		requestURL.Scheme = "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			requestURL.Scheme = "https"
+		}
+	}
+	target = strings.ReplaceAll(target, redirectURLPlaceholder, url.QueryEscape(requestURL.String()))
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// IdentityFromContext returns the identity that a guard put on a request's
+// context
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(*Identity)
+	return identity, ok
+}
+
+// withIdentity returns the request with the identity on its context
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey, identity))
+}
+
+// Requirement is what a request needs besides a logged-in user. Every field
+// that is set must be met.
+type Requirement struct {
+	Product     string
+	Entitlement string
+	Role        string
+}
+
+// Check resolves the user of a request, reusing the identity of an earlier
+// guard for the same app, and checks the requirement. The identity is
+// returned even if the check fails, as long as the user is logged in. Unlike
+// the middleware, Check doesn't respond to the request, so that callers can
+// turn failures into their own responses.
+func (g *Guard) Check(r *http.Request, req Requirement) (*Identity, *Failure) {
+	app, ok := g.getApp()
+	if !ok {
+		log.Printf("guard: the app is not configured")
+		return nil, &Failure{Status: 500, Reason: ReasonAppNotConfigured}
+	}
+
+	identity, ok := IdentityFromContext(r.Context())
+	if !ok || identity.App.Domain != app.Domain {
+		jwt := routes.GetJWTFromRequest(r, app)
+		if jwt == "" {
+			return nil, &Failure{Status: 401, Reason: ReasonNotLoggedIn}
+		}
+		user, err := auth.GetUserByJWT(app, jwt)
+		if err != nil || user.Id == "" {
+			return nil, &Failure{Status: 401, Reason: ReasonNotLoggedIn}
+		}
+		identity = &Identity{
+			App:          app,
+			User:         user,
+			Roles:        auth.GetRoles(app, user),
+			Products:     make(map[string]bool),
+			Entitlements: make(map[string]bool),
+		}
+	}
+
+	if req.Role != "" && !auth.HasRole(app, identity.User, req.Role) {
+		return identity, &Failure{Status: 403, Reason: ReasonRoleRequired, Required: req.Role}
+	}
+
+	if req.Product != "" {
+		active, ok := identity.Products[req.Product]
+		if !ok {
+			var err error
+			active, err = payments.IsUserSubscribed(app, identity.User, req.Product)
+			if err != nil {
+				log.Printf(
+					"guard: failed to check if user %v is subscribed to product %v: %v",
+					identity.User.Id,
+					req.Product,
+					err.Error(),
+				)
+				return identity, &Failure{Status: 500, Reason: ReasonFailedToCheckAccess}
+			}
+			identity.Products[req.Product] = active
+		}
+		if !active {
+			return identity, &Failure{Status: 402, Reason: ReasonSubscriptionRequired, Required: req.Product}
+		}
+	}
+
+	if req.Entitlement != "" {
+		entitled, ok := identity.Entitlements[req.Entitlement]
+		if !ok {
+			var err error
+			entitled, err = payments.HasEntitlement(app, identity.User, req.Entitlement)
+			if err != nil {
+				log.Printf(
+					"guard: failed to check if user %v has entitlement %v: %v",
+					identity.User.Id,
+					req.Entitlement,
+					err.Error(),
+				)
+				return identity, &Failure{Status: 500, Reason: ReasonFailedToCheckAccess}
+			}
+			identity.Entitlements[req.Entitlement] = entitled
+		}
+		if !entitled {
+			return identity, &Failure{Status: 402, Reason: ReasonEntitlementRequired, Required: req.Entitlement}
+		}
+	}
+
+	return identity, nil
+}
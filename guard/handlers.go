@@ -0,0 +1,110 @@
+package guard
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GinIdentityKey holds the *Identity in gin contexts
+const GinIdentityKey = "fa-middleware/guard.identity"
+
+// IdentityFromGin returns the identity that a guard put on a gin context
+func IdentityFromGin(c *gin.Context) (*Identity, bool) {
+	value, ok := c.Get(GinIdentityKey)
+	if !ok {
+		return nil, false
+	}
+	identity, ok := value.(*Identity)
+	return identity, ok
+}
+
+// RequireUser only lets logged-in users through
+func (g *Guard) RequireUser() gin.HandlerFunc {
+	return g.Require(Requirement{})
+}
+
+// RequireSubscription only lets users through that have access to a
+// product, through a subscription or a one-time purchase
+func (g *Guard) RequireSubscription(productID string) gin.HandlerFunc {
+	return g.Require(Requirement{Product: productID})
+}
+
+// RequireEntitlement only lets users through that have access to a product
+// that grants an entitlement
+func (g *Guard) RequireEntitlement(entitlement string) gin.HandlerFunc {
+	return g.Require(Requirement{Entitlement: entitlement})
+}
+
+// RequireRole only lets users through whose registration to the app has a
+// role
+func (g *Guard) RequireRole(role string) gin.HandlerFunc {
+	return g.Require(Requirement{Role: role})
+}
+
+// Require only lets users through that meet every field of req
+func (g *Guard) Require(req Requirement) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, failure := g.Check(c.Request, req)
+		if identity != nil {
+			c.Set(GinIdentityKey, identity)
+			c.Request = withIdentity(c.Request, identity)
+		}
+		if failure != nil {
+			g.fail(c.Writer, c.Request, *failure)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// HTTPGuard has the same checks as Guard as plain net/http middleware
+type HTTPGuard struct {
+	g *Guard
+}
+
+// HTTP returns the net/http version of the guard's middleware
+func (g *Guard) HTTP() HTTPGuard {
+	return HTTPGuard{g: g}
+}
+
+// RequireUser only lets logged-in users through
+func (hg HTTPGuard) RequireUser() func(http.Handler) http.Handler {
+	return hg.Require(Requirement{})
+}
+
+// RequireSubscription only lets users through that have access to a
+// product, through a subscription or a one-time purchase
+func (hg HTTPGuard) RequireSubscription(productID string) func(http.Handler) http.Handler {
+	return hg.Require(Requirement{Product: productID})
+}
+
+// RequireEntitlement only lets users through that have access to a product
+// that grants an entitlement
+func (hg HTTPGuard) RequireEntitlement(entitlement string) func(http.Handler) http.Handler {
+	return hg.Require(Requirement{Entitlement: entitlement})
+}
+
+// RequireRole only lets users through whose registration to the app has a
+// role
+func (hg HTTPGuard) RequireRole(role string) func(http.Handler) http.Handler {
+	return hg.Require(Requirement{Role: role})
+}
+
+// Require only lets users through that meet every field of req
+func (hg HTTPGuard) Require(req Requirement) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, failure := hg.g.Check(r, req)
+			if identity != nil {
+				r = withIdentity(r, identity)
+			}
+			if failure != nil {
+				hg.g.fail(w, r, *failure)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package guard
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Headers that carry an identity to apps behind a proxy, see
+// SetIdentityHeaders
+const (
+	HeaderUserID       = "X-User-Id"
+	HeaderUserEmail    = "X-User-Email"
+	HeaderUserRoles    = "X-User-Roles"
+	HeaderEntitlements = "X-Entitlements"
+)
+
+// IdentityHeaders lists every header that SetIdentityHeaders sets
+var IdentityHeaders = []string{
+	HeaderUserID,
+	HeaderUserEmail,
+	HeaderUserRoles,
+	HeaderEntitlements,
+}
+
+// SetIdentityHeaders describes the user in headers; roles and entitlements
+// are comma-separated
+func SetIdentityHeaders(header http.Header, identity *Identity, entitlements []string) {
+	header.Set(HeaderUserID, identity.User.Id)
+	header.Set(HeaderUserEmail, identity.User.Email)
+	header.Set(HeaderUserRoles, strings.Join(identity.Roles, ","))
+	header.Set(HeaderEntitlements, strings.Join(entitlements, ","))
+}
@@ -1,6 +1,11 @@
 package helpers
 
-import "github.com/gin-gonic/gin"
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
 
 const (
 	NotFound                      = "not found"
@@ -12,7 +17,14 @@ const (
 	AccessControlAllowMethods     = "Access-Control-Allow-Methods"
 	AccessControlAllowOrigin      = "Access-Control-Allow-Origin"
 	AccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	AccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	AccessControlExposeHeaders    = "Access-Control-Expose-Headers"
 	CORSMethodsOptPost            = "OPTIONS, POST"
+	CORSMethodsData               = "OPTIONS, GET, PUT, DELETE"
+	CORSHeadersData               = "Content-Type, If-Match, If-None-Match"
+	CORSExposeHeadersData         = "ETag"
+	CORSMethodsOptGetPost         = "OPTIONS, GET, POST"
+	CORSHeadersJSON               = "Content-Type"
 )
 
 // Simple400 sets a quick and easy 400 gin response
@@ -50,3 +62,32 @@ func Simple200OK(c *gin.Context) {
 func SetCORSMethods(c *gin.Context) {
 	c.Header(AccessControlAllowMethods, CORSMethodsOptPost)
 }
+
+// SetCORSDataMethods sets the CORS headers for the user data endpoints, which
+// use conditional requests and ETags for optimistic concurrency
+func SetCORSDataMethods(c *gin.Context) {
+	c.Header(AccessControlAllowMethods, CORSMethodsData)
+	c.Header(AccessControlAllowHeaders, CORSHeadersData)
+	c.Header(AccessControlExposeHeaders, CORSExposeHeadersData)
+}
+
+// SetCORSJSONMethods sets the CORS headers for endpoints that are read with
+// GET and changed with a JSON POST body
+func SetCORSJSONMethods(c *gin.Context) {
+	c.Header(AccessControlAllowMethods, CORSMethodsOptGetPost)
+	c.Header(AccessControlAllowHeaders, CORSHeadersJSON)
+}
+
+// NewID returns a random version 4 uuid, used for ids that the middleware
+// generates itself such as webhook event ids
+func NewID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand only fails if the os can't provide randomness at all
+		panic(fmt.Sprintf("failed to generate random id: %v", err.Error()))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,221 @@
+// Package jobs runs side effects such as Stripe customer creation and
+// outbound webhook deliveries in the background, so that slow or failing
+// third party calls don't delay requests and are retried instead of only
+// being logged.
+package jobs
+
+import (
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxAttempts is how many times a job is attempted before it is
+	// dead-lettered, unless it is enqueued with a different limit
+	DefaultMaxAttempts = 8
+
+	// RetryBaseDelay is the delay before the first retry; every retry after
+	// that waits twice as long as the previous one, up to RetryMaxDelay
+	RetryBaseDelay = time.Second * 30
+	RetryMaxDelay  = time.Hour * 6
+
+	// DefaultWorkers is the size of the worker pool when
+	// GlobalConfig.JobWorkers is not set
+	DefaultWorkers = 4
+
+	// PollInterval is how often each idle worker checks for due jobs
+	PollInterval = time.Second * 2
+
+	// claimLease is how long a claimed job is hidden from other workers; a
+	// job that is still running after this long may be run twice
+	claimLease = time.Minute * 5
+)
+
+// Queue stores jobs until a worker runs them
+type Queue interface {
+	Enqueue(ctx context.Context, job models.Job) error
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]models.Job, error)
+	Complete(ctx context.Context, id string) error
+	// Fail records a failed attempt; a nil retryAt dead-letters the job
+	Fail(ctx context.Context, id string, lastError string, retryAt *time.Time) error
+	ListDead(ctx context.Context, limit int) ([]models.Job, error)
+	// Requeue gives dead jobs a fresh set of attempts, and returns how many
+	// of the ids were dead
+	Requeue(ctx context.Context, ids []string) (int, error)
+}
+
+// Handler runs a single job. Returning an error schedules a retry, or
+// dead-letters the job if it is out of attempts. The job's Attempts field
+// is the number of attempts that were made before this one.
+type Handler func(ctx context.Context, job models.Job) error
+
+var (
+	// Default is the queue used by Enqueue and the workers. It is in-memory
+	// until Initialize is called with the database enabled.
+	Default Queue = NewMemoryQueue()
+
+	handlers   = make(map[string]Handler)
+	handlersMu sync.RWMutex
+)
+
+// Initialize switches Default to the Postgres-backed queue if the database
+// is enabled, so that jobs survive restarts. It should be called once at the
+// beginning of the program, after the store has been initialized.
+func Initialize() {
+	if store.DB != nil {
+		Default = NewPostgresQueue(store.DB)
+	}
+}
+
+// Register sets the handler for a job type. It should be called before the
+// workers are started.
+func Register(jobType string, handler Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[jobType] = handler
+}
+
+// Enqueue adds a job of the given type to the Default queue, to be run as
+// soon as a worker is available. The payload is marshaled to JSON and passed
+// back to the handler as the job's Payload.
+func Enqueue(jobType string, payload interface{}) error {
+	return EnqueueWithAttempts(jobType, payload, DefaultMaxAttempts)
+}
+
+// EnqueueWithAttempts is the same as Enqueue but with a custom number of
+// attempts before the job is dead-lettered
+func EnqueueWithAttempts(jobType string, payload interface{}, maxAttempts int) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %v job payload: %v", jobType, err.Error())
+	}
+
+	return Default.Enqueue(context.Background(), models.Job{
+		ID:          h.NewID(),
+		Type:        jobType,
+		Payload:     data,
+		Status:      store.JobStatusPending,
+		MaxAttempts: maxAttempts,
+		RunAt:       time.Now(),
+	})
+}
+
+// ListDead returns the most recent dead jobs in the Default queue
+func ListDead(limit int) ([]models.Job, error) {
+	return Default.ListDead(context.Background(), limit)
+}
+
+// Requeue gives dead jobs in the Default queue a fresh set of attempts
+func Requeue(ids []string) (int, error) {
+	return Default.Requeue(context.Background(), ids)
+}
+
+// RetryDelay returns how long to wait after a failed attempt before trying
+// again, doubling each time
+func RetryDelay(attempt int) time.Duration {
+	delay := time.Duration(float64(RetryBaseDelay) * math.Pow(2, float64(attempt-1)))
+	if delay > RetryMaxDelay || delay <= 0 {
+		return RetryMaxDelay
+	}
+	return delay
+}
+
+// StartWorkers starts a pool of workers that run jobs from the Default
+// queue. It returns immediately.
+func StartWorkers(count int) {
+	if count <= 0 {
+		count = DefaultWorkers
+	}
+	for i := 0; i < count; i++ {
+		go runWorker(Default)
+	}
+	log.Printf("started %v job workers", count)
+}
+
+func runWorker(queue Queue) {
+	for {
+		jobs, err := queue.Claim(context.Background(), 1, claimLease)
+		if err != nil {
+			log.Printf("job worker: %v", err.Error())
+		}
+		if len(jobs) == 0 {
+			time.Sleep(PollInterval)
+			continue
+		}
+		for _, job := range jobs {
+			runJob(queue, job)
+		}
+	}
+}
+
+func runJob(queue Queue, job models.Job) {
+	ctx := context.Background()
+
+	handlersMu.RLock()
+	handler, ok := handlers[job.Type]
+	handlersMu.RUnlock()
+
+	var err error
+	if !ok {
+		err = fmt.Errorf("no handler is registered for job type %v", job.Type)
+	} else {
+		err = safeRun(ctx, handler, job)
+	}
+
+	if err == nil {
+		err = queue.Complete(ctx, job.ID)
+		if err != nil {
+			log.Printf("job worker: %v", err.Error())
+		}
+		return
+	}
+
+	attempts := job.Attempts + 1
+	var retryAt *time.Time
+	if ok && attempts < job.MaxAttempts {
+		next := time.Now().Add(RetryDelay(attempts))
+		retryAt = &next
+		log.Printf(
+			"%v job %v failed (attempt %v of %v), retrying at %v: %v",
+			job.Type,
+			job.ID,
+			attempts,
+			job.MaxAttempts,
+			next.Format(time.RFC3339),
+			err.Error(),
+		)
+	} else {
+		log.Printf(
+			"%v job %v failed (attempt %v of %v), dead-lettering: %v",
+			job.Type,
+			job.ID,
+			attempts,
+			job.MaxAttempts,
+			err.Error(),
+		)
+	}
+
+	failErr := queue.Fail(ctx, job.ID, err.Error(), retryAt)
+	if failErr != nil {
+		log.Printf("job worker: %v", failErr.Error())
+	}
+}
+
+// safeRun keeps a panicking handler from taking down the worker
+func safeRun(ctx context.Context, handler Handler, job models.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
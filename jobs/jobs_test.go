@@ -0,0 +1,21 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for attempt, expected := range map[int]time.Duration{
+		1:    30 * time.Second,
+		2:    time.Minute,
+		3:    2 * time.Minute,
+		10:   256 * time.Minute,
+		11:   RetryMaxDelay,
+		1000: RetryMaxDelay,
+	} {
+		if delay := RetryDelay(attempt); delay != expected {
+			t.Errorf("attempt %v: expected %v, got %v", attempt, expected, delay)
+		}
+	}
+}
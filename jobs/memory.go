@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxMemoryDeadJobs is how many dead jobs a MemoryQueue keeps; the oldest
+// ones are forgotten first. Finished jobs are forgotten right away.
+const maxMemoryDeadJobs = 1000
+
+// MemoryQueue is a Queue that only lives in memory, used when the database
+// isn't enabled. Jobs are lost on restart.
+type MemoryQueue struct {
+	mu   sync.Mutex
+	jobs map[string]*models.Job
+}
+
+// NewMemoryQueue returns an empty in-memory Queue
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{jobs: make(map[string]*models.Job)}
+}
+
+func (queue *MemoryQueue) Enqueue(ctx context.Context, job models.Job) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := time.Now()
+	job.Status = store.JobStatusPending
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	queue.jobs[job.ID] = &job
+	return nil
+}
+
+func (queue *MemoryQueue) Claim(ctx context.Context, limit int, lease time.Duration) ([]models.Job, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := time.Now()
+	due := []*models.Job{}
+	for _, job := range queue.jobs {
+		if job.Status == store.JobStatusPending && !job.RunAt.After(now) {
+			due = append(due, job)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].RunAt.Before(due[j].RunAt)
+	})
+
+	claimed := []models.Job{}
+	for i := 0; i < len(due) && i < limit; i++ {
+		due[i].RunAt = now.Add(lease)
+		claimed = append(claimed, *due[i])
+	}
+	return claimed, nil
+}
+
+func (queue *MemoryQueue) Complete(ctx context.Context, id string) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	delete(queue.jobs, id)
+	return nil
+}
+
+func (queue *MemoryQueue) Fail(ctx context.Context, id string, lastError string, retryAt *time.Time) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	job, ok := queue.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %v not found", id)
+	}
+	job.Attempts++
+	job.LastError = lastError
+	job.UpdatedAt = time.Now()
+	if retryAt == nil {
+		job.Status = store.JobStatusDead
+		queue.pruneDead()
+		return nil
+	}
+	job.RunAt = *retryAt
+	return nil
+}
+
+func (queue *MemoryQueue) ListDead(ctx context.Context, limit int) ([]models.Job, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	dead := []models.Job{}
+	for _, job := range queue.jobs {
+		if job.Status == store.JobStatusDead {
+			dead = append(dead, *job)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].UpdatedAt.After(dead[j].UpdatedAt)
+	})
+	if len(dead) > limit {
+		dead = dead[:limit]
+	}
+	return dead, nil
+}
+
+func (queue *MemoryQueue) Requeue(ctx context.Context, ids []string) (int, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, id := range ids {
+		job, ok := queue.jobs[id]
+		if !ok || job.Status != store.JobStatusDead {
+			continue
+		}
+		job.Status = store.JobStatusPending
+		job.Attempts = 0
+		job.LastError = ""
+		job.RunAt = now
+		job.UpdatedAt = now
+		count++
+	}
+	return count, nil
+}
+
+// pruneDead forgets the oldest dead jobs beyond maxMemoryDeadJobs. The
+// caller must hold the lock.
+func (queue *MemoryQueue) pruneDead() {
+	dead := []*models.Job{}
+	for _, job := range queue.jobs {
+		if job.Status == store.JobStatusDead {
+			dead = append(dead, job)
+		}
+	}
+	if len(dead) <= maxMemoryDeadJobs {
+		return
+	}
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].UpdatedAt.After(dead[j].UpdatedAt)
+	})
+	for _, job := range dead[maxMemoryDeadJobs:] {
+		delete(queue.jobs, job.ID)
+	}
+}
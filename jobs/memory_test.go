@@ -0,0 +1,82 @@
+package jobs
+
+import (
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// killJob enqueues a job and dead-letters it right away
+func killJob(t *testing.T, queue *MemoryQueue, id string) {
+	t.Helper()
+	ctx := context.Background()
+	err := queue.Enqueue(ctx, models.Job{ID: id, Type: "test", MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("failed to enqueue: %v", err)
+	}
+	err = queue.Fail(ctx, id, "failed", nil)
+	if err != nil {
+		t.Fatalf("failed to fail: %v", err)
+	}
+}
+
+func TestMemoryQueueRequeue(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+	killJob(t, queue, "dead")
+	err := queue.Enqueue(ctx, models.Job{ID: "pending", Type: "test", RunAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("failed to enqueue: %v", err)
+	}
+
+	count, err := queue.Requeue(ctx, []string{"dead", "pending", "missing"})
+	if err != nil {
+		t.Fatalf("failed to requeue: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected only the dead job to be requeued, got %v", count)
+	}
+
+	claimed, _ := queue.Claim(ctx, 10, time.Minute)
+	if len(claimed) != 1 || claimed[0].ID != "dead" {
+		t.Fatalf("expected the requeued job to be due, got %+v", claimed)
+	}
+	if claimed[0].Status != store.JobStatusPending || claimed[0].Attempts != 0 || claimed[0].LastError != "" {
+		t.Errorf("expected a fresh job, got %+v", claimed[0])
+	}
+}
+
+func TestMemoryQueuePrunesDeadJobs(t *testing.T) {
+	ctx := context.Background()
+	queue := NewMemoryQueue()
+	for i := 0; i <= maxMemoryDeadJobs; i++ {
+		killJob(t, queue, fmt.Sprintf("job-%v", i))
+		// the oldest dead job is pruned first
+		queue.jobs[fmt.Sprintf("job-%v", i)].UpdatedAt = time.Unix(int64(i), 0)
+	}
+	killJob(t, queue, "newest")
+
+	dead, _ := queue.ListDead(ctx, maxMemoryDeadJobs*2)
+	if len(dead) != maxMemoryDeadJobs {
+		t.Fatalf("expected %v dead jobs, got %v", maxMemoryDeadJobs, len(dead))
+	}
+	if dead[0].ID != "newest" {
+		t.Errorf("expected the newest dead job to be kept, got %v", dead[0].ID)
+	}
+	for _, job := range dead {
+		if job.ID == "job-0" || job.ID == "job-1" {
+			t.Errorf("expected %v to be pruned", job.ID)
+		}
+	}
+
+	// finished jobs aren't kept at all
+	_ = queue.Enqueue(ctx, models.Job{ID: "done", Type: "test"})
+	_ = queue.Complete(ctx, "done")
+	if _, ok := queue.jobs["done"]; ok {
+		t.Errorf("expected the finished job to be forgotten")
+	}
+}
@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"context"
+	"time"
+)
+
+// PostgresQueue is a durable Queue backed by the jobs table
+type PostgresQueue struct {
+	db *store.Store
+}
+
+// NewPostgresQueue returns a Queue that stores jobs in db
+func NewPostgresQueue(db *store.Store) *PostgresQueue {
+	return &PostgresQueue{db: db}
+}
+
+func (queue *PostgresQueue) Enqueue(ctx context.Context, job models.Job) error {
+	return queue.db.InsertJob(ctx, job)
+}
+
+func (queue *PostgresQueue) Claim(ctx context.Context, limit int, lease time.Duration) ([]models.Job, error) {
+	return queue.db.ClaimDueJobs(ctx, limit, lease)
+}
+
+func (queue *PostgresQueue) Complete(ctx context.Context, id string) error {
+	return queue.db.CompleteJob(ctx, id)
+}
+
+func (queue *PostgresQueue) Fail(ctx context.Context, id string, lastError string, retryAt *time.Time) error {
+	return queue.db.FailJob(ctx, id, lastError, retryAt)
+}
+
+func (queue *PostgresQueue) ListDead(ctx context.Context, limit int) ([]models.Job, error) {
+	return queue.db.ListDeadJobs(ctx, limit)
+}
+
+func (queue *PostgresQueue) Requeue(ctx context.Context, ids []string) (int, error) {
+	return queue.db.RequeueDeadJobs(ctx, ids)
+}
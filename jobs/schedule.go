@@ -0,0 +1,57 @@
+package jobs
+
+import (
+	"fa-middleware/store"
+
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// ScheduleCheckInterval is how often Every checks whether a periodic task is
+// due
+const ScheduleCheckInterval = time.Minute
+
+var (
+	lastRuns   = make(map[string]time.Time)
+	lastRunsMu sync.Mutex
+)
+
+// Every calls run in the background once per interval, which is read from
+// getInterval before each check so that it follows config reloads. A zero
+// interval pauses the task. When the database is enabled only one instance
+// of the middleware runs the task per interval, so run should usually just
+// enqueue a job. It returns immediately.
+func Every(name string, getInterval func() time.Duration, run func()) {
+	go func() {
+		for {
+			interval := getInterval()
+			if interval > 0 && claimRun(name, interval) {
+				run()
+			}
+			time.Sleep(ScheduleCheckInterval)
+		}
+	}()
+}
+
+// claimRun checks if a periodic task is due, and marks it as running if so
+func claimRun(name string, interval time.Duration) bool {
+	if store.DB != nil {
+		claimed, err := store.DB.ClaimScheduledRun(context.Background(), name, interval)
+		if err != nil {
+			log.Printf("scheduler: %v", err.Error())
+			return false
+		}
+		return claimed
+	}
+
+	lastRunsMu.Lock()
+	defer lastRunsMu.Unlock()
+	lastRun, ok := lastRuns[name]
+	if ok && time.Since(lastRun) < interval {
+		return false
+	}
+	lastRuns[name] = time.Now()
+	return true
+}
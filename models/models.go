@@ -1,5 +1,12 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
 type OauthState struct {
 	State    string `json:"state"`
 	Code     string `json:"code"`
@@ -34,6 +41,21 @@ type RegisterBody struct {
 type StripeProduct struct {
 	ProductID string   `yaml:"productId"`
 	PriceIDs  []string `yaml:"priceIds"`
+
+	// OneTime products are bought with a one-time payment instead of a
+	// subscription. Each purchase grants access for AccessDays, or forever
+	// if AccessDays is 0.
+	OneTime    bool `yaml:"oneTime"`
+	AccessDays int  `yaml:"accessDays"`
+
+	// Entitlements are the names of the features that access to the
+	// product grants, such as "export" or "pro"
+	Entitlements []string `yaml:"entitlements"`
+
+	// Family groups the products that a subscription can be switched
+	// between, such as the tiers of a plan. Without a family, a
+	// subscription can only be switched to another price of its product.
+	Family string `yaml:"family"`
 }
 
 type ProductPrice struct {
@@ -57,6 +79,449 @@ type ProductSummary struct {
 	Prices      []ProductPrice
 }
 
+// CheckoutLineItem is a price and quantity to check out, either requested
+// by the frontend or configured as an app's default line items
+type CheckoutLineItem struct {
+	PriceID  string `json:"priceId" yaml:"priceId"`
+	Quantity int64  `json:"quantity" yaml:"quantity"`
+}
+
+// CheckoutBody is the JSON body of /mw/create-checkout-session. If
+// LineItems is empty, the app's default line items are used.
+type CheckoutBody struct {
+	LineItems []CheckoutLineItem `json:"lineItems"`
+}
+
 type CreateCheckoutSessionResponse struct {
 	SessionID string `json:"id"`
+
+	// URL is the checkout page to send the user to
+	URL string `json:"url,omitempty"`
+}
+
+// CheckoutSessionStatus is the state of a checkout session as shown by
+// /mw/checkout/session/:id, so that a success page can tell whether the
+// payment went through. Products maps each of the app's products in the
+// session to whether the user now has access to it.
+type CheckoutSessionStatus struct {
+	ID             string          `json:"id"`
+	Status         string          `json:"status"`
+	PaymentStatus  string          `json:"paymentStatus"`
+	Mode           string          `json:"mode"`
+	Complete       bool            `json:"complete"`
+	SubscriptionID string          `json:"subscriptionId,omitempty"`
+	Products       map[string]bool `json:"products"`
+}
+
+// IdentityMapping links a FusionAuth user to their Stripe customer for a
+// single app, and is stored in the middleware's own database
+type IdentityMapping struct {
+	UserID           string    `json:"userId"`
+	AppID            string    `json:"appId"`
+	TenantID         string    `json:"tenantId"`
+	StripeCustomerID string    `json:"stripeCustomerId"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// UserDataEntry is a single key/value pair that belongs to a user for an app.
+// The version is incremented on every write and is used for optimistic
+// concurrency.
+type UserDataEntry struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	Version   int64           `json:"version"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// PrivateDataBody is used by other api's to read and write a user's data.
+// Action is one of "get", "put" or "delete". Version is optional, and if it
+// is set, the write only succeeds if it matches the current version.
+type PrivateDataBody struct {
+	APIKey  string          `json:"key"`
+	UserID  string          `json:"userId"`
+	JWT     string          `json:"jwt"`
+	DataKey string          `json:"dataKey"`
+	Action  string          `json:"action"`
+	Value   json.RawMessage `json:"value"`
+	Version int64           `json:"version"`
+}
+
+// WebhookEvent is the JSON body that is sent to an app's outbound webhook
+// endpoints whenever something happens to one of its users
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	AppID     string      `json:"appId"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookEventData is the data of every outbound webhook event. Fields that
+// don't apply to an event type are omitted.
+type WebhookEventData struct {
+	UserID           string `json:"userId"`
+	Email            string `json:"email,omitempty"`
+	StripeCustomerID string `json:"stripeCustomerId,omitempty"`
+	ProductID        string `json:"productId,omitempty"`
+}
+
+// WebhookDelivery tracks the delivery of a single event to a single
+// endpoint. Status is one of "pending", "delivered" or "failed".
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	AppID          string          `json:"appId"`
+	URL            string          `json:"url"`
+	EventID        string          `json:"eventId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	LastError      string          `json:"lastError"`
+	LastStatusCode int             `json:"lastStatusCode"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+// WebhookDeliveriesBody is used by other api's to list failed webhook
+// deliveries and to redeliver them
+type WebhookDeliveriesBody struct {
+	APIKey      string   `json:"key"`
+	DeliveryIDs []string `json:"deliveryIds"`
+}
+
+// DeadJobsBody is used by admins to list dead background jobs and to
+// requeue them
+type DeadJobsBody struct {
+	APIKey string   `json:"key"`
+	JobIDs []string `json:"jobIds"`
+}
+
+// Outbound webhook event types
+const (
+	EventUserRegistered        = "user.registered"
+	EventUserLoggedIn          = "user.logged_in"
+	EventStripeCustomerLinked  = "stripe.customer_linked"
+	EventSubscriptionActivated = "subscription.activated"
+	EventSubscriptionCanceled  = "subscription.canceled"
+	EventPurchaseCompleted     = "purchase.completed"
+	EventTokenIssued           = "token.issued"
+)
+
+// WebhookEventTypes lists every event type that can be sent to an outbound
+// webhook endpoint
+var WebhookEventTypes = []string{
+	EventUserRegistered,
+	EventUserLoggedIn,
+	EventStripeCustomerLinked,
+	EventSubscriptionActivated,
+	EventSubscriptionCanceled,
+	EventPurchaseCompleted,
+	EventTokenIssued,
+}
+
+// FusionAuthWebhookBody is the body of every webhook that FusionAuth sends
+//
+// https://fusionauth.io/docs/v1/tech/events-webhooks/events/
+type FusionAuthWebhookBody struct {
+	Event FusionAuthEvent `json:"event"`
+}
+
+// FusionAuthEvent only contains the fields of the FusionAuth user events
+// that the middleware cares about
+type FusionAuthEvent struct {
+	ID            string                      `json:"id"`
+	Type          string                      `json:"type"`
+	TenantID      string                      `json:"tenantId"`
+	ApplicationID string                      `json:"applicationId"`
+	User          fusionauth.User             `json:"user"`
+	Registration  fusionauth.UserRegistration `json:"registration"`
+}
+
+// Job is a unit of background work, such as propagating a user to Stripe.
+// Status is one of "pending", "done" or "dead"; dead jobs ran out of
+// attempts and are kept around for inspection.
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	RunAt       time.Time       `json:"runAt"`
+	LastError   string          `json:"lastError"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// SubscriptionSummary is a user's Stripe subscription as shown by
+// /mw/subscriptions. Only the items for the app's configured products are
+// included. Times are unix timestamps.
+type SubscriptionSummary struct {
+	ID                 string                    `json:"id"`
+	Status             string                    `json:"status"`
+	CancelAtPeriodEnd  bool                      `json:"cancelAtPeriodEnd"`
+	CancelAt           int64                     `json:"cancelAt,omitempty"`
+	CanceledAt         int64                     `json:"canceledAt,omitempty"`
+	CurrentPeriodStart int64                     `json:"currentPeriodStart"`
+	CurrentPeriodEnd   int64                     `json:"currentPeriodEnd"`
+	Items              []SubscriptionItemSummary `json:"items"`
+}
+
+type SubscriptionItemSummary struct {
+	ID        string `json:"id"`
+	ProductID string `json:"productId"`
+	PriceID   string `json:"priceId"`
+	Quantity  int64  `json:"quantity"`
+}
+
+// CancelSubscriptionBody cancels at the end of the current period unless
+// Immediately is set
+type CancelSubscriptionBody struct {
+	Immediately bool `json:"immediately"`
+}
+
+// ChangePlanBody switches a subscription item to another configured price.
+// ItemID is only needed if the subscription has several items, and
+// ProrationDate should be copied from the preview so that the user is
+// charged exactly what they were shown.
+type ChangePlanBody struct {
+	PriceID       string `json:"priceId"`
+	ItemID        string `json:"itemId"`
+	ProrationDate int64  `json:"prorationDate"`
+}
+
+// PlanChangePreview is the upcoming invoice that a plan change would
+// produce, including the proration lines. Amounts are in the smallest
+// currency unit, such as cents.
+type PlanChangePreview struct {
+	SubscriptionID string               `json:"subscriptionId"`
+	ItemID         string               `json:"itemId"`
+	PriceID        string               `json:"priceId"`
+	ProrationDate  int64                `json:"prorationDate"`
+	Currency       string               `json:"currency"`
+	Subtotal       int64                `json:"subtotal"`
+	Total          int64                `json:"total"`
+	AmountDue      int64                `json:"amountDue"`
+	Lines          []InvoiceLineSummary `json:"lines"`
+}
+
+type InvoiceLineSummary struct {
+	Description string `json:"description"`
+	Amount      int64  `json:"amount"`
+	Proration   bool   `json:"proration"`
+	PeriodStart int64  `json:"periodStart"`
+	PeriodEnd   int64  `json:"periodEnd"`
+}
+
+// BillingHistoryEntry is an invoice or a one-time charge as shown by
+// /mw/invoices. Type is "invoice" or "charge", and Lines only contains the
+// line items for the app's configured products. Amounts are in the smallest
+// currency unit, such as cents.
+type BillingHistoryEntry struct {
+	Type             string               `json:"type"`
+	ID               string               `json:"id"`
+	Number           string               `json:"number,omitempty"`
+	Amount           int64                `json:"amount"`
+	Currency         string               `json:"currency"`
+	Status           string               `json:"status"`
+	Created          int64                `json:"created"`
+	HostedInvoiceURL string               `json:"hostedInvoiceUrl,omitempty"`
+	InvoicePDF       string               `json:"invoicePdf,omitempty"`
+	ReceiptURL       string               `json:"receiptUrl,omitempty"`
+	Lines            []BillingHistoryLine `json:"lines"`
+}
+
+type BillingHistoryLine struct {
+	Description string `json:"description"`
+	ProductID   string `json:"productId"`
+	PriceID     string `json:"priceId"`
+	Quantity    int64  `json:"quantity"`
+	Amount      int64  `json:"amount"`
+}
+
+// BillingHistoryPage is a single page of /mw/invoices. If HasMore is set,
+// the next page is requested with ?before=NextBefore.
+type BillingHistoryPage struct {
+	Entries    []BillingHistoryEntry `json:"entries"`
+	HasMore    bool                  `json:"hasMore"`
+	NextBefore int64                 `json:"nextBefore,omitempty"`
+}
+
+// Purchase is a one-time product that a user paid for, recorded from a
+// completed checkout session or a paid invoice. ExpiresAt is nil for
+// lifetime access.
+type Purchase struct {
+	ID               string     `json:"id"`
+	UserID           string     `json:"userId"`
+	AppID            string     `json:"appId"`
+	StripeCustomerID string     `json:"stripeCustomerId"`
+	ProductID        string     `json:"productId"`
+	PriceID          string     `json:"priceId"`
+	SourceID         string     `json:"sourceId"`
+	PurchasedAt      time.Time  `json:"purchasedAt"`
+	ExpiresAt        *time.Time `json:"expiresAt"`
+	CreatedAt        time.Time  `json:"createdAt"`
+}
+
+// ProductAccess is the access to a one-time product that a user's purchases
+// add up to
+type ProductAccess struct {
+	ProductID string    `json:"productId"`
+	Lifetime  bool      `json:"lifetime"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// Active checks if the access hasn't expired at the given time
+func (access ProductAccess) Active(now time.Time) bool {
+	return access.Lifetime || access.ExpiresAt.After(now)
+}
+
+// DevFixtures seed the in-memory FusionAuth and payment provider of apps in
+// dev mode, see config.AppModeDev
+type DevFixtures struct {
+	Users    []DevUser    `yaml:"users"`
+	Products []DevProduct `yaml:"products"`
+}
+
+// DevUser is a user that exists in dev mode from the start, registered to
+// the app with the given roles
+type DevUser struct {
+	ID        string                 `yaml:"id"` // generated if empty
+	Email     string                 `yaml:"email"`
+	Password  string                 `yaml:"password"`
+	FirstName string                 `yaml:"firstName"`
+	LastName  string                 `yaml:"lastName"`
+	Roles     []string               `yaml:"roles"`
+	Data      map[string]interface{} `yaml:"data"`
+}
+
+// DevProduct overrides how a configured product looks in dev mode, which
+// otherwise is named after its ID and costs $10.00
+type DevProduct struct {
+	ProductID   string     `yaml:"productId"`
+	Name        string     `yaml:"name"`
+	Description string     `yaml:"description"`
+	ImageURL    string     `yaml:"imageUrl"`
+	Prices      []DevPrice `yaml:"prices"`
+}
+
+type DevPrice struct {
+	PriceID    string `yaml:"priceId"`
+	UnitAmount int64  `yaml:"unitAmount"` // in cents
+	Currency   string `yaml:"currency"`   // defaults to usd
+	Interval   string `yaml:"interval"`   // day, week, month or year; empty for one-time prices
+}
+
+// PrivateUserBody is used by private api endpoints that only need to find a
+// user, either via the jwt or via the user id
+type PrivateUserBody struct {
+	APIKey string `json:"key"`
+	UserID string `json:"userId"`
+	JWT    string `json:"jwt"`
+}
+
+// IntrospectResponse is everything that a backend may want to know about a
+// user, as returned by /mw/private/introspect. Subscriptions only include
+// active ones, and products include one-time purchases.
+type IntrospectResponse struct {
+	User             UserProfile           `json:"user"`
+	Roles            []string              `json:"roles"`
+	StripeCustomerID string                `json:"stripeCustomerId"`
+	Subscriptions    []SubscriptionSummary `json:"subscriptions"`
+	Products         []string              `json:"products"`
+	Entitlements     []string              `json:"entitlements"`
+}
+
+// UserProfile is the part of a FusionAuth user that is shared with backends
+type UserProfile struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	Username  string `json:"username"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	FullName  string `json:"fullName"`
+	ImageURL  string `json:"imageUrl"`
+	Verified  bool   `json:"verified"`
+	Active    bool   `json:"active"`
+}
+
+// EntitlementClaims are the claims of the tokens that the middleware signs
+// for downstream services, see package tokens. Times are unix timestamps.
+type EntitlementClaims struct {
+	Issuer       string   `json:"iss"`
+	Subject      string   `json:"sub"` // the FusionAuth user id
+	Audience     string   `json:"aud"` // the FusionAuth application id
+	IssuedAt     int64    `json:"iat"`
+	ExpiresAt    int64    `json:"exp"`
+	Email        string   `json:"email"`
+	Roles        []string `json:"roles"`
+	Products     []string `json:"products"`
+	Entitlements []string `json:"entitlements"`
+}
+
+// HasRole checks if the token's user has a role in the app
+func (claims EntitlementClaims) HasRole(role string) bool {
+	return containsString(claims.Roles, role)
+}
+
+// HasProduct checks if the token's user had access to a product when the
+// token was issued
+func (claims EntitlementClaims) HasProduct(productID string) bool {
+	return containsString(claims.Products, productID)
+}
+
+// HasEntitlement checks if the token's user had an entitlement when the
+// token was issued
+func (claims EntitlementClaims) HasEntitlement(entitlement string) bool {
+	return containsString(claims.Entitlements, entitlement)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenResponse is a freshly signed entitlement token
+type TokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// TokenEventData is the data of the token.issued webhook event, which is
+// sent when a user's access changes
+type TokenEventData struct {
+	UserID    string `json:"userId"`
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// JWKS is the set of public keys that entitlement tokens can be verified
+// with, as served by /mw/.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is an RSA public key. N and E are the base64url-encoded modulus and
+// exponent.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// SigningKey is a private key that entitlement tokens are signed with.
+// PrivateKey is PEM-encoded PKCS #8.
+type SigningKey struct {
+	ID         string
+	PrivateKey string
+	CreatedAt  time.Time
 }
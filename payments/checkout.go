@@ -0,0 +1,116 @@
+package payments
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/models"
+
+	"errors"
+	"fmt"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ErrCheckoutSessionNotFound means that the checkout session doesn't exist,
+// or that it wasn't created for the user by the app
+var ErrCheckoutSessionNotFound = errors.New("checkout session not found")
+
+// GetCheckoutSession reports the state of one of the user's checkout
+// sessions, typically from the page that Stripe redirects to afterwards.
+// Since the user has just paid, their cached subscription state is thrown
+// away and checked again for the products in the session, and a paid
+// one-time purchase is recorded right away instead of waiting for the
+// Stripe webhook. A subscription that the session started is reported as
+// subscription.activated.
+func GetCheckoutSession(app config.App, user fusionauth.User, sessionID string) (status models.CheckoutSessionStatus, err error) {
+	custID, err := GetStripeCustomerID(app, user)
+	if err != nil {
+		return status, err
+	}
+
+	provider := GetProvider(app)
+
+	params := &stripe.CheckoutSessionParams{}
+	params.AddExpand("line_items")
+	session, err := provider.GetCheckoutSession(sessionID, params)
+	if isResourceMissing(err) {
+		return status, ErrCheckoutSessionNotFound
+	}
+	if err != nil {
+		return status, fmt.Errorf("failed to get checkout session %v: %v", sessionID, err.Error())
+	}
+
+	// sessions are created with the user as the client reference, but
+	// sessions from elsewhere for the user's customer are accepted too
+	owned := session.ClientReferenceID == user.Id
+	if !owned && session.ClientReferenceID == "" && custID != "" {
+		owned = session.Customer != nil && session.Customer.ID == custID
+	}
+	appID := session.Metadata[MetadataAppID]
+	if !owned || (appID != "" && appID != app.FusionAuth.AppID) {
+		return status, ErrCheckoutSessionNotFound
+	}
+
+	status = models.CheckoutSessionStatus{
+		ID:            session.ID,
+		Status:        string(session.Status),
+		PaymentStatus: string(session.PaymentStatus),
+		Mode:          string(session.Mode),
+		Complete:      session.Status == stripe.CheckoutSessionStatusComplete,
+		Products:      map[string]bool{},
+	}
+	if session.Subscription != nil {
+		status.SubscriptionID = session.Subscription.ID
+	}
+	if session.Customer != nil && session.Customer.ID != "" {
+		custID = session.Customer.ID
+	}
+
+	items := []purchasedItem{}
+	if session.LineItems != nil {
+		for _, lineItem := range session.LineItems.Data {
+			if lineItem.Price == nil || lineItem.Price.Product == nil ||
+				!isConfiguredProduct(app, lineItem.Price.Product.ID) {
+				continue
+			}
+			status.Products[lineItem.Price.Product.ID] = false
+			item, ok := oneTimeItem(app, lineItem.Price, lineItem.Quantity)
+			if ok {
+				items = append(items, item)
+			}
+		}
+	}
+
+	// the same as the checkout.session.completed event, which won't record
+	// the purchase a second time
+	if session.Mode == stripe.CheckoutSessionModePayment &&
+		session.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid && len(items) > 0 {
+		err = recordItems(app, user, custID, items, session.ID)
+		if err != nil {
+			return status, err
+		}
+	}
+
+	if custID != "" {
+		// the session's subscription didn't exist before the checkout
+		subID := ""
+		if session.Subscription != nil {
+			subID = session.Subscription.ID
+		}
+		changed, err := refreshSubscriptionStates(app, user, custID, subID, nil)
+		if err != nil {
+			return status, err
+		}
+		if changed {
+			NotifyAccessChanged(app, user.Id)
+		}
+	}
+	for productID := range status.Products {
+		subscribed, err := IsUserSubscribed(app, user, productID)
+		if err != nil {
+			return status, err
+		}
+		status.Products[productID] = subscribed
+	}
+	return status, nil
+}
@@ -0,0 +1,56 @@
+package payments
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestCheckoutWithTrialGrantsAccess(t *testing.T) {
+	app, user := newTestApp(t)
+	app.Stripe.Checkout.TrialDays = 14
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(
+		"POST",
+		"/mw/create-checkout-session",
+		strings.NewReader(`{"lineItems": [{"priceId": "`+testPriceID+`"}]}`),
+	)
+	c.Request.Header.Set("Content-Type", "application/json")
+	err := CreateCheckoutSession(c, app, user)
+	if err != nil {
+		t.Fatalf("failed to create checkout session: %v", err)
+	}
+	created := struct {
+		ID string `json:"id"`
+	}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatalf("failed to decode checkout session: %v", err)
+	}
+	session, err := GetFakeProvider(app).CompleteCheckoutSession(app, created.ID)
+	if err != nil {
+		t.Fatalf("failed to complete checkout session: %v", err)
+	}
+	sub, err := GetFakeProvider(app).GetSubscription(session.Subscription.ID)
+	if err != nil {
+		t.Fatalf("failed to get subscription: %v", err)
+	}
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		t.Fatalf("expected the subscription to be trialing, got %v", sub.Status)
+	}
+
+	subscribed, err := IsUserSubscribed(app, user, testProductID)
+	if err != nil || !subscribed {
+		t.Errorf("expected a user in a trial to be subscribed, got %v: %v", subscribed, err)
+	}
+	active, err := GetActiveSubscriptions(app, user)
+	if err != nil || len(active) != 1 {
+		t.Errorf("expected the trial to be an active subscription, got %v: %v", active, err)
+	}
+}
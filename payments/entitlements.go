@@ -0,0 +1,89 @@
+package payments
+
+import (
+	"fa-middleware/config"
+
+	"sort"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+// GetActiveProducts returns the IDs of the app's configured products that a
+// user has access to right now, through a subscription or a one-time
+// purchase
+func GetActiveProducts(app config.App, user fusionauth.User) (productIDs []string, err error) {
+	for _, product := range app.Stripe.Products {
+		active, err := IsUserSubscribed(app, user, product.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		if active {
+			productIDs = append(productIDs, product.ProductID)
+		}
+	}
+	return productIDs, nil
+}
+
+// GetEntitlements returns the sorted names of every entitlement that a
+// user's active products grant
+func GetEntitlements(app config.App, user fusionauth.User) (entitlements []string, err error) {
+	productIDs, err := GetActiveProducts(app, user)
+	if err != nil {
+		return nil, err
+	}
+	return EntitlementsOf(app, productIDs), nil
+}
+
+// EntitlementsOf returns the sorted names of every entitlement that the
+// given products grant
+func EntitlementsOf(app config.App, productIDs []string) (entitlements []string) {
+	granted := make(map[string]bool)
+	for _, productID := range productIDs {
+		product, ok := app.Stripe.GetProduct(productID)
+		if !ok {
+			continue
+		}
+		for _, entitlement := range product.Entitlements {
+			if !granted[entitlement] {
+				granted[entitlement] = true
+				entitlements = append(entitlements, entitlement)
+			}
+		}
+	}
+	sort.Strings(entitlements)
+	return entitlements
+}
+
+// HasEntitlement checks if a user has access to any product that grants an
+// entitlement. Only those products are checked, so this is cheaper than
+// GetEntitlements.
+func HasEntitlement(app config.App, user fusionauth.User, entitlement string) (bool, error) {
+	for _, product := range app.Stripe.GetProductsWithEntitlement(entitlement) {
+		active, err := IsUserSubscribed(app, user, product.ProductID)
+		if err != nil {
+			return false, err
+		}
+		if active {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// accessChangedHooks are called by NotifyAccessChanged
+var accessChangedHooks []func(app config.App, userID string)
+
+// OnAccessChanged registers hook to be called whenever a user may have
+// gained or lost access to something in an app, such as a product or a role.
+// Hooks should be registered at startup, and must not block.
+func OnAccessChanged(hook func(app config.App, userID string)) {
+	accessChangedHooks = append(accessChangedHooks, hook)
+}
+
+// NotifyAccessChanged calls every hook that was registered with
+// OnAccessChanged
+func NotifyAccessChanged(app config.App, userID string) {
+	for _, hook := range accessChangedHooks {
+		hook(app, userID)
+	}
+}
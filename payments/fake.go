@@ -0,0 +1,1028 @@
+package payments
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/charge"
+	checkoutsession "github.com/stripe/stripe-go/v72/checkout/session"
+	"github.com/stripe/stripe-go/v72/customer"
+	"github.com/stripe/stripe-go/v72/form"
+	"github.com/stripe/stripe-go/v72/invoice"
+	"github.com/stripe/stripe-go/v72/sub"
+)
+
+// FakeCheckoutPath is where the checkout sessions of the fake provider are
+// paid, followed by the session ID. It depends on where the routes are
+// mounted, see fam.Middleware.Register.
+var FakeCheckoutPath = "/mw/fake/checkout/"
+
+const (
+	// fakeUnitAmount is the price of the products that the fake provider
+	// creates from the config, in cents
+	fakeUnitAmount = 1000
+	fakeCurrency   = stripe.CurrencyUSD
+)
+
+var (
+	fakeProviders     = make(map[string]*FakeProvider)
+	fakeProvidersLock sync.Mutex
+)
+
+// FakeProvider is a PaymentProvider that keeps everything in memory and
+// never makes a network call. Every product and price in the app's config
+// exists, costing $10.00, and prices are monthly subscriptions unless the
+// product is oneTime; apps in dev mode can describe them differently with
+// product fixtures. Checkout sessions are paid by visiting their URL, see
+// CompleteCheckoutSession.
+//
+// Only the parts of the Stripe API that the middleware uses are
+// implemented, and there are no prorations, taxes or discounts.
+type FakeProvider struct {
+	lock sync.Mutex
+
+	products         map[string]*stripe.Product
+	prices           map[string]*stripe.Price
+	customers        []*stripe.Customer
+	idempotencyKeys  map[string]*stripe.Customer
+	sessions         []*stripe.CheckoutSession
+	sessionLineItems map[string][]*stripe.LineItem
+	sessionParams    map[string]*stripe.CheckoutSessionParams
+	subscriptions    []*stripe.Subscription
+	invoices         []*stripe.Invoice
+	charges          []*stripe.Charge
+}
+
+// GetFakeProvider returns the fake provider of an app, which lives for as
+// long as the middleware runs. Products and prices that were added to the
+// config since the last call are created.
+func GetFakeProvider(app config.App) *FakeProvider {
+	fakeProvidersLock.Lock()
+	fake, ok := fakeProviders[app.Domain]
+	if !ok {
+		fake = NewFakeProvider()
+		fakeProviders[app.Domain] = fake
+	}
+	fakeProvidersLock.Unlock()
+
+	fake.syncCatalog(app)
+	return fake
+}
+
+// NewFakeProvider returns an empty fake provider without any products
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		products:         make(map[string]*stripe.Product),
+		prices:           make(map[string]*stripe.Price),
+		idempotencyKeys:  make(map[string]*stripe.Customer),
+		sessionLineItems: make(map[string][]*stripe.LineItem),
+		sessionParams:    make(map[string]*stripe.CheckoutSessionParams),
+	}
+}
+
+// FindFakeCheckoutSession finds the app whose fake provider created a
+// checkout session
+func FindFakeCheckoutSession(conf config.Config, sessionID string) (app config.App, fake *FakeProvider, ok bool) {
+	for _, app := range conf.Apps {
+		if app.Stripe.Provider != config.PaymentProviderFake {
+			continue
+		}
+		fake := GetFakeProvider(app)
+		fake.lock.Lock()
+		session := fake.findSession(sessionID)
+		fake.lock.Unlock()
+		if session != nil {
+			return app, fake, true
+		}
+	}
+	return app, nil, false
+}
+
+func (fake *FakeProvider) syncCatalog(app config.App) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	for _, configured := range app.Stripe.Products {
+		product, ok := fake.products[configured.ProductID]
+		if !ok {
+			product = &stripe.Product{
+				ID:      configured.ProductID,
+				Object:  "product",
+				Name:    configured.ProductID,
+				Active:  true,
+				Created: time.Now().Unix(),
+			}
+			fake.products[product.ID] = product
+		}
+		for _, priceID := range configured.PriceIDs {
+			if _, ok := fake.prices[priceID]; ok {
+				continue
+			}
+			price := &stripe.Price{
+				ID:                priceID,
+				Object:            "price",
+				Active:            true,
+				Currency:          fakeCurrency,
+				Product:           product,
+				UnitAmount:        fakeUnitAmount,
+				UnitAmountDecimal: fakeUnitAmount,
+				Type:              stripe.PriceTypeOneTime,
+				Created:           time.Now().Unix(),
+			}
+			if !configured.OneTime {
+				price.Type = stripe.PriceTypeRecurring
+				price.Recurring = &stripe.PriceRecurring{
+					Interval:      stripe.PriceRecurringIntervalMonth,
+					IntervalCount: 1,
+				}
+			}
+			fake.prices[priceID] = price
+		}
+	}
+
+	for _, fixture := range app.Dev.Fixtures.Products {
+		fake.applyProductFixture(fixture)
+	}
+}
+
+// applyProductFixture updates a product and its prices to look like a dev
+// mode fixture, creating any that don't exist yet
+func (fake *FakeProvider) applyProductFixture(fixture models.DevProduct) {
+	product, ok := fake.products[fixture.ProductID]
+	if !ok {
+		product = &stripe.Product{
+			ID:      fixture.ProductID,
+			Object:  "product",
+			Active:  true,
+			Created: time.Now().Unix(),
+		}
+		fake.products[product.ID] = product
+	}
+	product.Name = fixture.ProductID
+	if fixture.Name != "" {
+		product.Name = fixture.Name
+	}
+	product.Description = fixture.Description
+	product.Images = nil
+	if fixture.ImageURL != "" {
+		product.Images = []string{fixture.ImageURL}
+	}
+
+	for _, priceFixture := range fixture.Prices {
+		price, ok := fake.prices[priceFixture.PriceID]
+		if !ok {
+			price = &stripe.Price{
+				ID:      priceFixture.PriceID,
+				Object:  "price",
+				Active:  true,
+				Created: time.Now().Unix(),
+			}
+			fake.prices[price.ID] = price
+		}
+		price.Product = product
+		price.Currency = fakeCurrency
+		if priceFixture.Currency != "" {
+			price.Currency = stripe.Currency(strings.ToLower(priceFixture.Currency))
+		}
+		price.UnitAmount = priceFixture.UnitAmount
+		price.UnitAmountDecimal = float64(priceFixture.UnitAmount)
+		price.Type = stripe.PriceTypeOneTime
+		price.Recurring = nil
+		if priceFixture.Interval != "" {
+			price.Type = stripe.PriceTypeRecurring
+			price.Recurring = &stripe.PriceRecurring{
+				Interval:      stripe.PriceRecurringInterval(priceFixture.Interval),
+				IntervalCount: 1,
+			}
+		}
+	}
+}
+
+// AddProduct adds a product and its prices to the fake provider, replacing
+// any that have the same IDs
+func (fake *FakeProvider) AddProduct(product *stripe.Product, prices ...*stripe.Price) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.products[product.ID] = product
+	for _, price := range prices {
+		price.Product = product
+		fake.prices[price.ID] = price
+	}
+}
+
+func fakeID(prefix string) string {
+	return prefix + "_fake" + strings.ReplaceAll(h.NewID(), "-", "")[:20]
+}
+
+// fakeNotFound returns the same error as Stripe does for a missing object
+func fakeNotFound(kind string, id string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %v: '%v'", kind, id),
+	}
+}
+
+func fakeInvalidRequest(format string, args ...interface{}) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		HTTPStatusCode: http.StatusBadRequest,
+		Msg:            fmt.Sprintf(format, args...),
+	}
+}
+
+// fakeList turns a list of objects into a stripe-go iterator with a single
+// page. list is the stripe-go list type that the iterator expects.
+func fakeList(params stripe.ListParamsContainer, list stripe.ListContainer, values []interface{}) *stripe.Iter {
+	return stripe.GetIter(params, func(*stripe.Params, *form.Values) ([]interface{}, stripe.ListContainer, error) {
+		return values, list, nil
+	})
+}
+
+// applyMetadata merges metadata the way Stripe does, where an empty value
+// removes the key
+func applyMetadata(metadata map[string]string, changes map[string]string) map[string]string {
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	for key, value := range changes {
+		if value == "" {
+			delete(metadata, key)
+		} else {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	return applyMetadata(nil, metadata)
+}
+
+func (fake *FakeProvider) findCustomer(id string) *stripe.Customer {
+	for _, cust := range fake.customers {
+		if cust.ID == id {
+			return cust
+		}
+	}
+	return nil
+}
+
+func (fake *FakeProvider) findSession(id string) *stripe.CheckoutSession {
+	for _, session := range fake.sessions {
+		if session.ID == id {
+			return session
+		}
+	}
+	return nil
+}
+
+func (fake *FakeProvider) findSubscription(id string) *stripe.Subscription {
+	for _, subscription := range fake.subscriptions {
+		if subscription.ID == id {
+			return subscription
+		}
+	}
+	return nil
+}
+
+// copyCustomer returns a copy of a customer along with its subscriptions,
+// so that callers can't change the provider's state without locking it
+func (fake *FakeProvider) copyCustomer(cust *stripe.Customer) *stripe.Customer {
+	copied := *cust
+	copied.Metadata = copyMetadata(cust.Metadata)
+	copied.Subscriptions = &stripe.SubscriptionList{Data: []*stripe.Subscription{}}
+	for _, subscription := range fake.subscriptions {
+		if subscription.Customer.ID == cust.ID && subscription.Status != stripe.SubscriptionStatusCanceled {
+			copied.Subscriptions.Data = append(copied.Subscriptions.Data, fake.copySubscription(subscription))
+		}
+	}
+	return &copied
+}
+
+func (fake *FakeProvider) copySubscription(subscription *stripe.Subscription) *stripe.Subscription {
+	copied := *subscription
+	copied.Metadata = copyMetadata(subscription.Metadata)
+	copied.Items = &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{}}
+	for _, item := range subscription.Items.Data {
+		copiedItem := *item
+		copied.Items.Data = append(copied.Items.Data, &copiedItem)
+	}
+	return &copied
+}
+
+func (fake *FakeProvider) copySession(session *stripe.CheckoutSession) *stripe.CheckoutSession {
+	copied := *session
+	copied.Metadata = copyMetadata(session.Metadata)
+	copied.LineItems = &stripe.LineItemList{Data: fake.sessionLineItems[session.ID]}
+	return &copied
+}
+
+func (fake *FakeProvider) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	cust := fake.findCustomer(id)
+	if cust == nil {
+		return nil, fakeNotFound("customer", id)
+	}
+	return fake.copyCustomer(cust), nil
+}
+
+func (fake *FakeProvider) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if params.IdempotencyKey != nil {
+		if existing, ok := fake.idempotencyKeys[*params.IdempotencyKey]; ok {
+			return fake.copyCustomer(existing), nil
+		}
+	}
+
+	cust := &stripe.Customer{
+		ID:       fakeID("cus"),
+		Object:   "customer",
+		Created:  time.Now().Unix(),
+		Metadata: copyMetadata(params.Metadata),
+	}
+	if params.Email != nil {
+		cust.Email = *params.Email
+	}
+	if params.Name != nil {
+		cust.Name = *params.Name
+	}
+	if params.Phone != nil {
+		cust.Phone = *params.Phone
+	}
+	fake.customers = append(fake.customers, cust)
+	if params.IdempotencyKey != nil {
+		fake.idempotencyKeys[*params.IdempotencyKey] = cust
+	}
+	return fake.copyCustomer(cust), nil
+}
+
+func (fake *FakeProvider) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	cust := fake.findCustomer(id)
+	if cust == nil {
+		return nil, fakeNotFound("customer", id)
+	}
+	if params.Email != nil {
+		cust.Email = *params.Email
+	}
+	if params.Name != nil {
+		cust.Name = *params.Name
+	}
+	if params.Phone != nil {
+		cust.Phone = *params.Phone
+	}
+	cust.Metadata = applyMetadata(cust.Metadata, params.Metadata)
+	return fake.copyCustomer(cust), nil
+}
+
+// ListCustomers lists the newest customers first, like Stripe
+func (fake *FakeProvider) ListCustomers(params *stripe.CustomerListParams) *customer.Iter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for i := len(fake.customers) - 1; i >= 0; i-- {
+		cust := fake.customers[i]
+		if params != nil && params.Email != nil && cust.Email != *params.Email {
+			continue
+		}
+		values = append(values, fake.copyCustomer(cust))
+	}
+	return &customer.Iter{Iter: fakeList(params, &stripe.CustomerList{}, values)}
+}
+
+// SearchCustomersByMetadata is always up to date, unlike Stripe's search
+func (fake *FakeProvider) SearchCustomersByMetadata(key string, value string) *customer.SearchIter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for _, cust := range fake.customers {
+		if cust.Metadata[key] == value {
+			values = append(values, fake.copyCustomer(cust))
+		}
+	}
+	params := &stripe.CustomerSearchParams{}
+	return &customer.SearchIter{
+		SearchIter: stripe.GetSearchIter(params, func(*stripe.Params, *form.Values) ([]interface{}, stripe.SearchContainer, error) {
+			return values, &stripe.CustomerSearchResult{}, nil
+		}),
+	}
+}
+
+func (fake *FakeProvider) GetProduct(id string) (*stripe.Product, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	product, ok := fake.products[id]
+	if !ok {
+		return nil, fakeNotFound("product", id)
+	}
+	copied := *product
+	return &copied, nil
+}
+
+func (fake *FakeProvider) GetPrice(id string) (*stripe.Price, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	price, ok := fake.prices[id]
+	if !ok {
+		return nil, fakeNotFound("price", id)
+	}
+	copied := *price
+	return &copied, nil
+}
+
+// NewCheckoutSession creates an open session whose URL is relative to the
+// middleware, see FakeCheckoutPath
+func (fake *FakeProvider) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if params.Customer == nil || fake.findCustomer(*params.Customer) == nil {
+		return nil, fakeInvalidRequest("a customer is required")
+	}
+	if len(params.LineItems) == 0 {
+		return nil, fakeInvalidRequest("line_items must not be empty")
+	}
+	mode := stripe.CheckoutSessionModePayment
+	if params.Mode != nil {
+		mode = stripe.CheckoutSessionMode(*params.Mode)
+	}
+
+	session := &stripe.CheckoutSession{
+		ID:            fakeID("cs"),
+		Object:        "checkout.session",
+		Customer:      &stripe.Customer{ID: *params.Customer},
+		Currency:      fakeCurrency,
+		Livemode:      false,
+		Metadata:      copyMetadata(params.Metadata),
+		Mode:          mode,
+		Status:        stripe.CheckoutSessionStatusOpen,
+		PaymentStatus: stripe.CheckoutSessionPaymentStatusUnpaid,
+	}
+	session.URL = FakeCheckoutPath + session.ID
+	if params.ClientReferenceID != nil {
+		session.ClientReferenceID = *params.ClientReferenceID
+	}
+	if params.SuccessURL != nil {
+		session.SuccessURL = *params.SuccessURL
+	}
+	if params.CancelURL != nil {
+		session.CancelURL = *params.CancelURL
+	}
+
+	lineItems := []*stripe.LineItem{}
+	recurring := false
+	for _, itemParams := range params.LineItems {
+		if itemParams.Price == nil {
+			return nil, fakeInvalidRequest("line items must have a price")
+		}
+		price, ok := fake.prices[*itemParams.Price]
+		if !ok {
+			return nil, fakeNotFound("price", *itemParams.Price)
+		}
+		if !price.Active {
+			return nil, fakeInvalidRequest("price %v is not active", price.ID)
+		}
+		if price.Recurring != nil {
+			recurring = true
+		}
+		quantity := int64(1)
+		if itemParams.Quantity != nil {
+			quantity = *itemParams.Quantity
+		}
+		amount := price.UnitAmount * quantity
+		lineItems = append(lineItems, &stripe.LineItem{
+			ID:             fakeID("li"),
+			Object:         "item",
+			AmountSubtotal: amount,
+			AmountTotal:    amount,
+			Currency:       price.Currency,
+			Description:    price.Product.Name,
+			Price:          price,
+			Quantity:       quantity,
+		})
+		session.AmountSubtotal += amount
+		session.AmountTotal += amount
+	}
+	if mode == stripe.CheckoutSessionModeSubscription && !recurring {
+		return nil, fakeInvalidRequest("subscription mode requires at least one recurring price")
+	}
+	if mode == stripe.CheckoutSessionModePayment && recurring {
+		return nil, fakeInvalidRequest("payment mode does not accept recurring prices")
+	}
+
+	fake.sessions = append(fake.sessions, session)
+	fake.sessionLineItems[session.ID] = lineItems
+	fake.sessionParams[session.ID] = params
+	return fake.copySession(session), nil
+}
+
+func (fake *FakeProvider) GetCheckoutSession(id string, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	session := fake.findSession(id)
+	if session == nil {
+		return nil, fakeNotFound("checkout.session", id)
+	}
+	return fake.copySession(session), nil
+}
+
+func (fake *FakeProvider) ListCheckoutSessions(params *stripe.CheckoutSessionListParams) *checkoutsession.Iter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for i := len(fake.sessions) - 1; i >= 0; i-- {
+		session := fake.sessions[i]
+		if params != nil && params.PaymentIntent != nil &&
+			(session.PaymentIntent == nil || session.PaymentIntent.ID != *params.PaymentIntent) {
+			continue
+		}
+		if params != nil && params.Subscription != nil &&
+			(session.Subscription == nil || session.Subscription.ID != *params.Subscription) {
+			continue
+		}
+		values = append(values, fake.copySession(session))
+	}
+	return &checkoutsession.Iter{Iter: fakeList(params, &stripe.CheckoutSessionList{}, values)}
+}
+
+func (fake *FakeProvider) ListCheckoutSessionLineItems(id string, params *stripe.CheckoutSessionListLineItemsParams) *checkoutsession.LineItemIter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for _, item := range fake.sessionLineItems[id] {
+		values = append(values, item)
+	}
+	return &checkoutsession.LineItemIter{Iter: fakeList(params, &stripe.LineItemList{}, values)}
+}
+
+func (fake *FakeProvider) GetSubscription(id string) (*stripe.Subscription, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	subscription := fake.findSubscription(id)
+	if subscription == nil {
+		return nil, fakeNotFound("subscription", id)
+	}
+	return fake.copySubscription(subscription), nil
+}
+
+// ListSubscriptions leaves out canceled subscriptions unless they are
+// requested with a status of "all" or "canceled", like Stripe
+func (fake *FakeProvider) ListSubscriptions(params *stripe.SubscriptionListParams) *sub.Iter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for i := len(fake.subscriptions) - 1; i >= 0; i-- {
+		subscription := fake.subscriptions[i]
+		if params != nil && params.Customer != "" && subscription.Customer.ID != params.Customer {
+			continue
+		}
+		status := ""
+		if params != nil {
+			status = params.Status
+		}
+		switch status {
+		case "all":
+		case "":
+			if subscription.Status == stripe.SubscriptionStatusCanceled {
+				continue
+			}
+		default:
+			if string(subscription.Status) != status {
+				continue
+			}
+		}
+		values = append(values, fake.copySubscription(subscription))
+	}
+	return &sub.Iter{Iter: fakeList(params, &stripe.SubscriptionList{}, values)}
+}
+
+// UpdateSubscription supports cancelling at the end of the period and
+// switching the price of items
+func (fake *FakeProvider) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	subscription := fake.findSubscription(id)
+	if subscription == nil {
+		return nil, fakeNotFound("subscription", id)
+	}
+	if subscription.Status == stripe.SubscriptionStatusCanceled {
+		return nil, fakeInvalidRequest("subscription %v is canceled", id)
+	}
+
+	for _, itemParams := range params.Items {
+		if itemParams.ID == nil || itemParams.Price == nil {
+			return nil, fakeInvalidRequest("items must have an id and a price")
+		}
+		price, ok := fake.prices[*itemParams.Price]
+		if !ok {
+			return nil, fakeNotFound("price", *itemParams.Price)
+		}
+		if price.Recurring == nil {
+			return nil, fakeInvalidRequest("price %v is not recurring", price.ID)
+		}
+		found := false
+		for _, item := range subscription.Items.Data {
+			if item.ID == *itemParams.ID {
+				item.Price = price
+				item.Plan = fakePlan(price)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fakeNotFound("subscription_item", *itemParams.ID)
+		}
+	}
+	subscription.Plan = subscription.Items.Data[0].Plan
+
+	if params.CancelAtPeriodEnd != nil {
+		subscription.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+		subscription.CancelAt = 0
+		subscription.CanceledAt = 0
+		if subscription.CancelAtPeriodEnd {
+			subscription.CancelAt = subscription.CurrentPeriodEnd
+			subscription.CanceledAt = time.Now().Unix()
+		}
+	}
+	return fake.copySubscription(subscription), nil
+}
+
+func (fake *FakeProvider) CancelSubscription(id string) (*stripe.Subscription, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	subscription := fake.findSubscription(id)
+	if subscription == nil {
+		return nil, fakeNotFound("subscription", id)
+	}
+	now := time.Now().Unix()
+	subscription.Status = stripe.SubscriptionStatusCanceled
+	subscription.CanceledAt = now
+	subscription.EndedAt = now
+	return fake.copySubscription(subscription), nil
+}
+
+// GetUpcomingInvoice returns the next invoice of a subscription, with any
+// items switched to the prices in params.SubscriptionItems. There are no
+// prorations; every item is charged in full for the next period.
+func (fake *FakeProvider) GetUpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if params.Subscription == nil {
+		return nil, fakeInvalidRequest("a subscription is required")
+	}
+	subscription := fake.findSubscription(*params.Subscription)
+	if subscription == nil {
+		return nil, fakeNotFound("subscription", *params.Subscription)
+	}
+
+	inv := &stripe.Invoice{
+		Object:       "invoice",
+		Currency:     fakeCurrency,
+		Customer:     &stripe.Customer{ID: subscription.Customer.ID},
+		Subscription: &stripe.Subscription{ID: subscription.ID},
+		Status:       stripe.InvoiceStatusDraft,
+		Lines:        &stripe.InvoiceLineList{Data: []*stripe.InvoiceLine{}},
+	}
+	periodEnd := fakePeriodEnd(time.Unix(subscription.CurrentPeriodEnd, 0), subscription.Items.Data[0].Price)
+	for _, item := range subscription.Items.Data {
+		price := item.Price
+		for _, itemParams := range params.SubscriptionItems {
+			if itemParams.ID != nil && *itemParams.ID == item.ID && itemParams.Price != nil {
+				changed, ok := fake.prices[*itemParams.Price]
+				if !ok {
+					return nil, fakeNotFound("price", *itemParams.Price)
+				}
+				price = changed
+			}
+		}
+		line := fakeInvoiceLine(price, item.Quantity, subscription.ID)
+		line.Period = &stripe.Period{Start: subscription.CurrentPeriodEnd, End: periodEnd.Unix()}
+		inv.Lines.Data = append(inv.Lines.Data, line)
+		inv.Subtotal += line.Amount
+	}
+	inv.Total = inv.Subtotal
+	inv.AmountDue = inv.Subtotal
+	return inv, nil
+}
+
+// fakeListedInvoiceLines is how many lines of each invoice are included
+// when listing invoices
+const fakeListedInvoiceLines = 10
+
+// ListInvoices lists the newest invoices first, like Stripe
+func (fake *FakeProvider) ListInvoices(params *stripe.InvoiceListParams) *invoice.Iter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for i := len(fake.invoices) - 1; i >= 0; i-- {
+		inv := fake.invoices[i]
+		if params != nil && params.Customer != nil && inv.Customer.ID != *params.Customer {
+			continue
+		}
+		if params != nil && !inCreatedRange(params.CreatedRange, inv.Created) {
+			continue
+		}
+		copied := *inv
+		if inv.Lines != nil && len(inv.Lines.Data) > fakeListedInvoiceLines {
+			// like stripe, only the first lines are included in lists
+			copied.Lines = &stripe.InvoiceLineList{Data: inv.Lines.Data[:fakeListedInvoiceLines]}
+			copied.Lines.HasMore = true
+		}
+		values = append(values, &copied)
+	}
+	return &invoice.Iter{Iter: fakeList(params, &stripe.InvoiceList{}, values)}
+}
+
+func (fake *FakeProvider) ListInvoiceLines(params *stripe.InvoiceLineListParams) *invoice.LineIter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for _, inv := range fake.invoices {
+		if params.ID == nil || inv.ID != *params.ID || inv.Lines == nil {
+			continue
+		}
+		for _, line := range inv.Lines.Data {
+			values = append(values, line)
+		}
+	}
+	return &invoice.LineIter{Iter: fakeList(params, &stripe.InvoiceLineList{}, values)}
+}
+
+// ListCharges lists the newest charges first, like Stripe
+func (fake *FakeProvider) ListCharges(params *stripe.ChargeListParams) *charge.Iter {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	values := []interface{}{}
+	for i := len(fake.charges) - 1; i >= 0; i-- {
+		ch := fake.charges[i]
+		if params != nil && params.Customer != nil && ch.Customer.ID != *params.Customer {
+			continue
+		}
+		if params != nil && !inCreatedRange(params.CreatedRange, ch.Created) {
+			continue
+		}
+		copied := *ch
+		values = append(values, &copied)
+	}
+	return &charge.Iter{Iter: fakeList(params, &stripe.ChargeList{}, values)}
+}
+
+// ParseWebhook checks signatures the same way as Stripe, so that events
+// can be sent to the fake with webhook.GenerateTestSignedPayload
+func (fake *FakeProvider) ParseWebhook(payload []byte, signature string, secret string) (stripe.Event, error) {
+	return parseSignedEvent(payload, signature, secret)
+}
+
+func inCreatedRange(createdRange *stripe.RangeQueryParams, created int64) bool {
+	if createdRange == nil {
+		return true
+	}
+	if createdRange.LesserThan > 0 && created >= createdRange.LesserThan {
+		return false
+	}
+	if createdRange.LesserThanOrEqual > 0 && created > createdRange.LesserThanOrEqual {
+		return false
+	}
+	if createdRange.GreaterThan > 0 && created <= createdRange.GreaterThan {
+		return false
+	}
+	if createdRange.GreaterThanOrEqual > 0 && created < createdRange.GreaterThanOrEqual {
+		return false
+	}
+	return true
+}
+
+func fakePlan(price *stripe.Price) *stripe.Plan {
+	plan := &stripe.Plan{
+		ID:       price.ID,
+		Object:   "plan",
+		Active:   price.Active,
+		Amount:   price.UnitAmount,
+		Currency: price.Currency,
+		Product:  price.Product,
+	}
+	if price.Recurring != nil {
+		plan.Interval = stripe.PlanInterval(price.Recurring.Interval)
+		plan.IntervalCount = price.Recurring.IntervalCount
+	}
+	return plan
+}
+
+// fakePeriodEnd returns the end of a billing period of a recurring price
+// that starts at start
+func fakePeriodEnd(start time.Time, price *stripe.Price) time.Time {
+	if price.Recurring == nil {
+		return start
+	}
+	count := int(price.Recurring.IntervalCount)
+	if count < 1 {
+		count = 1
+	}
+	switch price.Recurring.Interval {
+	case stripe.PriceRecurringIntervalDay:
+		return start.AddDate(0, 0, count)
+	case stripe.PriceRecurringIntervalWeek:
+		return start.AddDate(0, 0, 7*count)
+	case stripe.PriceRecurringIntervalYear:
+		return start.AddDate(count, 0, 0)
+	}
+	return start.AddDate(0, count, 0)
+}
+
+func fakeInvoiceLine(price *stripe.Price, quantity int64, subscriptionID string) *stripe.InvoiceLine {
+	line := &stripe.InvoiceLine{
+		ID:          fakeID("il"),
+		Object:      "line_item",
+		Amount:      price.UnitAmount * quantity,
+		Currency:    price.Currency,
+		Description: fmt.Sprintf("%v × %v", quantity, price.Product.Name),
+		Price:       price,
+		Quantity:    quantity,
+		Type:        stripe.InvoiceLineTypeInvoiceItem,
+	}
+	if price.Recurring != nil {
+		line.Type = stripe.InvoiceLineTypeSubscription
+		line.Subscription = subscriptionID
+		line.Plan = fakePlan(price)
+	}
+	return line
+}
+
+// CompleteCheckoutSession pays an open checkout session, as if the user had
+// gone through Stripe's checkout page. A subscription session starts a
+// subscription with the recurring prices and bills everything on its first
+// invoice, and a payment session creates a charge. The same events that
+// Stripe would send are then queued for the app, so one-time purchases are
+// recorded in the same way.
+func (fake *FakeProvider) CompleteCheckoutSession(app config.App, id string) (*stripe.CheckoutSession, error) {
+	fake.lock.Lock()
+	session := fake.findSession(id)
+	if session == nil {
+		fake.lock.Unlock()
+		return nil, fakeNotFound("checkout.session", id)
+	}
+	if session.Status != stripe.CheckoutSessionStatusOpen {
+		fake.lock.Unlock()
+		return nil, fakeInvalidRequest("checkout session %v is %v", id, session.Status)
+	}
+
+	now := time.Now()
+	params := fake.sessionParams[id]
+	lineItems := fake.sessionLineItems[id]
+	custID := session.Customer.ID
+	session.Status = stripe.CheckoutSessionStatusComplete
+	session.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+
+	var paidInvoice *stripe.Invoice
+	var createdSubscription *stripe.Subscription
+	if session.Mode == stripe.CheckoutSessionModeSubscription {
+		subscription := &stripe.Subscription{
+			ID:                 fakeID("sub"),
+			Object:             "subscription",
+			Created:            now.Unix(),
+			Customer:           &stripe.Customer{ID: custID},
+			Status:             stripe.SubscriptionStatusActive,
+			StartDate:          now.Unix(),
+			CurrentPeriodStart: now.Unix(),
+			Items:              &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{}},
+		}
+		paidInvoice = &stripe.Invoice{
+			ID:           fakeID("in"),
+			Object:       "invoice",
+			Created:      now.Unix(),
+			Currency:     fakeCurrency,
+			Customer:     &stripe.Customer{ID: custID},
+			Subscription: &stripe.Subscription{ID: subscription.ID},
+			Status:       stripe.InvoiceStatusPaid,
+			Paid:         true,
+			Number:       fmt.Sprintf("FAKE-%04d", len(fake.invoices)+1),
+			Lines:        &stripe.InvoiceLineList{Data: []*stripe.InvoiceLine{}},
+		}
+		for _, item := range lineItems {
+			if item.Price.Recurring != nil {
+				subscription.Items.Data = append(subscription.Items.Data, &stripe.SubscriptionItem{
+					ID:       fakeID("si"),
+					Object:   "subscription_item",
+					Created:  now.Unix(),
+					Price:    item.Price,
+					Plan:     fakePlan(item.Price),
+					Quantity: item.Quantity,
+				})
+			}
+			line := fakeInvoiceLine(item.Price, item.Quantity, subscription.ID)
+			paidInvoice.Lines.Data = append(paidInvoice.Lines.Data, line)
+			paidInvoice.Subtotal += line.Amount
+		}
+		first := subscription.Items.Data[0]
+		subscription.Plan = first.Plan
+		subscription.CurrentPeriodEnd = fakePeriodEnd(now, first.Price).Unix()
+		if params != nil && params.SubscriptionData != nil {
+			subscription.Metadata = copyMetadata(params.SubscriptionData.Metadata)
+			if params.SubscriptionData.TrialPeriodDays != nil && *params.SubscriptionData.TrialPeriodDays > 0 {
+				subscription.Status = stripe.SubscriptionStatusTrialing
+				subscription.TrialStart = now.Unix()
+				subscription.TrialEnd = now.AddDate(0, 0, int(*params.SubscriptionData.TrialPeriodDays)).Unix()
+				subscription.CurrentPeriodEnd = subscription.TrialEnd
+			}
+		}
+		for _, line := range paidInvoice.Lines.Data {
+			line.Period = &stripe.Period{Start: now.Unix(), End: subscription.CurrentPeriodEnd}
+		}
+		paidInvoice.Total = paidInvoice.Subtotal
+		paidInvoice.AmountDue = paidInvoice.Subtotal
+		paidInvoice.AmountPaid = paidInvoice.Subtotal
+
+		fake.subscriptions = append(fake.subscriptions, subscription)
+		fake.invoices = append(fake.invoices, paidInvoice)
+		createdSubscription = fake.copySubscription(subscription)
+		session.Subscription = &stripe.Subscription{ID: subscription.ID}
+	} else {
+		intent := &stripe.PaymentIntent{
+			ID:       fakeID("pi"),
+			Object:   "payment_intent",
+			Created:  now.Unix(),
+			Amount:   session.AmountTotal,
+			Currency: string(fakeCurrency),
+			Status:   stripe.PaymentIntentStatusSucceeded,
+		}
+		if params != nil && params.PaymentIntentData != nil {
+			intent.Metadata = copyMetadata(params.PaymentIntentData.Metadata)
+		}
+		fake.charges = append(fake.charges, &stripe.Charge{
+			ID:             fakeID("ch"),
+			Object:         "charge",
+			Created:        now.Unix(),
+			Amount:         session.AmountTotal,
+			AmountCaptured: session.AmountTotal,
+			Captured:       true,
+			Currency:       fakeCurrency,
+			Customer:       &stripe.Customer{ID: custID},
+			Paid:           true,
+			PaymentIntent:  &stripe.PaymentIntent{ID: intent.ID},
+			Status:         stripe.ChargeStatusSucceeded,
+		})
+		session.PaymentIntent = intent
+	}
+	completed := fake.copySession(session)
+	fake.lock.Unlock()
+
+	PurgeCachedCustomer(custID)
+	fake.sendEvent(app, StripeEventCheckoutCompleted, completed)
+	if createdSubscription != nil {
+		fake.sendEvent(app, StripeEventSubscriptionCreated, createdSubscription)
+	}
+	if paidInvoice != nil {
+		fake.sendEvent(app, StripeEventInvoicePaid, paidInvoice)
+	}
+	return completed, nil
+}
+
+// sendEvent queues an event for the app as if the Stripe webhook had
+// received it
+func (fake *FakeProvider) sendEvent(app config.App, eventType string, object interface{}) {
+	if !HandlesStripeEvent(eventType) {
+		return
+	}
+	raw, err := json.Marshal(object)
+	if err != nil {
+		log.Printf("failed to marshal fake %v event: %v", eventType, err.Error())
+		return
+	}
+	err = EnqueueStripeEvent(app, fakeID("evt"), eventType, raw, nil)
+	if err != nil {
+		log.Printf("failed to enqueue fake %v event: %v", eventType, err.Error())
+	}
+}
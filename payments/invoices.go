@@ -0,0 +1,312 @@
+package payments
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/models"
+
+	"fmt"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	// DefaultBillingHistoryLimit is the page size of /mw/invoices when no
+	// limit is requested
+	DefaultBillingHistoryLimit = 20
+	MaxBillingHistoryLimit     = 100
+
+	BillingEntryInvoice = "invoice"
+	BillingEntryCharge  = "charge"
+)
+
+// billingSource yields the billing history entries of a single Stripe list,
+// newest first, and allows looking at the next entry without consuming it
+// so that two sources can be merged
+type billingSource struct {
+	next   func() (*models.BillingHistoryEntry, error)
+	peeked *models.BillingHistoryEntry
+	done   bool
+}
+
+func (src *billingSource) peek() (*models.BillingHistoryEntry, error) {
+	if src.peeked == nil && !src.done {
+		entry, err := src.next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			src.done = true
+		}
+		src.peeked = entry
+	}
+	return src.peeked, nil
+}
+
+func (src *billingSource) pop() {
+	src.peeked = nil
+}
+
+// GetBillingHistory returns a page of the user's invoices and one-time
+// charges, newest first. Only entries that contain one of the app's
+// configured products are included, so that apps sharing a Stripe account
+// don't see each other's purchases; see invoiceEntry for entries that also
+// contain other products. before is a unix timestamp; only
+// entries created before it are returned, or all of them if it's 0.
+//
+// A page can be slightly larger than limit, since entries created in the
+// same second as the last one are always returned together.
+func GetBillingHistory(app config.App, user fusionauth.User, before int64, limit int) (page models.BillingHistoryPage, err error) {
+	page.Entries = []models.BillingHistoryEntry{}
+
+	custID, err := GetStripeCustomerID(app, user)
+	if err != nil {
+		return page, err
+	}
+	if custID == "" {
+		return page, nil
+	}
+
+	provider := GetProvider(app)
+
+	var createdRange *stripe.RangeQueryParams
+	if before > 0 {
+		createdRange = &stripe.RangeQueryParams{LesserThan: before}
+	}
+
+	invoiceParams := &stripe.InvoiceListParams{
+		Customer:     stripe.String(custID),
+		CreatedRange: createdRange,
+	}
+	invoiceParams.Limit = stripe.Int64(int64(limit))
+	invoices := provider.ListInvoices(invoiceParams)
+	invoiceSource := &billingSource{
+		next: func() (*models.BillingHistoryEntry, error) {
+			for invoices.Next() {
+				inv := invoices.Invoice()
+				if inv.Status == stripe.InvoiceStatusDraft {
+					continue
+				}
+				entry, err := invoiceEntry(provider, app, inv)
+				if err != nil {
+					return nil, err
+				}
+				if len(entry.Lines) > 0 {
+					return &entry, nil
+				}
+			}
+			if invoices.Err() != nil {
+				return nil, fmt.Errorf(
+					"failed to list invoices for customer %v: %v",
+					custID,
+					invoices.Err().Error(),
+				)
+			}
+			return nil, nil
+		},
+	}
+
+	chargeParams := &stripe.ChargeListParams{
+		Customer:     stripe.String(custID),
+		CreatedRange: createdRange,
+	}
+	chargeParams.Limit = stripe.Int64(int64(limit))
+	charges := provider.ListCharges(chargeParams)
+	chargeSource := &billingSource{
+		next: func() (*models.BillingHistoryEntry, error) {
+			for charges.Next() {
+				ch := charges.Charge()
+				if ch.Invoice != nil && ch.Invoice.ID != "" {
+					// already listed as part of the invoice
+					continue
+				}
+				entry, err := chargeEntry(provider, app, ch)
+				if err != nil {
+					return nil, err
+				}
+				if len(entry.Lines) > 0 {
+					return &entry, nil
+				}
+			}
+			if charges.Err() != nil {
+				return nil, fmt.Errorf(
+					"failed to list charges for customer %v: %v",
+					custID,
+					charges.Err().Error(),
+				)
+			}
+			return nil, nil
+		},
+	}
+
+	for {
+		nextInvoice, err := invoiceSource.peek()
+		if err != nil {
+			return page, err
+		}
+		nextCharge, err := chargeSource.peek()
+		if err != nil {
+			return page, err
+		}
+
+		source := invoiceSource
+		entry := nextInvoice
+		if entry == nil || (nextCharge != nil && nextCharge.Created > entry.Created) {
+			source = chargeSource
+			entry = nextCharge
+		}
+		if entry == nil {
+			return page, nil
+		}
+
+		count := len(page.Entries)
+		if count >= limit && entry.Created != page.Entries[count-1].Created {
+			page.HasMore = true
+			page.NextBefore = page.Entries[count-1].Created
+			return page, nil
+		}
+
+		page.Entries = append(page.Entries, *entry)
+		source.pop()
+	}
+}
+
+// invoiceEntry converts an invoice, keeping only the lines for the app's
+// products. If the invoice also contains other products, such as those of
+// another app in the same Stripe account, its amount is only the sum of the
+// app's lines, and the urls are left out since the hosted invoice and PDF
+// would show everything.
+func invoiceEntry(provider PaymentProvider, app config.App, inv *stripe.Invoice) (entry models.BillingHistoryEntry, err error) {
+	entry = models.BillingHistoryEntry{
+		Type:             BillingEntryInvoice,
+		ID:               inv.ID,
+		Number:           inv.Number,
+		Amount:           inv.Total,
+		Currency:         string(inv.Currency),
+		Status:           string(inv.Status),
+		Created:          inv.Created,
+		HostedInvoiceURL: inv.HostedInvoiceURL,
+		InvoicePDF:       inv.InvoicePDF,
+		Lines:            []models.BillingHistoryLine{},
+	}
+	if inv.Lines == nil {
+		return entry, nil
+	}
+
+	lines := inv.Lines.Data
+	if inv.Lines.HasMore {
+		// the invoice list only includes the first 10 lines
+		lines, err = listInvoiceLines(provider, inv.ID)
+		if err != nil {
+			return entry, err
+		}
+	}
+
+	mixed := false
+	var amount int64
+	for _, line := range lines {
+		if line.Price == nil || line.Price.Product == nil ||
+			!isConfiguredProduct(app, line.Price.Product.ID) {
+			mixed = true
+			continue
+		}
+		entry.Lines = append(entry.Lines, models.BillingHistoryLine{
+			Description: line.Description,
+			ProductID:   line.Price.Product.ID,
+			PriceID:     line.Price.ID,
+			Quantity:    line.Quantity,
+			Amount:      line.Amount,
+		})
+		amount += line.Amount
+	}
+	if mixed {
+		entry.Amount = amount
+		entry.HostedInvoiceURL = ""
+		entry.InvoicePDF = ""
+	}
+	return entry, nil
+}
+
+// listInvoiceLines retrieves every line of an invoice
+func listInvoiceLines(provider PaymentProvider, invoiceID string) (lines []*stripe.InvoiceLine, err error) {
+	params := &stripe.InvoiceLineListParams{ID: stripe.String(invoiceID)}
+	params.Limit = stripe.Int64(100)
+	iter := provider.ListInvoiceLines(params)
+	for iter.Next() {
+		lines = append(lines, iter.InvoiceLine())
+	}
+	if iter.Err() != nil {
+		return nil, fmt.Errorf(
+			"failed to list lines of invoice %v: %v",
+			invoiceID,
+			iter.Err().Error(),
+		)
+	}
+	return lines, nil
+}
+
+// chargeEntry converts a one-time charge. Charges don't have line items of
+// their own, so the products are taken from the checkout session that
+// created the charge; charges that weren't made through checkout have no
+// lines and are left out. Like invoices, a charge that also paid for other
+// products only has the amount of the app's lines, and no receipt url.
+func chargeEntry(provider PaymentProvider, app config.App, ch *stripe.Charge) (entry models.BillingHistoryEntry, err error) {
+	status := string(ch.Status)
+	if ch.Refunded {
+		status = "refunded"
+	}
+	entry = models.BillingHistoryEntry{
+		Type:       BillingEntryCharge,
+		ID:         ch.ID,
+		Amount:     ch.Amount,
+		Currency:   string(ch.Currency),
+		Status:     status,
+		Created:    ch.Created,
+		ReceiptURL: ch.ReceiptURL,
+		Lines:      []models.BillingHistoryLine{},
+	}
+	if ch.PaymentIntent == nil || ch.PaymentIntent.ID == "" {
+		return entry, nil
+	}
+
+	params := &stripe.CheckoutSessionListParams{
+		PaymentIntent: stripe.String(ch.PaymentIntent.ID),
+	}
+	params.AddExpand("data.line_items")
+	sessions := provider.ListCheckoutSessions(params)
+	mixed := false
+	var amount int64
+	for sessions.Next() {
+		session := sessions.CheckoutSession()
+		if session.LineItems == nil {
+			continue
+		}
+		for _, item := range session.LineItems.Data {
+			if item.Price == nil || item.Price.Product == nil ||
+				!isConfiguredProduct(app, item.Price.Product.ID) {
+				mixed = true
+				continue
+			}
+			entry.Lines = append(entry.Lines, models.BillingHistoryLine{
+				Description: item.Description,
+				ProductID:   item.Price.Product.ID,
+				PriceID:     item.Price.ID,
+				Quantity:    item.Quantity,
+				Amount:      item.AmountTotal,
+			})
+			amount += item.AmountTotal
+		}
+	}
+	if sessions.Err() != nil {
+		return entry, fmt.Errorf(
+			"failed to get checkout session for charge %v: %v",
+			ch.ID,
+			sessions.Err().Error(),
+		)
+	}
+	if mixed {
+		entry.Amount = amount
+		entry.ReceiptURL = ""
+	}
+	return entry, nil
+}
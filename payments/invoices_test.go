@@ -0,0 +1,98 @@
+package payments
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// testLine is an invoice line for a price of the product
+func testLine(productID string, amount int64) *stripe.InvoiceLine {
+	return &stripe.InvoiceLine{
+		ID:          fakeID("il"),
+		Amount:      amount,
+		Description: productID,
+		Quantity:    1,
+		Price:       &stripe.Price{ID: "price_" + productID, Product: &stripe.Product{ID: productID}},
+	}
+}
+
+func TestBillingHistoryOnlyShowsTheAppsShare(t *testing.T) {
+	app, user := newTestApp(t)
+	custID := user.Data[StripeCustomerIDField].(string)
+	fake := GetFakeProvider(app)
+	created := time.Now().Unix()
+
+	// the app's line comes after the ones that are included in the list
+	mixedLines := []*stripe.InvoiceLine{}
+	for i := 0; i < fakeListedInvoiceLines+1; i++ {
+		mixedLines = append(mixedLines, testLine(fmt.Sprintf("prod_other%v", i), 100))
+	}
+	mixedLines = append(mixedLines, testLine(testProductID, 1000))
+
+	fake.lock.Lock()
+	fake.invoices = append(fake.invoices,
+		&stripe.Invoice{
+			ID:               "in_own",
+			Customer:         &stripe.Customer{ID: custID},
+			Status:           stripe.InvoiceStatusPaid,
+			Created:          created - 2,
+			Total:            1190,
+			HostedInvoiceURL: "https://invoice.test/own",
+			InvoicePDF:       "https://invoice.test/own.pdf",
+			Lines:            &stripe.InvoiceLineList{Data: []*stripe.InvoiceLine{testLine(testProductID, 1000)}},
+		},
+		&stripe.Invoice{
+			ID:               "in_mixed",
+			Customer:         &stripe.Customer{ID: custID},
+			Status:           stripe.InvoiceStatusPaid,
+			Created:          created - 1,
+			Total:            2100,
+			HostedInvoiceURL: "https://invoice.test/mixed",
+			InvoicePDF:       "https://invoice.test/mixed.pdf",
+			Lines:            &stripe.InvoiceLineList{Data: mixedLines},
+		},
+	)
+	fake.sessions = append(fake.sessions, &stripe.CheckoutSession{
+		ID:            "cs_mixed",
+		PaymentIntent: &stripe.PaymentIntent{ID: "pi_mixed"},
+	})
+	fake.sessionLineItems["cs_mixed"] = []*stripe.LineItem{
+		{Price: &stripe.Price{ID: testPriceID, Product: &stripe.Product{ID: testProductID}}, Quantity: 1, AmountTotal: 1000},
+		{Price: &stripe.Price{ID: "price_other", Product: &stripe.Product{ID: "prod_other"}}, Quantity: 1, AmountTotal: 500},
+	}
+	fake.charges = append(fake.charges, &stripe.Charge{
+		ID:            "ch_mixed",
+		Customer:      &stripe.Customer{ID: custID},
+		Status:        stripe.ChargeStatusSucceeded,
+		Created:       created,
+		Amount:        1500,
+		ReceiptURL:    "https://receipt.test/mixed",
+		PaymentIntent: &stripe.PaymentIntent{ID: "pi_mixed"},
+	})
+	fake.lock.Unlock()
+
+	page, err := GetBillingHistory(app, user, 0, DefaultBillingHistoryLimit)
+	if err != nil {
+		t.Fatalf("failed to get billing history: %v", err)
+	}
+	if len(page.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", page.Entries)
+	}
+
+	charge, mixed, own := page.Entries[0], page.Entries[1], page.Entries[2]
+	if charge.ID != "ch_mixed" || charge.Amount != 1000 || charge.ReceiptURL != "" || len(charge.Lines) != 1 {
+		t.Errorf("expected only the app's share of the charge, got %+v", charge)
+	}
+	if mixed.ID != "in_mixed" || mixed.Amount != 1000 || mixed.HostedInvoiceURL != "" || mixed.InvoicePDF != "" {
+		t.Errorf("expected only the app's share of the invoice, got %+v", mixed)
+	}
+	if len(mixed.Lines) != 1 || mixed.Lines[0].ProductID != testProductID {
+		t.Errorf("expected the app's line beyond the listed ones, got %+v", mixed.Lines)
+	}
+	if own.ID != "in_own" || own.Amount != 1190 || own.HostedInvoiceURL == "" || own.InvoicePDF == "" {
+		t.Errorf("expected the whole invoice, got %+v", own)
+	}
+}
@@ -0,0 +1,229 @@
+package payments
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+const (
+	// JobTypePropagateCustomer creates the Stripe customer for a user
+	JobTypePropagateCustomer = "stripe.propagate_customer"
+
+	// JobTypeSyncCustomer pushes a user's details to their Stripe customer
+	JobTypeSyncCustomer = "stripe.sync_customer"
+
+	// JobTypeStripeEvent handles an event that was received by the Stripe
+	// webhook
+	JobTypeStripeEvent = "stripe.event"
+
+	// JobTypeReconcile runs Reconcile for a single app
+	JobTypeReconcile = "stripe.reconcile"
+
+	// reconcileMaxAttempts is low since a failed run is repeated at the next
+	// interval anyway
+	reconcileMaxAttempts = 3
+)
+
+// propagateCustomerJob is the payload of a JobTypePropagateCustomer job. The
+// user is retrieved from FusionAuth when the job runs so that the latest
+// user data is used.
+type propagateCustomerJob struct {
+	AppID  string `json:"appId"`
+	UserID string `json:"userId"`
+}
+
+// syncCustomerJob is the payload of a JobTypeSyncCustomer job. The user's
+// details are part of the payload since the user may have been deleted from
+// FusionAuth by the time the job runs.
+type syncCustomerJob struct {
+	AppID      string            `json:"appId"`
+	CustomerID string            `json:"customerId"`
+	UserID     string            `json:"userId"`
+	Email      string            `json:"email"`
+	FullName   string            `json:"fullName"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// stripeEventJob is the payload of a JobTypeStripeEvent job. Data is the
+// event's object, such as a checkout session, and PreviousAttributes are
+// the fields that an update changed.
+type stripeEventJob struct {
+	AppID              string          `json:"appId"`
+	EventID            string          `json:"eventId"`
+	EventType          string          `json:"eventType"`
+	Data               json.RawMessage `json:"data"`
+	PreviousAttributes json.RawMessage `json:"previousAttributes,omitempty"`
+}
+
+// reconcileJob is the payload of a JobTypeReconcile job
+type reconcileJob struct {
+	AppID string `json:"appId"`
+	Fix   bool   `json:"fix"`
+}
+
+// EnqueuePropagateUserToStripe queues PropagateUserToStripe to run in the
+// background so that a slow or failing Stripe API doesn't delay the request,
+// and so that failures are retried
+func EnqueuePropagateUserToStripe(app config.App, user fusionauth.User) error {
+	return jobs.Enqueue(JobTypePropagateCustomer, propagateCustomerJob{
+		AppID:  app.FusionAuth.AppID,
+		UserID: user.Id,
+	})
+}
+
+// EnqueueSyncStripeCustomer queues SyncStripeCustomer to run in the
+// background
+func EnqueueSyncStripeCustomer(app config.App, user fusionauth.User, custID string, extraMetadata map[string]string) error {
+	return jobs.Enqueue(JobTypeSyncCustomer, syncCustomerJob{
+		AppID:      app.FusionAuth.AppID,
+		CustomerID: custID,
+		UserID:     user.Id,
+		Email:      user.Email,
+		FullName:   user.FullName,
+		Metadata:   extraMetadata,
+	})
+}
+
+// EnqueueStripeEvent queues HandleStripeEvent to run in the background, so
+// that the webhook can respond to Stripe right away
+func EnqueueStripeEvent(app config.App, eventID string, eventType string, data json.RawMessage, previousAttributes json.RawMessage) error {
+	return jobs.Enqueue(JobTypeStripeEvent, stripeEventJob{
+		AppID:              app.FusionAuth.AppID,
+		EventID:            eventID,
+		EventType:          eventType,
+		Data:               data,
+		PreviousAttributes: previousAttributes,
+	})
+}
+
+// ScheduleReconcile queues a reconcile job for every app once per
+// global.reconcile.intervalMinutes. It returns immediately.
+func ScheduleReconcile(getConfig func() config.Config) {
+	jobs.Every(
+		JobTypeReconcile,
+		func() time.Duration {
+			return time.Minute * time.Duration(getConfig().Global.Reconcile.IntervalMinutes)
+		},
+		func() {
+			conf := getConfig()
+			for _, app := range conf.Apps {
+				err := jobs.EnqueueWithAttempts(JobTypeReconcile, reconcileJob{
+					AppID: app.FusionAuth.AppID,
+					Fix:   conf.Global.Reconcile.Fix,
+				}, reconcileMaxAttempts)
+				if err != nil {
+					log.Printf("failed to enqueue reconcile job for app %v: %v", app.Domain, err.Error())
+				}
+			}
+		},
+	)
+}
+
+// RegisterJobs registers the handlers for the Stripe jobs. Apps are looked up
+// from the active config when each job runs.
+func RegisterJobs(getConfig func() config.Config) {
+	jobs.Register(JobTypePropagateCustomer, func(ctx context.Context, job models.Job) error {
+		payload := propagateCustomerJob{}
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal job payload: %v", err.Error())
+		}
+
+		conf := getConfig()
+		app, ok := conf.GetConfigForAppID(payload.AppID)
+		if !ok {
+			return fmt.Errorf("app %v is no longer configured", payload.AppID)
+		}
+
+		user, err := auth.GetUserByID(app, payload.UserID)
+		if err != nil {
+			return err
+		}
+
+		_, err = PropagateUserToStripe(app, user)
+		return err
+	})
+
+	jobs.Register(JobTypeSyncCustomer, func(ctx context.Context, job models.Job) error {
+		payload := syncCustomerJob{}
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal job payload: %v", err.Error())
+		}
+
+		conf := getConfig()
+		app, ok := conf.GetConfigForAppID(payload.AppID)
+		if !ok {
+			return fmt.Errorf("app %v is no longer configured", payload.AppID)
+		}
+
+		user := fusionauth.User{
+			Email:    payload.Email,
+			FullName: payload.FullName,
+		}
+		user.Id = payload.UserID
+
+		return SyncStripeCustomer(app, user, payload.CustomerID, payload.Metadata)
+	})
+
+	jobs.Register(JobTypeStripeEvent, func(ctx context.Context, job models.Job) error {
+		payload := stripeEventJob{}
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal job payload: %v", err.Error())
+		}
+
+		conf := getConfig()
+		app, ok := conf.GetConfigForAppID(payload.AppID)
+		if !ok {
+			return fmt.Errorf("app %v is no longer configured", payload.AppID)
+		}
+
+		err = HandleStripeEvent(app, payload.EventType, payload.Data, payload.PreviousAttributes)
+		if err != nil {
+			return fmt.Errorf("failed to handle stripe event %v: %v", payload.EventID, err.Error())
+		}
+		return nil
+	})
+
+	jobs.Register(JobTypeReconcile, func(ctx context.Context, job models.Job) error {
+		payload := reconcileJob{}
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal job payload: %v", err.Error())
+		}
+
+		conf := getConfig()
+		app, ok := conf.GetConfigForAppID(payload.AppID)
+		if !ok {
+			return fmt.Errorf("app %v is no longer configured", payload.AppID)
+		}
+
+		report, err := Reconcile(app, payload.Fix)
+		if err != nil {
+			return err
+		}
+		for _, issue := range report.Issues {
+			log.Printf("reconcile %v: %v", app.Domain, FormatReconcileIssue(issue))
+		}
+		log.Printf(
+			"reconciled %v: %v users, %v customers, %v issue(s), %v unfixed",
+			app.Domain,
+			report.Users,
+			report.Customers,
+			len(report.Issues),
+			report.Unfixed(),
+		)
+		return nil
+	})
+}
@@ -4,21 +4,30 @@ import (
 	"fa-middleware/auth"
 	"fa-middleware/config"
 	"fa-middleware/models"
+	"fa-middleware/store"
+	"fa-middleware/webhooks"
 
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/FusionAuth/go-client/pkg/fusionauth"
 	"github.com/gin-gonic/gin"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
 )
 
 const (
 	CacheExpirationSeconds = 60
 	StripeCustomerIDField  = "stripeCustomerID"
+
+	// Stripe customer metadata keys that tie a customer to FusionAuth
+	MetadataUserID   = "faUserId"
+	MetadataAppID    = "faAppId"
+	MetadataTenantID = "faTenantId"
 )
 
 // CachedUser is the struct that is responsible for what data gets associated
@@ -28,17 +37,45 @@ type CachedUser struct {
 	Subscribed bool
 }
 
-var SubscribedUserCache map[string]CachedUser
+var (
+	// subscribedUserCache is read and written by request handlers, webhook
+	// handlers and job workers at the same time, so every access has to hold
+	// subscribedUserCacheLock
+	subscribedUserCache     = make(map[string]CachedUser)
+	subscribedUserCacheLock sync.RWMutex
+
+	// reportedSubscriptionStates is the last subscription state that was
+	// reported for each customer and product, see reportSubscriptionStates.
+	// It uses the same keys and lock as subscribedUserCache, but is never
+	// purged.
+	reportedSubscriptionStates = make(map[string]bool)
+)
 
-// InitializeSubscribedUserCache should be called once at the beginning of
-// the program so that the cache map can be initialized.
+// InitializeSubscribedUserCache empties the cache, such as at the beginning
+// of the program
 func InitializeSubscribedUserCache() {
-	SubscribedUserCache = make(map[string]CachedUser)
+	subscribedUserCacheLock.Lock()
+	defer subscribedUserCacheLock.Unlock()
+	subscribedUserCache = make(map[string]CachedUser)
+	reportedSubscriptionStates = make(map[string]bool)
+}
+
+// SubscribedUserCache returns a copy of the cached subscription check
+// results. It used to be the cache map itself, which can't be read safely
+// while handlers and jobs write to it, so callers get a snapshot instead.
+func SubscribedUserCache() map[string]CachedUser {
+	subscribedUserCacheLock.RLock()
+	defer subscribedUserCacheLock.RUnlock()
+	snapshot := make(map[string]CachedUser, len(subscribedUserCache))
+	for cacheStr, cachedUser := range subscribedUserCache {
+		snapshot[cacheStr] = cachedUser
+	}
+	return snapshot
 }
 
 // getCustomerProductCacheStr simply builds a value that pairs
 // a Stripe customer ID with the product ID as a string. This value
-// is a string that gets put into the SubscribedUserCache as the key,
+// is a string that gets put into the subscription cache as the key,
 // and the value is a CachedUser (struct).
 //
 // Example: cus_J83zKLOHeJS4kC_prod_J7bo97LpdukduC
@@ -65,17 +102,41 @@ func (cachedUser *CachedUser) IsUserCacheExpired() bool {
 // AddUserToCache adds a Stripe customer & product check result to the
 // in-memory cache with the current time as the cache start time.
 func AddUserToCache(stripeCustID string, stripeProductID string, subState bool) {
+	subscribedUserCacheLock.Lock()
+	defer subscribedUserCacheLock.Unlock()
+	addUserToCacheLocked(stripeCustID, stripeProductID, subState)
+}
+
+// addUserToCacheLocked is AddUserToCache for callers that already hold
+// subscribedUserCacheLock
+func addUserToCacheLocked(stripeCustID string, stripeProductID string, subState bool) {
 	cacheStr := getCustomerProductCacheStr(stripeCustID, stripeProductID)
-	SubscribedUserCache[cacheStr] = CachedUser{
+	subscribedUserCache[cacheStr] = CachedUser{
 		CacheTime:  time.Now(),
 		Subscribed: subState,
 	}
 }
 
+// PurgeCachedCustomer removes every cached subscription check result for a
+// Stripe customer, so that the next check goes to the Stripe API
+func PurgeCachedCustomer(stripeCustID string) {
+	subscribedUserCacheLock.Lock()
+	defer subscribedUserCacheLock.Unlock()
+
+	prefix := getCustomerProductCacheStr(stripeCustID, "")
+	for cacheStr := range subscribedUserCache {
+		if strings.HasPrefix(cacheStr, prefix) {
+			delete(subscribedUserCache, cacheStr)
+		}
+	}
+}
+
 // IsUserSubscribedCached checks if a user is subscribed via cache
 func IsUserSubscribedCached(stripeCustomerID string, stripeProductID string) (bool, bool) {
 	cacheStr := getCustomerProductCacheStr(stripeCustomerID, stripeProductID)
-	cachedUser, ok := SubscribedUserCache[cacheStr]
+	subscribedUserCacheLock.RLock()
+	cachedUser, ok := subscribedUserCache[cacheStr]
+	subscribedUserCacheLock.RUnlock()
 	cacheExpired := cachedUser.IsUserCacheExpired()
 	if !ok || cacheExpired {
 		// the user's cached value has expired, or the user has not yet been
@@ -89,6 +150,56 @@ func IsUserSubscribedCached(stripeCustomerID string, stripeProductID string) (bo
 	return cachedUser.Subscribed, false
 }
 
+// GetStripeCustomerID returns the Stripe customer ID that is linked to a
+// user for an app. The middleware's database is checked first if it's
+// enabled, and otherwise the FusionAuth user data is used. An empty string
+// means the user hasn't been propagated to Stripe yet.
+func GetStripeCustomerID(app config.App, user fusionauth.User) (string, error) {
+	if store.DB != nil {
+		mapping, ok, err := store.DB.GetIdentityMapping(
+			context.Background(),
+			user.Id,
+			app.FusionAuth.AppID,
+		)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return mapping.StripeCustomerID, nil
+		}
+	}
+
+	existingID, _ := user.Data[StripeCustomerIDField].(string)
+
+	// users that were propagated before the database was enabled only have
+	// their customer id in the fusionauth user data, so backfill the mapping
+	if store.DB != nil && existingID != "" {
+		err := saveIdentityMapping(app, user, existingID)
+		if err != nil {
+			log.Printf("failed to backfill identity mapping: %v", err.Error())
+		}
+	}
+
+	return existingID, nil
+}
+
+// saveIdentityMapping records the link between a user and their Stripe
+// customer in the middleware's database, if it's enabled
+func saveIdentityMapping(app config.App, user fusionauth.User, custID string) error {
+	if store.DB == nil {
+		return nil
+	}
+	return store.DB.UpsertIdentityMapping(
+		context.Background(),
+		models.IdentityMapping{
+			UserID:           user.Id,
+			AppID:            app.FusionAuth.AppID,
+			TenantID:         app.FusionAuth.TenantID,
+			StripeCustomerID: custID,
+		},
+	)
+}
+
 // IsUserSubscribed checks if a user is subscribed to a given Stripe productID
 // by first checking the in-memory cache, and if not, it will do an API call
 // to Stripe directly.
@@ -98,10 +209,19 @@ func IsUserSubscribedCached(stripeCustomerID string, stripeProductID string) (bo
 //
 // TODO: The default expiration time for a cached entry is currently hardcoded
 func IsUserSubscribed(conf config.App, user fusionauth.User, productID string) (bool, error) {
-	sc := &client.API{}
-	sc.Init(conf.Stripe.SecretKey, nil)
+	// one-time products are never part of a subscription, so access to
+	// them comes from the user's recorded purchases instead
+	product, ok := conf.Stripe.GetProduct(productID)
+	if ok && product.OneTime {
+		return HasProductAccess(conf, user, productID)
+	}
+
+	provider := GetProvider(conf)
 
-	existingID := user.Data[StripeCustomerIDField].(string)
+	existingID, err := GetStripeCustomerID(conf, user)
+	if err != nil {
+		return false, err
+	}
 	if existingID == "" {
 		log.Printf("user %v is has no customer id", user.Id)
 		return false, nil
@@ -113,36 +233,170 @@ func IsUserSubscribed(conf config.App, user fusionauth.User, productID string) (
 	}
 
 	// query stripe to find the user
+	subs, err := getCustomerSubscriptions(provider, existingID)
+	if err != nil {
+		return false, err
+	}
+	states := subscriptionStates(subs)
+	if reportSubscriptionStates(conf, user, existingID, nil, states) {
+		NotifyAccessChanged(conf, user.Id)
+	}
+	return states[productID], nil
+}
+
+// getCustomerSubscriptions retrieves the subscriptions of a Stripe customer
+// that haven't been canceled yet
+func getCustomerSubscriptions(provider PaymentProvider, custID string) ([]*stripe.Subscription, error) {
 	params := &stripe.CustomerParams{}
 	params.AddExpand("subscriptions")
-	customer, err := sc.Customers.Get(existingID, params)
+	customer, err := provider.GetCustomer(custID, params)
 	if err != nil {
-		return false, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"failed to get customer id %v: %v",
-			existingID,
+			custID,
 			err.Error(),
 		)
 	}
-	if customer.ID != existingID {
-		return false, fmt.Errorf(
+	if customer.ID != custID {
+		return nil, fmt.Errorf(
 			"customer id %v mismatched stripe customer id %v",
-			existingID,
+			custID,
 			customer.ID,
 		)
 	}
-	for _, sub := range customer.Subscriptions.Data {
-		if sub.Plan.Product.ID == productID {
-			isActive := sub.Status == stripe.SubscriptionStatusActive
-			AddUserToCache(
-				existingID,
-				productID,
-				isActive,
-			)
-			return isActive, nil
+	if customer.Subscriptions == nil {
+		return nil, nil
+	}
+	return customer.Subscriptions.Data, nil
+}
+
+// grantsAccess checks if a subscription with the given status gives access
+// to its products. Subscriptions in a free trial do, just like paid ones.
+func grantsAccess(status stripe.SubscriptionStatus) bool {
+	return status == stripe.SubscriptionStatusActive || status == stripe.SubscriptionStatusTrialing
+}
+
+// subscriptionStates returns whether each product in the subscriptions is
+// subscribed to. A product is subscribed to if any subscription that
+// contains it grants access, see grantsAccess.
+func subscriptionStates(subs []*stripe.Subscription) map[string]bool {
+	states := make(map[string]bool)
+	for _, sub := range subs {
+		active := grantsAccess(sub.Status)
+		for _, productID := range subscriptionProductIDs(sub) {
+			states[productID] = states[productID] || active
+		}
+	}
+	return states
+}
+
+// subscriptionProductIDs returns the products of every item of a
+// subscription, or of its plan for subscriptions without expanded items
+func subscriptionProductIDs(sub *stripe.Subscription) (productIDs []string) {
+	if sub.Items != nil {
+		for _, item := range sub.Items.Data {
+			if item.Price != nil && item.Price.Product != nil {
+				productIDs = append(productIDs, item.Price.Product.ID)
+			}
+		}
+	}
+	if len(productIDs) == 0 && sub.Plan != nil && sub.Plan.Product != nil {
+		productIDs = append(productIDs, sub.Plan.Product.ID)
+	}
+	return productIDs
+}
+
+// replaceSubscription returns subs with the subscription that has the same
+// ID as replacement swapped for it, or without it if replacement is nil,
+// so that the states before a change can be worked out
+func replaceSubscription(subs []*stripe.Subscription, id string, replacement *stripe.Subscription) []*stripe.Subscription {
+	replaced := []*stripe.Subscription{}
+	for _, sub := range subs {
+		if sub.ID != id {
+			replaced = append(replaced, sub)
 		}
 	}
-	AddUserToCache(existingID, productID, false)
-	return false, nil
+	if replacement != nil {
+		replaced = append(replaced, replacement)
+	}
+	return replaced
+}
+
+// refreshSubscriptionStates checks a customer's subscriptions again after
+// one of them changed, and reports the changes. previous is the changed
+// subscription as it was before the change, or nil if it was just created;
+// together with the customer's other subscriptions, it gives the states to
+// compare with. It returns whether any of the app's products changed.
+func refreshSubscriptionStates(app config.App, user fusionauth.User, stripeCustID string, changedID string, previous *stripe.Subscription) (changed bool, err error) {
+	PurgeCachedCustomer(stripeCustID)
+	subs, err := getCustomerSubscriptions(GetProvider(app), stripeCustID)
+	if err != nil {
+		return false, err
+	}
+	before := subscriptionStates(replaceSubscription(subs, changedID, previous))
+	return reportSubscriptionStates(app, user, stripeCustID, before, subscriptionStates(subs)), nil
+}
+
+// reportSubscriptionStates caches freshly checked subscription states, and
+// emits subscription.activated or subscription.canceled for every one of
+// the app's products whose state changed.
+//
+// A state changed if it differs from the last state that was reported for
+// the customer and product, which is kept apart from the cache so that
+// purging or expiring the cache doesn't lose it. If nothing was reported
+// yet, such as after a restart, the state is compared with before instead,
+// which is the state from before a change that the caller knows about; a
+// nil before only records the states. It returns whether any state changed,
+// so that callers can notify about the change in access.
+func reportSubscriptionStates(app config.App, user fusionauth.User, stripeCustID string, before map[string]bool, after map[string]bool) bool {
+	// products without a subscription aren't subscribed to
+	states := make(map[string]bool)
+	for _, product := range app.Stripe.Products {
+		if !product.OneTime {
+			states[product.ProductID] = false
+		}
+	}
+	for productID, subscribed := range after {
+		states[productID] = subscribed
+	}
+
+	changed := map[string]bool{}
+
+	// the previous states are read and replaced under the same lock, so that
+	// concurrent checks can't both see the old state and emit twice
+	subscribedUserCacheLock.Lock()
+	for productID, subscribed := range states {
+		addUserToCacheLocked(stripeCustID, productID, subscribed)
+		if !isConfiguredProduct(app, productID) {
+			continue
+		}
+
+		cacheStr := getCustomerProductCacheStr(stripeCustID, productID)
+		previous, ok := reportedSubscriptionStates[cacheStr]
+		if !ok && before != nil {
+			// products missing from before weren't subscribed to
+			previous, ok = before[productID], true
+		}
+		reportedSubscriptionStates[cacheStr] = subscribed
+		if ok && previous != subscribed {
+			changed[productID] = subscribed
+		}
+	}
+	subscribedUserCacheLock.Unlock()
+
+	for productID, subscribed := range changed {
+		eventType := models.EventSubscriptionCanceled
+		if subscribed {
+			eventType = models.EventSubscriptionActivated
+		}
+		webhooks.Emit(app, eventType, models.WebhookEventData{
+			UserID:           user.Id,
+			Email:            user.Email,
+			StripeCustomerID: stripeCustID,
+			ProductID:        productID,
+		})
+	}
+	return len(changed) > 0
 }
 
 // PropagateUserToStripe pushes a user to Stripe via the Stripe API, this is
@@ -150,50 +404,189 @@ func IsUserSubscribed(conf config.App, user fusionauth.User, productID string) (
 // between Stripe and FusionAuth users. Email is the second most reliable
 // correlation, but that can change as well.
 //
-// TODO: Set user ID and other metadata after propagation to Stripe
+// Before a new customer is created, Stripe is searched for a customer that
+// already belongs to the user, so that a failure after a previous
+// Customers.New call (such as failing to save the customer ID to FusionAuth)
+// doesn't leave duplicate customers behind. New customers get the
+// FusionAuth IDs as metadata, and are created with an idempotency key that
+// is derived from the user ID.
 func PropagateUserToStripe(app config.App, user fusionauth.User) (custID string, err error) {
-	sc := &client.API{}
-	sc.Init(app.Stripe.SecretKey, nil)
+	provider := GetProvider(app)
 
-	existingID := user.Data[StripeCustomerIDField]
-	if existingID != nil && existingID.(string) != "" {
-		return existingID.(string), nil
+	existingID, err := GetStripeCustomerID(app, user)
+	if err != nil {
+		return "", err
+	}
+	if existingID != "" {
+		// TODO: validate that the customer's email matches stripe email, and update if needed
+		return existingID, nil
 	}
 
-	// customer probably doesn't exist, so let's try to create a new one in stripe
-	if existingID == nil || existingID.(string) == "" {
-		log.Printf(
-			"user %v customer id is not in fa user data; setting up next...",
-			user.Id,
-		)
-		customer, err := sc.Customers.New(
-			&stripe.CustomerParams{
-				Email: &user.Email,
-				Name:  &user.FullName,
-				Phone: &user.MobilePhone,
-			},
-		)
+	log.Printf(
+		"user %v customer id is not in fa user data; setting up next...",
+		user.Id,
+	)
+
+	customer, err := FindStripeCustomer(provider, user)
+	if err != nil {
+		return "", err
+	}
+
+	if customer != nil {
+		log.Printf("found existing customer id %v for user %v", customer.ID, user.Id)
+		if customer.Metadata[MetadataUserID] != user.Id {
+			// adopt the customer so that it can be found by metadata next time
+			err = SyncStripeCustomer(app, user, customer.ID, nil)
+			if err != nil {
+				return "", err
+			}
+		}
+	} else {
+		params := &stripe.CustomerParams{
+			Email: &user.Email,
+			Name:  &user.FullName,
+			Phone: &user.MobilePhone,
+		}
+		params.AddMetadata(MetadataUserID, user.Id)
+		params.AddMetadata(MetadataAppID, app.FusionAuth.AppID)
+		params.AddMetadata(MetadataTenantID, app.FusionAuth.TenantID)
+		params.SetIdempotencyKey(customerIdempotencyKey(user))
+
+		customer, err = provider.NewCustomer(params)
 		if err != nil {
 			return "", fmt.Errorf("failed to create new customer: %v", err.Error())
 		}
-
-		// push the customer's ID to our db immediately!
 		log.Printf("new customer id %v for user %v", customer.ID, user.Id)
-		err = auth.SetUserData(app, user, "stripeCustomerID", customer.ID)
-		if err != nil {
-			return customer.ID, fmt.Errorf(
-				"failed to push customer id %v to database: %v",
-				customer.ID,
-				err.Error(),
-			)
+	}
+
+	// push the customer's ID to our db immediately!
+	err = saveIdentityMapping(app, user, customer.ID)
+	if err != nil {
+		return customer.ID, fmt.Errorf(
+			"failed to save identity mapping for customer id %v: %v",
+			customer.ID,
+			err.Error(),
+		)
+	}
+	err = auth.SetUserData(app, user, StripeCustomerIDField, customer.ID)
+	if err != nil {
+		return customer.ID, fmt.Errorf(
+			"failed to push customer id %v to fusionauth: %v",
+			customer.ID,
+			err.Error(),
+		)
+	}
+
+	webhooks.Emit(app, models.EventStripeCustomerLinked, models.WebhookEventData{
+		UserID:           user.Id,
+		Email:            user.Email,
+		StripeCustomerID: customer.ID,
+	})
+
+	return customer.ID, nil
+}
+
+// customerIdempotencyKey makes retried Customers.New calls for the same user
+// return the customer that was created by the first call instead of a new
+// one. Stripe keeps idempotency keys for 24 hours. Apps that share a Stripe
+// account also share their users' customers, so the key only depends on the
+// user, just like FindStripeCustomer.
+func customerIdempotencyKey(user fusionauth.User) string {
+	return fmt.Sprintf("fa-middleware-customer-%v", user.Id)
+}
+
+// FindStripeCustomer looks for a Stripe customer that already belongs to a
+// user. Customers with the user's ID in their metadata are preferred, and
+// otherwise a customer with the same email and no FusionAuth user ID of its
+// own is used. If there are several candidates, the oldest one wins. A nil
+// customer means that none was found. The search isn't limited to an app,
+// so every app on the same Stripe account uses the user's one customer, and
+// only sees its own products of it.
+//
+// Stripe's search index can lag behind by up to a minute, which is why new
+// customers are also created with an idempotency key.
+func FindStripeCustomer(provider PaymentProvider, user fusionauth.User) (*stripe.Customer, error) {
+	var found *stripe.Customer
+	pick := func(customer *stripe.Customer) {
+		if customer.Deleted {
+			return
 		}
+		if found == nil || customer.Created < found.Created {
+			found = customer
+		}
+	}
+
+	iter := provider.SearchCustomersByMetadata(MetadataUserID, user.Id)
+	for iter.Next() {
+		pick(iter.Customer())
+	}
+	if iter.Err() != nil {
+		return nil, fmt.Errorf(
+			"failed to search customers for user %v: %v",
+			user.Id,
+			iter.Err().Error(),
+		)
+	}
+	if found != nil || user.Email == "" {
+		return found, nil
+	}
 
-		return customer.ID, nil
+	listParams := &stripe.CustomerListParams{Email: stripe.String(user.Email)}
+	listIter := provider.ListCustomers(listParams)
+	for listIter.Next() {
+		customer := listIter.Customer()
+		ownerID := customer.Metadata[MetadataUserID]
+		if ownerID != "" && ownerID != user.Id {
+			// same email, but it belongs to another fusionauth user
+			continue
+		}
+		pick(customer)
 	}
+	if listIter.Err() != nil {
+		return nil, fmt.Errorf(
+			"failed to list customers by email for user %v: %v",
+			user.Id,
+			listIter.Err().Error(),
+		)
+	}
+
+	return found, nil
+}
 
-	// now the customer DOES exist already, so we don't have to propagate them to Stripe
-	// TODO: validate that the customer's email matches stripe email, and update if needed
-	return custID, nil
+// escapeSearchValue escapes a value for use in a quoted Stripe search query
+//
+// https://stripe.com/docs/search#search-query-language
+func escapeSearchValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+// SyncStripeCustomer pushes a FusionAuth user's current name and email to
+// their Stripe customer, along with the FusionAuth IDs and any extra
+// metadata, such as whether the user is still active
+func SyncStripeCustomer(app config.App, user fusionauth.User, custID string, extraMetadata map[string]string) error {
+	provider := GetProvider(app)
+
+	params := &stripe.CustomerParams{
+		Email: stripe.String(user.Email),
+		Name:  stripe.String(user.FullName),
+	}
+	params.AddMetadata(MetadataUserID, user.Id)
+	params.AddMetadata(MetadataAppID, app.FusionAuth.AppID)
+	params.AddMetadata(MetadataTenantID, app.FusionAuth.TenantID)
+	for key, value := range extraMetadata {
+		params.AddMetadata(key, value)
+	}
+
+	_, err := provider.UpdateCustomer(custID, params)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to sync user %v to customer %v: %v",
+			user.Id,
+			custID,
+			err.Error(),
+		)
+	}
+	return nil
 }
 
 // GetProducts returns a list of products that are configured in one of your
@@ -201,12 +594,10 @@ func PropagateUserToStripe(app config.App, user fusionauth.User) (custID string,
 //
 // https://stripe.com/docs/api/products/retrieve
 func GetProducts(app config.App) (products []models.ProductSummary, err error) {
-	sc := &client.API{}
-	sc.Init(app.Stripe.SecretKey, nil)
-	params := &stripe.ProductParams{}
+	provider := GetProvider(app)
 
 	for _, stripeProduct := range app.Stripe.Products {
-		product, err := sc.Products.Get(stripeProduct.ProductID, params)
+		product, err := provider.GetProduct(stripeProduct.ProductID)
 		if err != nil {
 			return products, fmt.Errorf(
 				"failed to get product from stripe by id %v: %v",
@@ -247,7 +638,7 @@ func GetProducts(app config.App) (products []models.ProductSummary, err error) {
 		// get all the prices now
 		productPrices := []models.ProductPrice{}
 		for _, priceID := range stripeProduct.PriceIDs {
-			stripePrice, err := sc.Prices.Get(priceID, &stripe.PriceParams{})
+			stripePrice, err := provider.GetPrice(priceID)
 			if err != nil {
 				log.Printf(
 					"failed to get price id %v for product id %v: %v",
@@ -312,104 +703,238 @@ func GetProducts(app config.App) (products []models.ProductSummary, err error) {
 	return products, nil
 }
 
+// CheckoutRequestError means that a checkout session can't be created
+// because of what was requested, such as an unconfigured price, rather than
+// because of a problem with Stripe. It should be returned as a 400.
+type CheckoutRequestError struct {
+	Reason string
+}
+
+func (reqErr CheckoutRequestError) Error() string {
+	return reqErr.Reason
+}
+
+func checkoutRequestErrorf(format string, args ...interface{}) CheckoutRequestError {
+	return CheckoutRequestError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// getRequestedLineItems reads the line items from the JSON body, or from the
+// older ids query parameter (a CSV list of price IDs, each with a quantity
+// of 1) when there is no body. If neither is set, the app's default line
+// items are used.
+func getRequestedLineItems(c *gin.Context, conf config.App) ([]models.CheckoutLineItem, error) {
+	body := models.CheckoutBody{}
+	err := c.ShouldBindJSON(&body)
+	if err != nil && err != io.EOF {
+		return nil, checkoutRequestErrorf("malformed checkout body: %v", err.Error())
+	}
+
+	items := body.LineItems
+	if len(items) == 0 && c.Query("ids") != "" {
+		for _, priceID := range strings.Split(c.Query("ids"), ",") {
+			items = append(items, models.CheckoutLineItem{PriceID: priceID, Quantity: 1})
+		}
+	}
+	if len(items) == 0 {
+		items = conf.Stripe.Checkout.DefaultLineItems
+	}
+	if len(items) == 0 {
+		return nil, checkoutRequestErrorf("no line items were requested and no default line items are configured")
+	}
+	return items, nil
+}
+
 // CreateCheckoutSession uses the suggested code pattern from the Stripe API
 // documentation - if there is an error, it will not set any gin response,
 // but if it succeeds, it will set a 200 response with JSON data containing
-// the Stripe session ID.
+// the Stripe session ID. A CheckoutRequestError is returned if the
+// requested line items are invalid.
 //
 // Reference:
 //
 // https://stripe.com/docs/api/checkout/sessions/create
 //
-// Query params:
-//
-// - ids: a CSV list of price IDs, real values from Stripe
-//
-// - m: either "s" or "p" for subscription or one-time payment (no quotes)
-//
-// TODO: if no ids are specified, just put in all of them? or choose a default?
+// The body is a models.CheckoutBody with the price IDs and quantities to
+// check out. Every price must be configured for the app and active in
+// Stripe. If any of them is recurring, the session is a subscription, which
+// may also contain one-time prices; otherwise it's a one-time payment.
 func CreateCheckoutSession(c *gin.Context, conf config.App, user fusionauth.User) error {
-	sc := &client.API{}
-	sc.Init(conf.Stripe.SecretKey, nil)
+	provider := GetProvider(conf)
 
-	// retrieve the products from stripe
-	products, err := GetProducts(conf)
+	items, err := getRequestedLineItems(c, conf)
 	if err != nil {
-		return fmt.Errorf(
-			"failed to retrieve products for checkout session: %v",
-			err.Error(),
-		)
+		return err
 	}
 
-	params := &stripe.CheckoutSessionParams{
-		PaymentMethodTypes: stripe.StringSlice([]string{
-			"card",
-		}),
-		CustomerEmail: &user.Email,
-		LineItems:     []*stripe.CheckoutSessionLineItemParams{},
-		SuccessURL:    stripe.String(conf.Stripe.PaymentSuccessURL),
-		CancelURL:     stripe.String(conf.Stripe.PaymentCancelURL),
+	// check out as the user's linked customer, so that stripe doesn't
+	// create a second customer with the same email
+	custID, err := PropagateUserToStripe(conf, user)
+	if err != nil && custID == "" {
+		return fmt.Errorf("failed to get stripe customer for checkout: %v", err.Error())
+	}
+	if err != nil {
+		log.Printf("checking out as customer %v despite error: %v", custID, err.Error())
 	}
 
-	// populate the checkout with the provided price ids, if they exist
-	// retrieve the form query for the product ids. Otherwise, add them all
-	// TODO: add "default line item" in config
-	csvPriceIDs := c.Query("ids")
-	priceIDs := strings.Split(csvPriceIDs, ",")
-	if csvPriceIDs == "" {
-		for _, stripeProduct := range conf.Stripe.Products {
-			priceIDs = append(priceIDs, stripeProduct.PriceIDs...)
+	checkout := conf.Stripe.Checkout
+	params := &stripe.CheckoutSessionParams{
+		PaymentMethodTypes: stripe.StringSlice(checkout.GetPaymentMethodTypes()),
+		Customer:           stripe.String(custID),
+		ClientReferenceID:  stripe.String(user.Id),
+		LineItems:          []*stripe.CheckoutSessionLineItemParams{},
+		SuccessURL:         stripe.String(conf.Stripe.PaymentSuccessURL),
+		CancelURL:          stripe.String(conf.Stripe.PaymentCancelURL),
+	}
+	params.AddMetadata(MetadataUserID, user.Id)
+	params.AddMetadata(MetadataAppID, conf.FusionAuth.AppID)
+	if checkout.AllowPromotionCodes {
+		params.AllowPromotionCodes = stripe.Bool(true)
+	}
+	// stripe only collects these for existing customers if it's allowed to
+	// save them on the customer
+	if checkout.BillingAddressCollection != "" || checkout.TaxIDCollection {
+		params.CustomerUpdate = &stripe.CheckoutSessionCustomerUpdateParams{
+			Address: stripe.String("auto"),
+		}
+	}
+	if checkout.BillingAddressCollection != "" {
+		params.BillingAddressCollection = stripe.String(checkout.BillingAddressCollection)
+	}
+	if checkout.TaxIDCollection {
+		params.CustomerUpdate.Name = stripe.String("auto")
+		params.TaxIDCollection = &stripe.CheckoutSessionTaxIDCollectionParams{
+			Enabled: stripe.Bool(true),
 		}
 	}
 
-	// priceMode must be either "s" for subscription or "p" for one-type payment
-	priceMode := c.Query("m")
+	recurring := false
+	for _, item := range items {
+		product, ok := conf.Stripe.GetProductForPrice(item.PriceID)
+		if !ok {
+			return checkoutRequestErrorf("price %v is not configured for this app", item.PriceID)
+		}
+		if item.Quantity < 0 {
+			return checkoutRequestErrorf("quantity of price %v must not be negative", item.PriceID)
+		}
+		quantity := item.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
 
-	switch priceMode {
-	case "p":
-		params.Mode = stripe.String(string(stripe.CheckoutSessionModePayment))
-	case "s":
+		price, err := provider.GetPrice(item.PriceID)
+		if isResourceMissing(err) {
+			return checkoutRequestErrorf("price %v does not exist in stripe", item.PriceID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get price %v: %v", item.PriceID, err.Error())
+		}
+		if !price.Active {
+			return checkoutRequestErrorf("price %v is not active", item.PriceID)
+		}
+		if price.Product == nil || price.Product.ID != product.ProductID {
+			return checkoutRequestErrorf(
+				"price %v does not belong to product %v",
+				item.PriceID,
+				product.ProductID,
+			)
+		}
+		if price.Recurring != nil {
+			recurring = true
+		}
+
+		params.LineItems = append(
+			params.LineItems,
+			&stripe.CheckoutSessionLineItemParams{
+				Price:    stripe.String(item.PriceID),
+				Quantity: stripe.Int64(quantity),
+			},
+		)
+	}
+
+	// stripe allows one-time prices in subscription mode, where they are
+	// added to the first invoice, but not the other way around
+	if recurring {
 		params.Mode = stripe.String(string(stripe.CheckoutSessionModeSubscription))
-	default:
-		return fmt.Errorf("priceMode query parameter was not set to either 'p' or 's'")
-	}
-
-	for _, product := range products {
-		for _, price := range product.Prices {
-			for _, queriedPriceID := range priceIDs {
-				if queriedPriceID == price.ID {
-					// we found a price that was requested by the URL that was entered,
-					// so proceed to add it to the LineItems for the Stripe checkout.
-					// But first, we have to ignore all prices that don't match the query parameter
-					// for a subscription vs. a one-time payment
-					if priceMode == "s" && price.RecurringInterval == "" {
-						break
-					}
-					if priceMode == "m" && price.RecurringInterval != "" {
-						break
-					}
-					params.LineItems = append(
-						params.LineItems,
-						&stripe.CheckoutSessionLineItemParams{
-							Price:    stripe.String(queriedPriceID),
-							Quantity: stripe.Int64(1),
-						},
-					)
-					break
-				}
-			}
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{}
+		params.SubscriptionData.AddMetadata(MetadataUserID, user.Id)
+		params.SubscriptionData.AddMetadata(MetadataAppID, conf.FusionAuth.AppID)
+		if checkout.TrialDays > 0 {
+			params.SubscriptionData.TrialPeriodDays = stripe.Int64(int64(checkout.TrialDays))
 		}
+	} else {
+		params.Mode = stripe.String(string(stripe.CheckoutSessionModePayment))
+		params.PaymentIntentData = &stripe.CheckoutSessionPaymentIntentDataParams{}
+		params.PaymentIntentData.AddMetadata(MetadataUserID, user.Id)
+		params.PaymentIntentData.AddMetadata(MetadataAppID, conf.FusionAuth.AppID)
 	}
 
-	session, err := sc.CheckoutSessions.New(params)
+	session, err := provider.NewCheckoutSession(params)
 	if err != nil {
 		return fmt.Errorf("session.new: %v", err.Error())
 	}
 
 	data := models.CreateCheckoutSessionResponse{
 		SessionID: session.ID,
+		URL:       session.URL,
+	}
+	// the fake provider's checkout page is served by the middleware itself
+	if strings.HasPrefix(data.URL, "/") {
+		scheme := "http"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		data.URL = fmt.Sprintf("%v://%v%v", scheme, c.Request.Host, data.URL)
 	}
 
 	c.JSON(200, data)
 	return nil
 }
+
+// VerifyStripeConfig makes sure that every product and price configured for
+// an app exists in Stripe and that each price belongs to its product. Any
+// problems are appended to errs using path as the prefix for the field names.
+func VerifyStripeConfig(app config.App, path string, errs *config.ValidationErrors) {
+	provider := GetProvider(app)
+
+	for i, stripeProduct := range app.Stripe.Products {
+		productPath := fmt.Sprintf("%v.stripe.products[%v]", path, i)
+		product, err := provider.GetProduct(stripeProduct.ProductID)
+		if err != nil {
+			errs.Add(
+				productPath+".productId",
+				"failed to get product %v from stripe: %v",
+				stripeProduct.ProductID,
+				err.Error(),
+			)
+			continue
+		}
+		if !product.Active {
+			errs.Add(productPath+".productId", "product %v is not active", product.ID)
+		}
+
+		for j, priceID := range stripeProduct.PriceIDs {
+			pricePath := fmt.Sprintf("%v.priceIds[%v]", productPath, j)
+			price, err := provider.GetPrice(priceID)
+			if err != nil {
+				errs.Add(
+					pricePath,
+					"failed to get price %v from stripe: %v",
+					priceID,
+					err.Error(),
+				)
+				continue
+			}
+			if price.Product == nil || price.Product.ID != stripeProduct.ProductID {
+				errs.Add(
+					pricePath,
+					"price %v does not belong to product %v",
+					priceID,
+					stripeProduct.ProductID,
+				)
+			}
+			if !price.Active {
+				errs.Add(pricePath, "price %v is not active", priceID)
+			}
+		}
+	}
+}
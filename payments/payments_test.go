@@ -0,0 +1,113 @@
+package payments
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/models"
+
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestSubscribedUserCacheConcurrentAccess(t *testing.T) {
+	InitializeSubscribedUserCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			custID := fmt.Sprintf("cus_%v", i%2)
+			for j := 0; j < 200; j++ {
+				productID := fmt.Sprintf("prod_%v", j%5)
+				AddUserToCache(custID, productID, j%2 == 0)
+				IsUserSubscribedCached(custID, productID)
+				if j%10 == 0 {
+					PurgeCachedCustomer(custID)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPurgeCachedCustomer(t *testing.T) {
+	InitializeSubscribedUserCache()
+	AddUserToCache("cus_a", "prod_1", true)
+	AddUserToCache("cus_ab", "prod_1", true)
+
+	PurgeCachedCustomer("cus_a")
+
+	if _, expired := IsUserSubscribedCached("cus_a", "prod_1"); !expired {
+		t.Errorf("expected cus_a to be purged")
+	}
+	if subscribed, expired := IsUserSubscribedCached("cus_ab", "prod_1"); expired || !subscribed {
+		t.Errorf("expected cus_ab to stay cached")
+	}
+}
+
+func TestSubscribedUserCacheIsACopy(t *testing.T) {
+	InitializeSubscribedUserCache()
+	AddUserToCache("cus_a", "prod_1", true)
+
+	snapshot := SubscribedUserCache()
+	if !snapshot["cus_a_prod_1"].Subscribed {
+		t.Errorf("expected cus_a to be in the snapshot, got %v", snapshot)
+	}
+	delete(snapshot, "cus_a_prod_1")
+	if subscribed, expired := IsUserSubscribedCached("cus_a", "prod_1"); expired || !subscribed {
+		t.Errorf("expected changes to the snapshot not to reach the cache")
+	}
+}
+
+func TestAppsOnOneStripeAccountShareTheCustomer(t *testing.T) {
+	provider := NewFakeProvider()
+	conf := config.Config{}
+	for _, domain := range []string{"first.test", "second.test"} {
+		app := config.App{
+			Domain: domain,
+			Mode:   config.AppModeDev,
+			FusionAuth: config.FusionAuthConfig{
+				AppID:    config.DevAppID,
+				TenantID: config.DevTenantID,
+			},
+			Stripe: config.StripeConfig{Provider: config.PaymentProviderFake},
+			Dev: config.DevConfig{Fixtures: models.DevFixtures{Users: []models.DevUser{
+				{ID: "shared-user", Email: "shared@example.com", Password: "password1234"},
+			}}},
+		}
+		SetProvider(domain, provider)
+		defer SetProvider(domain, nil)
+		conf.Apps = append(conf.Apps, app)
+	}
+	err := conf.InitClients()
+	if err != nil {
+		t.Fatalf("failed to init clients: %v", err)
+	}
+
+	custIDs := []string{}
+	for _, app := range conf.Apps {
+		user := fusionauth.User{Email: "shared@example.com"}
+		user.Id = "shared-user"
+		custID, err := PropagateUserToStripe(app, user)
+		if err != nil {
+			t.Fatalf("failed to propagate user to %v: %v", app.Domain, err)
+		}
+		custIDs = append(custIDs, custID)
+	}
+	if custIDs[0] == "" || custIDs[0] != custIDs[1] {
+		t.Errorf("expected both apps to use the same customer, got %v", custIDs)
+	}
+
+	customers := 0
+	iter := provider.ListCustomers(&stripe.CustomerListParams{Email: stripe.String("shared@example.com")})
+	for iter.Next() {
+		customers++
+	}
+	if customers != 1 {
+		t.Errorf("expected a single customer, got %v", customers)
+	}
+}
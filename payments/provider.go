@@ -0,0 +1,216 @@
+package payments
+
+import (
+	"fa-middleware/config"
+
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/charge"
+	checkoutsession "github.com/stripe/stripe-go/v72/checkout/session"
+	"github.com/stripe/stripe-go/v72/client"
+	"github.com/stripe/stripe-go/v72/customer"
+	"github.com/stripe/stripe-go/v72/invoice"
+	"github.com/stripe/stripe-go/v72/sub"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// PaymentProvider is everything that the middleware needs from a payment
+// processor. Objects are described with stripe-go's types, since those are
+// what the rest of the payments package works with, and lists are returned
+// as stripe-go iterators so that they can be paged through lazily.
+//
+// Use GetProvider to get the provider that is configured for an app.
+type PaymentProvider interface {
+	// customers
+	GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	ListCustomers(params *stripe.CustomerListParams) *customer.Iter
+	SearchCustomersByMetadata(key string, value string) *customer.SearchIter
+
+	// products and prices
+	GetProduct(id string) (*stripe.Product, error)
+	GetPrice(id string) (*stripe.Price, error)
+
+	// checkout
+	NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	GetCheckoutSession(id string, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	ListCheckoutSessions(params *stripe.CheckoutSessionListParams) *checkoutsession.Iter
+	ListCheckoutSessionLineItems(id string, params *stripe.CheckoutSessionListLineItemsParams) *checkoutsession.LineItemIter
+
+	// subscriptions and billing
+	GetSubscription(id string) (*stripe.Subscription, error)
+	ListSubscriptions(params *stripe.SubscriptionListParams) *sub.Iter
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(id string) (*stripe.Subscription, error)
+	GetUpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error)
+	ListInvoices(params *stripe.InvoiceListParams) *invoice.Iter
+	ListInvoiceLines(params *stripe.InvoiceLineListParams) *invoice.LineIter
+	ListCharges(params *stripe.ChargeListParams) *charge.Iter
+
+	// ParseWebhook checks the signature of a webhook event that was sent
+	// with the given secret, and parses it
+	ParseWebhook(payload []byte, signature string, secret string) (stripe.Event, error)
+}
+
+var (
+	providerOverrides     = make(map[string]PaymentProvider)
+	providerOverridesLock sync.RWMutex
+)
+
+// GetProvider returns the payment provider that is configured for an app in
+// stripe.provider, unless one was set with SetProvider
+func GetProvider(app config.App) PaymentProvider {
+	providerOverridesLock.RLock()
+	provider, ok := providerOverrides[app.Domain]
+	providerOverridesLock.RUnlock()
+	if ok {
+		return provider
+	}
+
+	if app.Stripe.Provider == config.PaymentProviderFake {
+		return GetFakeProvider(app)
+	}
+	return newStripeProvider(app.Stripe.SecretKey)
+}
+
+// SetProvider makes GetProvider return provider for the app with the given
+// domain regardless of its config, such as a provider with a custom Stripe
+// client. A nil provider goes back to the configured one.
+func SetProvider(domain string, provider PaymentProvider) {
+	providerOverridesLock.Lock()
+	defer providerOverridesLock.Unlock()
+
+	if provider == nil {
+		delete(providerOverrides, domain)
+		return
+	}
+	providerOverrides[domain] = provider
+}
+
+// parseSignedEvent verifies a Stripe-Signature header and parses the event
+//
+// https://stripe.com/docs/webhooks/signatures
+func parseSignedEvent(payload []byte, signature string, secret string) (event stripe.Event, err error) {
+	if secret == "" {
+		return event, fmt.Errorf("no webhook secret is configured")
+	}
+	err = webhook.ValidatePayload(payload, signature, secret)
+	if err != nil {
+		return event, err
+	}
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		return event, fmt.Errorf("failed to parse event: %v", err.Error())
+	}
+	if event.Data == nil {
+		return event, fmt.Errorf("event %v has no data", event.ID)
+	}
+	return event, nil
+}
+
+// stripeProvider is the PaymentProvider that calls the Stripe API
+type stripeProvider struct {
+	sc *client.API
+}
+
+func newStripeProvider(secretKey string) *stripeProvider {
+	sc := &client.API{}
+	sc.Init(secretKey, nil)
+	return &stripeProvider{sc: sc}
+}
+
+// NewStripeProvider returns a PaymentProvider that calls the Stripe API
+// through an already initialized client
+func NewStripeProvider(sc *client.API) PaymentProvider {
+	return &stripeProvider{sc: sc}
+}
+
+func (provider *stripeProvider) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return provider.sc.Customers.Get(id, params)
+}
+
+func (provider *stripeProvider) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return provider.sc.Customers.New(params)
+}
+
+func (provider *stripeProvider) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return provider.sc.Customers.Update(id, params)
+}
+
+func (provider *stripeProvider) ListCustomers(params *stripe.CustomerListParams) *customer.Iter {
+	return provider.sc.Customers.List(params)
+}
+
+// SearchCustomersByMetadata uses Stripe's search, which can lag behind by up
+// to a minute
+//
+// https://stripe.com/docs/search#search-query-language
+func (provider *stripeProvider) SearchCustomersByMetadata(key string, value string) *customer.SearchIter {
+	params := &stripe.CustomerSearchParams{}
+	params.Query = fmt.Sprintf("metadata['%v']:'%v'", key, escapeSearchValue(value))
+	return provider.sc.Customers.Search(params)
+}
+
+func (provider *stripeProvider) GetProduct(id string) (*stripe.Product, error) {
+	return provider.sc.Products.Get(id, &stripe.ProductParams{})
+}
+
+func (provider *stripeProvider) GetPrice(id string) (*stripe.Price, error) {
+	return provider.sc.Prices.Get(id, &stripe.PriceParams{})
+}
+
+func (provider *stripeProvider) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	return provider.sc.CheckoutSessions.New(params)
+}
+
+func (provider *stripeProvider) GetCheckoutSession(id string, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	return provider.sc.CheckoutSessions.Get(id, params)
+}
+
+func (provider *stripeProvider) ListCheckoutSessions(params *stripe.CheckoutSessionListParams) *checkoutsession.Iter {
+	return provider.sc.CheckoutSessions.List(params)
+}
+
+func (provider *stripeProvider) ListCheckoutSessionLineItems(id string, params *stripe.CheckoutSessionListLineItemsParams) *checkoutsession.LineItemIter {
+	return provider.sc.CheckoutSessions.ListLineItems(id, params)
+}
+
+func (provider *stripeProvider) GetSubscription(id string) (*stripe.Subscription, error) {
+	return provider.sc.Subscriptions.Get(id, nil)
+}
+
+func (provider *stripeProvider) ListSubscriptions(params *stripe.SubscriptionListParams) *sub.Iter {
+	return provider.sc.Subscriptions.List(params)
+}
+
+func (provider *stripeProvider) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return provider.sc.Subscriptions.Update(id, params)
+}
+
+func (provider *stripeProvider) CancelSubscription(id string) (*stripe.Subscription, error) {
+	return provider.sc.Subscriptions.Cancel(id, nil)
+}
+
+func (provider *stripeProvider) GetUpcomingInvoice(params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	return provider.sc.Invoices.GetNext(params)
+}
+
+func (provider *stripeProvider) ListInvoices(params *stripe.InvoiceListParams) *invoice.Iter {
+	return provider.sc.Invoices.List(params)
+}
+
+func (provider *stripeProvider) ListInvoiceLines(params *stripe.InvoiceLineListParams) *invoice.LineIter {
+	return provider.sc.Invoices.ListLines(params)
+}
+
+func (provider *stripeProvider) ListCharges(params *stripe.ChargeListParams) *charge.Iter {
+	return provider.sc.Charges.List(params)
+}
+
+func (provider *stripeProvider) ParseWebhook(payload []byte, signature string, secret string) (stripe.Event, error) {
+	return parseSignedEvent(payload, signature, secret)
+}
@@ -0,0 +1,398 @@
+package payments
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/store"
+	"fa-middleware/webhooks"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	// MetadataAccessPrefix is followed by a product ID in the Stripe
+	// customer metadata that records one-time purchases when the database
+	// isn't enabled. The value is "<expiry>|<source id>", where the expiry
+	// is a unix timestamp or "lifetime".
+	MetadataAccessPrefix = "faAccess_"
+	accessLifetime       = "lifetime"
+
+	// Stripe events that complete a one-time purchase
+	StripeEventCheckoutCompleted             = "checkout.session.completed"
+	StripeEventCheckoutAsyncPaymentSucceeded = "checkout.session.async_payment_succeeded"
+	StripeEventInvoicePaid                   = "invoice.paid"
+
+	// Stripe events that change a subscription, including renewals and
+	// changes that were made in the Stripe dashboard
+	StripeEventSubscriptionCreated = "customer.subscription.created"
+	StripeEventSubscriptionUpdated = "customer.subscription.updated"
+	StripeEventSubscriptionDeleted = "customer.subscription.deleted"
+)
+
+// errAlreadyRecorded means that a purchase from the same checkout session or
+// invoice was already recorded
+var errAlreadyRecorded = errors.New("purchase was already recorded")
+
+// HasProductAccess checks if a user's purchases of a one-time product give
+// them access to it right now. Results are cached the same way as
+// subscription checks.
+func HasProductAccess(app config.App, user fusionauth.User, productID string) (bool, error) {
+	custID, err := GetStripeCustomerID(app, user)
+	if err != nil {
+		return false, err
+	}
+	if custID != "" {
+		cached, cacheExpired := IsUserSubscribedCached(custID, productID)
+		if !cacheExpired {
+			return cached, nil
+		}
+	}
+
+	access, err := GetProductAccess(app, user, productID)
+	if err != nil {
+		return false, err
+	}
+	active := access.Active(time.Now())
+	if custID != "" {
+		AddUserToCache(custID, productID, active)
+	}
+	return active, nil
+}
+
+// GetProductAccess adds up a user's purchases of a one-time product, from
+// the middleware's database if it's enabled, and otherwise from the
+// metadata of their Stripe customer
+func GetProductAccess(app config.App, user fusionauth.User, productID string) (access models.ProductAccess, err error) {
+	if store.DB != nil {
+		return store.DB.GetProductAccess(
+			context.Background(),
+			user.Id,
+			app.FusionAuth.AppID,
+			productID,
+		)
+	}
+
+	access.ProductID = productID
+	custID, err := GetStripeCustomerID(app, user)
+	if err != nil || custID == "" {
+		return access, err
+	}
+
+	provider := GetProvider(app)
+	customer, err := provider.GetCustomer(custID, nil)
+	if err != nil {
+		return access, fmt.Errorf("failed to get customer id %v: %v", custID, err.Error())
+	}
+	access, _ = parseAccessMetadata(productID, customer.Metadata[MetadataAccessPrefix+productID])
+	return access, nil
+}
+
+// parseAccessMetadata reads a MetadataAccessPrefix value, and also returns
+// the ID of the checkout session or invoice that last changed it
+func parseAccessMetadata(productID string, value string) (access models.ProductAccess, sourceID string) {
+	access.ProductID = productID
+	parts := strings.SplitN(value, "|", 2)
+	if len(parts) == 2 {
+		sourceID = parts[1]
+	}
+	if parts[0] == accessLifetime {
+		access.Lifetime = true
+		return access, sourceID
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err == nil {
+		access.ExpiresAt = time.Unix(expiry, 0)
+	}
+	return access, sourceID
+}
+
+// RecordPurchase grants a user access to a one-time product that they paid
+// for. Time-boxed access is added on top of any access that hasn't expired
+// yet, so buying a 30 day pass twice gives 60 days. Recording the same
+// sourceID (a checkout session or invoice ID) twice has no effect.
+func RecordPurchase(app config.App, user fusionauth.User, custID string, product models.StripeProduct, priceID string, quantity int64, sourceID string) error {
+	access, err := GetProductAccess(app, user, product.ProductID)
+	if err != nil {
+		return err
+	}
+	if quantity < 1 {
+		quantity = 1
+	}
+
+	now := time.Now()
+	var expiresAt *time.Time
+	if product.AccessDays > 0 {
+		start := now
+		if access.ExpiresAt.After(start) {
+			start = access.ExpiresAt
+		}
+		expiry := start.AddDate(0, 0, product.AccessDays*int(quantity))
+		expiresAt = &expiry
+	}
+
+	if store.DB != nil {
+		inserted, err := store.DB.InsertPurchase(context.Background(), models.Purchase{
+			ID:               h.NewID(),
+			UserID:           user.Id,
+			AppID:            app.FusionAuth.AppID,
+			StripeCustomerID: custID,
+			ProductID:        product.ProductID,
+			PriceID:          priceID,
+			SourceID:         sourceID,
+			PurchasedAt:      now,
+			ExpiresAt:        expiresAt,
+		})
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			return nil
+		}
+	} else {
+		err = saveAccessMetadata(app, user, custID, product.ProductID, sourceID, expiresAt)
+		if err == errAlreadyRecorded {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	linkedID, err := GetStripeCustomerID(app, user)
+	if err == nil && linkedID != "" {
+		PurgeCachedCustomer(linkedID)
+	}
+	PurgeCachedCustomer(custID)
+
+	log.Printf("recorded purchase of %v by user %v from %v", product.ProductID, user.Id, sourceID)
+	webhooks.Emit(app, models.EventPurchaseCompleted, models.WebhookEventData{
+		UserID:           user.Id,
+		Email:            user.Email,
+		StripeCustomerID: custID,
+		ProductID:        product.ProductID,
+	})
+	NotifyAccessChanged(app, user.Id)
+	return nil
+}
+
+// saveAccessMetadata records a purchase in the metadata of the user's
+// linked Stripe customer, or of the paying customer if the user isn't
+// linked yet
+func saveAccessMetadata(app config.App, user fusionauth.User, custID string, productID string, sourceID string, expiresAt *time.Time) error {
+	linkedID, err := GetStripeCustomerID(app, user)
+	if err != nil {
+		return err
+	}
+	if linkedID != "" {
+		custID = linkedID
+	}
+	if custID == "" {
+		return fmt.Errorf("user %v has no stripe customer to record the purchase on", user.Id)
+	}
+
+	provider := GetProvider(app)
+	customer, err := provider.GetCustomer(custID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get customer id %v: %v", custID, err.Error())
+	}
+	key := MetadataAccessPrefix + productID
+	existing, existingSourceID := parseAccessMetadata(productID, customer.Metadata[key])
+	if existingSourceID == sourceID {
+		return errAlreadyRecorded
+	}
+
+	value := accessLifetime
+	if expiresAt != nil && !existing.Lifetime {
+		value = strconv.FormatInt(expiresAt.Unix(), 10)
+	}
+	params := &stripe.CustomerParams{}
+	params.AddMetadata(key, fmt.Sprintf("%v|%v", value, sourceID))
+	_, err = provider.UpdateCustomer(custID, params)
+	if err != nil {
+		return fmt.Errorf("failed to record purchase on customer %v: %v", custID, err.Error())
+	}
+	return nil
+}
+
+// purchasedItem is a one-time product in a checkout session or invoice
+type purchasedItem struct {
+	product  models.StripeProduct
+	priceID  string
+	quantity int64
+}
+
+// oneTimeItem returns the configured one-time product that a price belongs
+// to, if any
+func oneTimeItem(app config.App, price *stripe.Price, quantity int64) (purchasedItem, bool) {
+	if price == nil || price.Product == nil {
+		return purchasedItem{}, false
+	}
+	product, ok := app.Stripe.GetProduct(price.Product.ID)
+	if !ok || !product.OneTime {
+		return purchasedItem{}, false
+	}
+	return purchasedItem{product: product, priceID: price.ID, quantity: quantity}, true
+}
+
+// HandlesStripeEvent checks if HandleStripeEvent does anything with an event
+// type, so that other events don't have to be queued at all
+func HandlesStripeEvent(eventType string) bool {
+	switch eventType {
+	case StripeEventCheckoutCompleted,
+		StripeEventCheckoutAsyncPaymentSucceeded,
+		StripeEventInvoicePaid,
+		StripeEventSubscriptionCreated,
+		StripeEventSubscriptionUpdated,
+		StripeEventSubscriptionDeleted:
+		return true
+	}
+	return false
+}
+
+// HandleStripeEvent records the one-time purchases in a Stripe event that
+// was received by the Stripe webhook, and reports subscriptions that were
+// activated or canceled. previousAttributes are the changed fields of an
+// updated object, as Stripe sends them. Other events are ignored.
+func HandleStripeEvent(app config.App, eventType string, data json.RawMessage, previousAttributes json.RawMessage) error {
+	provider := GetProvider(app)
+
+	switch eventType {
+	case StripeEventSubscriptionCreated, StripeEventSubscriptionUpdated, StripeEventSubscriptionDeleted:
+		return handleSubscriptionEvent(app, eventType, data, previousAttributes)
+
+	case StripeEventCheckoutCompleted, StripeEventCheckoutAsyncPaymentSucceeded:
+		session := stripe.CheckoutSession{}
+		err := json.Unmarshal(data, &session)
+		if err != nil {
+			return fmt.Errorf("failed to parse checkout session: %v", err.Error())
+		}
+		// subscriptions are checked directly, and delayed payment methods
+		// send async_payment_succeeded once the payment goes through
+		if session.Mode != stripe.CheckoutSessionModePayment ||
+			session.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+			return nil
+		}
+
+		items := []purchasedItem{}
+		iter := provider.ListCheckoutSessionLineItems(session.ID, &stripe.CheckoutSessionListLineItemsParams{})
+		for iter.Next() {
+			lineItem := iter.LineItem()
+			item, ok := oneTimeItem(app, lineItem.Price, lineItem.Quantity)
+			if ok {
+				items = append(items, item)
+			}
+		}
+		if iter.Err() != nil {
+			return fmt.Errorf(
+				"failed to list line items of checkout session %v: %v",
+				session.ID,
+				iter.Err().Error(),
+			)
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		custID := ""
+		if session.Customer != nil {
+			custID = session.Customer.ID
+		}
+		email := session.CustomerEmail
+		if email == "" && session.CustomerDetails != nil {
+			email = session.CustomerDetails.Email
+		}
+		user, err := findPurchaser(provider, app, custID, session.ClientReferenceID, session.Metadata, email)
+		if err != nil {
+			return err
+		}
+		return recordItems(app, user, custID, items, session.ID)
+
+	case StripeEventInvoicePaid:
+		inv := stripe.Invoice{}
+		err := json.Unmarshal(data, &inv)
+		if err != nil {
+			return fmt.Errorf("failed to parse invoice: %v", err.Error())
+		}
+
+		items := []purchasedItem{}
+		if inv.Lines != nil {
+			for _, line := range inv.Lines.Data {
+				// one-time prices from a mixed checkout are invoice items on
+				// the subscription's first invoice
+				if line.Type == stripe.InvoiceLineTypeSubscription {
+					continue
+				}
+				item, ok := oneTimeItem(app, line.Price, line.Quantity)
+				if ok {
+					items = append(items, item)
+				}
+			}
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		custID := ""
+		if inv.Customer != nil {
+			custID = inv.Customer.ID
+		}
+		user, err := findPurchaser(provider, app, custID, "", inv.Metadata, inv.CustomerEmail)
+		if err != nil {
+			return err
+		}
+		return recordItems(app, user, custID, items, inv.ID)
+	}
+
+	return nil
+}
+
+func recordItems(app config.App, user fusionauth.User, custID string, items []purchasedItem, sourceID string) error {
+	for _, item := range items {
+		err := RecordPurchase(app, user, custID, item.product, item.priceID, item.quantity, sourceID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findPurchaser finds the FusionAuth user that paid for a purchase: via the
+// client reference ID or faUserId metadata that checkout sessions are
+// created with, then via the Stripe customer's metadata, and finally via
+// the email address
+func findPurchaser(provider PaymentProvider, app config.App, custID string, clientReferenceID string, metadata map[string]string, email string) (user fusionauth.User, err error) {
+	userID := clientReferenceID
+	if userID == "" {
+		userID = metadata[MetadataUserID]
+	}
+	if userID == "" && custID != "" {
+		customer, err := provider.GetCustomer(custID, nil)
+		if err != nil {
+			return user, fmt.Errorf("failed to get customer id %v: %v", custID, err.Error())
+		}
+		userID = customer.Metadata[MetadataUserID]
+		if email == "" {
+			email = customer.Email
+		}
+	}
+
+	if userID != "" {
+		return auth.GetUserByID(app, userID)
+	}
+	if email != "" {
+		return auth.GetUserByEmail(app, email)
+	}
+	return user, fmt.Errorf("no fusionauth user could be found for customer %v", custID)
+}
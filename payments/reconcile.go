@@ -0,0 +1,472 @@
+package payments
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	"fa-middleware/store"
+
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// Mismatches between FusionAuth users and Stripe customers that Reconcile
+// reports
+const (
+	// IssueMissingLink is a user that isn't linked to any Stripe customer
+	IssueMissingLink = "missing_link"
+
+	// IssueDanglingCustomerID is a user that is linked to a Stripe customer
+	// that has been deleted or doesn't exist
+	IssueDanglingCustomerID = "dangling_customer_id"
+
+	// IssueConflictingLink is a user whose customer ID in the middleware's
+	// database differs from the one in their FusionAuth user data
+	IssueConflictingLink = "conflicting_link"
+
+	// IssueEmailDrift is a linked customer whose email differs from the
+	// user's
+	IssueEmailDrift = "email_drift"
+
+	// IssueMissingMetadata is a linked customer that doesn't have the user's
+	// ID in its metadata
+	IssueMissingMetadata = "missing_metadata"
+
+	// IssueForeignOwner is a linked customer whose metadata names a
+	// different user
+	IssueForeignOwner = "foreign_owner"
+
+	// IssueDuplicateCustomers is a user with more than one Stripe customer
+	IssueDuplicateCustomers = "duplicate_customers"
+
+	// IssueOrphanedCustomer is a Stripe customer that no user of the app is
+	// linked to
+	IssueOrphanedCustomer = "orphaned_customer"
+)
+
+// ReconcileIssue is a single mismatch found by Reconcile. Fixed is set if
+// it was repaired, and FixError if repairing it failed. Issues that can't
+// be repaired automatically, such as duplicates, are left for a human.
+type ReconcileIssue struct {
+	Type             string `json:"type"`
+	UserID           string `json:"userId,omitempty"`
+	Email            string `json:"email,omitempty"`
+	StripeCustomerID string `json:"stripeCustomerId,omitempty"`
+	Detail           string `json:"detail"`
+	Fixed            bool   `json:"fixed"`
+	FixError         string `json:"fixError,omitempty"`
+}
+
+// ReconcileReport is the result of reconciling a single app
+type ReconcileReport struct {
+	AppID     string           `json:"appId"`
+	Domain    string           `json:"domain"`
+	Users     int              `json:"users"`
+	Customers int              `json:"customers"`
+	Issues    []ReconcileIssue `json:"issues"`
+}
+
+// Unfixed returns the number of issues that still need attention
+func (report ReconcileReport) Unfixed() (count int) {
+	for _, issue := range report.Issues {
+		if !issue.Fixed {
+			count++
+		}
+	}
+	return count
+}
+
+// FormatReconcileIssue describes an issue on a single line
+func FormatReconcileIssue(issue ReconcileIssue) string {
+	status := "unfixed"
+	if issue.Fixed {
+		status = "fixed"
+	} else if issue.FixError != "" {
+		status = fmt.Sprintf("fix failed: %v", issue.FixError)
+	}
+	return fmt.Sprintf(
+		"%v user=%v email=%v customer=%v: %v (%v)",
+		issue.Type,
+		issue.UserID,
+		issue.Email,
+		issue.StripeCustomerID,
+		issue.Detail,
+		status,
+	)
+}
+
+// reconciler holds everything that is known about an app's users and
+// customers while it is being reconciled
+type reconciler struct {
+	app      config.App
+	provider PaymentProvider
+	fix      bool
+	report   *ReconcileReport
+
+	customers       map[string]*stripe.Customer
+	customersByUser map[string][]*stripe.Customer
+	users           map[string]bool
+	linked          map[string]bool
+}
+
+// Reconcile pages through every FusionAuth user registered to the app and
+// every Stripe customer for the app's Stripe key, and reports mismatches
+// between them. With fix, each mismatch is repaired using the same rules as
+// PropagateUserToStripe:
+//
+// - users without a customer, or linked to a deleted customer, are
+// propagated again, which adopts an existing customer before creating one
+//
+// - linked customers with a drifted email or missing metadata are synced
+// from the user
+//
+// - conflicting links are resolved in favor of the middleware's database,
+// which is what GetStripeCustomerID reads first
+//
+// - orphaned customers that belong to a deleted FusionAuth user are tagged
+// with faDeleted, the same as when a user.delete webhook is received
+//
+// Stripe customers are never deleted or merged, so duplicates and customers
+// that belong to another user are only reported.
+func Reconcile(app config.App, fix bool) (report ReconcileReport, err error) {
+	report = ReconcileReport{
+		AppID:  app.FusionAuth.AppID,
+		Domain: app.Domain,
+		Issues: []ReconcileIssue{},
+	}
+
+	provider := GetProvider(app)
+
+	r := &reconciler{
+		app:             app,
+		provider:        provider,
+		fix:             fix,
+		report:          &report,
+		customers:       make(map[string]*stripe.Customer),
+		customersByUser: make(map[string][]*stripe.Customer),
+		users:           make(map[string]bool),
+		linked:          make(map[string]bool),
+	}
+
+	iter := provider.ListCustomers(&stripe.CustomerListParams{})
+	for iter.Next() {
+		customer := iter.Customer()
+		r.customers[customer.ID] = customer
+		ownerID := customer.Metadata[MetadataUserID]
+		if ownerID != "" {
+			r.customersByUser[ownerID] = append(r.customersByUser[ownerID], customer)
+		}
+	}
+	if iter.Err() != nil {
+		return report, fmt.Errorf("failed to list stripe customers: %v", iter.Err().Error())
+	}
+	report.Customers = len(r.customers)
+
+	users, err := auth.GetAppUsers(app)
+	if err != nil {
+		return report, err
+	}
+	report.Users = len(users)
+
+	for _, user := range users {
+		r.users[user.Id] = true
+	}
+	for _, user := range users {
+		err = r.checkUser(user)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	err = r.checkOrphans()
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// checkUser compares a single user with their linked customer
+func (r *reconciler) checkUser(user fusionauth.User) error {
+	dataID, _ := user.Data[StripeCustomerIDField].(string)
+	storeID := ""
+	if store.DB != nil {
+		mapping, ok, err := store.DB.GetIdentityMapping(
+			context.Background(),
+			user.Id,
+			r.app.FusionAuth.AppID,
+		)
+		if err != nil {
+			return err
+		}
+		if ok {
+			storeID = mapping.StripeCustomerID
+		}
+	}
+
+	// the same precedence as GetStripeCustomerID
+	custID := storeID
+	if custID == "" {
+		custID = dataID
+	}
+
+	if storeID != "" && dataID != "" && storeID != dataID {
+		r.add(ReconcileIssue{
+			Type:             IssueConflictingLink,
+			UserID:           user.Id,
+			Email:            user.Email,
+			StripeCustomerID: storeID,
+			Detail: fmt.Sprintf(
+				"database links customer %v but fusionauth user data links %v",
+				storeID,
+				dataID,
+			),
+		}, func() error {
+			return auth.SetUserData(r.app, user, StripeCustomerIDField, storeID)
+		})
+	}
+
+	if custID == "" {
+		r.add(ReconcileIssue{
+			Type:   IssueMissingLink,
+			UserID: user.Id,
+			Email:  user.Email,
+			Detail: "user is not linked to a stripe customer",
+		}, func() error {
+			return r.relink(user)
+		})
+		return nil
+	}
+
+	customer, ok := r.customers[custID]
+	if !ok {
+		// the customer may have been created after it was listed
+		var err error
+		customer, err = r.provider.GetCustomer(custID, nil)
+		if err != nil && !isResourceMissing(err) {
+			return fmt.Errorf("failed to get customer id %v: %v", custID, err.Error())
+		}
+		if err != nil || customer.Deleted {
+			r.add(ReconcileIssue{
+				Type:             IssueDanglingCustomerID,
+				UserID:           user.Id,
+				Email:            user.Email,
+				StripeCustomerID: custID,
+				Detail:           fmt.Sprintf("linked customer %v does not exist", custID),
+			}, func() error {
+				err := r.unlink(user)
+				if err != nil {
+					return err
+				}
+				return r.relink(user)
+			})
+			return nil
+		}
+		r.customers[custID] = customer
+	}
+	r.linked[custID] = true
+
+	ownerID := customer.Metadata[MetadataUserID]
+	if ownerID != "" && ownerID != user.Id {
+		r.add(ReconcileIssue{
+			Type:             IssueForeignOwner,
+			UserID:           user.Id,
+			Email:            user.Email,
+			StripeCustomerID: custID,
+			Detail:           fmt.Sprintf("linked customer %v belongs to user %v", custID, ownerID),
+		}, nil)
+	} else {
+		start := len(r.report.Issues)
+		needsSync := false
+		if ownerID == "" {
+			needsSync = true
+			r.add(ReconcileIssue{
+				Type:             IssueMissingMetadata,
+				UserID:           user.Id,
+				Email:            user.Email,
+				StripeCustomerID: custID,
+				Detail:           fmt.Sprintf("linked customer %v has no %v metadata", custID, MetadataUserID),
+			}, nil)
+		}
+		if !strings.EqualFold(customer.Email, user.Email) {
+			needsSync = true
+			r.add(ReconcileIssue{
+				Type:             IssueEmailDrift,
+				UserID:           user.Id,
+				Email:            user.Email,
+				StripeCustomerID: custID,
+				Detail:           fmt.Sprintf("linked customer %v has email %v", custID, customer.Email),
+			}, nil)
+		}
+		if needsSync && r.fix {
+			// a single sync repairs both the email and the metadata
+			r.resolveFrom(start, SyncStripeCustomer(r.app, user, custID, nil))
+		}
+	}
+
+	duplicateIDs := []string{}
+	for _, duplicate := range r.customersByUser[user.Id] {
+		if duplicate.ID != custID {
+			duplicateIDs = append(duplicateIDs, duplicate.ID)
+			r.linked[duplicate.ID] = true
+		}
+	}
+	if len(duplicateIDs) > 0 {
+		sort.Strings(duplicateIDs)
+		r.add(ReconcileIssue{
+			Type:             IssueDuplicateCustomers,
+			UserID:           user.Id,
+			Email:            user.Email,
+			StripeCustomerID: custID,
+			Detail: fmt.Sprintf(
+				"user also owns customer(s) %v, which must be merged manually",
+				strings.Join(duplicateIDs, ", "),
+			),
+		}, nil)
+	}
+
+	return nil
+}
+
+// checkOrphans reports the customers that belong to this app but aren't
+// linked to any of its users. Customers without any FusionAuth metadata may
+// belong to another app that shares the Stripe key, and are reported too.
+func (r *reconciler) checkOrphans() error {
+	ids := []string{}
+	for id := range r.customers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		customer := r.customers[id]
+		if r.linked[id] || customer.Deleted {
+			continue
+		}
+		appID := customer.Metadata[MetadataAppID]
+		if appID != "" && appID != r.app.FusionAuth.AppID {
+			continue
+		}
+		if customer.Metadata["faDeleted"] == "true" {
+			continue
+		}
+
+		ownerID := customer.Metadata[MetadataUserID]
+		if ownerID == "" {
+			r.add(ReconcileIssue{
+				Type:             IssueOrphanedCustomer,
+				Email:            customer.Email,
+				StripeCustomerID: id,
+				Detail:           "customer has no fusionauth owner",
+			}, nil)
+			continue
+		}
+		if r.users[ownerID] {
+			// the owner is linked to another customer, which is reported as
+			// a duplicate
+			continue
+		}
+
+		exists, err := auth.UserExists(r.app, ownerID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			r.add(ReconcileIssue{
+				Type:             IssueOrphanedCustomer,
+				UserID:           ownerID,
+				Email:            customer.Email,
+				StripeCustomerID: id,
+				Detail:           "customer's owner is not registered to the app",
+			}, nil)
+			continue
+		}
+		r.add(ReconcileIssue{
+			Type:             IssueOrphanedCustomer,
+			UserID:           ownerID,
+			Email:            customer.Email,
+			StripeCustomerID: id,
+			Detail:           "customer's owner was deleted from fusionauth",
+		}, func() error {
+			return markCustomerDeleted(r.provider, id)
+		})
+	}
+
+	return nil
+}
+
+// add records an issue, and repairs it right away with repair when fixing.
+// A nil repair means that the issue can't be repaired automatically.
+func (r *reconciler) add(issue ReconcileIssue, repair func() error) {
+	start := len(r.report.Issues)
+	r.report.Issues = append(r.report.Issues, issue)
+	if r.fix && repair != nil {
+		r.resolveFrom(start, repair())
+	}
+}
+
+// resolveFrom marks every issue from index start onwards as fixed, or
+// records why they couldn't be
+func (r *reconciler) resolveFrom(start int, err error) {
+	for i := start; i < len(r.report.Issues); i++ {
+		if err != nil {
+			r.report.Issues[i].FixError = err.Error()
+			continue
+		}
+		r.report.Issues[i].Fixed = true
+	}
+}
+
+// relink propagates the user to Stripe, which links them to an existing
+// customer if there is one and creates one otherwise
+func (r *reconciler) relink(user fusionauth.User) error {
+	custID, err := PropagateUserToStripe(r.app, user)
+	if err != nil {
+		return err
+	}
+	r.linked[custID] = true
+	return nil
+}
+
+// unlink removes a user's link to their customer from both the middleware's
+// database and the FusionAuth user data
+func (r *reconciler) unlink(user fusionauth.User) error {
+	if store.DB != nil {
+		err := store.DB.DeleteIdentityMapping(
+			context.Background(),
+			user.Id,
+			r.app.FusionAuth.AppID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := user.Data[StripeCustomerIDField]; ok {
+		// an empty customer id is treated the same as a missing one
+		return auth.SetUserData(r.app, user, StripeCustomerIDField, "")
+	}
+	return nil
+}
+
+// markCustomerDeleted tags a customer whose FusionAuth user no longer exists
+func markCustomerDeleted(provider PaymentProvider, custID string) error {
+	params := &stripe.CustomerParams{}
+	params.AddMetadata("faDeleted", "true")
+	params.AddMetadata("faActive", "false")
+	_, err := provider.UpdateCustomer(custID, params)
+	if err != nil {
+		return fmt.Errorf("failed to tag customer %v as deleted: %v", custID, err.Error())
+	}
+	return nil
+}
+
+// isResourceMissing checks if a Stripe API error means that the object
+// doesn't exist
+func isResourceMissing(err error) bool {
+	stripeErr, ok := err.(*stripe.Error)
+	return ok && stripeErr.Code == stripe.ErrorCodeResourceMissing
+}
@@ -0,0 +1,460 @@
+package payments
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/models"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+var (
+	// ErrSubscriptionNotFound means that the subscription doesn't exist, or
+	// that it doesn't belong to the user or to the app's products
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+
+	// ErrUnknownPrice means that a price isn't configured for the app
+	ErrUnknownPrice = errors.New("price is not configured for this app")
+
+	// ErrOneTimePrice means that a plan change was requested to the price of
+	// a product that is bought with a one-time payment
+	ErrOneTimePrice = errors.New("price is for a one-time product")
+
+	// ErrOtherFamily means that a plan change was requested to a product
+	// that isn't in the same family as the subscribed product
+	ErrOtherFamily = errors.New("price is for a product that the subscription can't be switched to")
+
+	// ErrAmbiguousItem means that a subscription has several items for the
+	// app's products, and the item to change wasn't specified
+	ErrAmbiguousItem = errors.New("subscription has several items, itemId must be specified")
+
+	// ErrNotResumable means that the subscription has no pending
+	// cancellation, or has already ended
+	ErrNotResumable = errors.New("subscription is not pending cancellation")
+)
+
+// isConfiguredProduct checks if a product is one of the app's products
+func isConfiguredProduct(app config.App, productID string) bool {
+	_, ok := app.Stripe.GetProduct(productID)
+	return ok
+}
+
+// configuredItems returns the items of a subscription that are for the
+// app's products
+func configuredItems(app config.App, sub *stripe.Subscription) (items []*stripe.SubscriptionItem) {
+	if sub.Items == nil {
+		return items
+	}
+	for _, item := range sub.Items.Data {
+		if item.Price != nil && item.Price.Product != nil &&
+			isConfiguredProduct(app, item.Price.Product.ID) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func summarizeSubscription(app config.App, sub *stripe.Subscription) models.SubscriptionSummary {
+	summary := models.SubscriptionSummary{
+		ID:                 sub.ID,
+		Status:             string(sub.Status),
+		CancelAtPeriodEnd:  sub.CancelAtPeriodEnd,
+		CancelAt:           sub.CancelAt,
+		CanceledAt:         sub.CanceledAt,
+		CurrentPeriodStart: sub.CurrentPeriodStart,
+		CurrentPeriodEnd:   sub.CurrentPeriodEnd,
+		Items:              []models.SubscriptionItemSummary{},
+	}
+	for _, item := range configuredItems(app, sub) {
+		summary.Items = append(summary.Items, models.SubscriptionItemSummary{
+			ID:        item.ID,
+			ProductID: item.Price.Product.ID,
+			PriceID:   item.Price.ID,
+			Quantity:  item.Quantity,
+		})
+	}
+	return summary
+}
+
+// GetSubscriptions lists every subscription of the user, including ended
+// ones, that contains at least one of the app's configured products
+func GetSubscriptions(app config.App, user fusionauth.User) (subs []models.SubscriptionSummary, err error) {
+	subs = []models.SubscriptionSummary{}
+
+	custID, err := GetStripeCustomerID(app, user)
+	if err != nil {
+		return subs, err
+	}
+	if custID == "" {
+		return subs, nil
+	}
+
+	provider := GetProvider(app)
+
+	params := &stripe.SubscriptionListParams{
+		Customer: custID,
+		Status:   "all",
+	}
+	iter := provider.ListSubscriptions(params)
+	for iter.Next() {
+		sub := iter.Subscription()
+		if len(configuredItems(app, sub)) == 0 {
+			continue
+		}
+		subs = append(subs, summarizeSubscription(app, sub))
+	}
+	if iter.Err() != nil {
+		return subs, fmt.Errorf(
+			"failed to list subscriptions for customer %v: %v",
+			custID,
+			iter.Err().Error(),
+		)
+	}
+	return subs, nil
+}
+
+// GetActiveSubscriptions lists the subscriptions of the user that grant
+// access right now, which are the same ones that IsUserSubscribed counts
+func GetActiveSubscriptions(app config.App, user fusionauth.User) (active []models.SubscriptionSummary, err error) {
+	active = []models.SubscriptionSummary{}
+	subs, err := GetSubscriptions(app, user)
+	if err != nil {
+		return active, err
+	}
+	for _, sub := range subs {
+		if grantsAccess(stripe.SubscriptionStatus(sub.Status)) {
+			active = append(active, sub)
+		}
+	}
+	return active, nil
+}
+
+// handleSubscriptionEvent reports the subscription states of the customer
+// of a subscription that Stripe created, updated or deleted. Subscriptions
+// without any of the app's products are ignored.
+func handleSubscriptionEvent(app config.App, eventType string, data json.RawMessage, previousAttributes json.RawMessage) error {
+	sub := &stripe.Subscription{}
+	err := json.Unmarshal(data, sub)
+	if err != nil {
+		return fmt.Errorf("failed to parse subscription: %v", err.Error())
+	}
+	configured := false
+	for _, productID := range subscriptionProductIDs(sub) {
+		configured = configured || isConfiguredProduct(app, productID)
+	}
+	if !configured || sub.Customer == nil || sub.Customer.ID == "" {
+		return nil
+	}
+
+	var previous *stripe.Subscription
+	switch eventType {
+	case StripeEventSubscriptionUpdated:
+		previous, err = previousSubscription(sub, previousAttributes)
+		if err != nil {
+			return err
+		}
+	case StripeEventSubscriptionDeleted:
+		// stripe doesn't say what the status was before, so a deleted
+		// subscription is assumed to have been active
+		copied := *sub
+		copied.Status = stripe.SubscriptionStatusActive
+		previous = &copied
+	}
+
+	user, err := findPurchaser(GetProvider(app), app, sub.Customer.ID, "", sub.Metadata, "")
+	if err != nil {
+		return err
+	}
+	changed, err := refreshSubscriptionStates(app, user, sub.Customer.ID, sub.ID, previous)
+	if err != nil {
+		return err
+	}
+	if changed {
+		NotifyAccessChanged(app, user.Id)
+	}
+	return nil
+}
+
+// previousSubscription applies the previous attributes of an updated event
+// to a copy of the subscription. Only the status and the items matter for
+// subscription states.
+func previousSubscription(sub *stripe.Subscription, previousAttributes json.RawMessage) (*stripe.Subscription, error) {
+	previous := *sub
+	if len(previousAttributes) == 0 {
+		return &previous, nil
+	}
+
+	attributes := struct {
+		Status *stripe.SubscriptionStatus   `json:"status"`
+		Items  *stripe.SubscriptionItemList `json:"items"`
+	}{}
+	err := json.Unmarshal(previousAttributes, &attributes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse previous attributes: %v", err.Error())
+	}
+	if attributes.Status != nil {
+		previous.Status = *attributes.Status
+	}
+	if attributes.Items != nil {
+		previous.Items = attributes.Items
+		previous.Plan = nil
+	}
+	return &previous, nil
+}
+
+// getOwnedSubscription retrieves a subscription and makes sure that it
+// belongs to the user and contains one of the app's products, so that users
+// can't modify each other's subscriptions or those of other apps
+func getOwnedSubscription(provider PaymentProvider, app config.App, user fusionauth.User, subID string) (sub *stripe.Subscription, custID string, err error) {
+	custID, err = GetStripeCustomerID(app, user)
+	if err != nil {
+		return nil, "", err
+	}
+	if custID == "" || subID == "" {
+		return nil, custID, ErrSubscriptionNotFound
+	}
+
+	sub, err = provider.GetSubscription(subID)
+	if isResourceMissing(err) {
+		return nil, custID, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, custID, fmt.Errorf("failed to get subscription %v: %v", subID, err.Error())
+	}
+	if sub.Customer == nil || sub.Customer.ID != custID || len(configuredItems(app, sub)) == 0 {
+		return nil, custID, ErrSubscriptionNotFound
+	}
+	return sub, custID, nil
+}
+
+// CancelSubscription cancels one of the user's subscriptions, either at the
+// end of the current period so that the user keeps access until then, or
+// immediately
+func CancelSubscription(app config.App, user fusionauth.User, subID string, immediately bool) (summary models.SubscriptionSummary, err error) {
+	provider := GetProvider(app)
+
+	sub, custID, err := getOwnedSubscription(provider, app, user, subID)
+	if err != nil {
+		return summary, err
+	}
+	previous := sub
+
+	if immediately {
+		sub, err = provider.CancelSubscription(sub.ID)
+	} else {
+		sub, err = provider.UpdateSubscription(sub.ID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+	}
+	if err != nil {
+		return summary, fmt.Errorf("failed to cancel subscription %v: %v", subID, err.Error())
+	}
+
+	updateSubscriptionStates(app, user, custID, previous)
+	return summarizeSubscription(app, sub), nil
+}
+
+// ResumeSubscription undoes a cancellation at the end of the period, as long
+// as the period hasn't ended yet
+func ResumeSubscription(app config.App, user fusionauth.User, subID string) (summary models.SubscriptionSummary, err error) {
+	provider := GetProvider(app)
+
+	sub, custID, err := getOwnedSubscription(provider, app, user, subID)
+	if err != nil {
+		return summary, err
+	}
+	if !sub.CancelAtPeriodEnd || sub.Status == stripe.SubscriptionStatusCanceled {
+		return summary, ErrNotResumable
+	}
+	previous := sub
+
+	sub, err = provider.UpdateSubscription(sub.ID, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	})
+	if err != nil {
+		return summary, fmt.Errorf("failed to resume subscription %v: %v", subID, err.Error())
+	}
+
+	updateSubscriptionStates(app, user, custID, previous)
+	return summarizeSubscription(app, sub), nil
+}
+
+// updateSubscriptionStates reports the changes that the user made to one of
+// their subscriptions. The change itself already succeeded, so a failure
+// to check the new states is only logged. Access hooks are always notified,
+// since a cancellation or plan change matters to them even before the
+// subscription state changes.
+func updateSubscriptionStates(app config.App, user fusionauth.User, custID string, previous *stripe.Subscription) {
+	defer NotifyAccessChanged(app, user.Id)
+	_, err := refreshSubscriptionStates(app, user, custID, previous.ID, previous)
+	if err != nil {
+		log.Printf(
+			"failed to refresh subscription states of customer %v: %v",
+			custID,
+			err.Error(),
+		)
+	}
+}
+
+// getChangedItem finds the subscription item that a plan change applies to
+func getChangedItem(app config.App, sub *stripe.Subscription, itemID string) (*stripe.SubscriptionItem, error) {
+	items := configuredItems(app, sub)
+	if itemID == "" {
+		if len(items) != 1 {
+			return nil, ErrAmbiguousItem
+		}
+		return items[0], nil
+	}
+	for _, item := range items {
+		if item.ID == itemID {
+			return item, nil
+		}
+	}
+	return nil, ErrSubscriptionNotFound
+}
+
+// checkPlanChange checks if a subscription item may be switched to a price,
+// which must be a subscription price of the same product, or of another
+// product in the same family
+func checkPlanChange(app config.App, item *stripe.SubscriptionItem, priceID string) error {
+	product, ok := app.Stripe.GetProductForPrice(priceID)
+	if !ok {
+		return ErrUnknownPrice
+	}
+	if product.OneTime {
+		return ErrOneTimePrice
+	}
+
+	current, _ := app.Stripe.GetProduct(item.Price.Product.ID)
+	if product.ProductID == current.ProductID {
+		return nil
+	}
+	if product.Family == "" || product.Family != current.Family {
+		return ErrOtherFamily
+	}
+	return nil
+}
+
+// PreviewPlanChange returns the upcoming invoice that switching a
+// subscription item to another configured price would produce, without
+// changing anything. The returned ProrationDate should be passed to
+// ChangePlan so that the actual change is prorated the same way.
+func PreviewPlanChange(app config.App, user fusionauth.User, subID string, body models.ChangePlanBody) (preview models.PlanChangePreview, err error) {
+	if !app.Stripe.HasPrice(body.PriceID) {
+		return preview, ErrUnknownPrice
+	}
+
+	provider := GetProvider(app)
+
+	sub, custID, err := getOwnedSubscription(provider, app, user, subID)
+	if err != nil {
+		return preview, err
+	}
+	item, err := getChangedItem(app, sub, body.ItemID)
+	if err != nil {
+		return preview, err
+	}
+	err = checkPlanChange(app, item, body.PriceID)
+	if err != nil {
+		return preview, err
+	}
+
+	prorationDate := time.Now().Unix()
+	invoice, err := provider.GetUpcomingInvoice(&stripe.InvoiceParams{
+		Customer:     stripe.String(custID),
+		Subscription: stripe.String(sub.ID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(item.ID),
+				Price: stripe.String(body.PriceID),
+			},
+		},
+		SubscriptionProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+		SubscriptionProrationDate:     stripe.Int64(prorationDate),
+	})
+	if err != nil {
+		return preview, fmt.Errorf(
+			"failed to preview plan change for subscription %v: %v",
+			subID,
+			err.Error(),
+		)
+	}
+
+	preview = models.PlanChangePreview{
+		SubscriptionID: sub.ID,
+		ItemID:         item.ID,
+		PriceID:        body.PriceID,
+		ProrationDate:  prorationDate,
+		Currency:       string(invoice.Currency),
+		Subtotal:       invoice.Subtotal,
+		Total:          invoice.Total,
+		AmountDue:      invoice.AmountDue,
+		Lines:          []models.InvoiceLineSummary{},
+	}
+	if invoice.Lines != nil {
+		for _, line := range invoice.Lines.Data {
+			summary := models.InvoiceLineSummary{
+				Description: line.Description,
+				Amount:      line.Amount,
+				Proration:   line.Proration,
+			}
+			if line.Period != nil {
+				summary.PeriodStart = line.Period.Start
+				summary.PeriodEnd = line.Period.End
+			}
+			preview.Lines = append(preview.Lines, summary)
+		}
+	}
+	return preview, nil
+}
+
+// ChangePlan switches a subscription item to another configured price, with
+// prorations. body.ProrationDate should come from PreviewPlanChange.
+func ChangePlan(app config.App, user fusionauth.User, subID string, body models.ChangePlanBody) (summary models.SubscriptionSummary, err error) {
+	if !app.Stripe.HasPrice(body.PriceID) {
+		return summary, ErrUnknownPrice
+	}
+
+	provider := GetProvider(app)
+
+	sub, custID, err := getOwnedSubscription(provider, app, user, subID)
+	if err != nil {
+		return summary, err
+	}
+	item, err := getChangedItem(app, sub, body.ItemID)
+	if err != nil {
+		return summary, err
+	}
+	err = checkPlanChange(app, item, body.PriceID)
+	if err != nil {
+		return summary, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(item.ID),
+				Price: stripe.String(body.PriceID),
+			},
+		},
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+	}
+	if body.ProrationDate > 0 {
+		params.ProrationDate = stripe.Int64(body.ProrationDate)
+	}
+	previous := sub
+	sub, err = provider.UpdateSubscription(sub.ID, params)
+	if err != nil {
+		return summary, fmt.Errorf("failed to change plan of subscription %v: %v", subID, err.Error())
+	}
+
+	// the user may have switched between products
+	updateSubscriptionStates(app, user, custID, previous)
+	return summarizeSubscription(app, sub), nil
+}
@@ -0,0 +1,302 @@
+package payments
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+	"fa-middleware/webhooks"
+
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	testProductID = "prod_pro"
+	testPriceID   = "price_pro_monthly"
+	testFamily    = "plans"
+)
+
+// newTestApp returns an app in dev mode, so that FusionAuth and Stripe are
+// kept in memory, and a user of it with a Stripe customer. The app has a
+// webhook endpoint for every event, and extraProducts besides the test
+// product.
+func newTestApp(t *testing.T, extraProducts ...models.StripeProduct) (config.App, fusionauth.User) {
+	t.Helper()
+	InitializeSubscribedUserCache()
+
+	conf := config.Config{
+		Apps: []config.App{
+			{
+				Domain:        strings.ToLower(t.Name()) + ".test",
+				FullDomainURL: "https://" + strings.ToLower(t.Name()) + ".test",
+				Mode:          config.AppModeDev,
+				FusionAuth: config.FusionAuthConfig{
+					AppID:    config.DevAppID,
+					TenantID: config.DevTenantID,
+				},
+				Stripe: config.StripeConfig{
+					Provider: config.PaymentProviderFake,
+					Products: append([]models.StripeProduct{
+						{
+							ProductID:    testProductID,
+							PriceIDs:     []string{testPriceID, "price_pro_yearly"},
+							Entitlements: []string{"reports"},
+							Family:       testFamily,
+						},
+					}, extraProducts...),
+				},
+				Webhooks: []config.WebhookConfig{
+					{URL: "https://hooks.test/events", Secret: "whsec_test"},
+				},
+			},
+		},
+	}
+
+	app := conf.Apps[0]
+	cust, err := GetFakeProvider(app).NewCustomer(&stripe.CustomerParams{
+		Email: stripe.String("subscriber@example.com"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create customer: %v", err)
+	}
+	conf.Apps[0].Dev.Fixtures.Users = []models.DevUser{
+		{
+			ID:       "user-" + cust.ID,
+			Email:    "subscriber@example.com",
+			Password: "password1234",
+			Data:     map[string]interface{}{StripeCustomerIDField: cust.ID},
+		},
+	}
+	err = conf.InitClients()
+	if err != nil {
+		t.Fatalf("failed to init clients: %v", err)
+	}
+
+	app = conf.Apps[0]
+	user := fusionauth.User{
+		Email: "subscriber@example.com",
+		Data:  map[string]interface{}{StripeCustomerIDField: cust.ID},
+	}
+	user.Id = "user-" + cust.ID
+	return app, user
+}
+
+// subscribe pays for a subscription checkout session, and returns the new
+// subscription
+func subscribe(t *testing.T, app config.App, user fusionauth.User) *stripe.Subscription {
+	t.Helper()
+	fake := GetFakeProvider(app)
+	params := &stripe.CheckoutSessionParams{
+		Customer: stripe.String(user.Data[StripeCustomerIDField].(string)),
+		Mode:     stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String(testPriceID), Quantity: stripe.Int64(1)},
+		},
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{},
+	}
+	params.SubscriptionData.AddMetadata(MetadataUserID, user.Id)
+	session, err := fake.NewCheckoutSession(params)
+	if err != nil {
+		t.Fatalf("failed to create checkout session: %v", err)
+	}
+	session, err = fake.CompleteCheckoutSession(app, session.ID)
+	if err != nil {
+		t.Fatalf("failed to complete checkout session: %v", err)
+	}
+	sub, err := fake.GetSubscription(session.Subscription.ID)
+	if err != nil {
+		t.Fatalf("failed to get subscription: %v", err)
+	}
+	return sub
+}
+
+// captureJobs swaps in an empty job queue, and returns a function that
+// claims every job that was queued since
+func captureJobs(t *testing.T) func() []models.Job {
+	t.Helper()
+	previous := jobs.Default
+	queue := jobs.NewMemoryQueue()
+	jobs.Default = queue
+	t.Cleanup(func() { jobs.Default = previous })
+
+	return func() []models.Job {
+		claimed, err := queue.Claim(context.Background(), 1000, time.Minute)
+		if err != nil {
+			t.Fatalf("failed to claim jobs: %v", err)
+		}
+		return claimed
+	}
+}
+
+// webhookEvents returns the event types of the webhook deliveries among
+// queued jobs
+func webhookEvents(t *testing.T, queued []models.Job) (eventTypes []string) {
+	t.Helper()
+	for _, job := range queued {
+		if job.Type != webhooks.JobTypeDeliver {
+			continue
+		}
+		delivery := models.WebhookDelivery{}
+		err := json.Unmarshal(job.Payload, &delivery)
+		if err != nil {
+			t.Fatalf("failed to decode delivery: %v", err)
+		}
+		eventTypes = append(eventTypes, delivery.EventType)
+	}
+	return eventTypes
+}
+
+func expectEvents(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+}
+
+func TestCancelSubscriptionEmitsCanceled(t *testing.T) {
+	for _, checkedBefore := range []bool{true, false} {
+		app, user := newTestApp(t)
+		sub := subscribe(t, app, user)
+		if checkedBefore {
+			subscribed, err := IsUserSubscribed(app, user, testProductID)
+			if err != nil || !subscribed {
+				t.Fatalf("expected to be subscribed, got %v: %v", subscribed, err)
+			}
+		}
+
+		queued := captureJobs(t)
+		_, err := CancelSubscription(app, user, sub.ID, true)
+		if err != nil {
+			t.Fatalf("failed to cancel: %v", err)
+		}
+		expectEvents(t, webhookEvents(t, queued()), models.EventSubscriptionCanceled)
+
+		// the stripe event for the same cancellation isn't reported again
+		data, _ := json.Marshal(sub)
+		err = HandleStripeEvent(app, StripeEventSubscriptionDeleted, data, nil)
+		if err != nil {
+			t.Fatalf("failed to handle event: %v", err)
+		}
+		expectEvents(t, webhookEvents(t, queued()))
+	}
+}
+
+func TestCancelAtPeriodEndKeepsAccess(t *testing.T) {
+	app, user := newTestApp(t)
+	sub := subscribe(t, app, user)
+
+	queued := captureJobs(t)
+	_, err := CancelSubscription(app, user, sub.ID, false)
+	if err != nil {
+		t.Fatalf("failed to cancel: %v", err)
+	}
+	expectEvents(t, webhookEvents(t, queued()))
+
+	subscribed, err := IsUserSubscribed(app, user, testProductID)
+	if err != nil || !subscribed {
+		t.Errorf("expected access until the end of the period, got %v: %v", subscribed, err)
+	}
+}
+
+func TestSubscriptionStripeEvents(t *testing.T) {
+	app, user := newTestApp(t)
+	queued := captureJobs(t)
+
+	// created in the stripe dashboard
+	sub := subscribe(t, app, user)
+	queued()
+	data, _ := json.Marshal(sub)
+	err := HandleStripeEvent(app, StripeEventSubscriptionCreated, data, nil)
+	if err != nil {
+		t.Fatalf("failed to handle event: %v", err)
+	}
+	expectEvents(t, webhookEvents(t, queued()), models.EventSubscriptionActivated)
+
+	// a renewal doesn't change anything
+	err = HandleStripeEvent(app, StripeEventSubscriptionUpdated, data, json.RawMessage(`{"current_period_end": 1}`))
+	if err != nil {
+		t.Fatalf("failed to handle event: %v", err)
+	}
+	expectEvents(t, webhookEvents(t, queued()))
+
+	// canceled in the stripe dashboard
+	_, err = GetFakeProvider(app).CancelSubscription(sub.ID)
+	if err != nil {
+		t.Fatalf("failed to cancel: %v", err)
+	}
+	err = HandleStripeEvent(app, StripeEventSubscriptionDeleted, data, nil)
+	if err != nil {
+		t.Fatalf("failed to handle event: %v", err)
+	}
+	expectEvents(t, webhookEvents(t, queued()), models.EventSubscriptionCanceled)
+}
+
+func TestPreviousSubscription(t *testing.T) {
+	sub := &stripe.Subscription{
+		ID:     "sub_1",
+		Status: stripe.SubscriptionStatusActive,
+		Items: &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{
+			{Price: &stripe.Price{Product: &stripe.Product{ID: "prod_new"}}},
+		}},
+	}
+
+	previous, err := previousSubscription(sub, json.RawMessage(`{
+		"status": "past_due",
+		"items": {"data": [{"price": {"product": "prod_old"}}]}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to apply previous attributes: %v", err)
+	}
+	if previous.Status != stripe.SubscriptionStatusPastDue {
+		t.Errorf("expected the previous status, got %v", previous.Status)
+	}
+	if ids := subscriptionProductIDs(previous); len(ids) != 1 || ids[0] != "prod_old" {
+		t.Errorf("expected the previous product, got %v", ids)
+	}
+	if sub.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("expected the subscription itself to be unchanged")
+	}
+}
+
+func TestChangePlanChecksThePrice(t *testing.T) {
+	app, user := newTestApp(t,
+		models.StripeProduct{ProductID: "prod_team", PriceIDs: []string{"price_team"}, Family: testFamily},
+		models.StripeProduct{ProductID: "prod_addon", PriceIDs: []string{"price_addon"}},
+		models.StripeProduct{ProductID: "prod_lifetime", PriceIDs: []string{"price_lifetime"}, OneTime: true},
+	)
+	sub := subscribe(t, app, user)
+
+	for priceID, expected := range map[string]error{
+		"price_unknown":    ErrUnknownPrice,
+		"price_lifetime":   ErrOneTimePrice,
+		"price_addon":      ErrOtherFamily,
+		"price_pro_yearly": nil,
+		"price_team":       nil,
+	} {
+		_, err := PreviewPlanChange(app, user, sub.ID, models.ChangePlanBody{PriceID: priceID})
+		if err != expected {
+			t.Errorf("expected previewing %v to fail with %v, got %v", priceID, expected, err)
+		}
+		if expected == nil {
+			continue
+		}
+		_, err = ChangePlan(app, user, sub.ID, models.ChangePlanBody{PriceID: priceID})
+		if err != expected {
+			t.Errorf("expected changing to %v to fail with %v, got %v", priceID, expected, err)
+		}
+	}
+
+	summary, err := ChangePlan(app, user, sub.ID, models.ChangePlanBody{PriceID: "price_team"})
+	if err != nil {
+		t.Fatalf("failed to change plan: %v", err)
+	}
+	if len(summary.Items) != 1 || summary.Items[0].ProductID != "prod_team" {
+		t.Errorf("expected the subscription to be switched to the team plan, got %+v", summary.Items)
+	}
+}
@@ -0,0 +1,185 @@
+// Package proxy puts apps that don't know about FusionAuth or Stripe behind
+// the middleware. Every app can declare routes in proxy.routes that send
+// requests with a path prefix to an upstream, once the user meets the
+// route's requirements. The app's JWT cookie is removed before the request
+// is passed on, and the user is described in signed identity headers
+// instead, see Verify.
+package proxy
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/guard"
+	h "fa-middleware/helpers"
+	"fa-middleware/payments"
+
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Handler sends requests to the upstream of the matching route of the app
+// that they're for, as found by their Host header
+type Handler struct {
+	getConfig func() config.Config
+}
+
+// New returns a handler that looks up the routes in the current config on
+// every request, so that reloads apply
+func New(getConfig func() config.Config) *Handler {
+	return &Handler{getConfig: getConfig}
+}
+
+func (p *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conf := p.getConfig()
+	app, ok := conf.GetAppByDomain(r.Host)
+	if !ok {
+		http.Error(w, h.NotFound, 404)
+		return
+	}
+	route, ok := findRoute(app, r.URL.Path)
+	if !ok {
+		http.Error(w, h.NotFound, 404)
+		return
+	}
+
+	// identity headers may only come from the middleware itself
+	for _, header := range guard.IdentityHeaders {
+		r.Header.Del(header)
+	}
+	r.Header.Del(SignatureHeader)
+
+	if route.Anonymous {
+		// the user is described if they're logged in, but they don't have
+		// to be
+		identity, _ := guard.New(app).Check(r, guard.Requirement{})
+		p.forward(w, r, app, route, identity)
+		return
+	}
+
+	g := guard.New(app, redirectOptions(app)...)
+	g.HTTP().Require(guard.Requirement{
+		Role:        route.Role,
+		Product:     route.Product,
+		Entitlement: route.Entitlement,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := guard.IdentityFromContext(r.Context())
+		p.forward(w, r, app, route, identity)
+	})).ServeHTTP(w, r)
+}
+
+// redirectOptions only redirects the failures that the app has a page for
+func redirectOptions(app config.App) (options []guard.Option) {
+	if app.Proxy.LoginURL != "" {
+		options = append(options, guard.WithRedirect(401, app.Proxy.LoginURL))
+	}
+	if app.Proxy.PricingURL != "" {
+		options = append(options, guard.WithRedirect(402, app.Proxy.PricingURL))
+	}
+	return options
+}
+
+// findRoute returns the route with the longest path prefix that matches
+// path. A prefix only matches whole path segments, so /app matches /app and
+// /app/x but not /apple. A trailing slash doesn't make a prefix longer, so
+// of /app and /app/ the one that is configured first wins.
+func findRoute(app config.App, path string) (route config.ProxyRoute, ok bool) {
+	longest := 0
+	for _, candidate := range app.Proxy.Routes {
+		prefix := strings.TrimSuffix(candidate.PathPrefix, "/")
+		matches := path == prefix || strings.HasPrefix(path, prefix+"/")
+		if matches && (!ok || len(prefix) > longest) {
+			route = candidate
+			longest = len(prefix)
+			ok = true
+		}
+	}
+	return route, ok
+}
+
+// forward streams the request to the route's upstream and the response
+// back. identity is nil for anonymous users.
+func (p *Handler) forward(w http.ResponseWriter, r *http.Request, app config.App, route config.ProxyRoute, identity *guard.Identity) {
+	upstream, err := url.Parse(route.Upstream)
+	if err != nil {
+		log.Printf("proxy: invalid upstream %v: %v", route.Upstream, err.Error())
+		http.Error(w, h.ServerError, 500)
+		return
+	}
+
+	if identity != nil {
+		entitlements, err := payments.GetEntitlements(app, identity.User)
+		if err != nil {
+			log.Printf(
+				"proxy: failed to get entitlements of user %v: %v",
+				identity.User.Id,
+				err.Error(),
+			)
+			http.Error(w, h.ServerError, 500)
+			return
+		}
+		guard.SetIdentityHeaders(r.Header, identity, entitlements)
+		r.Header.Set(SignatureHeader, Sign(app.Proxy.Secret, time.Now(), r.Header))
+	}
+	removeCookie(r, app.JWT.CookieName)
+
+	path := r.URL.Path
+	if route.StripPrefix {
+		path = "/" + strings.TrimPrefix(
+			strings.TrimPrefix(path, strings.TrimSuffix(route.PathPrefix, "/")),
+			"/",
+		)
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = upstream.Scheme
+			out.URL.Host = upstream.Host
+			out.URL.Path = singleJoiningSlash(upstream.Path, path)
+			out.URL.RawPath = ""
+			out.Header.Set("X-Forwarded-Host", r.Host)
+			if r.TLS != nil {
+				out.Header.Set("X-Forwarded-Proto", "https")
+			} else if out.Header.Get("X-Forwarded-Proto") == "" {
+				out.Header.Set("X-Forwarded-Proto", "http")
+			}
+			// keep go's default user agent from being added
+			if _, ok := out.Header["User-Agent"]; !ok {
+				out.Header.Set("User-Agent", "")
+			}
+		},
+		// responses are streamed, such as server-sent events
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("proxy: failed to reach upstream %v: %v", route.Upstream, err.Error())
+			http.Error(w, "bad gateway", 502)
+		},
+	}
+	reverseProxy.ServeHTTP(w, r)
+}
+
+// removeCookie keeps the user's JWT from reaching upstreams, which get the
+// identity headers instead
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func singleJoiningSlash(a string, b string) string {
+	aSlash := strings.HasSuffix(a, "/")
+	bSlash := strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+	return a + b
+}
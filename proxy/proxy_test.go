@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/guard"
+
+	"net/http"
+	"testing"
+	"time"
+)
+
+// signedHeader returns identity headers signed at the given time
+func signedHeader(secret string, signedAt time.Time) http.Header {
+	header := http.Header{}
+	header.Set(guard.HeaderUserID, "user-1")
+	header.Set(guard.HeaderUserEmail, "user@example.com")
+	header.Set(guard.HeaderEntitlements, "reports")
+	header.Set(SignatureHeader, Sign(secret, signedAt, header))
+	return header
+}
+
+func TestVerify(t *testing.T) {
+	header := signedHeader("secret", time.Now())
+	if err := Verify("secret", header, DefaultMaxSignatureAge); err != nil {
+		t.Errorf("expected the signature to be valid, got %v", err)
+	}
+	if err := Verify("other-secret", header, DefaultMaxSignatureAge); err == nil {
+		t.Errorf("expected a different secret to be rejected")
+	}
+
+	header.Set(guard.HeaderEntitlements, "reports,admin")
+	if err := Verify("secret", header, DefaultMaxSignatureAge); err == nil {
+		t.Errorf("expected a changed identity header to be rejected")
+	}
+
+	header = signedHeader("secret", time.Now().Add(-DefaultMaxSignatureAge-time.Minute))
+	if err := Verify("secret", header, DefaultMaxSignatureAge); err == nil {
+		t.Errorf("expected an old signature to be rejected")
+	}
+
+	header = signedHeader("secret", time.Now().Add(DefaultMaxSignatureAge))
+	if err := Verify("secret", header, DefaultMaxSignatureAge); err == nil {
+		t.Errorf("expected a signature from the future to be rejected")
+	}
+	header = signedHeader("secret", time.Now().Add(maxSignatureSkew/2))
+	if err := Verify("secret", header, DefaultMaxSignatureAge); err != nil {
+		t.Errorf("expected a little clock skew to be allowed, got %v", err)
+	}
+
+	header.Del(SignatureHeader)
+	if err := Verify("secret", header, DefaultMaxSignatureAge); err == nil {
+		t.Errorf("expected a request without a signature to be rejected")
+	}
+}
+
+func TestFindRoute(t *testing.T) {
+	app := config.App{Proxy: config.ProxyConfig{Routes: []config.ProxyRoute{
+		{PathPrefix: "/", Upstream: "http://site"},
+		{PathPrefix: "/app", Upstream: "http://app"},
+		{PathPrefix: "/app/reports/", Upstream: "http://reports"},
+	}}}
+	for path, expected := range map[string]string{
+		"/":                 "http://site",
+		"/apple":            "http://site",
+		"/app":              "http://app",
+		"/app/settings":     "http://app",
+		"/app/reports":      "http://reports",
+		"/app/reports/2024": "http://reports",
+	} {
+		route, ok := findRoute(app, path)
+		if !ok || route.Upstream != expected {
+			t.Errorf("%v: expected %v, got %v", path, expected, route.Upstream)
+		}
+	}
+
+	for _, routes := range [][]config.ProxyRoute{
+		{{PathPrefix: "/app", Upstream: "http://first"}, {PathPrefix: "/app/", Upstream: "http://second"}},
+		{{PathPrefix: "/app/", Upstream: "http://first"}, {PathPrefix: "/app", Upstream: "http://second"}},
+	} {
+		tied := config.App{Proxy: config.ProxyConfig{Routes: routes}}
+		route, _ := findRoute(tied, "/app/settings")
+		if route.Upstream != "http://first" {
+			t.Errorf("expected the first of %v and %v to win, got %v", routes[0].PathPrefix, routes[1].PathPrefix, route.Upstream)
+		}
+	}
+
+	app.Proxy.Routes = app.Proxy.Routes[1:]
+	if route, ok := findRoute(app, "/apple"); ok {
+		t.Errorf("expected /apple not to match, got %v", route.Upstream)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fa-middleware/guard"
+	"fa-middleware/webhooks"
+
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader contains "t=<unix timestamp>,v1=<signature>", where the
+	// signature is the hex-encoded HMAC-SHA256 of "<timestamp>." followed by
+	// the values of the identity headers, each on its own line, using
+	// proxy.secret. It's the same scheme as outbound webhooks.
+	SignatureHeader = "X-Identity-Signature"
+
+	// DefaultMaxSignatureAge is how old a signature may be for Verify to
+	// accept it
+	DefaultMaxSignatureAge = time.Minute * 5
+
+	// maxSignatureSkew is how far ahead of the upstream's clock the
+	// middleware's clock may be
+	maxSignatureSkew = time.Second * 30
+)
+
+// Sign computes the value of the SignatureHeader for the identity headers in
+// header
+func Sign(secret string, timestamp time.Time, header http.Header) string {
+	return webhooks.Sign(secret, timestamp, identityPayload(header))
+}
+
+// Verify checks that the identity headers of a request that an upstream
+// received were set by the middleware no longer than maxAge ago. Requests
+// without a signature are from anonymous users.
+func Verify(secret string, header http.Header, maxAge time.Duration) error {
+	signature := header.Get(SignatureHeader)
+	if signature == "" {
+		return errors.New("the request has no identity signature")
+	}
+
+	timestamp := int64(0)
+	for _, part := range strings.Split(signature, ",") {
+		if strings.HasPrefix(part, "t=") {
+			parsed, err := strconv.ParseInt(strings.TrimPrefix(part, "t="), 10, 64)
+			if err != nil {
+				return errors.New("the identity signature has an invalid timestamp")
+			}
+			timestamp = parsed
+		}
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if time.Since(signedAt) > maxAge {
+		return errors.New("the identity signature has expired")
+	}
+	// allow for some clock skew, but a signature from further in the
+	// future would stay valid for longer than maxAge
+	if signedAt.After(time.Now().Add(maxSignatureSkew)) {
+		return errors.New("the identity signature is from the future")
+	}
+
+	expected := Sign(secret, signedAt, header)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("the identity signature is invalid")
+	}
+	return nil
+}
+
+func identityPayload(header http.Header) []byte {
+	values := []string{}
+	for _, name := range guard.IdentityHeaders {
+		values = append(values, header.Get(name))
+	}
+	return []byte(strings.Join(values, "\n"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/jobs"
+	"fa-middleware/payments"
+	"fa-middleware/store"
+
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// reconcile implements the reconcile subcommand, which compares the
+// FusionAuth users of each app with the customers of its Stripe account
+// and prints every mismatch. With -fix the mismatches are repaired as well.
+// It exits with 1 on errors and with 2 if any issues are left unfixed.
+//
+// Usage: fa-middleware reconcile [-fix] [-app example.com] [-json] [-config /res/config.yml]
+func reconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "repair the mismatches instead of only reporting them")
+	domain := flags.String("app", "", "only reconcile the app with this domain")
+	asJSON := flags.Bool("json", false, "print the reports as json")
+	confFile := flags.String("config", config.GetConfigFilePath(), "path to the config file")
+	_ = flags.Parse(args)
+
+	payments.InitializeSubscribedUserCache()
+
+	conf, err := config.LoadConfigYamlFile(*confFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	err = conf.InitClients()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	if conf.Global.DatabaseURL != "" {
+		err = store.Initialize(context.Background(), conf.Global.DatabaseURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to initialize database: %v\n", err.Error())
+			return 1
+		}
+		defer store.DB.Close()
+	}
+
+	// webhook events from fixes are queued for the running middleware to
+	// deliver, which only works when the queue is in the database
+	jobs.Initialize()
+
+	apps := conf.Apps
+	if *domain != "" {
+		app, ok := conf.GetAppByDomain(*domain)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no app is configured for domain %v\n", *domain)
+			return 1
+		}
+		apps = []config.App{app}
+	}
+
+	reports := []payments.ReconcileReport{}
+	exitCode := 0
+	for _, app := range apps {
+		report, err := payments.Reconcile(app, *fix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to reconcile %v: %v\n", app.Domain, err.Error())
+			return 1
+		}
+		if report.Unfixed() > 0 {
+			exitCode = 2
+		}
+		reports = append(reports, report)
+
+		if *asJSON {
+			continue
+		}
+		fmt.Printf(
+			"%v: %v users, %v customers, %v issue(s), %v unfixed\n",
+			app.Domain,
+			report.Users,
+			report.Customers,
+			len(report.Issues),
+			report.Unfixed(),
+		)
+		for _, issue := range report.Issues {
+			fmt.Printf("  %v\n", payments.FormatReconcileIssue(issue))
+		}
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		fmt.Println(string(data))
+	}
+
+	return exitCode
+}
@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/payments"
+
+	"log"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/gin-gonic/gin"
+)
+
+// GetCheckoutSession responds with the state of one of the logged-in
+// user's checkout sessions, or a 404 if it isn't theirs
+func GetCheckoutSession(c *gin.Context, app config.App, user fusionauth.User) {
+	status, err := payments.GetCheckoutSession(app, user, c.Param("id"))
+	if err == payments.ErrCheckoutSessionNotFound {
+		h.Simple404(c)
+		return
+	}
+	if err != nil {
+		log.Printf(
+			"failed to get checkout session %v for user %v: %v",
+			c.Param("id"),
+			user.Id,
+			err.Error(),
+		)
+		h.Simple500(c)
+		return
+	}
+	c.JSON(200, status)
+}
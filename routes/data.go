@@ -0,0 +1,277 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/gin-gonic/gin"
+)
+
+// dataKeyPattern restricts user data keys so that they are safe to use in
+// urls without any escaping
+var dataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// dataRequest is a single read, write or delete of a user data key, either
+// from the user themselves or from a private api call
+type dataRequest struct {
+	app             config.App
+	user            fusionauth.User
+	key             string
+	expectedVersion int64
+	createOnly      bool
+}
+
+// GetData responds with the value stored under the :key url param for the
+// logged-in user, and sets the ETag header to its version
+func GetData(c *gin.Context, app config.App, user fusionauth.User) {
+	req, ok := newDataRequest(c, app, user, c.Param("key"))
+	if !ok {
+		return
+	}
+	getData(c, req)
+}
+
+// PutData stores the JSON request body under the :key url param for the
+// logged-in user. If-Match can be set to the ETag from a previous read so
+// that concurrent changes aren't overwritten, and If-None-Match: * only
+// allows creating a new key.
+func PutData(c *gin.Context, app config.App, user fusionauth.User) {
+	req, ok := newDataRequest(c, app, user, c.Param("key"))
+	if !ok {
+		return
+	}
+	req.expectedVersion, req.createOnly, ok = parseConditionalHeaders(c, req)
+	if !ok {
+		return
+	}
+
+	// read one byte past the limit so that putData can tell that the value
+	// is too large without reading an unbounded body
+	maxBytes := int64(app.Data.GetMaxValueBytes())
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+	if err != nil {
+		h.Simple400(c)
+		return
+	}
+	putData(c, req, body)
+}
+
+// DeleteData removes the :key url param for the logged-in user. If-Match can
+// be set to the ETag from a previous read.
+func DeleteData(c *gin.Context, app config.App, user fusionauth.User) {
+	req, ok := newDataRequest(c, app, user, c.Param("key"))
+	if !ok {
+		return
+	}
+	req.expectedVersion, _, ok = parseConditionalHeaders(c, req)
+	if !ok {
+		return
+	}
+	deleteData(c, req)
+}
+
+// PrivateData enables other api's to read and write the same user data that
+// the user can access via /mw/data
+func PrivateData(c *gin.Context, conf config.Config) {
+	body := models.PrivateDataBody{}
+	err := c.BindJSON(&body)
+	if err != nil {
+		return
+	}
+
+	app, user, ok := GetPrivateAppAndUser(c, conf, body.APIKey, body.JWT, body.UserID)
+	if !ok {
+		return
+	}
+
+	req, ok := newDataRequest(c, app, user, body.DataKey)
+	if !ok {
+		return
+	}
+	req.expectedVersion = body.Version
+
+	switch body.Action {
+	case "get":
+		getData(c, req)
+	case "put":
+		putData(c, req, body.Value)
+	case "delete":
+		deleteData(c, req)
+	default:
+		c.Data(400, "text/plain", []byte("action must be one of get, put or delete"))
+	}
+}
+
+// newDataRequest validates the key and makes sure that the database is
+// enabled. It will set the gin response if there's an error.
+func newDataRequest(c *gin.Context, app config.App, user fusionauth.User, key string) (req dataRequest, ok bool) {
+	if store.DB == nil {
+		c.Data(501, "text/plain", []byte("user data storage is not enabled"))
+		return req, false
+	}
+	if !dataKeyPattern.MatchString(key) {
+		c.Data(400, "text/plain", []byte("invalid key"))
+		return req, false
+	}
+	return dataRequest{app: app, user: user, key: key}, true
+}
+
+// parseConditionalHeaders reads If-Match and If-None-Match. If-Match: * is
+// resolved to the key's current version, since the key must exist.
+func parseConditionalHeaders(c *gin.Context, req dataRequest) (expectedVersion int64, createOnly bool, ok bool) {
+	if c.GetHeader("If-None-Match") == "*" {
+		return 0, true, true
+	}
+
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		return 0, false, true
+	}
+
+	if ifMatch == "*" {
+		entry, found, err := store.DB.GetUserData(
+			context.Background(),
+			req.app.FusionAuth.AppID,
+			req.user.Id,
+			req.key,
+		)
+		if err != nil {
+			log.Printf("failed to check user data for If-Match: %v", err.Error())
+			h.Simple500(c)
+			return 0, false, false
+		}
+		if !found {
+			c.Data(412, "text/plain", []byte("precondition failed"))
+			return 0, false, false
+		}
+		return entry.Version, false, true
+	}
+
+	version, err := strconv.ParseInt(
+		strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`),
+		10,
+		64,
+	)
+	if err != nil || version < 1 {
+		c.Data(400, "text/plain", []byte("invalid If-Match header"))
+		return 0, false, false
+	}
+	return version, false, true
+}
+
+func setDataETag(c *gin.Context, entry models.UserDataEntry) {
+	c.Header("ETag", fmt.Sprintf(`"%v"`, entry.Version))
+}
+
+func getData(c *gin.Context, req dataRequest) {
+	entry, found, err := store.DB.GetUserData(
+		context.Background(),
+		req.app.FusionAuth.AppID,
+		req.user.Id,
+		req.key,
+	)
+	if err != nil {
+		log.Printf("failed to get user data: %v", err.Error())
+		h.Simple500(c)
+		return
+	}
+	if !found {
+		h.Simple404(c)
+		return
+	}
+
+	setDataETag(c, entry)
+	c.JSON(200, entry)
+}
+
+func putData(c *gin.Context, req dataRequest, value []byte) {
+	if len(value) > req.app.Data.GetMaxValueBytes() {
+		c.Data(413, "text/plain", []byte("value is too large"))
+		return
+	}
+	if len(value) == 0 || !json.Valid(value) {
+		c.Data(400, "text/plain", []byte("value must be valid json"))
+		return
+	}
+
+	ctx := context.Background()
+	appID := req.app.FusionAuth.AppID
+
+	// only new keys count towards the limit, so there's no need to check
+	// when the key is required to exist already
+	if req.expectedVersion == 0 {
+		_, found, err := store.DB.GetUserData(ctx, appID, req.user.Id, req.key)
+		if err != nil {
+			log.Printf("failed to get user data: %v", err.Error())
+			h.Simple500(c)
+			return
+		}
+		if !found {
+			count, err := store.DB.CountUserData(ctx, appID, req.user.Id)
+			if err != nil {
+				log.Printf("failed to count user data: %v", err.Error())
+				h.Simple500(c)
+				return
+			}
+			if count >= req.app.Data.GetMaxKeys() {
+				c.Data(403, "text/plain", []byte("too many keys"))
+				return
+			}
+		}
+	}
+
+	entry, err := store.DB.PutUserData(ctx, store.UserDataWrite{
+		AppID:           appID,
+		UserID:          req.user.Id,
+		Key:             req.key,
+		Value:           value,
+		ExpectedVersion: req.expectedVersion,
+		CreateOnly:      req.createOnly,
+	})
+	if err == store.ErrVersionConflict {
+		c.Data(412, "text/plain", []byte("precondition failed"))
+		return
+	}
+	if err != nil {
+		log.Printf("failed to put user data: %v", err.Error())
+		h.Simple500(c)
+		return
+	}
+
+	setDataETag(c, entry)
+	c.JSON(200, entry)
+}
+
+func deleteData(c *gin.Context, req dataRequest) {
+	err := store.DB.DeleteUserData(
+		context.Background(),
+		req.app.FusionAuth.AppID,
+		req.user.Id,
+		req.key,
+		req.expectedVersion,
+	)
+	switch err {
+	case nil:
+		c.Status(204)
+	case store.ErrNotFound:
+		h.Simple404(c)
+	case store.ErrVersionConflict:
+		c.Data(412, "text/plain", []byte("precondition failed"))
+	default:
+		log.Printf("failed to delete user data: %v", err.Error())
+		h.Simple500(c)
+	}
+}
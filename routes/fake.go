@@ -0,0 +1,43 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/payments"
+
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FakeCheckout is the checkout page of apps that use the fake payment
+// provider. Visiting it pays the session right away and redirects to the
+// success URL; adding ?cancel=true redirects to the cancel URL instead and
+// leaves the session open.
+func FakeCheckout(c *gin.Context, conf config.Config) {
+	sessionID := c.Param("id")
+	app, fake, ok := payments.FindFakeCheckoutSession(conf, sessionID)
+	if !ok {
+		h.Simple404(c)
+		return
+	}
+
+	if c.Query("cancel") != "" {
+		session, err := fake.GetCheckoutSession(sessionID, nil)
+		if err != nil {
+			h.Simple404(c)
+			return
+		}
+		c.Redirect(303, session.CancelURL)
+		return
+	}
+
+	session, err := fake.CompleteCheckoutSession(app, sessionID)
+	if err != nil {
+		log.Printf("failed to complete fake checkout session %v: %v", sessionID, err.Error())
+		c.Data(400, "text/plain", []byte(err.Error()))
+		return
+	}
+	c.Redirect(303, strings.ReplaceAll(session.SuccessURL, "{CHECKOUT_SESSION_ID}", session.ID))
+}
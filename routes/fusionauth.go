@@ -0,0 +1,173 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+	"fa-middleware/store"
+
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FusionAuth user event types that are handled by FusionAuthWebhook
+const (
+	FAEventUserDelete             = "user.delete"
+	FAEventUserUpdate             = "user.update"
+	FAEventUserDeactivate         = "user.deactivate"
+	FAEventUserReactivate         = "user.reactivate"
+	FAEventUserEmailVerified      = "user.email.verified"
+	FAEventUserRegistrationPrefix = "user.registration."
+	FAEventUserRegistrationDelete = "user.registration.delete"
+)
+
+// FusionAuthWebhook receives user lifecycle events from FusionAuth, so that
+// changes made in the FusionAuth UI are reflected in the Stripe customer and
+// in the cached subscription state
+//
+// https://fusionauth.io/docs/v1/tech/events-webhooks/
+func FusionAuthWebhook(c *gin.Context, conf config.Config) {
+	if !conf.Global.FusionAuthWebhook.Enabled() {
+		h.Simple404(c)
+		return
+	}
+	if !isFusionAuthWebhookAuthorized(c, conf.Global.FusionAuthWebhook) {
+		h.Simple401(c)
+		return
+	}
+
+	body := models.FusionAuthWebhookBody{}
+	err := c.BindJSON(&body)
+	if err != nil {
+		return
+	}
+	event := body.Event
+
+	// every app that could be affected by the event
+	apps := []config.App{}
+	for _, app := range conf.Apps {
+		if strings.HasPrefix(event.Type, FAEventUserRegistrationPrefix) {
+			if app.FusionAuth.AppID == event.ApplicationID {
+				apps = append(apps, app)
+			}
+			continue
+		}
+		tenantID := event.TenantID
+		if tenantID == "" {
+			tenantID = event.User.TenantId
+		}
+		if tenantID == "" || app.FusionAuth.TenantID == tenantID {
+			apps = append(apps, app)
+		}
+	}
+
+	err = handleFusionAuthEvent(event, apps)
+	if err != nil {
+		log.Printf(
+			"failed to handle fusionauth event %v (%v) for user %v: %v",
+			event.ID,
+			event.Type,
+			event.User.Id,
+			err.Error(),
+		)
+		h.Simple500(c)
+		return
+	}
+
+	h.Simple200OK(c)
+}
+
+// handleFusionAuthEvent purges the user's cached subscription state and
+// queues a sync of their Stripe customer for each app. Events that aren't handled are
+// ignored.
+func handleFusionAuthEvent(event models.FusionAuthEvent, apps []config.App) error {
+	user := event.User
+	if user.Id == "" {
+		return fmt.Errorf("event has no user")
+	}
+
+	var metadata map[string]string
+	switch {
+	case event.Type == FAEventUserDelete:
+		metadata = map[string]string{"faDeleted": "true", "faActive": "false"}
+	case event.Type == FAEventUserDeactivate:
+		metadata = map[string]string{"faActive": "false"}
+	case event.Type == FAEventUserReactivate:
+		metadata = map[string]string{"faActive": "true"}
+	case event.Type == FAEventUserUpdate,
+		event.Type == FAEventUserEmailVerified:
+		metadata = map[string]string{}
+	case event.Type == FAEventUserRegistrationDelete:
+		metadata = map[string]string{"faRegistered": "false"}
+	case strings.HasPrefix(event.Type, FAEventUserRegistrationPrefix):
+		metadata = map[string]string{"faRegistered": "true"}
+	default:
+		log.Printf("ignoring fusionauth event %v", event.Type)
+		return nil
+	}
+	if event.Type == FAEventUserEmailVerified || user.Verified {
+		metadata["faEmailVerified"] = "true"
+	}
+
+	for _, app := range apps {
+		// roles come from the registration, and deactivated users lose
+		// access altogether
+		if event.Type == FAEventUserDeactivate ||
+			event.Type == FAEventUserReactivate ||
+			strings.HasPrefix(event.Type, FAEventUserRegistrationPrefix) {
+			payments.NotifyAccessChanged(app, user.Id)
+		}
+
+		custID, err := payments.GetStripeCustomerID(app, user)
+		if err != nil {
+			return err
+		}
+		if custID == "" {
+			continue
+		}
+
+		payments.PurgeCachedCustomer(custID)
+
+		err = payments.EnqueueSyncStripeCustomer(app, user, custID, metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	if event.Type == FAEventUserDelete && store.DB != nil {
+		err := store.DB.DeleteIdentityMappings(context.Background(), user.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isFusionAuthWebhookAuthorized checks the credentials that FusionAuth sends,
+// either a shared secret in the Authorization header or HTTP basic auth
+func isFusionAuthWebhookAuthorized(c *gin.Context, webhook config.FusionAuthWebhookConfig) bool {
+	if webhook.Secret != "" {
+		authorization := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte(webhook.Secret)) == 1 {
+			return true
+		}
+	}
+
+	if webhook.Username != "" {
+		username, password, ok := c.Request.BasicAuth()
+		if ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(webhook.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(webhook.Password)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
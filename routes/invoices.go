@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/payments"
+
+	"log"
+	"strconv"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/gin-gonic/gin"
+)
+
+// ListInvoices responds with a page of the logged-in user's billing history.
+//
+// Query params:
+//
+// - limit: the page size, up to payments.MaxBillingHistoryLimit
+//
+// - before: the nextBefore value from the previous page
+func ListInvoices(c *gin.Context, app config.App, user fusionauth.User) {
+	limit := payments.DefaultBillingHistoryLimit
+	if c.Query("limit") != "" {
+		parsed, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || parsed < 1 || parsed > payments.MaxBillingHistoryLimit {
+			c.Data(400, "text/plain", []byte("invalid limit value"))
+			return
+		}
+		limit = parsed
+	}
+
+	before := int64(0)
+	if c.Query("before") != "" {
+		parsed, err := strconv.ParseInt(c.Query("before"), 10, 64)
+		if err != nil || parsed < 1 {
+			c.Data(400, "text/plain", []byte("invalid before value"))
+			return
+		}
+		before = parsed
+	}
+
+	page, err := payments.GetBillingHistory(app, user, before, limit)
+	if err != nil {
+		log.Printf("failed to get billing history for user %v: %v", user.Id, err.Error())
+		h.Simple500(c)
+		return
+	}
+	c.JSON(200, page)
+}
@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+
+	"crypto/subtle"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeadJobListLimit is the max number of dead jobs returned by ListDeadJobs
+const DeadJobListLimit = 100
+
+// ListDeadJobs responds with the most recent background jobs that ran out
+// of attempts
+func ListDeadJobs(c *gin.Context, conf config.Config) {
+	body := models.DeadJobsBody{}
+	if !bindAdminBody(c, conf, &body) {
+		return
+	}
+
+	dead, err := jobs.ListDead(DeadJobListLimit)
+	if err != nil {
+		log.Printf("failed to list dead jobs: %v", err.Error())
+		h.Simple500(c)
+		return
+	}
+	if dead == nil {
+		dead = []models.Job{}
+	}
+
+	c.JSON(200, dead)
+}
+
+// RequeueDeadJobs queues dead background jobs to be run again with a fresh
+// set of attempts
+func RequeueDeadJobs(c *gin.Context, conf config.Config) {
+	body := models.DeadJobsBody{}
+	if !bindAdminBody(c, conf, &body) {
+		return
+	}
+	if len(body.JobIDs) == 0 {
+		c.Data(400, "text/plain", []byte("no jobIds were specified"))
+		return
+	}
+
+	count, err := jobs.Requeue(body.JobIDs)
+	if err != nil {
+		log.Printf("failed to requeue dead jobs: %v", err.Error())
+		h.Simple500(c)
+		return
+	}
+
+	c.JSON(200, gin.H{"requeued": count})
+}
+
+// bindAdminBody binds the request body and checks it against the admin api
+// key. Jobs aren't tied to an app, so app api keys don't work here. It will
+// set the gin response if there's an error.
+func bindAdminBody(c *gin.Context, conf config.Config, body *models.DeadJobsBody) bool {
+	if conf.Global.AdminAPIKey == "" {
+		h.Simple404(c)
+		return false
+	}
+
+	err := c.BindJSON(body)
+	if err != nil {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(body.APIKey), []byte(conf.Global.AdminAPIKey)) != 1 {
+		h.Simple401(c)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package routes
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+
+	"log"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/gin-gonic/gin"
+)
+
+// GetPrivateAppAndUser is shared by every private api endpoint. It finds the
+// app that the api key belongs to, and then finds the user either via the
+// jwt or, if the jwt isn't specified, via the user id. It will set the gin
+// response if there's an error.
+func GetPrivateAppAndUser(c *gin.Context, conf config.Config, apiKey string, jwt string, userID string) (app config.App, user fusionauth.User, ok bool) {
+	app, ok = conf.GetAppByAPIKey(apiKey)
+	if !ok {
+		c.Data(401, "text/plain", []byte("unauthorized"))
+		return app, user, false
+	}
+
+	// if the jwt isn't specified, attempt to retrieve the user via the other params
+	if jwt == "" {
+		if userID == "" {
+			c.Data(400, "text/plain", []byte("not all required fields were specified"))
+			return app, user, false
+		}
+		// TODO: properly handler the "errors" return value
+		qUser, _, err := app.FusionAuth.Client.RetrieveUser(userID)
+		if err != nil {
+			log.Printf("failed to find user for private api: %v", err.Error())
+			c.Data(400, "text/plain", []byte("failed to find user"))
+			return app, user, false
+		}
+		if qUser.User.Id != userID {
+			c.Data(400, "text/plain", []byte("failed to find user"))
+			return app, user, false
+		}
+		return app, qUser.User, true
+	}
+
+	user, err := auth.GetUserByJWT(app, jwt)
+	if err != nil {
+		c.Data(400, "text/plain", []byte("jwt doesn't correspond to any user"))
+		return app, user, false
+	}
+
+	return app, user, true
+}
+
+// Introspect responds with everything that a backend may want to know about
+// a user in a single request: their profile, roles, stripe customer,
+// active subscriptions, products and entitlements
+func Introspect(c *gin.Context, conf config.Config) {
+	body := models.PrivateUserBody{}
+	err := c.BindJSON(&body)
+	if err != nil {
+		return
+	}
+	app, user, ok := GetPrivateAppAndUser(c, conf, body.APIKey, body.JWT, body.UserID)
+	if !ok {
+		return
+	}
+
+	resp := models.IntrospectResponse{
+		User: models.UserProfile{
+			ID:        user.Id,
+			Email:     user.Email,
+			Username:  user.Username,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			FullName:  user.FullName,
+			ImageURL:  user.ImageUrl,
+			Verified:  user.Verified,
+			Active:    user.Active,
+		},
+		Roles:        auth.GetRoles(app, user),
+		Products:     []string{},
+		Entitlements: []string{},
+	}
+	if resp.Roles == nil {
+		resp.Roles = []string{}
+	}
+
+	resp.StripeCustomerID, err = payments.GetStripeCustomerID(app, user)
+	if err != nil {
+		log.Printf("introspect: failed to get stripe customer of user %v: %v", user.Id, err.Error())
+		h.Simple500(c)
+		return
+	}
+
+	resp.Subscriptions, err = payments.GetActiveSubscriptions(app, user)
+	if err != nil {
+		log.Printf("introspect: failed to get subscriptions of user %v: %v", user.Id, err.Error())
+		h.Simple500(c)
+		return
+	}
+
+	productIDs, err := payments.GetActiveProducts(app, user)
+	if err != nil {
+		log.Printf("introspect: failed to get products of user %v: %v", user.Id, err.Error())
+		h.Simple500(c)
+		return
+	}
+	if productIDs != nil {
+		resp.Products = productIDs
+	}
+	if entitlements := payments.EntitlementsOf(app, productIDs); entitlements != nil {
+		resp.Entitlements = entitlements
+	}
+
+	c.JSON(200, resp)
+}
@@ -6,6 +6,7 @@ import (
 	h "fa-middleware/helpers"
 	"fa-middleware/models"
 	"fa-middleware/payments"
+	"fa-middleware/webhooks"
 
 	"fmt"
 	"log"
@@ -73,7 +74,13 @@ func GetUserFromGinJWT(c *gin.Context, app config.App) (user fusionauth.User, er
 // GetJWTFromGin allows for quick retrieval of a JWT HttpOnly cookie from
 // a Gin context
 func GetJWTFromGin(c *gin.Context, app config.App) string {
-	cookies := c.Request.Cookies()
+	return GetJWTFromRequest(c.Request, app)
+}
+
+// GetJWTFromRequest returns the JWT HttpOnly cookie of a plain net/http
+// request
+func GetJWTFromRequest(r *http.Request, app config.App) string {
+	cookies := r.Cookies()
 	for _, cookie := range cookies {
 		if cookie.Name == app.JWT.CookieName {
 			return cookie.Value
@@ -161,16 +168,21 @@ func Register(c *gin.Context, app config.App) {
 		true,
 	)
 
-	customerID, err := payments.PropagateUserToStripe(app, user)
+	// the stripe customer is created in the background so that a slow or
+	// failing stripe api doesn't delay the response
+	err = payments.EnqueuePropagateUserToStripe(app, user)
 	if err != nil {
 		log.Printf(
-			"failed to push user %v to stripe: %v",
+			"failed to queue pushing user %v to stripe: %v",
 			user.Id,
 			err.Error(),
 		)
 	}
 
-	log.Printf("new customer id: %v", customerID)
+	webhooks.Emit(app, models.EventUserRegistered, models.WebhookEventData{
+		UserID: user.Id,
+		Email:  user.Email,
+	})
 
 	c.JSON(200, resp)
 }
@@ -251,16 +263,21 @@ func Login(c *gin.Context, app config.App) {
 		true,
 	)
 
-	customerID, err := payments.PropagateUserToStripe(app, user)
+	// the stripe customer is created in the background so that a slow or
+	// failing stripe api doesn't delay the response
+	err = payments.EnqueuePropagateUserToStripe(app, user)
 	if err != nil {
 		log.Printf(
-			"failed to push user %v to stripe: %v",
+			"failed to queue pushing user %v to stripe: %v",
 			user.Id,
 			err.Error(),
 		)
 	}
 
-	log.Printf("new customer id: %v", customerID)
+	webhooks.Emit(app, models.EventUserLoggedIn, models.WebhookEventData{
+		UserID: user.Id,
+		Email:  user.Email,
+	})
 
 	c.JSON(200, resp)
 }
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/payments"
+
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// MaxStripeWebhookBytes limits the size of the events that the Stripe
+// webhook accepts
+const MaxStripeWebhookBytes = 1024 * 1024
+
+// StripeWebhook receives events from Stripe and queues them to be handled
+// for every app whose stripe.webhookSecret matches the event's signature.
+// Apps that share a Stripe account can share a single webhook endpoint, and
+// each of them only acts on its own products.
+//
+// https://stripe.com/docs/webhooks/signatures
+func StripeWebhook(c *gin.Context, conf config.Config) {
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, MaxStripeWebhookBytes))
+	if err != nil {
+		h.Simple400(c)
+		return
+	}
+	signature := c.GetHeader("Stripe-Signature")
+
+	apps := []config.App{}
+	event := stripe.Event{}
+	for _, app := range conf.Apps {
+		if app.Stripe.WebhookSecret == "" {
+			continue
+		}
+		parsed, err := payments.GetProvider(app).ParseWebhook(body, signature, app.Stripe.WebhookSecret)
+		if err == nil {
+			apps = append(apps, app)
+			event = parsed
+		}
+	}
+	if len(apps) == 0 {
+		h.Simple401(c)
+		return
+	}
+	if !payments.HandlesStripeEvent(event.Type) {
+		h.Simple200OK(c)
+		return
+	}
+
+	var previousAttributes json.RawMessage
+	if len(event.Data.PreviousAttributes) > 0 {
+		previousAttributes, err = json.Marshal(event.Data.PreviousAttributes)
+		if err != nil {
+			h.Simple400(c)
+			return
+		}
+	}
+
+	for _, app := range apps {
+		err = payments.EnqueueStripeEvent(app, event.ID, event.Type, event.Data.Raw, previousAttributes)
+		if err != nil {
+			log.Printf(
+				"failed to enqueue stripe event %v (%v) for app %v: %v",
+				event.ID,
+				event.Type,
+				app.Domain,
+				err.Error(),
+			)
+			h.Simple500(c)
+			return
+		}
+	}
+
+	h.Simple200OK(c)
+}
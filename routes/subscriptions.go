@@ -0,0 +1,108 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+
+	"io"
+	"log"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/gin-gonic/gin"
+)
+
+// ListSubscriptions responds with the logged-in user's subscriptions to the
+// app's products
+func ListSubscriptions(c *gin.Context, app config.App, user fusionauth.User) {
+	subs, err := payments.GetSubscriptions(app, user)
+	if err != nil {
+		log.Printf("failed to list subscriptions for user %v: %v", user.Id, err.Error())
+		h.Simple500(c)
+		return
+	}
+	c.JSON(200, subs)
+}
+
+// CancelSubscription cancels the :id subscription at the end of the current
+// period, or right away if the body is {"immediately": true}
+func CancelSubscription(c *gin.Context, app config.App, user fusionauth.User) {
+	body := models.CancelSubscriptionBody{}
+	// the body is optional
+	err := c.ShouldBindJSON(&body)
+	if err != nil && err != io.EOF {
+		h.Simple400(c)
+		return
+	}
+
+	summary, err := payments.CancelSubscription(app, user, c.Param("id"), body.Immediately)
+	if err != nil {
+		respondSubscriptionError(c, user, err)
+		return
+	}
+	c.JSON(200, summary)
+}
+
+// ResumeSubscription undoes a pending cancellation of the :id subscription
+func ResumeSubscription(c *gin.Context, app config.App, user fusionauth.User) {
+	summary, err := payments.ResumeSubscription(app, user, c.Param("id"))
+	if err != nil {
+		respondSubscriptionError(c, user, err)
+		return
+	}
+	c.JSON(200, summary)
+}
+
+// PreviewPlanChange responds with what switching the :id subscription to
+// another price would cost, without changing anything
+func PreviewPlanChange(c *gin.Context, app config.App, user fusionauth.User) {
+	body := models.ChangePlanBody{}
+	err := c.BindJSON(&body)
+	if err != nil {
+		return
+	}
+
+	preview, err := payments.PreviewPlanChange(app, user, c.Param("id"), body)
+	if err != nil {
+		respondSubscriptionError(c, user, err)
+		return
+	}
+	c.JSON(200, preview)
+}
+
+// ChangePlan switches the :id subscription to another price. The
+// prorationDate from the preview should be sent along.
+func ChangePlan(c *gin.Context, app config.App, user fusionauth.User) {
+	body := models.ChangePlanBody{}
+	err := c.BindJSON(&body)
+	if err != nil {
+		return
+	}
+
+	summary, err := payments.ChangePlan(app, user, c.Param("id"), body)
+	if err != nil {
+		respondSubscriptionError(c, user, err)
+		return
+	}
+	c.JSON(200, summary)
+}
+
+func respondSubscriptionError(c *gin.Context, user fusionauth.User, err error) {
+	switch err {
+	case payments.ErrSubscriptionNotFound:
+		h.Simple404(c)
+	case payments.ErrUnknownPrice, payments.ErrOneTimePrice, payments.ErrOtherFamily, payments.ErrAmbiguousItem:
+		c.Data(400, "text/plain", []byte(err.Error()))
+	case payments.ErrNotResumable:
+		c.Data(409, "text/plain", []byte(err.Error()))
+	default:
+		log.Printf(
+			"failed to update subscription %v for user %v: %v",
+			c.Param("id"),
+			user.Id,
+			err.Error(),
+		)
+		h.Simple500(c)
+	}
+}
@@ -0,0 +1,90 @@
+package routes
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/store"
+	"fa-middleware/webhooks"
+
+	"context"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FailedWebhookListLimit is the max number of failed deliveries returned by
+// ListFailedWebhooks
+const FailedWebhookListLimit = 100
+
+// ListFailedWebhooks responds with the most recent outbound webhook
+// deliveries for the app that the api key belongs to that ran out of retries
+func ListFailedWebhooks(c *gin.Context, conf config.Config) {
+	body := models.WebhookDeliveriesBody{}
+	app, ok := getWebhookDeliveriesApp(c, conf, &body)
+	if !ok {
+		return
+	}
+
+	deliveries, err := store.DB.ListFailedWebhookDeliveries(
+		context.Background(),
+		app.FusionAuth.AppID,
+		FailedWebhookListLimit,
+	)
+	if err != nil {
+		log.Printf("failed to list failed webhooks: %v", err.Error())
+		h.Simple500(c)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []models.WebhookDelivery{}
+	}
+
+	c.JSON(200, deliveries)
+}
+
+// RedeliverWebhooks queues failed outbound webhook deliveries to be sent
+// again with a fresh set of retries
+func RedeliverWebhooks(c *gin.Context, conf config.Config) {
+	body := models.WebhookDeliveriesBody{}
+	app, ok := getWebhookDeliveriesApp(c, conf, &body)
+	if !ok {
+		return
+	}
+	if len(body.DeliveryIDs) == 0 {
+		c.Data(400, "text/plain", []byte("no deliveryIds were specified"))
+		return
+	}
+
+	count, err := webhooks.Redeliver(app, body.DeliveryIDs)
+	if err != nil {
+		log.Printf("failed to redeliver webhooks: %v", err.Error())
+		h.Simple500(c)
+		return
+	}
+
+	c.JSON(200, gin.H{"redelivered": count})
+}
+
+// getWebhookDeliveriesApp binds the request body and finds the app
+// that the api key belongs to. It will set the gin response if there's an
+// error.
+func getWebhookDeliveriesApp(c *gin.Context, conf config.Config, body *models.WebhookDeliveriesBody) (app config.App, ok bool) {
+	err := c.BindJSON(body)
+	if err != nil {
+		return app, false
+	}
+
+	app, ok = conf.GetAppByAPIKey(body.APIKey)
+	if !ok {
+		h.Simple401(c)
+		return app, false
+	}
+
+	if store.DB == nil {
+		c.Data(501, "text/plain", []byte("webhook delivery tracking requires the database"))
+		return app, false
+	}
+
+	return app, true
+}
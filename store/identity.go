@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// UpsertIdentityMapping creates or updates the Stripe customer that is linked
+// to a FusionAuth user for a single app
+func (s *Store) UpsertIdentityMapping(ctx context.Context, mapping models.IdentityMapping) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`INSERT INTO identity_mappings
+			(fa_user_id, fa_app_id, fa_tenant_id, stripe_customer_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (fa_user_id, fa_app_id) DO UPDATE SET
+			fa_tenant_id = EXCLUDED.fa_tenant_id,
+			stripe_customer_id = EXCLUDED.stripe_customer_id,
+			updated_at = NOW()`,
+		mapping.UserID,
+		mapping.AppID,
+		mapping.TenantID,
+		mapping.StripeCustomerID,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to upsert identity mapping for user %v app %v: %v",
+			mapping.UserID,
+			mapping.AppID,
+			err.Error(),
+		)
+	}
+	return nil
+}
+
+// GetIdentityMapping retrieves the mapping for a FusionAuth user and app. The
+// returned bool is false if there is no mapping yet.
+func (s *Store) GetIdentityMapping(ctx context.Context, userID string, appID string) (mapping models.IdentityMapping, found bool, err error) {
+	err = s.pool.QueryRow(
+		ctx,
+		`SELECT fa_user_id, fa_app_id, fa_tenant_id, stripe_customer_id, created_at, updated_at
+		FROM identity_mappings
+		WHERE fa_user_id = $1 AND fa_app_id = $2`,
+		userID,
+		appID,
+	).Scan(
+		&mapping.UserID,
+		&mapping.AppID,
+		&mapping.TenantID,
+		&mapping.StripeCustomerID,
+		&mapping.CreatedAt,
+		&mapping.UpdatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return mapping, false, nil
+	}
+	if err != nil {
+		return mapping, false, fmt.Errorf(
+			"failed to get identity mapping for user %v app %v: %v",
+			userID,
+			appID,
+			err.Error(),
+		)
+	}
+	return mapping, true, nil
+}
+
+// DeleteIdentityMappings removes every mapping for a FusionAuth user, across
+// all apps
+func (s *Store) DeleteIdentityMappings(ctx context.Context, userID string) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM identity_mappings WHERE fa_user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete identity mappings for user %v: %v", userID, err.Error())
+	}
+	return nil
+}
+
+// DeleteIdentityMapping removes the mapping for a FusionAuth user and a
+// single app
+func (s *Store) DeleteIdentityMapping(ctx context.Context, userID string, appID string) error {
+	_, err := s.pool.Exec(
+		ctx,
+		"DELETE FROM identity_mappings WHERE fa_user_id = $1 AND fa_app_id = $2",
+		userID,
+		appID,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to delete identity mapping for user %v app %v: %v",
+			userID,
+			appID,
+			err.Error(),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	JobStatusPending = "pending"
+	JobStatusDone    = "done"
+	JobStatusDead    = "dead"
+)
+
+const jobColumns = `id, type, payload, status, attempts, max_attempts, run_at,
+	last_error, created_at, updated_at`
+
+// InsertJob persists a new pending job
+func (s *Store) InsertJob(ctx context.Context, job models.Job) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`INSERT INTO jobs (id, type, payload, status, max_attempts, run_at)
+		VALUES ($1, $2, $3::jsonb, $4, $5, $6)`,
+		job.ID,
+		job.Type,
+		string(job.Payload),
+		JobStatusPending,
+		job.MaxAttempts,
+		job.RunAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert %v job: %v", job.Type, err.Error())
+	}
+	return nil
+}
+
+// ClaimDueJobs returns up to limit pending jobs that are due, and pushes
+// their run time back by lease so that no other worker picks them up while
+// they are running. If the worker dies, the job becomes due again once the
+// lease runs out.
+func (s *Store) ClaimDueJobs(ctx context.Context, limit int, lease time.Duration) (jobs []models.Job, err error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`UPDATE jobs SET run_at = NOW() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE status = $3 AND run_at <= NOW()
+			ORDER BY run_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns,
+		limit,
+		lease.Seconds(),
+		JobStatusPending,
+	)
+	if err != nil {
+		return jobs, fmt.Errorf("failed to claim jobs: %v", err.Error())
+	}
+	return scanJobs(rows)
+}
+
+// CompleteJob removes a job that finished successfully
+func (s *Store) CompleteJob(ctx context.Context, id string) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM jobs WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("failed to complete job %v: %v", id, err.Error())
+	}
+	return nil
+}
+
+// FailJob records a failed attempt. If retryAt is nil, the job is dead and
+// won't be attempted again.
+func (s *Store) FailJob(ctx context.Context, id string, lastError string, retryAt *time.Time) error {
+	status := JobStatusDead
+	runAt := time.Now()
+	if retryAt != nil {
+		status = JobStatusPending
+		runAt = *retryAt
+	}
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE jobs SET
+			status = $2,
+			attempts = attempts + 1,
+			last_error = $3,
+			run_at = $4,
+			updated_at = NOW()
+		WHERE id = $1`,
+		id,
+		status,
+		lastError,
+		runAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update job %v: %v", id, err.Error())
+	}
+	return nil
+}
+
+// ListDeadJobs returns the most recent jobs that ran out of attempts
+func (s *Store) ListDeadJobs(ctx context.Context, limit int) (jobs []models.Job, err error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT `+jobColumns+`
+		FROM jobs
+		WHERE status = $1
+		ORDER BY updated_at DESC
+		LIMIT $2`,
+		JobStatusDead,
+		limit,
+	)
+	if err != nil {
+		return jobs, fmt.Errorf("failed to list dead jobs: %v", err.Error())
+	}
+	return scanJobs(rows)
+}
+
+// RequeueDeadJobs resets dead jobs so that they are attempted again with a
+// fresh set of attempts, and returns how many were reset
+func (s *Store) RequeueDeadJobs(ctx context.Context, ids []string) (int, error) {
+	tag, err := s.pool.Exec(
+		ctx,
+		`UPDATE jobs SET
+			status = $2,
+			attempts = 0,
+			last_error = '',
+			run_at = NOW(),
+			updated_at = NOW()
+		WHERE id = ANY($1) AND status = $3`,
+		ids,
+		JobStatusPending,
+		JobStatusDead,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue dead jobs: %v", err.Error())
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func scanJobs(rows pgx.Rows) (jobs []models.Job, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		job := models.Job{}
+		var payload []byte
+		err = rows.Scan(
+			&job.ID,
+			&job.Type,
+			&payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.RunAt,
+			&job.LastError,
+			&job.CreatedAt,
+			&job.UpdatedAt,
+		)
+		if err != nil {
+			return jobs, fmt.Errorf("failed to scan job: %v", err.Error())
+		}
+		job.Payload = payload
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationLockID is an arbitrary key for the postgres advisory lock that
+// keeps two instances of the middleware from migrating at the same time
+const migrationLockID = 7245318
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a single versioned schema change. The version comes from the
+// numeric prefix of the migration's file name, such as 0001_init.sql.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Migrations returns every embedded migration sorted by version
+func Migrations() (migrations []Migration, err error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return migrations, fmt.Errorf("failed to read migrations: %v", err.Error())
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix := strings.SplitN(name, "_", 2)[0]
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return migrations, fmt.Errorf("migration %v has no numeric version prefix", name)
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return migrations, fmt.Errorf("failed to read migration %v: %v", name, err.Error())
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			SQL:     string(data),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return migrations, fmt.Errorf(
+				"migrations %v and %v have the same version",
+				migrations[i-1].Name,
+				migrations[i].Name,
+			)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies every migration that hasn't been applied yet, each in its
+// own transaction, and records it in the schema_migrations table
+func (s *Store) Migrate(ctx context.Context) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection for migrations: %v", err.Error())
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+	if err != nil {
+		return fmt.Errorf("failed to lock for migrations: %v", err.Error())
+	}
+	defer func() {
+		_, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+		if err != nil {
+			log.Printf("failed to unlock after migrations: %v", err.Error())
+		}
+	}()
+
+	_, err = conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER     PRIMARY KEY,
+			name       TEXT        NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err.Error())
+	}
+
+	applied := make(map[int]bool)
+	rows, err := conn.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return fmt.Errorf("failed to query applied migrations: %v", err.Error())
+	}
+	for rows.Next() {
+		var version int
+		err = rows.Scan(&version)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan applied migration: %v", err.Error())
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return fmt.Errorf("failed to query applied migrations: %v", rows.Err().Error())
+	}
+
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %v: %v", migration.Name, err.Error())
+		}
+		_, err = tx.Exec(ctx, migration.SQL)
+		if err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("failed to apply migration %v: %v", migration.Name, err.Error())
+		}
+		_, err = tx.Exec(
+			ctx,
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+			migration.Version,
+			migration.Name,
+		)
+		if err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("failed to record migration %v: %v", migration.Name, err.Error())
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to commit migration %v: %v", migration.Name, err.Error())
+		}
+
+		log.Printf("applied migration %v", migration.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+-- links a FusionAuth user to their Stripe customer for a single app
+CREATE TABLE identity_mappings (
+    fa_user_id         TEXT        NOT NULL,
+    fa_app_id          TEXT        NOT NULL,
+    fa_tenant_id       TEXT        NOT NULL,
+    stripe_customer_id TEXT        NOT NULL,
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (fa_user_id, fa_app_id)
+);
+
+CREATE INDEX identity_mappings_stripe_customer_id_idx
+    ON identity_mappings (stripe_customer_id);
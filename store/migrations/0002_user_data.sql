@@ -0,0 +1,11 @@
+-- per-user key/value data for each app, see /mw/data
+CREATE TABLE user_data (
+    fa_app_id  TEXT        NOT NULL,
+    fa_user_id TEXT        NOT NULL,
+    key        TEXT        NOT NULL,
+    value      JSONB       NOT NULL,
+    version    BIGINT      NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (fa_app_id, fa_user_id, key)
+);
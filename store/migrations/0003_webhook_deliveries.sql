@@ -0,0 +1,22 @@
+-- outbound webhook deliveries to app backends, see the webhooks package
+CREATE TABLE webhook_deliveries (
+    id               TEXT        PRIMARY KEY,
+    fa_app_id        TEXT        NOT NULL,
+    url              TEXT        NOT NULL,
+    event_id         TEXT        NOT NULL,
+    event_type       TEXT        NOT NULL,
+    payload          JSONB       NOT NULL,
+    status           TEXT        NOT NULL,
+    attempts         INTEGER     NOT NULL DEFAULT 0,
+    next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error       TEXT        NOT NULL DEFAULT '',
+    last_status_code INTEGER     NOT NULL DEFAULT 0,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX webhook_deliveries_due_idx
+    ON webhook_deliveries (status, next_attempt_at);
+
+CREATE INDEX webhook_deliveries_app_status_idx
+    ON webhook_deliveries (fa_app_id, status);
@@ -0,0 +1,19 @@
+-- durable background jobs, see the jobs package
+CREATE TABLE jobs (
+    id           TEXT        PRIMARY KEY,
+    type         TEXT        NOT NULL,
+    payload      JSONB       NOT NULL,
+    status       TEXT        NOT NULL,
+    attempts     INTEGER     NOT NULL DEFAULT 0,
+    max_attempts INTEGER     NOT NULL,
+    run_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error   TEXT        NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX jobs_due_idx ON jobs (status, run_at);
+
+-- webhook deliveries are now sent by the job queue, which tracks the retry
+-- schedule itself
+DROP INDEX webhook_deliveries_due_idx;
@@ -0,0 +1,6 @@
+-- the last time each periodic task ran, so that only one instance of the
+-- middleware runs it per interval, see jobs.Every
+CREATE TABLE scheduled_runs (
+    name        TEXT        PRIMARY KEY,
+    last_run_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,18 @@
+-- one-time products that users paid for, see payments.RecordPurchase
+CREATE TABLE purchases (
+    id                 TEXT        PRIMARY KEY,
+    fa_user_id         TEXT        NOT NULL,
+    fa_app_id          TEXT        NOT NULL,
+    stripe_customer_id TEXT        NOT NULL DEFAULT '',
+    product_id         TEXT        NOT NULL,
+    price_id           TEXT        NOT NULL DEFAULT '',
+    -- the checkout session or invoice that paid for the product
+    source_id          TEXT        NOT NULL,
+    purchased_at       TIMESTAMPTZ NOT NULL,
+    -- NULL for lifetime access
+    expires_at         TIMESTAMPTZ,
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (source_id, product_id)
+);
+
+CREATE INDEX purchases_user_idx ON purchases (fa_user_id, fa_app_id, product_id);
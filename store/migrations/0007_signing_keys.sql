@@ -0,0 +1,10 @@
+-- the keys that entitlement tokens are signed with, shared by every instance
+-- of the middleware, see package tokens
+CREATE TABLE signing_keys (
+    id          TEXT        PRIMARY KEY,
+    -- PEM-encoded PKCS #8
+    private_key TEXT        NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX signing_keys_created_idx ON signing_keys (created_at);
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"fmt"
+	"time"
+)
+
+// InsertPurchase records a purchase. The returned bool is false if the same
+// product was already recorded for the same checkout session or invoice,
+// since Stripe may send the same event more than once.
+func (s *Store) InsertPurchase(ctx context.Context, purchase models.Purchase) (bool, error) {
+	tag, err := s.pool.Exec(
+		ctx,
+		`INSERT INTO purchases
+			(id, fa_user_id, fa_app_id, stripe_customer_id, product_id, price_id,
+			source_id, purchased_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (source_id, product_id) DO NOTHING`,
+		purchase.ID,
+		purchase.UserID,
+		purchase.AppID,
+		purchase.StripeCustomerID,
+		purchase.ProductID,
+		purchase.PriceID,
+		purchase.SourceID,
+		purchase.PurchasedAt,
+		purchase.ExpiresAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf(
+			"failed to insert purchase of %v for user %v: %v",
+			purchase.ProductID,
+			purchase.UserID,
+			err.Error(),
+		)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetProductAccess adds up every purchase of a product by a user
+func (s *Store) GetProductAccess(ctx context.Context, userID string, appID string, productID string) (access models.ProductAccess, err error) {
+	access.ProductID = productID
+	var expiresAt *time.Time
+	err = s.pool.QueryRow(
+		ctx,
+		`SELECT COALESCE(BOOL_OR(expires_at IS NULL), FALSE), MAX(expires_at)
+		FROM purchases
+		WHERE fa_user_id = $1 AND fa_app_id = $2 AND product_id = $3`,
+		userID,
+		appID,
+		productID,
+	).Scan(&access.Lifetime, &expiresAt)
+	if err != nil {
+		return access, fmt.Errorf(
+			"failed to get access to %v for user %v: %v",
+			productID,
+			userID,
+			err.Error(),
+		)
+	}
+	if expiresAt != nil {
+		access.ExpiresAt = *expiresAt
+	}
+	return access, nil
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ClaimScheduledRun records that the periodic task called name is running
+// now, unless it already ran less than interval ago. The returned bool is
+// true if the caller claimed the run and should go ahead with it, which is
+// only ever the case for one instance of the middleware per interval.
+func (s *Store) ClaimScheduledRun(ctx context.Context, name string, interval time.Duration) (bool, error) {
+	var claimed string
+	err := s.pool.QueryRow(
+		ctx,
+		`INSERT INTO scheduled_runs (name, last_run_at)
+		VALUES ($1, NOW())
+		ON CONFLICT (name) DO UPDATE SET last_run_at = NOW()
+		WHERE scheduled_runs.last_run_at <= NOW() - make_interval(secs => $2)
+		RETURNING name`,
+		name,
+		interval.Seconds(),
+	).Scan(&claimed)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim scheduled run %v: %v", name, err.Error())
+	}
+	return true, nil
+}
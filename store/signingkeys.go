@@ -0,0 +1,64 @@
+package store
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"fmt"
+	"time"
+)
+
+// InsertSigningKey records a new key for signing entitlement tokens
+func (s *Store) InsertSigningKey(ctx context.Context, key models.SigningKey) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`INSERT INTO signing_keys (id, private_key, created_at) VALUES ($1, $2, $3)`,
+		key.ID,
+		key.PrivateKey,
+		key.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert signing key %v: %v", key.ID, err.Error())
+	}
+	return nil
+}
+
+// ListSigningKeys returns the keys that were created after since, newest
+// first
+func (s *Store) ListSigningKeys(ctx context.Context, since time.Time) (keys []models.SigningKey, err error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT id, private_key, created_at
+		FROM signing_keys
+		WHERE created_at > $1
+		ORDER BY created_at DESC`,
+		since,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list signing keys: %v", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key := models.SigningKey{}
+		err = rows.Scan(&key.ID, &key.PrivateKey, &key.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %v", err.Error())
+		}
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to list signing keys: %v", rows.Err().Error())
+	}
+	return keys, nil
+}
+
+// DeleteSigningKeys removes the keys that were created before before, since
+// no unexpired token can have been signed with them
+func (s *Store) DeleteSigningKeys(ctx context.Context, before time.Time) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM signing_keys WHERE created_at < $1`, before)
+	if err != nil {
+		return fmt.Errorf("failed to delete signing keys: %v", err.Error())
+	}
+	return nil
+}
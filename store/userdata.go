@@ -0,0 +1,173 @@
+package store
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	// ErrNotFound is returned when a row that is required to exist doesn't
+	ErrNotFound = errors.New("not found")
+
+	// ErrVersionConflict is returned when an optimistic concurrency check
+	// fails because the row was changed (or created) by someone else
+	ErrVersionConflict = errors.New("version conflict")
+)
+
+// UserDataWrite describes a write to a single user data key.
+//
+// If ExpectedVersion is set, the key must already exist with that version.
+// If CreateOnly is set, the key must not exist yet. Otherwise the key is
+// created or overwritten unconditionally.
+type UserDataWrite struct {
+	AppID           string
+	UserID          string
+	Key             string
+	Value           []byte
+	ExpectedVersion int64
+	CreateOnly      bool
+}
+
+// GetUserData retrieves a single key for a user. The returned bool is false
+// if the key doesn't exist.
+func (s *Store) GetUserData(ctx context.Context, appID string, userID string, key string) (entry models.UserDataEntry, found bool, err error) {
+	var value []byte
+	err = s.pool.QueryRow(
+		ctx,
+		`SELECT key, value, version, updated_at
+		FROM user_data
+		WHERE fa_app_id = $1 AND fa_user_id = $2 AND key = $3`,
+		appID,
+		userID,
+		key,
+	).Scan(&entry.Key, &value, &entry.Version, &entry.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf(
+			"failed to get user data %v for user %v app %v: %v",
+			key,
+			userID,
+			appID,
+			err.Error(),
+		)
+	}
+	entry.Value = value
+	return entry, true, nil
+}
+
+// CountUserData returns how many keys a user has for an app
+func (s *Store) CountUserData(ctx context.Context, appID string, userID string) (count int, err error) {
+	err = s.pool.QueryRow(
+		ctx,
+		"SELECT COUNT(*) FROM user_data WHERE fa_app_id = $1 AND fa_user_id = $2",
+		appID,
+		userID,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf(
+			"failed to count user data for user %v app %v: %v",
+			userID,
+			appID,
+			err.Error(),
+		)
+	}
+	return count, nil
+}
+
+// PutUserData writes a single key for a user and returns the stored entry
+// with its new version. ErrVersionConflict is returned if the write's
+// concurrency requirements aren't met.
+func (s *Store) PutUserData(ctx context.Context, write UserDataWrite) (entry models.UserDataEntry, err error) {
+	var query string
+	args := []interface{}{write.AppID, write.UserID, write.Key, string(write.Value)}
+
+	switch {
+	case write.ExpectedVersion > 0:
+		query = `UPDATE user_data SET
+				value = $4::jsonb,
+				version = version + 1,
+				updated_at = NOW()
+			WHERE fa_app_id = $1 AND fa_user_id = $2 AND key = $3 AND version = $5
+			RETURNING key, value, version, updated_at`
+		args = append(args, write.ExpectedVersion)
+	case write.CreateOnly:
+		query = `INSERT INTO user_data (fa_app_id, fa_user_id, key, value)
+			VALUES ($1, $2, $3, $4::jsonb)
+			ON CONFLICT (fa_app_id, fa_user_id, key) DO NOTHING
+			RETURNING key, value, version, updated_at`
+	default:
+		query = `INSERT INTO user_data (fa_app_id, fa_user_id, key, value)
+			VALUES ($1, $2, $3, $4::jsonb)
+			ON CONFLICT (fa_app_id, fa_user_id, key) DO UPDATE SET
+				value = EXCLUDED.value,
+				version = user_data.version + 1,
+				updated_at = NOW()
+			RETURNING key, value, version, updated_at`
+	}
+
+	var value []byte
+	err = s.pool.QueryRow(ctx, query, args...).Scan(
+		&entry.Key,
+		&value,
+		&entry.Version,
+		&entry.UpdatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return entry, ErrVersionConflict
+	}
+	if err != nil {
+		return entry, fmt.Errorf(
+			"failed to put user data %v for user %v app %v: %v",
+			write.Key,
+			write.UserID,
+			write.AppID,
+			err.Error(),
+		)
+	}
+	entry.Value = value
+	return entry, nil
+}
+
+// DeleteUserData removes a single key for a user. If expectedVersion is set,
+// the key is only deleted if its version matches, otherwise
+// ErrVersionConflict is returned. ErrNotFound is returned if the key doesn't
+// exist.
+func (s *Store) DeleteUserData(ctx context.Context, appID string, userID string, key string, expectedVersion int64) error {
+	query := "DELETE FROM user_data WHERE fa_app_id = $1 AND fa_user_id = $2 AND key = $3"
+	args := []interface{}{appID, userID, key}
+	if expectedVersion > 0 {
+		query += " AND version = $4"
+		args = append(args, expectedVersion)
+	}
+
+	tag, err := s.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to delete user data %v for user %v app %v: %v",
+			key,
+			userID,
+			appID,
+			err.Error(),
+		)
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+	if expectedVersion > 0 {
+		_, found, err := s.GetUserData(ctx, appID, userID, key)
+		if err != nil {
+			return err
+		}
+		if found {
+			return ErrVersionConflict
+		}
+	}
+	return ErrNotFound
+}
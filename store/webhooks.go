@@ -0,0 +1,152 @@
+package store
+
+import (
+	"fa-middleware/models"
+
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	WebhookStatusPending   = "pending"
+	WebhookStatusDelivered = "delivered"
+	WebhookStatusFailed    = "failed"
+)
+
+const webhookDeliveryColumns = `id, fa_app_id, url, event_id, event_type, payload, status,
+	attempts, next_attempt_at, last_error, last_status_code, created_at, updated_at`
+
+// InsertWebhookDeliveries records new deliveries so that their progress can
+// be tracked and failed deliveries can be redelivered
+func (s *Store) InsertWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error {
+	batch := &pgx.Batch{}
+	for _, delivery := range deliveries {
+		batch.Queue(
+			`INSERT INTO webhook_deliveries
+				(id, fa_app_id, url, event_id, event_type, payload, status)
+			VALUES ($1, $2, $3, $4, $5, $6::jsonb, $7)`,
+			delivery.ID,
+			delivery.AppID,
+			delivery.URL,
+			delivery.EventID,
+			delivery.EventType,
+			string(delivery.Payload),
+			WebhookStatusPending,
+		)
+	}
+
+	results := s.pool.SendBatch(ctx, batch)
+	defer results.Close()
+	for range deliveries {
+		_, err := results.Exec()
+		if err != nil {
+			return fmt.Errorf("failed to insert webhook delivery: %v", err.Error())
+		}
+	}
+	return nil
+}
+
+// FinishWebhookAttempt records the outcome of an attempt to send a delivery.
+// nextAttempt is when the delivery will be retried, or nil if it won't be.
+func (s *Store) FinishWebhookAttempt(ctx context.Context, id string, status string, statusCode int, lastError string, nextAttempt *time.Time) error {
+	next := time.Now()
+	if nextAttempt != nil {
+		next = *nextAttempt
+	}
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE webhook_deliveries SET
+			status = $2,
+			attempts = attempts + 1,
+			last_status_code = $3,
+			last_error = $4,
+			next_attempt_at = $5,
+			updated_at = NOW()
+		WHERE id = $1`,
+		id,
+		status,
+		statusCode,
+		lastError,
+		next,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery %v: %v", id, err.Error())
+	}
+	return nil
+}
+
+// ListFailedWebhookDeliveries returns the most recent deliveries for an app
+// that ran out of retries
+func (s *Store) ListFailedWebhookDeliveries(ctx context.Context, appID string, limit int) (deliveries []models.WebhookDelivery, err error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT `+webhookDeliveryColumns+`
+		FROM webhook_deliveries
+		WHERE fa_app_id = $1 AND status = $2
+		ORDER BY updated_at DESC
+		LIMIT $3`,
+		appID,
+		WebhookStatusFailed,
+		limit,
+	)
+	if err != nil {
+		return deliveries, fmt.Errorf("failed to list failed webhook deliveries: %v", err.Error())
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// RedeliverWebhookDeliveries resets failed deliveries for an app so that
+// they can be sent again with a fresh set of retries, and returns the
+// deliveries that were reset
+func (s *Store) RedeliverWebhookDeliveries(ctx context.Context, appID string, ids []string) (deliveries []models.WebhookDelivery, err error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`UPDATE webhook_deliveries SET
+			status = $3,
+			attempts = 0,
+			next_attempt_at = NOW(),
+			updated_at = NOW()
+		WHERE fa_app_id = $1 AND id = ANY($2) AND status = $4
+		RETURNING `+webhookDeliveryColumns,
+		appID,
+		ids,
+		WebhookStatusPending,
+		WebhookStatusFailed,
+	)
+	if err != nil {
+		return deliveries, fmt.Errorf("failed to redeliver webhook deliveries: %v", err.Error())
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func scanWebhookDeliveries(rows pgx.Rows) (deliveries []models.WebhookDelivery, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		delivery := models.WebhookDelivery{}
+		var payload []byte
+		err = rows.Scan(
+			&delivery.ID,
+			&delivery.AppID,
+			&delivery.URL,
+			&delivery.EventID,
+			&delivery.EventType,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastError,
+			&delivery.LastStatusCode,
+			&delivery.CreatedAt,
+			&delivery.UpdatedAt,
+		)
+		if err != nil {
+			return deliveries, fmt.Errorf("failed to scan webhook delivery: %v", err.Error())
+		}
+		delivery.Payload = payload
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
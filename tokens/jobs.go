@@ -0,0 +1,91 @@
+package tokens
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+	"fa-middleware/webhooks"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// JobTypeReissue signs a new token for a user whose access changed, and
+// sends it to the app's webhook endpoints as a token.issued event
+const JobTypeReissue = "token.reissue"
+
+type reissueJob struct {
+	AppID  string `json:"appId"`
+	UserID string `json:"userId"`
+}
+
+// RegisterJobs registers the reissue job, and queues it whenever a user's
+// access changes in an app with a webhook endpoint for token.issued. Apps
+// are looked up from the active config when each job runs.
+func RegisterJobs(getConfig func() config.Config) {
+	jobs.Register(JobTypeReissue, reissueHandler(getConfig))
+	payments.OnAccessChanged(enqueueReissue)
+}
+
+// reissueHandler runs the reissue job
+func reissueHandler(getConfig func() config.Config) jobs.Handler {
+	return func(ctx context.Context, job models.Job) error {
+		payload := reissueJob{}
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal job payload: %v", err.Error())
+		}
+
+		conf := getConfig()
+		app, ok := conf.GetConfigForAppID(payload.AppID)
+		if !ok {
+			log.Printf("not reissuing token for user %v, app %v is no longer configured", payload.UserID, payload.AppID)
+			return nil
+		}
+
+		// the user is looked up again, since roles may have changed since
+		// the job was queued
+		user, err := auth.GetUserByID(app, payload.UserID)
+		if err != nil {
+			return err
+		}
+		token, err := Issue(conf.Global.Tokens, app, user)
+		if err != nil {
+			return err
+		}
+
+		webhooks.Emit(app, models.EventTokenIssued, models.TokenEventData{
+			UserID:    user.Id,
+			Token:     token.Token,
+			ExpiresAt: token.ExpiresAt,
+		})
+		return nil
+	}
+}
+
+// enqueueReissue queues the reissue job when the user's access in the app
+// may have changed
+func enqueueReissue(app config.App, userID string) {
+	if !wantsTokens(app) {
+		return
+	}
+	err := jobs.Enqueue(JobTypeReissue, reissueJob{AppID: app.FusionAuth.AppID, UserID: userID})
+	if err != nil {
+		log.Printf("failed to enqueue token reissue for user %v: %v", userID, err.Error())
+	}
+}
+
+// wantsTokens checks if any of the app's webhook endpoints would receive a
+// reissued token, since signing one costs a subscription check per product
+func wantsTokens(app config.App) bool {
+	for _, webhook := range app.Webhooks {
+		if webhook.WantsEvent(models.EventTokenIssued) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package tokens
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+	"fa-middleware/webhooks"
+
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// newSubscribedUser returns a config with a single app in dev mode, and a
+// user of it with an active subscription
+func newSubscribedUser(t *testing.T) (config.Config, fusionauth.User, string) {
+	t.Helper()
+	conf := config.Config{
+		Apps: []config.App{
+			{
+				Domain:        "tokens.test",
+				FullDomainURL: "https://tokens.test",
+				Mode:          config.AppModeDev,
+				FusionAuth: config.FusionAuthConfig{
+					AppID:    config.DevAppID,
+					TenantID: config.DevTenantID,
+				},
+				Stripe: config.StripeConfig{
+					Provider: config.PaymentProviderFake,
+					Products: []models.StripeProduct{
+						{ProductID: "prod_pro", PriceIDs: []string{"price_pro"}},
+					},
+				},
+				Webhooks: []config.WebhookConfig{
+					{URL: "https://hooks.test/tokens", Secret: "whsec_test", Events: []string{models.EventTokenIssued}},
+				},
+			},
+		},
+	}
+
+	fake := payments.GetFakeProvider(conf.Apps[0])
+	cust, err := fake.NewCustomer(&stripe.CustomerParams{Email: stripe.String("tokens@example.com")})
+	if err != nil {
+		t.Fatalf("failed to create customer: %v", err)
+	}
+	data := map[string]interface{}{payments.StripeCustomerIDField: cust.ID}
+	conf.Apps[0].Dev.Fixtures.Users = []models.DevUser{
+		{ID: "user-tokens", Email: "tokens@example.com", Password: "password1234", Data: data},
+	}
+	err = conf.InitClients()
+	if err != nil {
+		t.Fatalf("failed to init clients: %v", err)
+	}
+	app := conf.Apps[0]
+
+	params := &stripe.CheckoutSessionParams{
+		Customer: stripe.String(cust.ID),
+		Mode:     stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String("price_pro"), Quantity: stripe.Int64(1)},
+		},
+	}
+	session, err := fake.NewCheckoutSession(params)
+	if err != nil {
+		t.Fatalf("failed to create checkout session: %v", err)
+	}
+	session, err = fake.CompleteCheckoutSession(app, session.ID)
+	if err != nil {
+		t.Fatalf("failed to complete checkout session: %v", err)
+	}
+
+	user := fusionauth.User{Email: "tokens@example.com", Data: data}
+	user.Id = "user-tokens"
+	return conf, user, session.Subscription.ID
+}
+
+func TestCancelSubscriptionIssuesToken(t *testing.T) {
+	conf, user, subID := newSubscribedUser(t)
+	app := conf.Apps[0]
+	RegisterJobs(func() config.Config { return conf })
+
+	previous := jobs.Default
+	queue := jobs.NewMemoryQueue()
+	jobs.Default = queue
+	defer func() { jobs.Default = previous }()
+
+	_, err := payments.CancelSubscription(app, user, subID, true)
+	if err != nil {
+		t.Fatalf("failed to cancel: %v", err)
+	}
+
+	// run the reissue job, which queues the delivery
+	claimed, err := queue.Claim(context.Background(), 100, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to claim jobs: %v", err)
+	}
+	reissued := 0
+	for _, job := range claimed {
+		if job.Type != JobTypeReissue {
+			continue
+		}
+		reissued++
+		err = reissueHandler(func() config.Config { return conf })(context.Background(), job)
+		if err != nil {
+			t.Fatalf("failed to reissue: %v", err)
+		}
+	}
+	if reissued != 1 {
+		t.Fatalf("expected 1 reissue job, got %v", reissued)
+	}
+
+	claimed, err = queue.Claim(context.Background(), 100, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to claim jobs: %v", err)
+	}
+	if len(claimed) != 1 || claimed[0].Type != webhooks.JobTypeDeliver {
+		t.Fatalf("expected a single webhook delivery, got %v", claimed)
+	}
+	delivery := models.WebhookDelivery{}
+	err = json.Unmarshal(claimed[0].Payload, &delivery)
+	if err != nil {
+		t.Fatalf("failed to decode delivery: %v", err)
+	}
+	if delivery.EventType != models.EventTokenIssued {
+		t.Fatalf("expected a %v delivery, got %v", models.EventTokenIssued, delivery.EventType)
+	}
+
+	event := struct {
+		Data models.TokenEventData `json:"data"`
+	}{}
+	err = json.Unmarshal(delivery.Payload, &event)
+	if err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	parts := strings.Split(event.Data.Token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a JWT, got %q", event.Data.Token)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	claims := models.EntitlementClaims{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	if claims.Subject != user.Id || len(claims.Products) != 0 {
+		t.Errorf("expected a token without products for %v, got %+v", user.Id, claims)
+	}
+}
@@ -0,0 +1,191 @@
+package tokens
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// KeyBits is the size of the RSA keys that tokens are signed with
+	KeyBits = 2048
+
+	// keysRefreshInterval is how often the keys are reloaded from the
+	// database, so that keys created by other instances get published
+	keysRefreshInterval = time.Minute
+
+	// JWKSCacheSeconds is how long verifiers may cache the JWKS
+	JWKSCacheSeconds = 60
+
+	// keyPrepublishPeriod is how long a new key is published before it
+	// signs tokens, so that verifiers with a cached JWKS already know it
+	keyPrepublishPeriod = JWKSCacheSeconds * time.Second
+)
+
+type signingKey struct {
+	id        string
+	private   *rsa.PrivateKey
+	createdAt time.Time
+}
+
+var (
+	keysMutex sync.Mutex
+
+	// keys are newest first; see activeKey for which one signs new tokens
+	keys         []signingKey
+	keysLoadedAt time.Time
+)
+
+// keyLifetime is how long a key is published: it is published ahead of
+// signing, signs new tokens until the rotation interval since its creation
+// has passed, and the last of those expire one ttl later
+func keyLifetime(tokens config.TokensConfig) time.Duration {
+	return tokens.GetRotationInterval() + tokens.GetTTL()
+}
+
+// getKeys returns every key that may have signed an unexpired token or is
+// about to sign tokens, newest first. The next key is created
+// keyPrepublishPeriod before the newest one is due for rotation. When
+// the database is enabled, keys are shared with the other instances of the
+// middleware through it; otherwise they only live in memory and are
+// replaced on restart.
+func getKeys(tokens config.TokensConfig) ([]signingKey, error) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	now := time.Now()
+	if store.DB != nil && now.Sub(keysLoadedAt) > keysRefreshInterval {
+		err := loadKeys(tokens, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pruneKeys(tokens, now)
+
+	if rotationDue(tokens, now) {
+		// another instance may have rotated the key already
+		if store.DB != nil && !keysLoadedAt.Equal(now) {
+			err := loadKeys(tokens, now)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rotationDue(tokens, now) {
+			err := rotateKey(tokens, now)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	published := make([]signingKey, len(keys))
+	copy(published, keys)
+	return published, nil
+}
+
+// rotationDue checks if the next key should be created, which is
+// keyPrepublishPeriod before the newest key stops signing
+func rotationDue(tokens config.TokensConfig, now time.Time) bool {
+	return len(keys) == 0 || now.Sub(keys[0].createdAt) >= tokens.GetRotationInterval()-keyPrepublishPeriod
+}
+
+// activeKey returns the key that signs new tokens, which is the newest key
+// that has been published for keyPrepublishPeriod. If there is none, such
+// as when the first key was just created, the oldest key is used, since
+// verifiers can't have cached a JWKS without it.
+func activeKey(keys []signingKey, now time.Time) signingKey {
+	for _, key := range keys {
+		if now.Sub(key.createdAt) >= keyPrepublishPeriod {
+			return key
+		}
+	}
+	return keys[len(keys)-1]
+}
+
+// loadKeys replaces the keys with the ones in the database
+func loadKeys(tokens config.TokensConfig, now time.Time) error {
+	stored, err := store.DB.ListSigningKeys(context.Background(), now.Add(-keyLifetime(tokens)))
+	if err != nil {
+		return err
+	}
+
+	loaded := []signingKey{}
+	for _, key := range stored {
+		block, _ := pem.Decode([]byte(key.PrivateKey))
+		if block == nil {
+			log.Printf("signing key %v is not PEM-encoded, skipping it", key.ID)
+			continue
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			log.Printf("failed to parse signing key %v, skipping it: %v", key.ID, err.Error())
+			continue
+		}
+		private, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			log.Printf("signing key %v is not an RSA key, skipping it", key.ID)
+			continue
+		}
+		loaded = append(loaded, signingKey{id: key.ID, private: private, createdAt: key.CreatedAt})
+	}
+
+	keys = loaded
+	keysLoadedAt = now
+	return nil
+}
+
+// pruneKeys forgets keys that can't have signed any unexpired token
+func pruneKeys(tokens config.TokensConfig, now time.Time) {
+	cutoff := now.Add(-keyLifetime(tokens))
+	for i, key := range keys {
+		if key.createdAt.Before(cutoff) {
+			keys = keys[:i]
+			return
+		}
+	}
+}
+
+// rotateKey creates a new key, which signs new tokens once it has been
+// published for keyPrepublishPeriod
+func rotateKey(tokens config.TokensConfig, now time.Time) error {
+	private, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return fmt.Errorf("failed to generate signing key: %v", err.Error())
+	}
+	key := signingKey{id: h.NewID(), private: private, createdAt: now}
+
+	if store.DB != nil {
+		encoded, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return fmt.Errorf("failed to encode signing key: %v", err.Error())
+		}
+		err = store.DB.InsertSigningKey(context.Background(), models.SigningKey{
+			ID:         key.id,
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded})),
+			CreatedAt:  now,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = store.DB.DeleteSigningKeys(context.Background(), now.Add(-keyLifetime(tokens)))
+		if err != nil {
+			log.Printf("failed to delete expired signing keys: %v", err.Error())
+		}
+	}
+
+	log.Printf("rotated the token signing key, the new key is %v", key.id)
+	keys = append([]signingKey{key}, keys...)
+	return nil
+}
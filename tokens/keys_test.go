@@ -0,0 +1,107 @@
+package tokens
+
+import (
+	"fa-middleware/config"
+
+	"testing"
+	"time"
+)
+
+// resetKeys forgets the keys, so that getKeys starts over
+func resetKeys() {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	keys = nil
+	keysLoadedAt = time.Time{}
+}
+
+// ageKeys moves the creation of every key back by age
+func ageKeys(age time.Duration) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	for i := range keys {
+		keys[i].createdAt = keys[i].createdAt.Add(-age)
+	}
+}
+
+func TestNextKeyIsPublishedBeforeSigning(t *testing.T) {
+	resetKeys()
+	defer resetKeys()
+	tokensConf := config.TokensConfig{RotationHours: 1}
+
+	published, err := getKeys(tokensConf)
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	if len(published) != 1 {
+		t.Fatalf("expected a single key, got %v", len(published))
+	}
+	first := published[0]
+	if activeKey(published, time.Now()).id != first.id {
+		t.Errorf("expected the first key to sign right away")
+	}
+
+	// just before the prepublish period starts, nothing changes
+	ageKeys(tokensConf.GetRotationInterval() - keyPrepublishPeriod - time.Minute)
+	published, err = getKeys(tokensConf)
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	if len(published) != 1 {
+		t.Fatalf("expected no new key yet, got %v keys", len(published))
+	}
+
+	ageKeys(2 * time.Minute)
+	published, err = getKeys(tokensConf)
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	if len(published) != 2 || published[1].id != first.id {
+		t.Fatalf("expected the next key to be published ahead of the first, got %v keys", len(published))
+	}
+	now := time.Now()
+	if activeKey(published, now).id != first.id {
+		t.Errorf("expected the first key to keep signing while the next one is prepublished")
+	}
+	if activeKey(published, now.Add(keyPrepublishPeriod)).id != published[0].id {
+		t.Errorf("expected the next key to sign once it has been published for %v", keyPrepublishPeriod)
+	}
+}
+
+func TestOldKeysArePruned(t *testing.T) {
+	resetKeys()
+	defer resetKeys()
+	tokensConf := config.TokensConfig{RotationHours: 1, TTLSeconds: 600}
+	lifetime := keyLifetime(tokensConf)
+
+	published, err := getKeys(tokensConf)
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	first := published[0]
+
+	// the first key has stopped signing, but tokens that it signed are
+	// still valid, so it stays published
+	ageKeys(tokensConf.GetRotationInterval() + time.Minute)
+	published, err = getKeys(tokensConf)
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	if len(published) != 2 || published[1].id != first.id {
+		t.Fatalf("expected the first key to stay published after rotation, got %v keys", len(published))
+	}
+
+	ageKeys(lifetime - tokensConf.GetRotationInterval())
+	published, err = getKeys(tokensConf)
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	for _, key := range published {
+		if key.id == first.id {
+			t.Errorf("expected the first key to be pruned once its tokens have expired")
+		}
+	}
+	if len(published) == 0 {
+		t.Errorf("expected a key to sign with")
+	}
+}
@@ -0,0 +1,118 @@
+// Package tokens signs short-lived JWTs that describe a user's access to an
+// app, so that downstream services can check it locally instead of calling
+// /mw/private/substatus for every request. The public keys are published at
+// /mw/.well-known/jwks.json, and the signing key is rotated every
+// global.tokens.rotationHours, see getKeys.
+package tokens
+
+import (
+	"fa-middleware/auth"
+	"fa-middleware/config"
+	"fa-middleware/models"
+	"fa-middleware/payments"
+
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/FusionAuth/go-client/pkg/fusionauth"
+)
+
+// Algorithm is the JWT algorithm that tokens are signed with
+const Algorithm = "RS256"
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Issue signs a token with the user's roles, active products and
+// entitlements in the app
+func Issue(tokens config.TokensConfig, app config.App, user fusionauth.User) (models.TokenResponse, error) {
+	products, err := payments.GetActiveProducts(app, user)
+	if err != nil {
+		return models.TokenResponse{}, fmt.Errorf("failed to get active products: %v", err.Error())
+	}
+
+	keys, err := getKeys(tokens)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	now := time.Now()
+	claims := models.EntitlementClaims{
+		Issuer:       app.FullDomainURL,
+		Subject:      user.Id,
+		Audience:     app.FusionAuth.AppID,
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    now.Add(tokens.GetTTL()).Unix(),
+		Email:        user.Email,
+		Roles:        nonNil(auth.GetRoles(app, user)),
+		Products:     nonNil(products),
+		Entitlements: nonNil(payments.EntitlementsOf(app, products)),
+	}
+	token, err := sign(activeKey(keys, now), claims)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+	return models.TokenResponse{Token: token, ExpiresAt: claims.ExpiresAt}, nil
+}
+
+// GetJWKS returns the public keys of every key that may have signed an
+// unexpired token
+func GetJWKS(tokens config.TokensConfig) (models.JWKS, error) {
+	keys, err := getKeys(tokens)
+	if err != nil {
+		return models.JWKS{}, err
+	}
+
+	jwks := models.JWKS{Keys: []models.JWK{}}
+	for _, key := range keys {
+		public := key.private.PublicKey
+		jwks.Keys = append(jwks.Keys, models.JWK{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: Algorithm,
+			KeyID:     key.id,
+			N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		})
+	}
+	return jwks, nil
+}
+
+// sign encodes the claims as a JWT that is signed with key
+func sign(key signingKey, claims models.EntitlementClaims) (string, error) {
+	encodedHeader, err := json.Marshal(header{Algorithm: Algorithm, Type: "JWT", KeyID: key.id})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token header: %v", err.Error())
+	}
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token claims: %v", err.Error())
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." +
+		base64.RawURLEncoding.EncodeToString(encodedClaims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err.Error())
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// nonNil keeps empty lists from being encoded as null
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
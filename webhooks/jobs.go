@@ -0,0 +1,102 @@
+package webhooks
+
+import (
+	"fa-middleware/config"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RegisterJobs registers the job handler that sends deliveries. The endpoint
+// secret is looked up from the active config on every attempt so that
+// rotated secrets take effect immediately.
+func RegisterJobs(getConfig func() config.Config) {
+	jobs.Register(JobTypeDeliver, func(ctx context.Context, job models.Job) error {
+		delivery := models.WebhookDelivery{}
+		err := json.Unmarshal(job.Payload, &delivery)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal webhook delivery: %v", err.Error())
+		}
+		return deliver(ctx, getConfig(), delivery, job)
+	})
+}
+
+// Redeliver resets failed deliveries for an app and queues them to be sent
+// again with a fresh set of retries. It returns how many were queued.
+func Redeliver(app config.App, deliveryIDs []string) (int, error) {
+	deliveries, err := store.DB.RedeliverWebhookDeliveries(
+		context.Background(),
+		app.FusionAuth.AppID,
+		deliveryIDs,
+	)
+	if err != nil {
+		return 0, err
+	}
+	enqueueDeliveries(deliveries)
+	return len(deliveries), nil
+}
+
+// deliver makes a single attempt and records the outcome. An error is
+// returned when the job queue should retry.
+func deliver(ctx context.Context, conf config.Config, delivery models.WebhookDelivery, job models.Job) error {
+	secret, ok := findEndpointSecret(conf, delivery)
+	if !ok {
+		// retrying won't help, so don't return an error
+		recordAttempt(ctx, delivery, store.WebhookStatusFailed, 0, "endpoint is no longer configured", nil)
+		return nil
+	}
+
+	statusCode, err := Send(delivery, secret)
+	if err == nil {
+		recordAttempt(ctx, delivery, store.WebhookStatusDelivered, statusCode, "", nil)
+		return nil
+	}
+
+	attempts := job.Attempts + 1
+	if attempts < job.MaxAttempts {
+		next := time.Now().Add(jobs.RetryDelay(attempts))
+		recordAttempt(ctx, delivery, store.WebhookStatusPending, statusCode, err.Error(), &next)
+	} else {
+		recordAttempt(ctx, delivery, store.WebhookStatusFailed, statusCode, err.Error(), nil)
+	}
+
+	return fmt.Errorf(
+		"delivery %v to %v failed (http %v): %v",
+		delivery.ID,
+		delivery.URL,
+		statusCode,
+		err.Error(),
+	)
+}
+
+// recordAttempt updates the delivery's record, if the database is enabled
+func recordAttempt(ctx context.Context, delivery models.WebhookDelivery, status string, statusCode int, lastError string, nextAttempt *time.Time) {
+	if store.DB == nil {
+		return
+	}
+	err := store.DB.FinishWebhookAttempt(ctx, delivery.ID, status, statusCode, lastError, nextAttempt)
+	if err != nil {
+		log.Printf("failed to record webhook delivery attempt: %v", err.Error())
+	}
+}
+
+// findEndpointSecret finds the current secret for the endpoint that a
+// delivery is addressed to
+func findEndpointSecret(conf config.Config, delivery models.WebhookDelivery) (string, bool) {
+	app, ok := conf.GetConfigForAppID(delivery.AppID)
+	if !ok {
+		return "", false
+	}
+	for _, webhook := range app.Webhooks {
+		if webhook.URL == delivery.URL {
+			return webhook.Secret, true
+		}
+	}
+	return "", false
+}
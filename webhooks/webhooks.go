@@ -0,0 +1,150 @@
+// Package webhooks sends signed JSON events to the outbound webhook
+// endpoints that each app configures, so that app backends don't have to
+// poll the private api to notice changes.
+package webhooks
+
+import (
+	"fa-middleware/config"
+	h "fa-middleware/helpers"
+	"fa-middleware/jobs"
+	"fa-middleware/models"
+	"fa-middleware/store"
+
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// SignatureHeader contains "t=<unix timestamp>,v1=<signature>", where the
+	// signature is the hex-encoded HMAC-SHA256 of "<timestamp>.<body>" using
+	// the endpoint's secret
+	SignatureHeader = "X-FA-Middleware-Signature"
+	EventTypeHeader = "X-FA-Middleware-Event"
+	DeliveryHeader  = "X-FA-Middleware-Delivery"
+
+	// MaxAttempts is how many times a delivery is attempted before it is
+	// marked as failed and has to be redelivered manually
+	MaxAttempts = 10
+
+	// JobTypeDeliver is the job that sends a single delivery
+	JobTypeDeliver = "webhook.deliver"
+
+	// DeliveryTimeout is the http timeout for a single delivery attempt
+	DeliveryTimeout = time.Second * 10
+)
+
+var httpClient = &http.Client{Timeout: DeliveryTimeout}
+
+// Emit sends an event to every webhook endpoint of the app that is subscribed
+// to eventType. Each delivery is a background job, so Emit never blocks on
+// the endpoints themselves. When the database is enabled, deliveries are
+// also recorded so that failed ones can be listed and redelivered.
+func Emit(app config.App, eventType string, data interface{}) {
+	endpoints := []config.WebhookConfig{}
+	for _, webhook := range app.Webhooks {
+		if webhook.WantsEvent(eventType) {
+			endpoints = append(endpoints, webhook)
+		}
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	event := models.WebhookEvent{
+		ID:        h.NewID(),
+		Type:      eventType,
+		AppID:     app.FusionAuth.AppID,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal webhook event %v: %v", eventType, err.Error())
+		return
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	for _, endpoint := range endpoints {
+		deliveries = append(deliveries, models.WebhookDelivery{
+			ID:        h.NewID(),
+			AppID:     app.FusionAuth.AppID,
+			URL:       endpoint.URL,
+			EventID:   event.ID,
+			EventType: eventType,
+			Payload:   payload,
+			Status:    store.WebhookStatusPending,
+		})
+	}
+
+	if store.DB != nil {
+		err = store.DB.InsertWebhookDeliveries(context.Background(), deliveries)
+		if err != nil {
+			log.Printf(
+				"failed to record webhook deliveries for event %v: %v",
+				event.ID,
+				err.Error(),
+			)
+		}
+	}
+
+	enqueueDeliveries(deliveries)
+}
+
+// enqueueDeliveries hands deliveries to the job queue, which takes care of
+// retrying them with exponential backoff
+func enqueueDeliveries(deliveries []models.WebhookDelivery) {
+	for _, delivery := range deliveries {
+		err := jobs.EnqueueWithAttempts(JobTypeDeliver, delivery, MaxAttempts)
+		if err != nil {
+			log.Printf(
+				"failed to enqueue webhook delivery %v to %v: %v",
+				delivery.ID,
+				delivery.URL,
+				err.Error(),
+			)
+		}
+	}
+}
+
+// Sign computes the value of the SignatureHeader for a payload
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%v.", timestamp.Unix())
+	_, _ = mac.Write(payload)
+	return fmt.Sprintf("t=%v,v1=%v", timestamp.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Send makes a single attempt to deliver an event. Any response other than a
+// 2xx is an error.
+func Send(delivery models.WebhookDelivery, secret string) (statusCode int, err error) {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %v", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(secret, time.Now(), delivery.Payload))
+	req.Header.Set(EventTypeHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with http %v", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,60 @@
+package webhooks
+
+import (
+	"fa-middleware/models"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	timestamp := time.Unix(1700000000, 0)
+	payload := []byte(`{"type":"test"}`)
+
+	signature := Sign("secret", timestamp, payload)
+	expected := "t=1700000000,v1=5164242d2d7c1061af198b4bfea622c8f5aeec1b9276e38d50a14d7f9dd39bee"
+	if signature != expected {
+		t.Errorf("expected %v, got %v", expected, signature)
+	}
+	if Sign("other-secret", timestamp, payload) == signature {
+		t.Errorf("expected a different secret to change the signature")
+	}
+	if Sign("secret", timestamp.Add(time.Second), payload) == signature {
+		t.Errorf("expected a different timestamp to change the signature")
+	}
+}
+
+func TestSend(t *testing.T) {
+	status := 200
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	delivery := models.WebhookDelivery{
+		ID:        "delivery-1",
+		URL:       server.URL,
+		EventType: "user.updated",
+		Payload:   []byte(`{"type":"user.updated"}`),
+	}
+	statusCode, err := Send(delivery, "secret")
+	if err != nil || statusCode != 200 {
+		t.Fatalf("expected the delivery to succeed, got %v: %v", statusCode, err)
+	}
+	if received.Get(EventTypeHeader) != "user.updated" || received.Get(DeliveryHeader) != "delivery-1" {
+		t.Errorf("expected the event and delivery headers, got %v", received)
+	}
+	if received.Get(SignatureHeader) == "" {
+		t.Errorf("expected the delivery to be signed")
+	}
+
+	status = 500
+	statusCode, err = Send(delivery, "secret")
+	if err == nil || statusCode != 500 {
+		t.Errorf("expected a 500 to be an error, got %v: %v", statusCode, err)
+	}
+}